@@ -0,0 +1,152 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+// The admin package implements a handler for controlling a running server.
+//
+// The handler does not authenticate requests. Serve the handler from a
+// separate server listening on localhost or a Unix socket:
+//
+//  a := &admin.Admin{Server: s, Router: router, Dumper: dumper}
+//  go (&server.Server{Addr: "localhost:8081", Handler: a.Handler()}).ListenAndServe()
+//
+// The commands are:
+//
+//  GET  /status            Show the server state and debug logging state.
+//  GET  /routes            Show the application routes.
+//  POST /debug?enabled=b   Enable or disable debug logging.
+//  POST /drain             Drain the server.
+//  POST /cache/invalidate  Invalidate the caches.
+package admin
+
+import (
+	"fmt"
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"os"
+	"strings"
+)
+
+// Invalidator is the interface implemented by caches that can be
+// invalidated by the admin handler. web.MemoryCacheStore implements this
+// interface.
+type Invalidator interface {
+	Invalidate() os.Error
+}
+
+// Admin specifies the parts of the application that are controlled by the
+// admin handler. Commands for nil fields respond with HTTP status 404.
+type Admin struct {
+	// Server is the application server.
+	Server *server.Server
+
+	// Router is the application router.
+	Router *web.Router
+
+	// Dumper is the debug logger.
+	Dumper *web.Dumper
+
+	// Caches are the caches invalidated by the /cache/invalidate command.
+	Caches []Invalidator
+}
+
+// Handler returns the admin handler.
+func (a *Admin) Handler() web.Handler {
+	return web.NewRouter().
+		Register("/status", "GET", func(req *web.Request) { a.status(req) }).
+		Register("/routes", "GET", func(req *web.Request) { a.routes(req) }).
+		Register("/debug", "POST", func(req *web.Request) { a.debug(req) }).
+		Register("/drain", "POST", func(req *web.Request) { a.drain(req) }).
+		Register("/cache/invalidate", "POST", func(req *web.Request) { a.invalidate(req) })
+}
+
+func respondText(req *web.Request) web.ResponseBody {
+	return req.Respond(web.StatusOK,
+		web.HeaderContentType, "text/plain; charset=utf-8",
+		web.HeaderCacheControl, "no-cache")
+}
+
+func (a *Admin) status(req *web.Request) {
+	w := respondText(req)
+	if w == nil {
+		return
+	}
+	if a.Server != nil {
+		active, conns, draining := a.Server.Stats()
+		fmt.Fprintf(w, "requests: %d\nconnections: %d\ndraining: %v\n", active, conns, draining)
+	}
+	if a.Dumper != nil {
+		fmt.Fprintf(w, "debug: %v\n", a.Dumper.Enabled())
+	}
+}
+
+func (a *Admin) routes(req *web.Request) {
+	if a.Router == nil {
+		req.Error(web.StatusNotFound, nil)
+		return
+	}
+	w := respondText(req)
+	if w == nil {
+		return
+	}
+	for _, r := range a.Router.Routes() {
+		fmt.Fprintf(w, "%s %s\n", r.Pattern, strings.Join(r.Methods, ","))
+	}
+}
+
+func (a *Admin) debug(req *web.Request) {
+	if a.Dumper == nil {
+		req.Error(web.StatusNotFound, nil)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	switch enabled, _ := req.Param.Get("enabled"); enabled {
+	case "1", "true", "on":
+		a.Dumper.SetEnabled(true)
+	case "0", "false", "off":
+		a.Dumper.SetEnabled(false)
+	default:
+		req.Error(web.StatusBadRequest, os.NewError("enabled must be true or false"))
+		return
+	}
+	if w := respondText(req); w != nil {
+		fmt.Fprintf(w, "debug: %v\n", a.Dumper.Enabled())
+	}
+}
+
+func (a *Admin) drain(req *web.Request) {
+	if a.Server == nil {
+		req.Error(web.StatusNotFound, nil)
+		return
+	}
+	a.Server.Drain()
+	if w := respondText(req); w != nil {
+		fmt.Fprintln(w, "draining")
+	}
+}
+
+func (a *Admin) invalidate(req *web.Request) {
+	for _, c := range a.Caches {
+		if err := c.Invalidate(); err != nil {
+			req.Error(web.StatusInternalServerError, err)
+			return
+		}
+	}
+	if w := respondText(req); w != nil {
+		fmt.Fprintf(w, "invalidated %d caches\n", len(a.Caches))
+	}
+}
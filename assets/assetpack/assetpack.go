@@ -0,0 +1,57 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The assetpack command generates a Go source file containing the files in a
+// directory tree. The generated file declares an assets.Set.
+//
+// Usage:
+//
+//  assetpack [-pkg=name] [-var=name] [-o=file] root
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/garyburd/twister/assets"
+	"io"
+	"os"
+)
+
+var (
+	pkg     = flag.String("pkg", "main", "Package name for the generated source.")
+	varName = flag.String("var", "Assets", "Variable name for the generated set.")
+	output  = flag.String("o", "", "Output file. Default is stdout.")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: assetpack [-pkg=name] [-var=name] [-o=file] root")
+		os.Exit(2)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Open(*output, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0666)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := assets.WriteSource(w, *pkg, *varName, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The assets package serves static files compiled into the application.
+//
+// Use the assetpack command or WriteSource to generate a Go source file that
+// defines a Set containing the files in a directory:
+//
+//  assetpack -pkg=static -var=Files -o=static/files.go static/files
+//
+// Register the set with a router to serve the files:
+//
+//  router.Register("/static/<path:.*>", "GET", static.Files)
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/garyburd/twister/web"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is a file in a Set.
+type File struct {
+	// Name is the slash separated path of the file relative to the root of
+	// the set. The name does not start with a slash.
+	Name string
+
+	// ModTime is the modification time of the file in seconds since the
+	// epoch or zero if the time is not known.
+	ModTime int64
+
+	// Data is the contents of the file.
+	Data string
+}
+
+type asset struct {
+	contentType  string
+	lastModified string
+	etag         string
+	data         []byte
+	gzip         []byte // Compressed data or nil if compression does not help.
+}
+
+// Set is a collection of files served from memory. Files are served with
+// ETag and Last-Modified headers. Files that compress well are also held in
+// gzip compressed form and served compressed to clients that accept the gzip
+// content coding.
+type Set struct {
+	assets map[string]*asset
+}
+
+// New returns a set containing the given files.
+func New(files ...File) *Set {
+	s := &Set{assets: make(map[string]*asset)}
+	for _, f := range files {
+		data := []byte(f.Data)
+		h := sha1.New()
+		h.Write(data)
+		a := &asset{
+			contentType: web.ContentType(f.Name, data),
+			etag:        "\"" + hex.EncodeToString(h.Sum()[0:10]) + "\"",
+			data:        data,
+		}
+		if f.ModTime > 0 {
+			a.lastModified = time.SecondsToUTC(f.ModTime).Format(web.TimeLayout)
+		}
+		var b bytes.Buffer
+		if zw, err := gzip.NewWriter(&b); err == nil {
+			zw.Write(data)
+			if err := zw.Close(); err == nil && b.Len() < len(data) {
+				a.gzip = b.Bytes()
+			}
+		}
+		s.assets[strings.TrimLeft(f.Name, "/")] = a
+	}
+	return s
+}
+
+// Get returns the contents of the named file.
+func (s *Set) Get(name string) ([]byte, bool) {
+	a, found := s.assets[strings.TrimLeft(name, "/")]
+	if !found {
+		return nil, false
+	}
+	return a.data, true
+}
+
+// acceptsGzip returns true if the Accept-Encoding header includes gzip with
+// a non-zero quality.
+func acceptsGzip(accept string) bool {
+	for _, item := range strings.Split(accept, ",", -1) {
+		params := strings.Split(item, ";", -1)
+		if strings.ToLower(strings.TrimSpace(params[0])) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.Atof64(param[2:]); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchETag returns true if the If-None-Match header value matches etag.
+func matchETag(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",", -1) {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag || strings.TrimLeft(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWeb serves the file named by the "path" request parameter or the
+// request URL path if the parameter is not set. The file index.html is
+// served for paths that end with a slash.
+func (s *Set) ServeWeb(req *web.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		req.Respond(web.StatusMethodNotAllowed, web.HeaderAllow, "GET, HEAD")
+		return
+	}
+	name, found := req.Param.Get("path")
+	if !found {
+		name = req.URL.Path
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	name = path.Clean("/" + name)
+	a, found := s.assets[name[1:]]
+	if !found {
+		req.Error(web.StatusNotFound, nil)
+		return
+	}
+
+	header := web.NewStringsMap(web.HeaderContentType, a.contentType)
+	data := a.data
+	etag := a.etag
+	if a.gzip != nil {
+		header.Set(web.HeaderVary, web.HeaderAcceptEncoding)
+		if acceptsGzip(req.Header.GetDef(web.HeaderAcceptEncoding, "")) {
+			data = a.gzip
+			// Use a distinct entity tag for the compressed representation.
+			etag = etag[0:len(etag)-1] + "-gzip\""
+			header.Set(web.HeaderContentEncoding, "gzip")
+		}
+	}
+	header.Set(web.HeaderETag, etag)
+	if a.lastModified != "" {
+		header.Set(web.HeaderLastModified, a.lastModified)
+	}
+	if inm, found := req.Header.Get(web.HeaderIfNoneMatch); found && matchETag(inm, etag) {
+		header.Del(web.HeaderContentType)
+		header.Del(web.HeaderContentEncoding)
+		req.Responder.Respond(web.StatusNotModified, header)
+		return
+	}
+	header.Set(web.HeaderContentLength, strconv.Itoa(len(data)))
+	w := req.Responder.Respond(web.StatusOK, header)
+	if w != nil && req.Method != "HEAD" {
+		w.Write(data)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/garyburd/twister/web"
+	"github.com/garyburd/twister/web/webtest"
+	"http"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveTestAsset(s *Set, path string, kvs ...string) *webtest.Responder {
+	r := &webtest.Responder{}
+	url, _ := http.ParseURL(path)
+	s.ServeWeb(&web.Request{
+		Method:    "GET",
+		URL:       url,
+		Header:    web.NewStringsMap(kvs...),
+		Param:     make(web.StringsMap),
+		Responder: r,
+		ErrorHandler: func(req *web.Request, status int, reason os.Error) {
+			r.Status = status
+		},
+	})
+	return r
+}
+
+var testSet = New(
+	File{Name: "index.html", ModTime: 1287000000, Data: "<html>" + strings.Repeat("home ", 100) + "</html>"},
+	File{Name: "css/site.css", Data: "a{}"},
+)
+
+func TestServeAsset(t *testing.T) {
+	r := serveTestAsset(testSet, "/css/site.css")
+	if r.Status != web.StatusOK || r.Body.String() != "a{}" {
+		t.Fatalf("site.css = %d %q, expected 200 a{}", r.Status, r.Body.String())
+	}
+	if r.Header.Has(web.HeaderContentEncoding) || r.Header.Has(web.HeaderVary) {
+		t.Errorf("site.css header = %v, expected uncompressed response", r.Header)
+	}
+	if !strings.HasPrefix(r.Header.GetDef(web.HeaderContentType, ""), "text/css") {
+		t.Errorf("site.css Content-Type = %q", r.Header.GetDef(web.HeaderContentType, ""))
+	}
+	if r := serveTestAsset(testSet, "/missing"); r.Status != web.StatusNotFound {
+		t.Errorf("missing status = %d, expected 404", r.Status)
+	}
+	if r := serveTestAsset(testSet, "/../css/site.css"); r.Status != web.StatusOK {
+		t.Errorf("/../css/site.css status = %d, expected 200", r.Status)
+	}
+}
+
+func TestServeAssetGzip(t *testing.T) {
+	plain := serveTestAsset(testSet, "/")
+	if plain.Status != web.StatusOK || !strings.HasPrefix(plain.Body.String(), "<html>") {
+		t.Fatalf("/ = %d %q, expected index.html", plain.Status, plain.Body.String())
+	}
+	if v := plain.Header.GetDef(web.HeaderLastModified, ""); v != "Wed, 13 Oct 2010 20:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", v)
+	}
+	r := serveTestAsset(testSet, "/index.html", web.HeaderAcceptEncoding, "deflate, gzip")
+	if r.Header.GetDef(web.HeaderContentEncoding, "") != "gzip" || r.Header.GetDef(web.HeaderVary, "") != web.HeaderAcceptEncoding {
+		t.Fatalf("header = %v, expected gzip encoding", r.Header)
+	}
+	if r.Header.GetDef(web.HeaderETag, "") == plain.Header.GetDef(web.HeaderETag, "") {
+		t.Errorf("compressed and uncompressed responses have the same entity tag")
+	}
+	zr, err := gzip.NewReader(&r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(zr)
+	if err != nil || string(p) != plain.Body.String() {
+		t.Errorf("decompressed body = %q, %v", p, err)
+	}
+	if r := serveTestAsset(testSet, "/", web.HeaderAcceptEncoding, "gzip;q=0"); r.Header.Has(web.HeaderContentEncoding) {
+		t.Errorf("gzip;q=0 returned compressed response")
+	}
+}
+
+func TestServeAssetNotModified(t *testing.T) {
+	etag := serveTestAsset(testSet, "/css/site.css").Header.GetDef(web.HeaderETag, "")
+	r := serveTestAsset(testSet, "/css/site.css", web.HeaderIfNoneMatch, "\"x\", "+etag)
+	if r.Status != web.StatusNotModified || r.Body.Len() != 0 {
+		t.Errorf("status = %d, expected 304", r.Status)
+	}
+	if r := serveTestAsset(testSet, "/css/site.css", web.HeaderIfNoneMatch, "\"x\""); r.Status != web.StatusOK {
+		t.Errorf("status = %d, expected 200", r.Status)
+	}
+}
+
+func TestWriteSource(t *testing.T) {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	root := dir + "/twister-assets-test-" + strconv.Itoa64(time.Nanoseconds())
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{"b.txt": "b\n", "a/c.js": "\"c\"", ".hidden": "x"} {
+		if err := os.MkdirAll(root+"/a", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(root+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if err := WriteSource(&b, "static", "Files", root); err != nil {
+		t.Fatal(err)
+	}
+	s := b.String()
+	for _, expected := range []string{"package static\n", "var Files = assets.New(\n", `Name:    "a/c.js"`, `Data:    "\"c\""`, `Data:    "b\n"`} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("source does not contain %q:\n%s", expected, s)
+		}
+	}
+	if strings.Contains(s, ".hidden") {
+		t.Errorf("source contains hidden file:\n%s", s)
+	}
+	if strings.Index(s, "a/c.js") > strings.Index(s, "b.txt") {
+		t.Errorf("files not sorted:\n%s", s)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package assets
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// collectFiles appends the regular files in the directory root/dir to files.
+// Files and directories with names starting with "." are skipped.
+func collectFiles(root string, dir string, files []string) ([]string, os.Error) {
+	f, err := os.Open(path.Join(root, dir), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	isDir := make(map[string]bool)
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name, ".") || !(info.IsRegular() || info.IsDirectory()) {
+			continue
+		}
+		names = names[0 : len(names)+1]
+		names[len(names)-1] = info.Name
+		isDir[info.Name] = info.IsDirectory()
+	}
+	sort.SortStrings(names)
+	for _, n := range names {
+		name := path.Join(dir, n)
+		if isDir[n] {
+			files, err = collectFiles(root, name, files)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(files) == cap(files) {
+			tmp := make([]string, len(files), 2*len(files)+8)
+			copy(tmp, files)
+			files = tmp
+		}
+		files = files[0 : len(files)+1]
+		files[len(files)-1] = name
+	}
+	return files, nil
+}
+
+// WriteSource writes Go source for package pkg to w. The source declares a
+// variable named varName of type *Set containing the regular files in the
+// directory tree at root. Hidden files and directories are skipped.
+func WriteSource(w io.Writer, pkg string, varName string, root string) os.Error {
+	files, err := collectFiles(root, "", nil)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	b.WriteString("// Code generated by assetpack. DO NOT EDIT.\n\n")
+	b.WriteString("package " + pkg + "\n\n")
+	b.WriteString("import \"github.com/garyburd/twister/assets\"\n\n")
+	b.WriteString("var " + varName + " = assets.New(\n")
+	for _, name := range files {
+		fname := path.Join(root, name)
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+		b.WriteString("\tassets.File{\n")
+		b.WriteString("\t\tName:    " + strconv.Quote(name) + ",\n")
+		b.WriteString("\t\tModTime: " + strconv.Itoa64(info.Mtime_ns/1e9) + ",\n")
+		b.WriteString("\t\tData:    " + strconv.Quote(string(data)) + ",\n")
+		b.WriteString("\t},\n")
+	}
+	b.WriteString(")\n")
+	return b.Flush()
+}
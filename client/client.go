@@ -0,0 +1,818 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The client package implements an HTTP client with persistent connections.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadStatusLine    = os.NewError("twister.client: could not parse status line")
+	ErrBadHeaderLine    = os.NewError("twister.client: could not parse header line")
+	ErrHeaderTooLong    = os.NewError("twister.client: header too long")
+	ErrBadChunk         = os.NewError("twister.client: bad chunk")
+	ErrTooManyRedirects = os.NewError("twister.client: too many redirects")
+	ErrUnsupportedURL   = os.NewError("twister.client: unsupported URL")
+	ErrConnectTimeout   = os.NewError("twister.client: connect timeout")
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost is the number of idle connections kept for
+	// each host when Client.MaxIdleConnsPerHost is zero.
+	DefaultMaxIdleConnsPerHost = 2
+
+	// DefaultMaxRedirects is the number of redirects followed by Do when
+	// Client.MaxRedirects is zero.
+	DefaultMaxRedirects = 10
+
+	maxLineLen     = 4096
+	maxHeaderCount = 256
+)
+
+// Request represents an outgoing HTTP request.
+type Request struct {
+	// Uppercase request method. GET, POST, etc.
+	Method string
+
+	// The request URL. The scheme must be "http" or "https".
+	URL *http.URL
+
+	// Header maps canonical header names to slices of header values. The
+	// client sets the Host, Content-Length and Transfer-Encoding headers.
+	Header web.StringsMap
+
+	// The request body or nil if the request does not have a body.
+	Body io.Reader
+
+	// ContentLength is the length of Body. If the length is less than zero,
+	// then the body is sent using the chunked transfer encoding.
+	ContentLength int
+}
+
+// NewRequest returns a request for the given method and URL.
+func NewRequest(method string, rawURL string) (*Request, os.Error) {
+	url, err := http.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Method: strings.ToUpper(method), URL: url, Header: make(web.StringsMap)}, nil
+}
+
+// Response represents the response to an outgoing HTTP request.
+type Response struct {
+	// The HTTP status code.
+	Status int
+
+	// Protocol version: major version * 1000 + minor version
+	ProtocolVersion int
+
+	// Header maps canonical header names to slices of header values.
+	Header web.StringsMap
+
+	// ContentLength is the length of the response body or -1 if the length
+	// is not known.
+	ContentLength int
+
+	// The response body. The caller must close the body. The connection is
+	// returned to the client's pool of idle connections when the body is
+	// read to EOF.
+	Body io.ReadCloser
+
+	// The URL of the request that produced this response. The URL differs
+	// from the original request URL when Do follows a redirect.
+	URL *http.URL
+}
+
+// Client sends HTTP requests and keeps idle connections for reuse. A Client
+// is safe for use by multiple goroutines.
+type Client struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept
+	// for each scheme and host.
+	MaxIdleConnsPerHost int
+
+	// MaxRedirects is the maximum number of redirects followed by Do.
+	// Set MaxRedirects to a negative value to disable redirects.
+	MaxRedirects int
+
+	// Timeout in nanoseconds for network reads and writes. There is no
+	// timeout if the value is zero.
+	Timeout int64
+
+	// ConnectTimeout is the timeout in nanoseconds for establishing a
+	// connection. There is no timeout if the value is zero.
+	ConnectTimeout int64
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// DefaultClient is the client used by Get and Post.
+var DefaultClient = &Client{}
+
+type conn struct {
+	key     string
+	netConn net.Conn
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	reused  bool
+}
+
+func (cn *conn) close() {
+	cn.netConn.Close()
+}
+
+// connKey returns the pool key and network address for url.
+func connKey(url *http.URL) (key string, addr string, secure bool, err os.Error) {
+	var port string
+	switch strings.ToLower(url.Scheme) {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+		secure = true
+	default:
+		return "", "", false, ErrUnsupportedURL
+	}
+	addr = strings.ToLower(url.Host)
+	if addr == "" {
+		return "", "", false, ErrUnsupportedURL
+	}
+	if strings.LastIndex(addr, ":") <= strings.LastIndex(addr, "]") {
+		addr = addr + ":" + port
+	}
+	if secure {
+		key = "https://" + addr
+	} else {
+		key = "http://" + addr
+	}
+	return key, addr, secure, nil
+}
+
+func (c *Client) maxIdleConnsPerHost() int {
+	if c.MaxIdleConnsPerHost <= 0 {
+		return DefaultMaxIdleConnsPerHost
+	}
+	return c.MaxIdleConnsPerHost
+}
+
+// getConn returns an idle connection for the URL or dials a new connection.
+func (c *Client) getConn(url *http.URL) (*conn, os.Error) {
+	key, addr, secure, err := connKey(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if conns := c.idle[key]; len(conns) > 0 {
+		cn := conns[len(conns)-1]
+		conns[len(conns)-1] = nil
+		c.idle[key] = conns[0 : len(conns)-1]
+		c.mu.Unlock()
+		cn.reused = true
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	netConn, err := dial(addr, secure, c.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		key:     key,
+		netConn: netConn,
+		br:      bufio.NewReader(netConn),
+		bw:      bufio.NewWriter(netConn)}, nil
+}
+
+type dialResult struct {
+	netConn net.Conn
+	err     os.Error
+}
+
+// dial connects to addr. If timeout is greater than zero, then dial returns
+// ErrConnectTimeout if the connection is not established within timeout
+// nanoseconds.
+func dial(addr string, secure bool, timeout int64) (net.Conn, os.Error) {
+	ch := make(chan dialResult, 1)
+	go func() {
+		var r dialResult
+		if secure {
+			r.netConn, r.err = tls.Dial("tcp", "", addr, nil)
+		} else {
+			r.netConn, r.err = net.Dial("tcp", "", addr)
+		}
+		ch <- r
+	}()
+	if timeout <= 0 {
+		r := <-ch
+		return r.netConn, r.err
+	}
+	select {
+	case r := <-ch:
+		return r.netConn, r.err
+	case <-time.After(timeout):
+		// Close the connection if the dial completes after the timeout.
+		go func() {
+			if r := <-ch; r.netConn != nil {
+				r.netConn.Close()
+			}
+		}()
+	}
+	return nil, ErrConnectTimeout
+}
+
+// putConn returns a connection to the pool of idle connections.
+func (c *Client) putConn(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = make(map[string][]*conn)
+	}
+	conns := c.idle[cn.key]
+	if conns == nil {
+		conns = make([]*conn, 0, c.maxIdleConnsPerHost())
+	}
+	if len(conns) >= cap(conns) {
+		cn.close()
+		return
+	}
+	conns = conns[0 : len(conns)+1]
+	conns[len(conns)-1] = cn
+	c.idle[cn.key] = conns
+}
+
+// CloseIdleConnections closes all idle connections in the pool.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, cn := range conns {
+			cn.close()
+		}
+		c.idle[key] = nil, false
+	}
+}
+
+// requestURI returns the request target for url.
+func requestURI(url *http.URL) string {
+	if url.RawPath == "" {
+		return "/"
+	}
+	return url.RawPath
+}
+
+// Headers written by writeRequest from the request URL and body.
+var requestSkipHeaders = []string{
+	web.HeaderHost,
+	web.HeaderContentLength,
+	web.HeaderTransferEncoding,
+}
+
+// requestHeader returns the header of req without the headers in
+// requestSkipHeaders. The request header is copied only if it contains one
+// of these headers.
+func requestHeader(req *Request) web.StringsMap {
+	for _, key := range requestSkipHeaders {
+		if req.Header.Has(key) {
+			header := make(web.StringsMap)
+			for key, values := range req.Header {
+				header[key] = values
+			}
+			for _, key := range requestSkipHeaders {
+				header.Del(key)
+			}
+			return header
+		}
+	}
+	return req.Header
+}
+
+func (cn *conn) writeRequest(req *Request) os.Error {
+	bw := cn.bw
+	bw.WriteString(req.Method)
+	bw.WriteString(" ")
+	bw.WriteString(requestURI(req.URL))
+	bw.WriteString(" HTTP/1.1\r\nHost: ")
+	bw.WriteString(req.URL.Host)
+	bw.WriteString("\r\n")
+	// WriteHttpHeader replaces CR and LF in values to prevent header
+	// injection.
+	requestHeader(req).WriteHttpHeader(bw)
+	chunked := false
+	if req.Body != nil {
+		if req.ContentLength >= 0 {
+			bw.WriteString("Content-Length: ")
+			bw.WriteString(strconv.Itoa(req.ContentLength))
+			bw.WriteString("\r\n")
+		} else {
+			bw.WriteString("Transfer-Encoding: chunked\r\n")
+			chunked = true
+		}
+	}
+	bw.WriteString("\r\n")
+
+	if req.Body != nil {
+		var err os.Error
+		if chunked {
+			cw := &chunkedWriter{bw}
+			if _, err = io.Copy(cw, req.Body); err == nil {
+				_, err = bw.WriteString("0\r\n\r\n")
+			}
+		} else {
+			_, err = io.Copyn(bw, req.Body, int64(req.ContentLength))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+var statusLineRegexp = regexp.MustCompile("^HTTP/([0-9]+)\\.([0-9]+) ([0-9][0-9][0-9])")
+
+func readStatusLine(br *bufio.Reader) (version int, status int, err os.Error) {
+	p, err := br.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = ErrBadStatusLine
+		}
+		return
+	}
+	m := statusLineRegexp.FindSubmatch(p)
+	if m == nil {
+		err = ErrBadStatusLine
+		return
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+	version = web.ProtocolVersion(major, minor)
+	status, _ = strconv.Atoi(string(m[3]))
+	return
+}
+
+func readHeader(br *bufio.Reader) (web.StringsMap, os.Error) {
+	header := make(web.StringsMap)
+	lastKey := ""
+	for n := 0; ; n++ {
+		if n > maxHeaderCount {
+			return nil, ErrHeaderTooLong
+		}
+		p, err := br.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				err = ErrHeaderTooLong
+			} else if err == os.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		continuation := web.IsSpaceByte(p[0]) && p[0] != '\r' && p[0] != '\n'
+		p = bytes.TrimSpace(p)
+		if len(p) == 0 {
+			// End of header.
+			break
+		}
+		if len(p) > maxLineLen {
+			return nil, ErrHeaderTooLong
+		}
+		if continuation {
+			if lastKey == "" {
+				return nil, ErrBadHeaderLine
+			}
+			values := header[lastKey]
+			values[len(values)-1] = values[len(values)-1] + " " + string(p)
+			continue
+		}
+		i := bytes.IndexByte(p, ':')
+		if i < 1 {
+			return nil, ErrBadHeaderLine
+		}
+		lastKey = web.HeaderNameBytes(bytes.TrimSpace(p[0:i]))
+		header.Append(lastKey, string(bytes.TrimSpace(p[i+1:])))
+	}
+	return header, nil
+}
+
+// readResponse reads the response head and sets up the response body.
+func (c *Client) readResponse(cn *conn, req *Request) (*Response, os.Error) {
+	var resp *Response
+	for {
+		version, status, err := readStatusLine(cn.br)
+		if err != nil {
+			return nil, err
+		}
+		header, err := readHeader(cn.br)
+		if err != nil {
+			return nil, err
+		}
+		resp = &Response{Status: status, ProtocolVersion: version, Header: header, URL: req.URL}
+		// Skip interim responses.
+		if status != web.StatusContinue {
+			break
+		}
+	}
+
+	connection := strings.ToLower(resp.Header.GetDef(web.HeaderConnection, ""))
+	keepAlive := false
+	if resp.ProtocolVersion >= web.ProtocolVersion(1, 1) {
+		keepAlive = connection != "close"
+	} else {
+		keepAlive = connection == "keep-alive"
+	}
+
+	b := &body{client: c, conn: cn, keepAlive: keepAlive}
+	resp.Body = b
+	resp.ContentLength = -1
+
+	switch {
+	case req.Method == "HEAD" || resp.Status == web.StatusNoContent || resp.Status == web.StatusNotModified:
+		resp.ContentLength = 0
+		b.r = eofReader{}
+	case strings.ToLower(resp.Header.GetDef(web.HeaderTransferEncoding, "")) == "chunked":
+		b.r = &chunkedReader{br: cn.br}
+	default:
+		if s, found := resp.Header.Get(web.HeaderContentLength); found {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, os.NewError("twister.client: bad content length")
+			}
+			resp.ContentLength = n
+			b.r = &lengthReader{r: cn.br, n: n}
+		} else {
+			// Body is terminated by connection close.
+			b.keepAlive = false
+			b.r = cn.br
+		}
+	}
+
+	if resp.ContentLength == 0 {
+		b.done()
+	}
+	return resp, nil
+}
+
+// RoundTrip sends a single request and returns the response. RoundTrip does
+// not follow redirects.
+func (c *Client) RoundTrip(req *Request) (*Response, os.Error) {
+	for {
+		cn, err := c.getConn(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		if c.Timeout > 0 {
+			cn.netConn.SetTimeout(c.Timeout)
+		}
+		err = cn.writeRequest(req)
+		var resp *Response
+		if err == nil {
+			resp, err = c.readResponse(cn, req)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		cn.close()
+		// The server may have closed an idle connection. Retry with a new
+		// connection if the request can be sent again.
+		if !cn.reused || !canRetry(req) {
+			return nil, err
+		}
+	}
+	panic("not reached")
+}
+
+// canRetry returns true if req can be sent again after a failure on a
+// reused connection. The server may have processed the request before the
+// failure, so only idempotent requests without a body are retried.
+func canRetry(req *Request) bool {
+	if req.Body != nil {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT":
+		return true
+	}
+	return false
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case web.StatusMovedPermanently, web.StatusFound, web.StatusSeeOther, web.StatusTemporaryRedirect:
+		return true
+	}
+	return false
+}
+
+// resolveURL resolves the Location header value ref relative to base.
+func resolveURL(base *http.URL, ref string) (*http.URL, os.Error) {
+	if url, err := http.ParseURL(ref); err == nil && url.Scheme != "" {
+		return url, nil
+	}
+	prefix := base.Scheme + "://" + base.Host
+	if !strings.HasPrefix(ref, "/") {
+		path := base.Path
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			path = path[0 : i+1]
+		} else {
+			path = "/"
+		}
+		prefix += path
+	}
+	return http.ParseURL(prefix + ref)
+}
+
+// Headers that are not sent with redirected requests. Redirected requests
+// do not have a body.
+var redirectSkipHeaders = []string{
+	web.HeaderContentEncoding,
+	web.HeaderContentLanguage,
+	web.HeaderContentLength,
+	web.HeaderContentType,
+	web.HeaderExpect,
+	web.HeaderTransferEncoding,
+}
+
+// Credential headers are not sent when a request is redirected to another
+// host.
+var credentialHeaders = []string{
+	web.HeaderAuthorization,
+	web.HeaderCookie,
+}
+
+// redirectHeader returns the header for the redirect of req to url.
+func redirectHeader(req *Request, url *http.URL) web.StringsMap {
+	header := make(web.StringsMap)
+	for key, values := range req.Header {
+		header[key] = values
+	}
+	for _, key := range redirectSkipHeaders {
+		header.Del(key)
+	}
+	if strings.ToLower(url.Host) != strings.ToLower(req.URL.Host) {
+		for _, key := range credentialHeaders {
+			header.Del(key)
+		}
+	}
+	return header
+}
+
+// Do sends the request and returns the response, following redirects for
+// GET and HEAD requests and See Other responses to all requests.
+func (c *Client) Do(req *Request) (*Response, os.Error) {
+	max := c.MaxRedirects
+	if max == 0 {
+		max = DefaultMaxRedirects
+	}
+	for i := 0; ; i++ {
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if !isRedirect(resp.Status) || max < 0 {
+			return resp, nil
+		}
+		if resp.Status != web.StatusSeeOther && req.Method != "GET" && req.Method != "HEAD" {
+			return resp, nil
+		}
+		location, found := resp.Header.Get(web.HeaderLocation)
+		if !found {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if i >= max {
+			return nil, ErrTooManyRedirects
+		}
+		url, err := resolveURL(req.URL, location)
+		if err != nil {
+			return nil, err
+		}
+		method := req.Method
+		if method != "HEAD" {
+			method = "GET"
+		}
+		req = &Request{Method: method, URL: url, Header: redirectHeader(req, url)}
+	}
+	panic("not reached")
+}
+
+// Get issues a GET request to the specified URL using the client.
+func (c *Client) Get(rawURL string) (*Response, os.Error) {
+	req, err := NewRequest("GET", rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Post issues a POST request to the specified URL using the client.
+func (c *Client) Post(rawURL string, contentType string, p []byte) (*Response, os.Error) {
+	req, err := NewRequest("POST", rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(web.HeaderContentType, contentType)
+	req.Body = bytes.NewBuffer(p)
+	req.ContentLength = len(p)
+	return c.Do(req)
+}
+
+// Get issues a GET request to the specified URL using the default client.
+func Get(rawURL string) (*Response, os.Error) {
+	return DefaultClient.Get(rawURL)
+}
+
+// Post issues a POST request to the specified URL using the default client.
+func Post(rawURL string, contentType string, p []byte) (*Response, os.Error) {
+	return DefaultClient.Post(rawURL, contentType, p)
+}
+
+// body is the response body. The body returns the connection to the pool
+// when the body is read to EOF.
+type body struct {
+	client    *Client
+	conn      *conn
+	r         io.Reader
+	keepAlive bool
+}
+
+// done releases the connection after the body is read or closed.
+func (b *body) done() {
+	if b.conn == nil {
+		return
+	}
+	if b.keepAlive {
+		b.client.putConn(b.conn)
+	} else {
+		b.conn.close()
+	}
+	b.conn = nil
+}
+
+func (b *body) Read(p []byte) (int, os.Error) {
+	if b.conn == nil {
+		return 0, os.EOF
+	}
+	n, err := b.r.Read(p)
+	if err == os.EOF {
+		b.done()
+	} else if err != nil {
+		b.keepAlive = false
+		b.done()
+	}
+	return n, err
+}
+
+// Close closes the body. The connection is closed if the body was not read
+// to EOF.
+func (b *body) Close() os.Error {
+	if b.conn != nil {
+		b.keepAlive = false
+		b.done()
+	}
+	return nil
+}
+
+// lengthReader reads a body with a Content-Length. The reader returns
+// io.ErrUnexpectedEOF if the connection is closed before the entire body is
+// read.
+type lengthReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *lengthReader) Read(p []byte) (int, os.Error) {
+	if r.n <= 0 {
+		return 0, os.EOF
+	}
+	if len(p) > r.n {
+		p = p[0:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= n
+	if err == os.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, os.Error) {
+	return 0, os.EOF
+}
+
+type chunkedReader struct {
+	br  *bufio.Reader
+	n   int
+	err os.Error
+}
+
+func (r *chunkedReader) readLine() ([]byte, os.Error) {
+	p, err := r.br.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull || err == os.EOF {
+			err = ErrBadChunk
+		}
+		return nil, err
+	}
+	return bytes.TrimSpace(p), nil
+}
+
+func (r *chunkedReader) Read(p []byte) (int, os.Error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.n == 0 {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			// Ignore chunk extensions.
+			line = line[0:i]
+		}
+		n, err := strconv.Btoui64(string(line), 16)
+		if err != nil || n > 1<<30 {
+			r.err = ErrBadChunk
+			return 0, r.err
+		}
+		if n == 0 {
+			// Skip trailer.
+			for {
+				line, err := r.readLine()
+				if err != nil {
+					r.err = err
+					return 0, err
+				}
+				if len(line) == 0 {
+					break
+				}
+			}
+			r.err = os.EOF
+			return 0, r.err
+		}
+		r.n = int(n)
+	}
+	if len(p) > r.n {
+		p = p[0:r.n]
+	}
+	n, err := r.br.Read(p)
+	r.n -= n
+	if err == nil && r.n == 0 {
+		var line []byte
+		line, err = r.readLine()
+		if err == nil && len(line) != 0 {
+			err = ErrBadChunk
+		}
+	}
+	if err != nil {
+		if err == os.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+	}
+	return n, err
+}
+
+type chunkedWriter struct {
+	bw *bufio.Writer
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, os.Error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.bw.WriteString(strconv.Itob(len(p), 16))
+	w.bw.WriteString("\r\n")
+	n, err := w.bw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = w.bw.WriteString("\r\n")
+	return n, err
+}
@@ -0,0 +1,211 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type readResponseTest struct {
+	name   string
+	s      string
+	status int
+	header web.StringsMap
+	body   string
+}
+
+var readResponseTests = []readResponseTest{
+	readResponseTest{"length", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", 200,
+		web.NewStringsMap(web.HeaderContentLength, "5"), "hello"},
+	readResponseTest{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\nTrailer: x\r\n\r\n", 200,
+		web.NewStringsMap(web.HeaderTransferEncoding, "chunked"), "hello, world"},
+	readResponseTest{"continue", "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", 404,
+		web.NewStringsMap(web.HeaderContentLength, "0"), ""},
+	readResponseTest{"continuation", "HTTP/1.0 200 OK\r\nX-Foo: a\r\n  b\r\n\r\nbody", 200,
+		web.NewStringsMap("X-Foo", "a b"), "body"},
+}
+
+func TestReadResponse(t *testing.T) {
+	c := &Client{}
+	url, _ := http.ParseURL("http://example.com/")
+	for _, tt := range readResponseTests {
+		cn := &conn{br: bufio.NewReader(bytes.NewBufferString(tt.s))}
+		resp, err := c.readResponse(cn, &Request{Method: "GET", URL: url})
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+			continue
+		}
+		if resp.Status != tt.status {
+			t.Errorf("%s: status=%d, expected %d", tt.name, resp.Status, tt.status)
+		}
+		if !reflect.DeepEqual(resp.Header, tt.header) {
+			t.Errorf("%s bad header\nexpected: %q\nactual:   %q", tt.name, tt.header, resp.Header)
+		}
+		// Read the underlying reader to avoid releasing the test connection.
+		p, err := ioutil.ReadAll(resp.Body.(*body).r)
+		if err != nil {
+			t.Errorf("%s: unexpected error reading body %s", tt.name, err)
+		}
+		if string(p) != tt.body {
+			t.Errorf("%s: body=%q, expected %q", tt.name, p, tt.body)
+		}
+	}
+}
+
+type resolveURLTest struct {
+	base     string
+	ref      string
+	expected string
+}
+
+var resolveURLTests = []resolveURLTest{
+	resolveURLTest{"http://example.com/a/b", "http://other.com/c", "http://other.com/c"},
+	resolveURLTest{"http://example.com/a/b", "/c", "http://example.com/c"},
+	resolveURLTest{"http://example.com/a/b", "c", "http://example.com/a/c"},
+}
+
+func TestResolveURL(t *testing.T) {
+	for _, tt := range resolveURLTests {
+		base, _ := http.ParseURL(tt.base)
+		url, err := resolveURL(base, tt.ref)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %s", tt.base, tt.ref, err)
+			continue
+		}
+		if url.String() != tt.expected {
+			t.Errorf("%s %s: url=%s, expected %s", tt.base, tt.ref, url.String(), tt.expected)
+		}
+	}
+}
+
+// closeConn records calls to Close.
+type closeConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeConn) Close() os.Error {
+	c.closed = true
+	return nil
+}
+
+func TestShortBody(t *testing.T) {
+	c := &Client{}
+	url, _ := http.ParseURL("http://example.com/")
+	netConn := &closeConn{}
+	cn := &conn{key: "example.com:80", netConn: netConn, br: bufio.NewReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"))}
+	resp, err := c.readResponse(cn, &Request{Method: "GET", URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(resp.Body)
+	if string(p) != "hello" || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAll() = %q, %v, expected %q, %v", p, err, "hello", io.ErrUnexpectedEOF)
+	}
+	if !netConn.closed {
+		t.Error("connection not closed after short body")
+	}
+	if len(c.idle[cn.key]) != 0 {
+		t.Error("connection returned to pool after short body")
+	}
+}
+
+type redirectHeaderTest struct {
+	location string
+	expected web.StringsMap
+}
+
+var redirectHeaderTests = []redirectHeaderTest{
+	redirectHeaderTest{"http://example.com/b", web.NewStringsMap(web.HeaderAuthorization, "x", web.HeaderCookie, "c=1", web.HeaderAccept, "*/*")},
+	redirectHeaderTest{"http://EXAMPLE.com/b", web.NewStringsMap(web.HeaderAuthorization, "x", web.HeaderCookie, "c=1", web.HeaderAccept, "*/*")},
+	redirectHeaderTest{"http://other.com/b", web.NewStringsMap(web.HeaderAccept, "*/*")},
+}
+
+func TestRedirectHeader(t *testing.T) {
+	url, _ := http.ParseURL("http://example.com/a")
+	header := web.NewStringsMap(
+		web.HeaderAuthorization, "x",
+		web.HeaderCookie, "c=1",
+		web.HeaderAccept, "*/*",
+		web.HeaderContentType, "application/x-www-form-urlencoded",
+		web.HeaderContentLength, "3")
+	req := &Request{Method: "POST", URL: url, Header: header}
+	for _, tt := range redirectHeaderTests {
+		location, _ := http.ParseURL(tt.location)
+		if h := redirectHeader(req, location); !reflect.DeepEqual(h, tt.expected) {
+			t.Errorf("%s: header = %v, expected %v", tt.location, h, tt.expected)
+		}
+	}
+	if !header.Has(web.HeaderContentType) {
+		t.Error("original header modified")
+	}
+}
+
+func TestWriteRequestHeader(t *testing.T) {
+	url, _ := http.ParseURL("http://example.com/a")
+	header := web.NewStringsMap(
+		web.HeaderAccept, "*/*\r\nX-Injected: 1",
+		web.HeaderHost, "other.com",
+		web.HeaderContentLength, "100")
+	var b bytes.Buffer
+	cn := &conn{bw: bufio.NewWriter(&b)}
+	if err := cn.writeRequest(&Request{Method: "GET", URL: url, Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "GET /a HTTP/1.1\r\nHost: example.com\r\nAccept: */*  X-Injected: 1\r\n\r\n"
+	if b.String() != expected {
+		t.Errorf("request = %q, expected %q", b.String(), expected)
+	}
+	if !header.Has(web.HeaderHost) {
+		t.Error("original header modified")
+	}
+}
+
+type canRetryTest struct {
+	method   string
+	body     bool
+	expected bool
+}
+
+var canRetryTests = []canRetryTest{
+	canRetryTest{"GET", false, true},
+	canRetryTest{"HEAD", false, true},
+	canRetryTest{"OPTIONS", false, true},
+	canRetryTest{"PUT", false, true},
+	canRetryTest{"PUT", true, false},
+	canRetryTest{"POST", false, false},
+	canRetryTest{"DELETE", false, false},
+}
+
+func TestCanRetry(t *testing.T) {
+	for _, tt := range canRetryTests {
+		req := &Request{Method: tt.method}
+		if tt.body {
+			req.Body = bytes.NewBuffer(nil)
+		}
+		if actual := canRetry(req); actual != tt.expected {
+			t.Errorf("canRetry(%s, body=%v) = %v, expected %v", tt.method, tt.body, actual, tt.expected)
+		}
+	}
+}
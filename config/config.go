@@ -0,0 +1,316 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+// The config package loads server options and static routes from a JSON
+// file. An example configuration is:
+//
+//  {
+//      "server": {
+//          "addr": ":8443",
+//          "certFile": "cert.pem",
+//          "keyFile": "key.pem",
+//          "readTimeout": 30,
+//          "maxRequestBodyLen": 1048576
+//      },
+//      "routes": [
+//          {"pattern": "/old", "redirect": "/new", "permanent": true},
+//          {"pattern": "/robots.txt", "contentType": "text/plain", "body": "User-agent: *\n"}
+//      ]
+//  }
+//
+// Timeouts are in seconds.
+package config
+
+import (
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"json"
+	"os"
+	"strconv"
+)
+
+// Error is a configuration error. Key is the path to the offending value,
+// for example "routes[2].pattern".
+type Error struct {
+	Key     string
+	Message string
+}
+
+func (e *Error) String() string {
+	if e.Key == "" {
+		return "config: " + e.Message
+	}
+	return "config: " + e.Key + ": " + e.Message
+}
+
+// Route is a static route.
+type Route struct {
+	// Pattern is the router pattern.
+	Pattern string
+
+	// Redirect is the redirect location. If Redirect is set, then the route
+	// redirects to the location with HTTP status 301 if Permanent is true and
+	// 302 otherwise.
+	Redirect  string
+	Permanent bool
+
+	// Status, ContentType and Body specify the response when Redirect is
+	// not set. The default status is 200.
+	Status      int
+	ContentType string
+	Body        string
+}
+
+// Config is a loaded configuration.
+type Config struct {
+	// Server has the server options from the configuration. The
+	// application sets the handler.
+	Server *server.Server
+
+	// CertFile and KeyFile are the TLS certificate and key files. Use
+	// ListenAndServe to start the server with TLS when set.
+	CertFile string
+	KeyFile  string
+
+	Routes []Route
+}
+
+// Load reads the configuration from the named file.
+func Load(filename string) (*Config, os.Error) {
+	p, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(p)
+}
+
+// Parse parses the configuration in p.
+func Parse(p []byte) (*Config, os.Error) {
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return nil, &Error{"", err.String()}
+	}
+	m, err := toObject("", v)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Server: &server.Server{}}
+	for key, v := range m {
+		switch key {
+		case "server":
+			err = c.parseServer(key, v)
+		case "routes":
+			err = c.parseRoutes(key, v)
+		default:
+			err = &Error{key, "unknown key"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func toObject(path string, v interface{}) (map[string]interface{}, os.Error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &Error{path, "expected object"}
+	}
+	return m, nil
+}
+
+func toString(path string, v interface{}) (string, os.Error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", &Error{path, "expected string"}
+	}
+	return s, nil
+}
+
+func toBool(path string, v interface{}) (bool, os.Error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, &Error{path, "expected true or false"}
+	}
+	return b, nil
+}
+
+func toInt(path string, v interface{}) (int, os.Error) {
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) || f < 0 {
+		return 0, &Error{path, "expected non-negative integer"}
+	}
+	return int(f), nil
+}
+
+// toNanoseconds converts a number of seconds to nanoseconds.
+func toNanoseconds(path string, v interface{}) (int64, os.Error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 {
+		return 0, &Error{path, "expected non-negative number of seconds"}
+	}
+	return int64(f * 1e9), nil
+}
+
+func (c *Config) parseServer(path string, v interface{}) os.Error {
+	m, err := toObject(path, v)
+	if err != nil {
+		return err
+	}
+	s := c.Server
+	for key, v := range m {
+		p := path + "." + key
+		switch key {
+		case "addr":
+			s.Addr, err = toString(p, v)
+		case "serverName":
+			s.ServerName, err = toString(p, v)
+		case "certFile":
+			c.CertFile, err = toString(p, v)
+		case "keyFile":
+			c.KeyFile, err = toString(p, v)
+		case "healthCheckPath":
+			s.HealthCheckPath, err = toString(p, v)
+		case "readTimeout":
+			s.ReadTimeout, err = toNanoseconds(p, v)
+		case "writeTimeout":
+			s.WriteTimeout, err = toNanoseconds(p, v)
+		case "maxURILen":
+			s.MaxURILen, err = toInt(p, v)
+		case "maxHeaderLineLen":
+			s.MaxHeaderLineLen, err = toInt(p, v)
+		case "maxHeaderValueLen":
+			s.MaxHeaderValueLen, err = toInt(p, v)
+		case "maxHeaderCount":
+			s.MaxHeaderCount, err = toInt(p, v)
+		case "maxHeaderBytes":
+			s.MaxHeaderBytes, err = toInt(p, v)
+		case "maxRequestBodyLen":
+			s.MaxRequestBodyLen, err = toInt(p, v)
+		case "maxPipelinedRequests":
+			s.MaxPipelinedRequests, err = toInt(p, v)
+		case "readBufferSize":
+			s.ReadBufferSize, err = toInt(p, v)
+		case "writeBufferSize":
+			s.WriteBufferSize, err = toInt(p, v)
+		default:
+			err = &Error{p, "unknown key"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return &Error{path, "certFile and keyFile must be set together"}
+	}
+	return nil
+}
+
+func (c *Config) parseRoutes(path string, v interface{}) os.Error {
+	a, ok := v.([]interface{})
+	if !ok {
+		return &Error{path, "expected array"}
+	}
+	c.Routes = make([]Route, len(a))
+	for i, v := range a {
+		if err := c.Routes[i].parse(path+"["+strconv.Itoa(i)+"]", v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route) parse(path string, v interface{}) os.Error {
+	m, err := toObject(path, v)
+	if err != nil {
+		return err
+	}
+	for key, v := range m {
+		p := path + "." + key
+		switch key {
+		case "pattern":
+			r.Pattern, err = toString(p, v)
+			if err == nil && (r.Pattern == "" || r.Pattern[0] != '/') {
+				err = &Error{p, "pattern must start with /"}
+			}
+		case "redirect":
+			r.Redirect, err = toString(p, v)
+		case "permanent":
+			r.Permanent, err = toBool(p, v)
+		case "status":
+			r.Status, err = toInt(p, v)
+			if err == nil && (r.Status < 100 || r.Status > 599) {
+				err = &Error{p, "bad HTTP status"}
+			}
+		case "contentType":
+			r.ContentType, err = toString(p, v)
+		case "body":
+			r.Body, err = toString(p, v)
+		default:
+			err = &Error{p, "unknown key"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if r.Pattern == "" {
+		return &Error{path + ".pattern", "missing"}
+	}
+	return nil
+}
+
+// Handler returns the handler for the route.
+func (r *Route) Handler() web.Handler {
+	if r.Redirect != "" {
+		return web.RedirectHandler(r.Redirect, r.Permanent)
+	}
+	status := r.Status
+	if status == 0 {
+		status = web.StatusOK
+	}
+	contentType := r.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	body := []byte(r.Body)
+	return web.HandlerFunc(func(req *web.Request) {
+		w := req.Respond(status,
+			web.HeaderContentType, contentType,
+			web.HeaderContentLength, strconv.Itoa(len(body)))
+		if w != nil {
+			w.Write(body)
+		}
+	})
+}
+
+// Register registers the static routes with router for GET and HEAD
+// requests. Register the static routes before the application routes to
+// give the static routes precedence.
+func (c *Config) Register(router *web.Router) {
+	for i := range c.Routes {
+		router.Register(c.Routes[i].Pattern, "GET", c.Routes[i].Handler())
+	}
+}
+
+// ListenAndServe starts the server with TLS if the configuration specifies
+// a certificate and key file and without TLS otherwise.
+func (c *Config) ListenAndServe(handler web.Handler) os.Error {
+	c.Server.Handler = handler
+	if c.CertFile != "" {
+		return c.Server.ListenAndServeTLS(c.CertFile, c.KeyFile)
+	}
+	return c.Server.ListenAndServe()
+}
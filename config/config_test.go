@@ -0,0 +1,70 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package config
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+		"server": {"addr": ":8080", "readTimeout": 1.5, "maxURILen": 1024},
+		"routes": [
+			{"pattern": "/old", "redirect": "/new", "permanent": true},
+			{"pattern": "/robots.txt", "body": "User-agent: *\n"}
+		]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Addr != ":8080" || c.Server.ReadTimeout != 1500000000 || c.Server.MaxURILen != 1024 {
+		t.Errorf("bad server options %+v", c.Server)
+	}
+	if len(c.Routes) != 2 || c.Routes[0].Redirect != "/new" || !c.Routes[0].Permanent || c.Routes[1].Body != "User-agent: *\n" {
+		t.Errorf("bad routes %+v", c.Routes)
+	}
+}
+
+type parseErrorTest struct {
+	config string
+	key    string
+}
+
+var parseErrorTests = []parseErrorTest{
+	parseErrorTest{`[]`, ""},
+	parseErrorTest{`{"srever": {}}`, "srever"},
+	parseErrorTest{`{"server": {"addr": 8080}}`, "server.addr"},
+	parseErrorTest{`{"server": {"maxURILen": -1}}`, "server.maxURILen"},
+	parseErrorTest{`{"server": {"readTimeout": "30s"}}`, "server.readTimeout"},
+	parseErrorTest{`{"server": {"certFile": "cert.pem"}}`, "server"},
+	parseErrorTest{`{"routes": {}}`, "routes"},
+	parseErrorTest{`{"routes": [{"pattern": "/a"}, {"pattern": "b"}]}`, "routes[1].pattern"},
+	parseErrorTest{`{"routes": [{"redirect": "/a"}]}`, "routes[0].pattern"},
+	parseErrorTest{`{"routes": [{"pattern": "/a", "status": 1000}]}`, "routes[0].status"},
+}
+
+func TestParseError(t *testing.T) {
+	for _, tt := range parseErrorTests {
+		_, err := Parse([]byte(tt.config))
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: expected config error, actual %v", tt.config, err)
+			continue
+		}
+		if e.Key != tt.key {
+			t.Errorf("%s: error key %q, expected %q", tt.config, e.Key, tt.key)
+		}
+	}
+}
@@ -3,68 +3,61 @@ package main
 import (
 	"github.com/garyburd/twister/web"
 	"template"
-	"sync"
 )
 
-var messageChan = make(chan []byte)
-
-type subscription struct {
-	conn      *web.WebSocketConn
-	subscribe bool
-}
-
-var subscriptionChan = make(chan subscription)
-
-func hub() {
-	conns := make(map[*web.WebSocketConn]int)
-	for {
-		select {
-		case subscription := <-subscriptionChan:
-			conns[subscription.conn] = 0, subscription.subscribe
-		case message := <-messageChan:
-			for conn, _ := range conns {
-				if err := conn.Send(message); err != nil {
-					conn.Close()
-				}
-			}
-		}
-	}
-}
-
-var hubOnce sync.Once
-
-func startHub() {
-	hubOnce.Do(func() { go hub() })
-}
+var hub = web.NewHub()
 
 func chatWsHandler(req *web.Request) {
-	startHub()
 	conn, err := web.WebSocketUpgrade(req)
 	if err != nil {
 		return
 	}
 
 	defer func() {
-		subscriptionChan <- subscription{conn, false}
+		hub.Unregister(conn)
 		conn.Close()
 	}()
 
-	subscriptionChan <- subscription{conn, true}
+	hub.Register(conn)
 
 	for {
 		p, err := conn.Receive()
 		if err != nil {
 			break
 		}
-		// copy because Receive reuses underling byte array.
-		mp := make([]byte, len(p))
-		copy(mp, p)
-		messageChan <- mp
+		hub.Broadcast(p)
 	}
 }
 
+// chatStreamHandler streams messages to browsers that do not support
+// WebSockets.
+func chatStreamHandler(req *web.Request) {
+	conn, err := web.NewStreamConn(req, web.StreamXHR)
+	if err != nil {
+		req.Error(web.ErrorStatus(err, web.StatusBadRequest), err)
+		return
+	}
+	hub.Register(conn)
+	conn.Wait()
+	hub.Unregister(conn)
+}
+
+// chatSendHandler receives messages from browsers that do not support
+// WebSockets.
+func chatSendHandler(req *web.Request) {
+	if msg := req.Param.GetDef("msg", ""); msg != "" {
+		hub.Broadcast([]byte(msg))
+	}
+	req.Respond(web.StatusNoContent)
+}
+
+type chatPage struct {
+	Host string
+	XSRF string
+}
+
 func chatFrameHandler(req *web.Request) {
-	chatTempl.Execute(req.URL.Host,
+	chatTempl.Execute(&chatPage{Host: req.URL.Host, XSRF: req.XSRFToken()},
 		req.Respond(web.StatusOK, web.HeaderContentType, "text/html; charset=utf-8"))
 }
 
@@ -112,7 +105,7 @@ const chatStr = `
     });
 
     if (window["WebSocket"]) {
-        conn = new WebSocket("ws://«@»/chat/ws");
+        conn = new WebSocket("ws://«Host»/chat/ws");
         conn.onclose = function(evt) {
             appendLog($("<div><b>Connection closed.</b></div>"))
         }
@@ -120,7 +113,36 @@ const chatStr = `
             appendLog($("<div/>").text(evt.data))
         }
     } else {
-        appendLog($("<div><b>Your browser does not support WebSockets.</b></div>"))
+        // Fall back to XHR streaming. Each line of the response is a
+        // JavaScript string literal holding a message.
+        conn = {
+            send: function(m) {
+                $.post("/chat/send", {msg: m, xsrf: "«XSRF»"});
+            }
+        };
+        var stream = function() {
+            var xhr = new XMLHttpRequest();
+            var pos = 0;
+            xhr.onreadystatechange = function() {
+                if (xhr.readyState >= 3) {
+                    var text = xhr.responseText;
+                    var i;
+                    while ((i = text.indexOf("\n", pos)) >= 0) {
+                        var line = text.substring(pos, i);
+                        pos = i + 1;
+                        if (line.charAt(0) == '"') {
+                            appendLog($("<div/>").text(eval(line)))
+                        }
+                    }
+                }
+                if (xhr.readyState == 4) {
+                    setTimeout(stream, 1000);
+                }
+            }
+            xhr.open("GET", "/chat/stream", true);
+            xhr.send(null);
+        }
+        stream();
     }
     });
 </script>
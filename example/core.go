@@ -1,27 +1,33 @@
 package main
 
 import (
+	"os"
 	"template"
 	"github.com/garyburd/twister/web"
 )
 
-func coreErrorHandler(req *web.Request, status int, message string) {
-	coreTempl.Execute(map[string]interface{}{
-		"req":     req,
-		"status":  status,
-		"message": message,
-		"xsrf":    req.Param.GetDef(web.XSRFParamName, ""),
-	},
+func coreErrorHandler(req *web.Request, status int, reason os.Error) {
+	message := web.StatusText[status]
+	if reason != nil {
+		message = reason.String()
+	}
+	data := web.TemplateData(req,
+		"req", req,
+		"status", status,
+		"message", message)
+	if _, found := data["xsrf"]; !found {
+		// The error occurred before the XSRF token was set.
+		data["xsrf"] = ""
+	}
+	coreTempl.Execute(data,
 		req.Respond(status, web.HeaderContentType, "text/html"))
 }
 
 func coreHandler(req *web.Request) {
-	coreTempl.Execute(map[string]interface{}{
-		"req":     req,
-		"status":  web.StatusOK,
-		"message": "ok",
-		"xsrf":    req.Param.GetDef(web.XSRFParamName, ""),
-	},
+	coreTempl.Execute(web.TemplateData(req,
+		"req", req,
+		"status", web.StatusOK,
+		"message", "ok"),
 		req.Respond(web.StatusOK, web.HeaderContentType, "text/html"))
 }
 
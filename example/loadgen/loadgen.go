@@ -0,0 +1,113 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The loadgen command sends requests to a server and reports throughput and
+// latency. Use loadgen to measure the performance of the server and
+// applications:
+//
+//  loadgen -c=10 -n=10000 http://localhost:8080/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/garyburd/twister/client"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	concurrency = flag.Int("c", 10, "Number of concurrent clients.")
+	requests    = flag.Int("n", 1000, "Total number of requests.")
+	timeout     = flag.Int64("timeout", 10e9, "Request timeout in nanoseconds.")
+)
+
+type result struct {
+	latency int // microseconds
+	status  int
+	err     os.Error
+}
+
+// worker sends n requests to url and sends the results to results.
+func worker(c *client.Client, url string, n int, results chan<- result) {
+	for i := 0; i < n; i++ {
+		start := time.Nanoseconds()
+		resp, err := c.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			continue
+		}
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		results <- result{latency: int((time.Nanoseconds() - start) / 1e3), status: resp.Status, err: err}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || *concurrency <= 0 || *requests <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: loadgen [-c=clients] [-n=requests] [-timeout=ns] url")
+		os.Exit(2)
+	}
+	url := flag.Arg(0)
+	c := &client.Client{ConnectTimeout: *timeout, Timeout: *timeout}
+	results := make(chan result, *concurrency)
+
+	start := time.Nanoseconds()
+	for i := 0; i < *concurrency; i++ {
+		n := *requests / *concurrency
+		if i < *requests%*concurrency {
+			n += 1
+		}
+		go worker(c, url, n, results)
+	}
+
+	latencies := make([]int, 0, *requests)
+	statuses := make(map[int]int)
+	errors := 0
+	for i := 0; i < *requests; i++ {
+		r := <-results
+		if r.err != nil {
+			errors += 1
+			if errors == 1 {
+				fmt.Fprintln(os.Stderr, "error:", r.err)
+			}
+			continue
+		}
+		statuses[r.status] += 1
+		latencies = latencies[0 : len(latencies)+1]
+		latencies[len(latencies)-1] = r.latency
+	}
+	elapsed := time.Nanoseconds() - start
+
+	fmt.Printf("requests:   %d\n", *requests)
+	fmt.Printf("errors:     %d\n", errors)
+	for status, count := range statuses {
+		fmt.Printf("status %d: %d\n", status, count)
+	}
+	fmt.Printf("elapsed:    %.3f s\n", float64(elapsed)/1e9)
+	fmt.Printf("throughput: %.1f requests/s\n", float64(*requests)*1e9/float64(elapsed))
+	if len(latencies) > 0 {
+		sort.SortInts(latencies)
+		total := 0
+		for _, l := range latencies {
+			total += l
+		}
+		percentile := func(p int) int { return latencies[(len(latencies)-1)*p/100] }
+		fmt.Printf("latency:    mean %d us, 50%% %d us, 90%% %d us, 99%% %d us, max %d us\n",
+			total/len(latencies), percentile(50), percentile(90), percentile(99), latencies[len(latencies)-1])
+	}
+}
@@ -15,16 +15,21 @@ func homeHandler(req *web.Request) {
 
 func main() {
 	flag.Parse()
-	h := web.SetErrorHandler(coreErrorHandler,
-		web.ProcessForm(10000, true, web.NewHostRouter(nil).
-			Register("www.example.com", web.NewRouter().
-			Register("/", "GET", homeHandler).
-			Register("/chat", "GET", chatFrameHandler).
-			Register("/chat/ws", "GET", chatWsHandler).
-			Register("/core/", "GET", coreHandler).
-			Register("/core/a/<a>/", "GET", coreHandler).
-			Register("/core/b/<b>/c/<c>", "GET", coreHandler).
-			Register("/core/c", "POST", coreHandler))))
+	router := web.NewRouter().
+		Register("/", "GET", homeHandler).
+		Register("/chat", "GET", chatFrameHandler).
+		Register("/chat/ws", "GET", chatWsHandler).
+		Register("/chat/stream", "GET", chatStreamHandler).
+		Register("/chat/send", "POST", chatSendHandler).
+		Register("/core/", "GET", coreHandler).
+		Register("/core/a/<a>/", "GET", coreHandler).
+		Register("/core/b/<b>/c/<c>", "GET", coreHandler).
+		Register("/core/c", "POST", coreHandler)
+
+	h := web.Chain(
+		web.SetErrorHandler(coreErrorHandler),
+		web.ProcessForm(10000, true),
+	)(web.NewHostRouter(nil).Register("www.example.com", router))
 
 	err := server.ListenAndServe("localhost:8080", ":8080", h)
 	if err != nil {
@@ -0,0 +1,173 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+// The logfile package implements a log file writer with rotation. Use the
+// writer with the web.AccessLog handler and the server's ErrorLog.
+package logfile
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// File is a log file that is rotated when the file exceeds a maximum size or
+// age. The current log is written to Path. Rotated logs are renamed to
+// Path.1, Path.2 and so on with Path.1 the most recent.
+type File struct {
+	// Path is the name of the log file.
+	Path string
+
+	// MaxSize is the maximum size of the file in bytes. There is no limit
+	// if the value is zero.
+	MaxSize int64
+
+	// MaxAge is the maximum time in seconds to write to a file before the
+	// file is rotated. There is no limit if the value is zero.
+	MaxAge int64
+
+	// MaxBackups is the number of rotated files to keep. Older files are
+	// deleted. All files are kept if the value is zero.
+	MaxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened int64
+}
+
+// Open opens the log file at path for appending. Set the rotation limits on
+// the returned file before writing to the file.
+func Open(path string) (*File, os.Error) {
+	f := &File{Path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() os.Error {
+	file, err := os.Open(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREAT, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f = file
+	f.size = info.Size
+	f.opened = time.Seconds()
+	return nil
+}
+
+func (f *File) close() os.Error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+func (f *File) backupPath(n int) string {
+	return f.Path + "." + strconv.Itoa(n)
+}
+
+// rotate renames the current file and the backups and opens a new file.
+func (f *File) rotate() os.Error {
+	f.close()
+	n := 1
+	for {
+		if _, err := os.Stat(f.backupPath(n)); err != nil {
+			break
+		}
+		n += 1
+	}
+	for ; n > 1; n-- {
+		if f.MaxBackups > 0 && n > f.MaxBackups {
+			os.Remove(f.backupPath(n - 1))
+		} else {
+			os.Rename(f.backupPath(n-1), f.backupPath(n))
+		}
+	}
+	if err := os.Rename(f.Path, f.backupPath(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *File) Write(p []byte) (int, os.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 &&
+		((f.MaxSize > 0 && f.size+int64(len(p)) > f.MaxSize) ||
+			(f.MaxAge > 0 && time.Seconds()-f.opened >= f.MaxAge)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (f *File) Rotate() os.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// Reopen closes and opens the file. Call Reopen after an external program
+// such as logrotate moves the file.
+func (f *File) Reopen() os.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.close()
+	return f.open()
+}
+
+// Close closes the file.
+func (f *File) Close() os.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.close()
+}
+
+// ReopenOnSIGHUP starts a goroutine that reopens the files when the process
+// receives SIGHUP. The goroutine receives all signals from signal.Incoming.
+// Applications that handle other signals should call Reopen from their own
+// signal loop instead.
+func ReopenOnSIGHUP(files ...*File) {
+	go func() {
+		for sig := range signal.Incoming {
+			if s, ok := sig.(signal.UnixSignal); ok && s == syscall.SIGHUP {
+				for _, f := range files {
+					f.Reopen()
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,64 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	dir := os.Getenv("TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	dir = dir + "/logfile_test." + strconv.Itoa(os.Getpid())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/access.log"
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.MaxSize = 10
+	f.MaxBackups = 2
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("line " + strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	expected := map[string]string{
+		path:        "line 3\n",
+		path + ".1": "line 2\n",
+		path + ".2": "line 1\n",
+	}
+	for name, s := range expected {
+		p, err := ioutil.ReadFile(name)
+		if err != nil || string(p) != s {
+			t.Errorf("%s = %q, %v, expected %q", name, p, err, s)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("%s.3 not removed", path)
+	}
+}
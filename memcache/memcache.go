@@ -0,0 +1,268 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The memcache package implements a web.CacheStore backed by memcached
+// servers. Use the store to share the output cache between servers.
+package memcache
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrValueTooLarge = os.NewError("twister.memcache: value too large")
+	ErrNotStored     = os.NewError("twister.memcache: value not stored")
+	ErrNoServers     = os.NewError("twister.memcache: no servers")
+	ErrDialTimeout   = os.NewError("twister.memcache: dial timeout")
+	errBadResponse   = os.NewError("twister.memcache: bad response from server")
+)
+
+// DefaultMaxValueLen is the default maximum length of a stored value. The
+// value matches the default item size limit in memcached.
+const DefaultMaxValueLen = 1 << 20
+
+// Store is a cache store backed by one or more memcached servers. Keys are
+// distributed across the servers by a hash of the key.
+type Store struct {
+	// Prefix is prepended to all keys before the key is hashed. Use the
+	// prefix to share the memcached servers between applications.
+	Prefix string
+
+	// MaxValueLen is the maximum length of a stored value. Set returns
+	// ErrValueTooLarge for longer values. The default value is used if the
+	// value is zero.
+	MaxValueLen int
+
+	// Timeout for connecting to a server and for network operations in
+	// nanoseconds. There is no timeout if the value is zero.
+	Timeout int64
+
+	servers []*server
+}
+
+type server struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+// New returns a store for the memcached servers at the given addresses. New
+// returns ErrNoServers if no addresses are given.
+func New(addrs ...string) (*Store, os.Error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoServers
+	}
+	s := &Store{servers: make([]*server, len(addrs))}
+	for i, addr := range addrs {
+		s.servers[i] = &server{addr: addr}
+	}
+	return s, nil
+}
+
+// hashKey returns a key that is valid for memcached. Memcached keys are
+// limited to 250 bytes and cannot contain spaces or control characters.
+func (s *Store) hashKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, s.Prefix)
+	io.WriteString(h, key)
+	return hex.EncodeToString(h.Sum())
+}
+
+func (s *Store) server(key string) *server {
+	return s.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(s.servers))]
+}
+
+// Get returns the value for key or nil if the key is not found.
+func (s *Store) Get(key string) ([]byte, os.Error) {
+	key = s.hashKey(key)
+	srv := s.server(key)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err := srv.connect(s.Timeout); err != nil {
+		return nil, err
+	}
+	value, err := srv.get(key)
+	if err != nil {
+		srv.close()
+	}
+	return value, err
+}
+
+// Set stores the value for key. The value expires after ttl seconds.
+func (s *Store) Set(key string, value []byte, ttl int) os.Error {
+	maxValueLen := s.MaxValueLen
+	if maxValueLen <= 0 {
+		maxValueLen = DefaultMaxValueLen
+	}
+	if len(value) > maxValueLen {
+		return ErrValueTooLarge
+	}
+	// Memcached interprets expiration times longer than 30 days as absolute
+	// Unix times.
+	exptime := int64(ttl)
+	if exptime > 60*60*24*30 {
+		exptime += time.Seconds()
+	}
+	key = s.hashKey(key)
+	srv := s.server(key)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err := srv.connect(s.Timeout); err != nil {
+		return err
+	}
+	err := srv.set(key, value, exptime)
+	if err != nil && err != ErrNotStored {
+		srv.close()
+	}
+	return err
+}
+
+func (srv *server) connect(timeout int64) os.Error {
+	if srv.conn != nil {
+		return nil
+	}
+	conn, err := dial(srv.addr, timeout)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		conn.SetTimeout(timeout)
+	}
+	srv.conn = conn
+	srv.br = bufio.NewReader(conn)
+	srv.bw = bufio.NewWriter(conn)
+	return nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  os.Error
+}
+
+// dial connects to addr. If timeout is greater than zero, then dial returns
+// ErrDialTimeout if the connection is not established within timeout
+// nanoseconds.
+func dial(addr string, timeout int64) (net.Conn, os.Error) {
+	if timeout <= 0 {
+		return net.Dial("tcp", "", addr)
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		conn, err := net.Dial("tcp", "", addr)
+		ch <- dialResult{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Close the connection if the dial completes after the timeout.
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+	}
+	return nil, ErrDialTimeout
+}
+
+func (srv *server) close() {
+	if srv.conn != nil {
+		srv.conn.Close()
+	}
+	srv.conn = nil
+	srv.br = nil
+	srv.bw = nil
+}
+
+func (srv *server) readLine() (string, os.Error) {
+	line, err := srv.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (srv *server) get(key string) ([]byte, os.Error) {
+	srv.bw.WriteString("get ")
+	srv.bw.WriteString(key)
+	srv.bw.WriteString("\r\n")
+	if err := srv.bw.Flush(); err != nil {
+		return nil, err
+	}
+	line, err := srv.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "END" {
+		return nil, nil
+	}
+	// VALUE <key> <flags> <bytes>
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "VALUE" || fields[1] != key {
+		return nil, errBadResponse
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil || n < 0 {
+		return nil, errBadResponse
+	}
+	value := make([]byte, n+2)
+	if _, err := io.ReadFull(srv.br, value); err != nil {
+		return nil, err
+	}
+	if line, err = srv.readLine(); err != nil {
+		return nil, err
+	}
+	if line != "END" {
+		return nil, errBadResponse
+	}
+	return value[0:n], nil
+}
+
+func (srv *server) set(key string, value []byte, exptime int64) os.Error {
+	srv.bw.WriteString("set ")
+	srv.bw.WriteString(key)
+	srv.bw.WriteString(" 0 ")
+	srv.bw.WriteString(strconv.Itoa64(exptime))
+	srv.bw.WriteString(" ")
+	srv.bw.WriteString(strconv.Itoa(len(value)))
+	srv.bw.WriteString("\r\n")
+	srv.bw.Write(value)
+	srv.bw.WriteString("\r\n")
+	if err := srv.bw.Flush(); err != nil {
+		return err
+	}
+	line, err := srv.readLine()
+	if err != nil {
+		return err
+	}
+	switch line {
+	case "STORED":
+		return nil
+	case "NOT_STORED":
+		return ErrNotStored
+	}
+	return errBadResponse
+}
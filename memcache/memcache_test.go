@@ -0,0 +1,98 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeServer implements the get and set commands of the memcached protocol.
+func fakeServer(t *testing.T, l net.Listener) {
+	values := make(map[string][]byte)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				break
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "get":
+				if value, found := values[fields[1]]; found {
+					io.WriteString(conn, "VALUE "+fields[1]+" 0 "+strconv.Itoa(len(value))+"\r\n")
+					conn.Write(value)
+					io.WriteString(conn, "\r\n")
+				}
+				io.WriteString(conn, "END\r\n")
+			case "set":
+				n, _ := strconv.Atoi(fields[4])
+				value := make([]byte, n+2)
+				io.ReadFull(br, value)
+				values[fields[1]] = value[0:n]
+				io.WriteString(conn, "STORED\r\n")
+			default:
+				t.Errorf("unexpected command %q", line)
+				io.WriteString(conn, "ERROR\r\n")
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestStore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeServer(t, l)
+
+	s, err := New(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxValueLen = 10
+
+	value, err := s.Get("a key with spaces")
+	if value != nil || err != nil {
+		t.Errorf("Get missing key returned %q, %v", value, err)
+	}
+	if err := s.Set("a key with spaces", []byte("hello"), 60); err != nil {
+		t.Errorf("Set returned %v", err)
+	}
+	value, err = s.Get("a key with spaces")
+	if string(value) != "hello" || err != nil {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+	if err := s.Set("b", []byte("hello world"), 60); err != ErrValueTooLarge {
+		t.Errorf("Set large value returned %v", err)
+	}
+}
+
+func TestNoServers(t *testing.T) {
+	if _, err := New(); err != ErrNoServers {
+		t.Errorf("New() returned %v, expected %v", err, ErrNoServers)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/garyburd/twister/web"
+	"hash/crc32"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Affinity modes for Balancer.
+const (
+	// AffinityNone distributes requests over the backends in turn.
+	AffinityNone = iota
+
+	// AffinityCookie routes a client to the backend named in a cookie. The
+	// balancer sets the cookie when the client does not have a valid cookie
+	// or when the client is moved to another backend.
+	AffinityCookie
+
+	// AffinityIPHash routes a client to a backend selected by a hash of the
+	// client's IP address.
+	AffinityIPHash
+)
+
+// DefaultBalancerCookieName is the default value for Balancer.CookieName.
+const DefaultBalancerCookieName = "twister_backend"
+
+var errNoBackend = web.NewError(web.StatusServiceUnavailable, "no backend available")
+
+// Balancer is a handler that distributes requests over several upstream
+// servers.
+//
+// A backend is marked down for RetryInterval seconds when a request to the
+// backend fails. GET and HEAD requests without a body are retried on another
+// backend. When a client is pinned to a backend that is down, the request is
+// sent to another backend if Failover is true and rejected with status 503
+// otherwise.
+type Balancer struct {
+	// Backends is the list of upstream servers.
+	Backends []*Proxy
+
+	// Affinity is AffinityNone, AffinityCookie or AffinityIPHash.
+	Affinity int
+
+	// CookieName is the name of the cookie used for AffinityCookie. If
+	// CookieName is "", then DefaultBalancerCookieName is used.
+	CookieName string
+
+	// Failover specifies whether clients pinned to a backend that is down are
+	// sent to another backend.
+	Failover bool
+
+	// RetryInterval is the number of seconds that a failed backend is
+	// skipped. If RetryInterval is zero, then 10 seconds is used.
+	RetryInterval int
+
+	mu   sync.Mutex
+	next int
+	down map[*Proxy]int64
+}
+
+// NewBalancer returns a balancer for the given backends.
+func NewBalancer(backends ...*Proxy) *Balancer {
+	return &Balancer{Backends: backends}
+}
+
+// backendID returns the value of the affinity cookie for backend p.
+func backendID(p *Proxy) string {
+	h := sha1.New()
+	h.Write([]byte(p.Upstream.String()))
+	return hex.EncodeToString(h.Sum()[0:8])
+}
+
+func (b *Balancer) cookieName() string {
+	if b.CookieName == "" {
+		return DefaultBalancerCookieName
+	}
+	return b.CookieName
+}
+
+// isUp returns true if backend i is not marked down.
+func (b *Balancer) isUp(i int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down[b.Backends[i]] <= time.Seconds()
+}
+
+// markDown marks backend i down for the retry interval.
+func (b *Balancer) markDown(i int) {
+	interval := b.RetryInterval
+	if interval <= 0 {
+		interval = 10
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down == nil {
+		b.down = make(map[*Proxy]int64)
+	}
+	b.down[b.Backends[i]] = time.Seconds() + int64(interval)
+}
+
+// pinned returns the index of the backend for the client or -1 if the client
+// is not pinned to a backend.
+func (b *Balancer) pinned(req *web.Request) int {
+	switch b.Affinity {
+	case AffinityCookie:
+		id, _ := req.CookieValue(b.cookieName())
+		if id == "" {
+			return -1
+		}
+		for i, p := range b.Backends {
+			if backendID(p) == id {
+				return i
+			}
+		}
+	case AffinityIPHash:
+		host := req.RemoteAddr
+		if net.ParseIP(host) == nil {
+			if i := strings.LastIndex(host, ":"); i > 0 {
+				host = host[0:i]
+			}
+		}
+		return int(crc32.ChecksumIEEE([]byte(host)) % uint32(len(b.Backends)))
+	}
+	return -1
+}
+
+// choose returns the index of a backend that is up or -1 if all backends are
+// down. The search starts at backend start. If start is less than zero, then
+// the search starts at the backend after the previous choice.
+func (b *Balancer) choose(start int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.Backends)
+	if start < 0 {
+		start = b.next
+		b.next = (b.next + 1) % n
+	}
+	now := time.Seconds()
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if b.down[b.Backends[i]] <= now {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Balancer) ServeWeb(req *web.Request) {
+	if len(b.Backends) == 0 {
+		req.Error(web.StatusServiceUnavailable, errNoBackend)
+		return
+	}
+
+	i := b.pinned(req)
+	pinned := i >= 0
+	if pinned && !b.isUp(i) {
+		if !b.Failover {
+			req.Error(web.StatusServiceUnavailable, errNoBackend)
+			return
+		}
+		if b.Affinity == AffinityIPHash {
+			// Keep the choice stable for all clients with this hash.
+			i = b.choose(i)
+		} else {
+			i = -1
+		}
+	}
+	if i < 0 {
+		i = b.choose(-1)
+	}
+
+	// chosen is the backend that serves the request or nil if no backend is
+	// available.
+	var chosen *Proxy
+	if b.Affinity == AffinityCookie {
+		cookieValue, _ := req.CookieValue(b.cookieName())
+		web.FilterRespond(req, func(status int, header web.StringsMap) (int, web.StringsMap) {
+			if chosen == nil {
+				return status, header
+			}
+			if id := backendID(chosen); id != cookieValue {
+				c := web.Cookie{Name: b.cookieName(), Value: id, Path: "/", HttpOnly: true}
+				header.Append(web.HeaderSetCookie, c.String())
+			}
+			return status, header
+		})
+	}
+
+	retry := req.ContentLength == 0 && (req.Method == "GET" || req.Method == "HEAD") && (!pinned || b.Failover)
+	for tries := 0; i >= 0; tries++ {
+		chosen = b.Backends[i]
+		err := chosen.serve(req)
+		if err == nil {
+			return
+		}
+		b.markDown(i)
+		if !retry || isTimeout(err) || tries+1 >= len(b.Backends) {
+			chosen.error(req, err)
+			return
+		}
+		i = b.choose(-1)
+	}
+	chosen = nil
+	req.Error(web.StatusServiceUnavailable, errNoBackend)
+}
@@ -0,0 +1,117 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"github.com/garyburd/twister/web"
+	"github.com/garyburd/twister/web/webtest"
+	"os"
+	"testing"
+)
+
+func newTestBalancer(t *testing.T, affinity int) *Balancer {
+	var backends []*Proxy
+	for _, rawURL := range []string{"http://a.example.com/", "http://b.example.com/", "http://c.example.com/"} {
+		p, err := New(rawURL, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = appendProxy(backends, p)
+	}
+	b := NewBalancer(backends...)
+	b.Affinity = affinity
+	return b
+}
+
+func appendProxy(s []*Proxy, p *Proxy) []*Proxy {
+	t := make([]*Proxy, len(s)+1)
+	copy(t, s)
+	t[len(s)] = p
+	return t
+}
+
+func TestBalancerChoose(t *testing.T) {
+	b := newTestBalancer(t, AffinityNone)
+	for j := 0; j < 6; j++ {
+		if i := b.choose(-1); i != j%3 {
+			t.Errorf("choose %d = %d, expected %d", j, i, j%3)
+		}
+	}
+	b.markDown(1)
+	if i := b.choose(1); i != 2 {
+		t.Errorf("choose(1) with backend 1 down = %d, expected 2", i)
+	}
+	b.markDown(0)
+	b.markDown(2)
+	if i := b.choose(-1); i != -1 {
+		t.Errorf("choose with all backends down = %d, expected -1", i)
+	}
+}
+
+func TestBalancerPinned(t *testing.T) {
+	b := newTestBalancer(t, AffinityCookie)
+	req := &web.Request{Cookie: web.NewStringsMap(DefaultBalancerCookieName, backendID(b.Backends[2]))}
+	if i := b.pinned(req); i != 2 {
+		t.Errorf("cookie pinned = %d, expected 2", i)
+	}
+	req.Cookie = web.NewStringsMap(DefaultBalancerCookieName, "unknown")
+	if i := b.pinned(req); i != -1 {
+		t.Errorf("unknown cookie pinned = %d, expected -1", i)
+	}
+
+	b.Affinity = AffinityIPHash
+	i := b.pinned(&web.Request{RemoteAddr: "10.0.0.1:1234"})
+	if j := b.pinned(&web.Request{RemoteAddr: "10.0.0.1:5678"}); i < 0 || i != j {
+		t.Errorf("IP hash pinned = %d, %d, expected same backend", i, j)
+	}
+}
+
+func TestBalancerPinnedDown(t *testing.T) {
+	b := newTestBalancer(t, AffinityCookie)
+	b.markDown(2)
+	status := 0
+	req := &web.Request{
+		Method:       "GET",
+		Cookie:       web.NewStringsMap(DefaultBalancerCookieName, backendID(b.Backends[2])),
+		ErrorHandler: func(req *web.Request, s int, err os.Error) { status = s },
+	}
+	b.ServeWeb(req)
+	if status != web.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", status, web.StatusServiceUnavailable)
+	}
+}
+
+func TestBalancerAllDown(t *testing.T) {
+	b := newTestBalancer(t, AffinityCookie)
+	for i := range b.Backends {
+		b.markDown(i)
+	}
+	tr := &webtest.Responder{}
+	req := &web.Request{
+		Method:    "GET",
+		Cookie:    make(web.StringsMap),
+		Responder: tr,
+		ErrorHandler: func(req *web.Request, status int, err os.Error) {
+			req.Respond(status)
+		},
+	}
+	b.ServeWeb(req)
+	if tr.Status != web.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", tr.Status, web.StatusServiceUnavailable)
+	}
+	if v, found := tr.Header.Get(web.HeaderSetCookie); found {
+		t.Errorf("Set-Cookie = %q, expected none", v)
+	}
+}
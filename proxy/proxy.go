@@ -0,0 +1,253 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The proxy package implements a reverse proxy handler and a load balancer.
+package proxy
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/client"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Proxy is a handler that forwards requests to an upstream server and copies
+// the upstream response to the client. As specified in RFC 2616, the proxy
+// removes hop-by-hop headers, adds itself to the Via header in requests and
+// responses and handles the Max-Forwards header in TRACE and OPTIONS
+// requests.
+type Proxy struct {
+	// Upstream is the URL of the upstream server. The request path is
+	// appended to the path of the upstream URL.
+	Upstream *http.URL
+
+	// Client sends requests to the upstream server. Set the connect and
+	// read timeouts for the upstream server on the client. If Client is nil,
+	// then client.DefaultClient is used.
+	Client RoundTripper
+
+	// ErrorHandler is called when the upstream request fails. The status is
+	// StatusGatewayTimeout if the upstream server did not respond in time
+	// and StatusBadGateway otherwise. If ErrorHandler is nil, then the
+	// request's error handler is used.
+	ErrorHandler func(req *web.Request, status int, err os.Error)
+
+	// Pseudonym is the name of the proxy in the Via header. If Pseudonym is
+	// "", then "twister" is used.
+	Pseudonym string
+}
+
+// RoundTripper sends a single request and returns the response. The
+// *client.Client type implements RoundTripper.
+type RoundTripper interface {
+	RoundTrip(req *client.Request) (*client.Response, os.Error)
+}
+
+// New returns a proxy for the upstream server at rawURL. The connectTimeout
+// and readTimeout are in nanoseconds. A timeout of zero means no timeout.
+func New(rawURL string, connectTimeout int64, readTimeout int64) (*Proxy, os.Error) {
+	url, err := http.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		Upstream: url,
+		Client:   &client.Client{ConnectTimeout: connectTimeout, Timeout: readTimeout},
+	}, nil
+}
+
+// Hop-by-hop headers are not forwarded by the proxy.
+var hopHeaders = map[string]bool{
+	web.HeaderConnection:         true,
+	"Keep-Alive":                 true,
+	web.HeaderProxyAuthenticate:  true,
+	web.HeaderProxyAuthorization: true,
+	web.HeaderTE:                 true,
+	web.HeaderTrailer:            true,
+	web.HeaderTransferEncoding:   true,
+	web.HeaderUpgrade:            true,
+}
+
+// copyHeader returns a copy of header without the hop-by-hop headers and
+// the headers named in the Connection header.
+func copyHeader(header web.StringsMap) web.StringsMap {
+	connection := make(map[string]bool)
+	for _, value := range header[web.HeaderConnection] {
+		for _, name := range strings.Split(value, ",", -1) {
+			if name = strings.TrimSpace(name); name != "" {
+				connection[web.HeaderName(name)] = true
+			}
+		}
+	}
+	result := make(web.StringsMap)
+	for key, values := range header {
+		if !hopHeaders[key] && !connection[key] {
+			result[key] = values
+		}
+	}
+	return result
+}
+
+// addVia appends the proxy to the Via header.
+func (p *Proxy) addVia(header web.StringsMap, protocolVersion int) {
+	pseudonym := p.Pseudonym
+	if pseudonym == "" {
+		pseudonym = "twister"
+	}
+	version := strconv.Itoa(protocolVersion/1000) + "." + strconv.Itoa(protocolVersion%1000)
+	header.Append(web.HeaderVia, version+" "+pseudonym)
+}
+
+// maxForwards handles the Max-Forwards header for TRACE and OPTIONS
+// requests. If the value of the header is zero, then maxForwards responds
+// to the request and returns false. Otherwise, the value in header is
+// decremented.
+func maxForwards(req *web.Request, header web.StringsMap) bool {
+	if req.Method != "TRACE" && req.Method != "OPTIONS" {
+		return true
+	}
+	s, found := header.Get(web.HeaderMaxForwards)
+	if !found {
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return true
+	}
+	if n > 0 {
+		header.Set(web.HeaderMaxForwards, strconv.Itoa(n-1))
+		return true
+	}
+	if req.Method == "OPTIONS" {
+		req.Respond(web.StatusOK, web.HeaderContentLength, "0")
+		return false
+	}
+	// Echo the request back to the client as the final recipient.
+	var b bytes.Buffer
+	b.WriteString(req.Method)
+	b.WriteString(" ")
+	b.WriteString(req.URL.Raw)
+	b.WriteString(" HTTP/")
+	b.WriteString(strconv.Itoa(req.ProtocolVersion / 1000))
+	b.WriteString(".")
+	b.WriteString(strconv.Itoa(req.ProtocolVersion % 1000))
+	b.WriteString("\r\n")
+	req.Header.WriteHttpHeader(&b)
+	b.WriteString("\r\n")
+	req.RespondBytes(web.StatusOK, "message/http", b.Bytes())
+	return false
+}
+
+type temporaryError interface {
+	Timeout() bool
+}
+
+// isTimeout returns true if err is a timeout error.
+func isTimeout(err os.Error) bool {
+	if err == client.ErrConnectTimeout {
+		return true
+	}
+	if t, ok := err.(temporaryError); ok {
+		return t.Timeout()
+	}
+	if e, ok := err.(*net.OpError); ok {
+		return e.Error == os.EAGAIN
+	}
+	return false
+}
+
+func (p *Proxy) error(req *web.Request, err os.Error) {
+	status := web.StatusBadGateway
+	if isTimeout(err) {
+		status = web.StatusGatewayTimeout
+	}
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(req, status, err)
+	} else {
+		req.Error(status, err)
+	}
+}
+
+// upstreamURL returns the URL of the upstream resource for req.
+func (p *Proxy) upstreamURL(req *web.Request) (*http.URL, os.Error) {
+	path := req.URL.RawPath
+	if path == "" {
+		path = req.URL.Path
+		if req.URL.RawQuery != "" {
+			path = path + "?" + req.URL.RawQuery
+		}
+	}
+	return http.ParseURL(p.Upstream.Scheme + "://" + p.Upstream.Host + strings.TrimRight(p.Upstream.Path, "/") + path)
+}
+
+func (p *Proxy) ServeWeb(req *web.Request) {
+	if err := p.serve(req); err != nil {
+		p.error(req, err)
+	}
+}
+
+// serve forwards the request to the upstream server and copies the upstream
+// response to the client. If the upstream request fails, then serve returns
+// the error without responding to the request.
+func (p *Proxy) serve(req *web.Request) os.Error {
+	url, err := p.upstreamURL(req)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return nil
+	}
+	header := copyHeader(req.Header)
+	if !maxForwards(req, header) {
+		return nil
+	}
+	p.addVia(header, req.ProtocolVersion)
+	if i := strings.LastIndex(req.RemoteAddr, ":"); i > 0 {
+		host := req.RemoteAddr[0:i]
+		// Join the header lines added by earlier proxies.
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		header.Set("X-Forwarded-For", host)
+	}
+	upstreamReq := &client.Request{Method: req.Method, URL: url, Header: header}
+	if req.ContentLength != 0 {
+		upstreamReq.Body = req.Body
+		upstreamReq.ContentLength = req.ContentLength
+	}
+	var c RoundTripper = client.DefaultClient
+	if p.Client != nil {
+		c = p.Client
+	}
+	resp, err := c.RoundTrip(upstreamReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	header = copyHeader(resp.Header)
+	p.addVia(header, resp.ProtocolVersion)
+	w := req.Responder.Respond(resp.Status, header)
+	if w != nil {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			// The response is started. Abort the response so that the
+			// client does not mistake the truncated body for a complete
+			// response.
+			web.AbortResponse(req)
+		}
+	}
+	return nil
+}
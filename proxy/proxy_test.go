@@ -0,0 +1,225 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/client"
+	"github.com/garyburd/twister/web"
+	"github.com/garyburd/twister/web/webtest"
+	"http"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestCopyHeader(t *testing.T) {
+	header := web.NewStringsMap(
+		web.HeaderConnection, "close, X-Private",
+		web.HeaderTE, "trailers",
+		"X-Private", "secret",
+		web.HeaderAccept, "text/html")
+	result := copyHeader(header)
+	for _, key := range []string{web.HeaderConnection, web.HeaderTE, "X-Private"} {
+		if result.Has(key) {
+			t.Errorf("copyHeader did not remove %s", key)
+		}
+	}
+	if v := result.GetDef(web.HeaderAccept, ""); v != "text/html" {
+		t.Errorf("Accept = %q, expected text/html", v)
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	header := web.NewStringsMap(web.HeaderVia, "1.0 fred")
+	p := &Proxy{Pseudonym: "example"}
+	p.addVia(header, 1001)
+	if v := header[web.HeaderVia]; len(v) != 2 || v[0] != "1.0 fred" || v[1] != "1.1 example" {
+		t.Errorf("Via = %q, expected [\"1.0 fred\" \"1.1 example\"]", v)
+	}
+}
+
+type maxForwardsTest struct {
+	method   string
+	value    string
+	forward  bool
+	expected string
+}
+
+var maxForwardsTests = []maxForwardsTest{
+	maxForwardsTest{"OPTIONS", "2", true, "1"},
+	maxForwardsTest{"TRACE", "1", true, "0"},
+	maxForwardsTest{"GET", "0", true, "0"},
+	maxForwardsTest{"OPTIONS", "x", true, "x"},
+}
+
+func TestMaxForwards(t *testing.T) {
+	for _, tt := range maxForwardsTests {
+		header := web.NewStringsMap(web.HeaderMaxForwards, tt.value)
+		req := &web.Request{Method: tt.method, Header: header}
+		if forward := maxForwards(req, header); forward != tt.forward {
+			t.Errorf("%s %s: forward = %v, expected %v", tt.method, tt.value, forward, tt.forward)
+		}
+		if v := header.GetDef(web.HeaderMaxForwards, ""); v != tt.expected {
+			t.Errorf("%s %s: Max-Forwards = %q, expected %q", tt.method, tt.value, v, tt.expected)
+		}
+	}
+}
+
+// stubClient returns a fixed response or error.
+type stubClient struct {
+	resp *client.Response
+	err  os.Error
+	req  *client.Request
+}
+
+func (c *stubClient) RoundTrip(req *client.Request) (*client.Response, os.Error) {
+	c.req = req
+	return c.resp, c.err
+}
+
+type stubBody struct {
+	*bytes.Buffer
+}
+
+func (stubBody) Close() os.Error { return nil }
+
+func newTestProxyRequest(t *testing.T, r web.Responder) *web.Request {
+	url, _ := http.ParseURL("http://example.com/a?b=c")
+	req, err := web.NewRequest("10.0.0.1:1234", "GET", url, web.ProtocolVersion(1, 1), web.NewStringsMap(web.HeaderHost, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Responder = r
+	return req
+}
+
+func TestProxyServe(t *testing.T) {
+	p, _ := New("http://upstream.example.com/base/", 0, 0)
+	c := &stubClient{resp: &client.Response{
+		Status:          web.StatusOK,
+		ProtocolVersion: web.ProtocolVersion(1, 1),
+		Header:          web.NewStringsMap(web.HeaderContentType, "text/plain", web.HeaderConnection, "close"),
+		Body:            stubBody{bytes.NewBufferString("hello")},
+	}}
+	p.Client = c
+	tr := &webtest.Responder{}
+	p.ServeWeb(newTestProxyRequest(t, tr))
+	if s := c.req.URL.String(); s != "http://upstream.example.com/base/a?b=c" {
+		t.Errorf("upstream URL = %s", s)
+	}
+	if v := c.req.Header.GetDef("X-Forwarded-For", ""); v != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, expected 10.0.0.1", v)
+	}
+	if tr.Status != web.StatusOK || tr.Body.String() != "hello" || tr.Header.Has(web.HeaderConnection) || !tr.Header.Has(web.HeaderVia) {
+		t.Errorf("status = %d, header = %v, body = %q", tr.Status, tr.Header, tr.Body.String())
+	}
+}
+
+func TestProxyForwardedFor(t *testing.T) {
+	p, _ := New("http://upstream.example.com/", 0, 0)
+	c := &stubClient{resp: &client.Response{
+		Status: web.StatusOK,
+		Header: make(web.StringsMap),
+		Body:   stubBody{bytes.NewBuffer(nil)},
+	}}
+	p.Client = c
+	req := newTestProxyRequest(t, &webtest.Responder{})
+	req.Header.Append("X-Forwarded-For", "1.1.1.1")
+	req.Header.Append("X-Forwarded-For", "2.2.2.2, 3.3.3.3")
+	p.ServeWeb(req)
+	if v := c.req.Header["X-Forwarded-For"]; len(v) != 1 || v[0] != "1.1.1.1, 2.2.2.2, 3.3.3.3, 10.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, expected [\"1.1.1.1, 2.2.2.2, 3.3.3.3, 10.0.0.1\"]", v)
+	}
+}
+
+// errorBody returns data and then an error.
+type errorBody struct {
+	data []byte
+}
+
+func (b *errorBody) Read(p []byte) (int, os.Error) {
+	if len(b.data) == 0 {
+		return 0, os.EPIPE
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *errorBody) Close() os.Error { return nil }
+
+// abortResponder records calls to Abort.
+type abortResponder struct {
+	webtest.Responder
+	aborted bool
+}
+
+func (r *abortResponder) Abort() { r.aborted = true }
+
+func TestProxyBodyError(t *testing.T) {
+	p, _ := New("http://upstream.example.com/", 0, 0)
+	p.Client = &stubClient{resp: &client.Response{
+		Status: web.StatusOK,
+		Header: make(web.StringsMap),
+		Body:   &errorBody{[]byte("hel")},
+	}}
+	r := &abortResponder{}
+	p.ServeWeb(newTestProxyRequest(t, r))
+	if r.Status != web.StatusOK || r.Body.String() != "hel" || !r.aborted {
+		t.Errorf("status = %d, body = %q, aborted = %v, expected aborted response", r.Status, r.Body.String(), r.aborted)
+	}
+}
+
+type proxyErrorTest struct {
+	err    os.Error
+	status int
+}
+
+var proxyErrorTests = []proxyErrorTest{
+	proxyErrorTest{os.NewError("connection refused"), web.StatusBadGateway},
+	proxyErrorTest{client.ErrConnectTimeout, web.StatusGatewayTimeout},
+	proxyErrorTest{&net.OpError{Op: "read", Net: "tcp", Error: os.EAGAIN}, web.StatusGatewayTimeout},
+}
+
+func TestProxyError(t *testing.T) {
+	for _, tt := range proxyErrorTests {
+		p, _ := New("http://upstream.example.com/", 0, 0)
+		p.Client = &stubClient{err: tt.err}
+
+		// The request's error handler is used by default.
+		var status int
+		var reason os.Error
+		req := newTestProxyRequest(t, &webtest.Responder{})
+		req.ErrorHandler = func(req *web.Request, s int, err os.Error) { status, reason = s, err }
+		p.ServeWeb(req)
+		if status != tt.status || reason != tt.err {
+			t.Errorf("%v: request error handler called with %d, %v, expected %d", tt.err, status, reason, tt.status)
+		}
+
+		// The proxy's error handler overrides the request's error handler.
+		status, reason = 0, nil
+		var proxyStatus int
+		var proxyReason os.Error
+		p.ErrorHandler = func(req *web.Request, s int, err os.Error) { proxyStatus, proxyReason = s, err }
+		p.ServeWeb(req)
+		if status != 0 {
+			t.Errorf("%v: request error handler called with proxy error handler set", tt.err)
+		}
+		if proxyStatus != tt.status || proxyReason != tt.err {
+			t.Errorf("%v: proxy error handler called with %d, %v, expected %d", tt.err, proxyStatus, proxyReason, tt.status)
+		}
+	}
+}
@@ -18,7 +18,10 @@ import (
 	"testing"
 	"bufio"
 	"bytes"
+	"http"
+	"os"
 	"reflect"
+	"strconv"
 	"github.com/garyburd/twister/web"
 )
 
@@ -56,14 +59,24 @@ Cookie: hello=world,
  foo=bar
 Content-Type: text/html
 
+`},
+	parseTest{"dav", "PROPFIND", "/dav/", web.ProtocolVersion(1, 1), web.NewStringsMap(
+		web.HeaderDepth, "1"),
+		`PROPFIND /dav/ HTTP/1.1
+Depth: 1
+
+`},
+	parseTest{"deltav", "VERSION-CONTROL", "/dav/file", web.ProtocolVersion(1, 1), web.NewStringsMap(),
+		`VERSION-CONTROL /dav/file HTTP/1.1
+
 `},
 }
 
 func TestParse(t *testing.T) {
 	for _, tt := range parseTests {
 		b := bufio.NewReader(bytes.NewBufferString(tt.s))
-		method, url, version, statusErr := parseRequestLine(b)
-		header, headerErr := parseHeader(b)
+		method, url, version, statusErr := parseRequestLine(b, &defaultLimits)
+		header, headerErr := parseHeader(b, &defaultLimits, new(headerFields))
 		if tt.method == "" {
 			if statusErr == nil && headerErr == nil {
 				t.Errorf("%s: expected error", tt.name)
@@ -84,3 +97,257 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+type parseLimitTest struct {
+	name   string
+	limits limits
+	err    os.Error
+	s      string
+}
+
+var testLimits = limits{
+	maxURILen:         10,
+	maxHeaderLineLen:  20,
+	maxHeaderValueLen: 30,
+	maxHeaderCount:    3,
+	maxHeaderBytes:    50,
+}
+
+var parseLimitTests = []parseLimitTest{
+	parseLimitTest{"ok", testLimits, nil,
+		"GET /foo HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n"},
+	parseLimitTest{"uri", testLimits, ErrURITooLong,
+		"GET /0123456789 HTTP/1.1\r\n\r\n"},
+	parseLimitTest{"line", testLimits, ErrLineTooLong,
+		"GET /foo HTTP/1.1\r\nA: 01234567890123456789\r\n\r\n"},
+	parseLimitTest{"value", testLimits, ErrHeaderTooLong,
+		"GET /foo HTTP/1.1\r\nA: 0123456789\r\n 0123456789\r\n 0123456789\r\n\r\n"},
+	parseLimitTest{"count", testLimits, ErrHeadersTooLong,
+		"GET /foo HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"},
+	parseLimitTest{"bytes", testLimits, ErrHeaderTooLarge,
+		"GET /foo HTTP/1.1\r\nA: 0123456789\r\n 0123456789\r\n 01234567\r\nB: 0123456789\r\n\r\n"},
+}
+
+func TestParseLimits(t *testing.T) {
+	for _, tt := range parseLimitTests {
+		b := bufio.NewReader(bytes.NewBufferString(tt.s))
+		_, _, _, err := parseRequestLine(b, &tt.limits)
+		if err == nil {
+			_, err = parseHeader(b, &tt.limits, new(headerFields))
+		}
+		if err != tt.err {
+			t.Errorf("%s: err=%v, expected %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+type parseAuthorityTest struct {
+	s    string
+	host string
+}
+
+var parseAuthorityTests = []parseAuthorityTest{
+	parseAuthorityTest{"example.com:443", "example.com:443"},
+	parseAuthorityTest{"127.0.0.1:8080", "127.0.0.1:8080"},
+	parseAuthorityTest{"example.com", ""},
+	parseAuthorityTest{"example.com:", ""},
+	parseAuthorityTest{":443", ""},
+	parseAuthorityTest{"example.com:https", ""},
+	parseAuthorityTest{"http://example.com:443/", ""},
+}
+
+func TestParseAuthority(t *testing.T) {
+	for _, tt := range parseAuthorityTests {
+		url, err := parseAuthority(tt.s)
+		if tt.host == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.s, err)
+			continue
+		}
+		if url.Host != tt.host {
+			t.Errorf("%s: host=%s, expected %s", tt.s, url.Host, tt.host)
+		}
+	}
+}
+
+type reconcileHostTest struct {
+	rawURL  string
+	host    string
+	version int
+	urlHost string
+	err     os.Error
+}
+
+var reconcileHostTests = []reconcileHostTest{
+	reconcileHostTest{"/", "example.com", web.ProtocolVersion(1, 1), "example.com", nil},
+	reconcileHostTest{"/", "", web.ProtocolVersion(1, 1), "", ErrMissingHost},
+	reconcileHostTest{"/", "", web.ProtocolVersion(1, 0), "", nil},
+	reconcileHostTest{"http://example.com/", "example.com", web.ProtocolVersion(1, 1), "example.com", nil},
+	reconcileHostTest{"http://example.com/", "EXAMPLE.com:80", web.ProtocolVersion(1, 1), "example.com", nil},
+	reconcileHostTest{"https://example.com:443/", "example.com", web.ProtocolVersion(1, 1), "example.com:443", nil},
+	reconcileHostTest{"http://example.com/", "other.com", web.ProtocolVersion(1, 1), "", ErrHostMismatch},
+	reconcileHostTest{"http://example.com/", "", web.ProtocolVersion(1, 1), "", ErrMissingHost},
+}
+
+func TestReconcileHost(t *testing.T) {
+	for _, tt := range reconcileHostTests {
+		url, err := http.ParseURL(tt.rawURL)
+		if err != nil {
+			t.Errorf("%s: could not parse URL, %s", tt.rawURL, err)
+			continue
+		}
+		header := web.NewStringsMap()
+		if tt.host != "" {
+			header.Set(web.HeaderHost, tt.host)
+		}
+		err = reconcileHost(url, header, tt.version)
+		if err != tt.err {
+			t.Errorf("%s host=%s: err=%v, expected %v", tt.rawURL, tt.host, err, tt.err)
+			continue
+		}
+		if err == nil && url.Host != tt.urlHost {
+			t.Errorf("%s host=%s: url.Host=%s, expected %s", tt.rawURL, tt.host, url.Host, tt.urlHost)
+		}
+	}
+}
+
+type parseRequestTargetTest struct {
+	method string
+	rawURL string
+	path   string
+	ok     bool
+}
+
+var parseRequestTargetTests = []parseRequestTargetTest{
+	parseRequestTargetTest{"GET", "/foo?bar", "/foo", true},
+	parseRequestTargetTest{"OPTIONS", "*", "*", true},
+	parseRequestTargetTest{"OPTIONS", "/foo", "/foo", true},
+	parseRequestTargetTest{"GET", "*", "", false},
+	parseRequestTargetTest{"CONNECT", "example.com:443", "", true},
+	parseRequestTargetTest{"CONNECT", "*", "", false},
+}
+
+func TestParseRequestTarget(t *testing.T) {
+	for _, tt := range parseRequestTargetTests {
+		url, err := parseRequestTarget(tt.method, tt.rawURL)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s %s: expected error", tt.method, tt.rawURL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %s", tt.method, tt.rawURL, err)
+			continue
+		}
+		if url.Path != tt.path {
+			t.Errorf("%s %s: path=%s, expected %s", tt.method, tt.rawURL, url.Path, tt.path)
+		}
+	}
+}
+
+type statusLineTest struct {
+	status   int
+	http11   bool
+	expected string
+}
+
+var statusLineTests = []statusLineTest{
+	statusLineTest{web.StatusOK, true, "HTTP/1.1 200 OK\r\n"},
+	statusLineTest{web.StatusNotFound, false, "HTTP/1.0 404 Not Found\r\n"},
+	statusLineTest{299, true, "HTTP/1.1 299 status code 299\r\n"},
+	statusLineTest{1000, false, "HTTP/1.0 1000 status code 1000\r\n"},
+}
+
+func TestStatusLine(t *testing.T) {
+	for _, tt := range statusLineTests {
+		if actual := string(statusLine(tt.status, tt.http11)); actual != tt.expected {
+			t.Errorf("statusLine(%d, %v) = %q, expected %q", tt.status, tt.http11, actual, tt.expected)
+		}
+	}
+}
+
+func TestDateLine(t *testing.T) {
+	var dc dateCache
+	line := string(dc.line())
+	if len(line) != len("Date: Mon, 02 Jan 2006 15:04:05 GMT\r\n") || line[0:6] != "Date: " || line[len(line)-6:] != " GMT\r\n" {
+		t.Errorf("line() = %q", line)
+	}
+}
+
+const benchRequest = "GET /posts/1234?page=2 HTTP/1.1\r\n" +
+	"Host: www.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; U; Linux x86_64; en-US) AppleWebKit/534.10 (KHTML, like Gecko) Chrome/8.0.552.215 Safari/534.10\r\n" +
+	"Accept: application/xml,application/xhtml+xml,text/html;q=0.9,text/plain;q=0.8,image/png,*/*;q=0.5\r\n" +
+	"Accept-Encoding: gzip,deflate,sdch\r\n" +
+	"Accept-Language: en-US,en;q=0.8\r\n" +
+	"Accept-Charset: ISO-8859-1,utf-8;q=0.7,*;q=0.3\r\n" +
+	"Cookie: session=0123456789abcdef; xsrf=01234567\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n"
+
+func BenchmarkParseRequest(b *testing.B) {
+	b.SetBytes(int64(len(benchRequest)))
+	var fields headerFields
+	for i := 0; i < b.N; i++ {
+		br := bufio.NewReader(bytes.NewBufferString(benchRequest))
+		parseRequestLine(br, &defaultLimits)
+		parseHeader(br, &defaultLimits, &fields)
+	}
+}
+
+// BenchmarkParseRequestNewFields allocates the header fields for each request
+// for comparison with BenchmarkParseRequest.
+func BenchmarkParseRequestNewFields(b *testing.B) {
+	b.SetBytes(int64(len(benchRequest)))
+	for i := 0; i < b.N; i++ {
+		br := bufio.NewReader(bytes.NewBufferString(benchRequest))
+		parseRequestLine(br, &defaultLimits)
+		parseHeader(br, &defaultLimits, new(headerFields))
+	}
+}
+
+func TestParseHeaderReuseFields(t *testing.T) {
+	var fields headerFields
+	h1, err := parseHeader(bufio.NewReader(bytes.NewBufferString("A: 1\r\nB: 2\r\n\r\n")), &defaultLimits, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := parseHeader(bufio.NewReader(bytes.NewBufferString("A: 3\r\n\r\n")), &defaultLimits, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h1, web.NewStringsMap("A", "1", "B", "2")) || !reflect.DeepEqual(h2, web.NewStringsMap("A", "3")) {
+		t.Errorf("h1 = %v, h2 = %v", h1, h2)
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	var h headerFields
+	for i := 0; i < smallHeaderLen+4; i++ {
+		h.Append("X-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	h.Append("X-1", "a")
+	h.Append("X-1", "b")
+	header := h.StringsMap()
+	if len(header) != smallHeaderLen+4 {
+		t.Errorf("len(header) = %d, expected %d", len(header), smallHeaderLen+4)
+	}
+	if !reflect.DeepEqual(header["X-1"], []string{"1", "a", "b"}) || !reflect.DeepEqual(header["X-2"], []string{"2"}) ||
+		header.GetDef("X-19", "") != "19" {
+		t.Errorf("header = %v", header)
+	}
+	header.Append("X-3", "c")
+	if !reflect.DeepEqual(header["X-4"], []string{"4"}) {
+		t.Errorf("Append modified value of another key, X-4 = %v", header["X-4"])
+	}
+	h.reset()
+	if len(h.fields) != 0 || len(h.StringsMap()) != 0 {
+		t.Error("fields not empty after reset")
+	}
+}
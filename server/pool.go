@@ -0,0 +1,155 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// The number of idle buffers of each kind kept by a server.
+const bufferPoolSize = 256
+
+// switchReader reads from r and records the first error returned from r. The
+// bufio.Reader in a readBuffer reads from a switchReader so that the reader
+// can be moved from one connection to another.
+type switchReader struct {
+	r   io.Reader
+	err os.Error
+}
+
+func (sr *switchReader) Read(p []byte) (int, os.Error) {
+	n, err := sr.r.Read(p)
+	if err != nil && sr.err == nil {
+		sr.err = err
+	}
+	return n, err
+}
+
+// switchWriter writes to w and records the first error returned from w.
+type switchWriter struct {
+	w   io.Writer
+	err os.Error
+}
+
+func (sw *switchWriter) Write(p []byte) (int, os.Error) {
+	n, err := sw.w.Write(p)
+	if err != nil && sw.err == nil {
+		sw.err = err
+	}
+	return n, err
+}
+
+// readBuffer is a reusable buffered reader for a connection.
+type readBuffer struct {
+	sr     switchReader
+	br     *bufio.Reader
+	fields headerFields
+}
+
+// writeBuffer is a reusable buffered writer for a response and a buffer for
+// output pending a write to the network.
+type writeBuffer struct {
+	sw  switchWriter
+	bw  *bufio.Writer
+	out bytes.Buffer
+	buf []byte // scratch buffer for copying response bodies
+}
+
+// scratch returns the write buffer's scratch buffer, allocating the buffer
+// on first use.
+func (wb *writeBuffer) scratch() []byte {
+	if wb.buf == nil {
+		wb.buf = make([]byte, maxCoalesceLen)
+	}
+	return wb.buf
+}
+
+// initPools creates the server's free lists if they have not been created
+// already.
+func (s *Server) initPools() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readBuffers == nil {
+		s.readBuffers = make(chan *readBuffer, bufferPoolSize)
+		s.writeBuffers = make(chan *writeBuffer, bufferPoolSize)
+	}
+}
+
+// getReadBuffer returns a buffered reader for r from the free list or
+// allocates a new one if the free list is empty.
+func (s *Server) getReadBuffer(r io.Reader, size int) (*readBuffer, os.Error) {
+	var rb *readBuffer
+	select {
+	case rb = <-s.readBuffers:
+	default:
+		rb = new(readBuffer)
+		var err os.Error
+		rb.br, err = bufio.NewReaderSize(&rb.sr, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rb.sr.r = r
+	return rb, nil
+}
+
+// putReadBuffer returns rb to the free list. The buffer is discarded if the
+// reader encountered an error or holds unread data.
+func (s *Server) putReadBuffer(rb *readBuffer) {
+	rb.sr.r = nil
+	rb.fields.reset()
+	if rb.sr.err != nil || rb.br.Buffered() != 0 {
+		return
+	}
+	select {
+	case s.readBuffers <- rb:
+	default:
+	}
+}
+
+// getWriteBuffer returns a buffered writer for w from the free list or
+// allocates a new one if the free list is empty.
+func (s *Server) getWriteBuffer(w io.Writer, size int) (*writeBuffer, os.Error) {
+	var wb *writeBuffer
+	select {
+	case wb = <-s.writeBuffers:
+	default:
+		wb = new(writeBuffer)
+		var err os.Error
+		wb.bw, err = bufio.NewWriterSize(&wb.sw, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	wb.sw.w = w
+	wb.out.Reset()
+	return wb, nil
+}
+
+// putWriteBuffer returns wb to the free list. The buffer is discarded if the
+// writer encountered an error or holds unflushed data.
+func (s *Server) putWriteBuffer(wb *writeBuffer) {
+	wb.sw.w = nil
+	if wb.sw.err != nil || wb.bw.Buffered() != 0 {
+		return
+	}
+	select {
+	case s.writeBuffers <- wb:
+	default:
+	}
+}
@@ -18,6 +18,8 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"github.com/garyburd/twister/web"
 	"http"
 	"io"
@@ -27,32 +29,292 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	ErrBadRequestLine = os.NewError("could not parse request line")
-	ErrLineTooLong    = os.NewError("request line or header line too long")
-	ErrBadHeaderLine  = os.NewError("could not parse header line")
-	ErrHeaderTooLong  = os.NewError("header value too long")
-	ErrHeadersTooLong = os.NewError("too many headers")
+	ErrBadRequestLine os.Error = web.NewError(web.StatusBadRequest, "could not parse request line")
+	ErrLineTooLong    os.Error = web.NewError(web.StatusRequestHeaderFieldsTooLarge, "request line or header line too long")
+	ErrBadHeaderLine  os.Error = web.NewError(web.StatusBadRequest, "could not parse header line")
+	ErrHeaderTooLong  os.Error = web.NewError(web.StatusRequestHeaderFieldsTooLarge, "header value too long")
+	ErrHeadersTooLong os.Error = web.NewError(web.StatusRequestHeaderFieldsTooLarge, "too many headers")
+	ErrHeaderTooLarge os.Error = web.NewError(web.StatusRequestHeaderFieldsTooLarge, "header too large")
+	ErrURITooLong     os.Error = web.NewError(web.StatusRequestURITooLong, "request URI too long")
+	ErrMissingHost    os.Error = web.NewError(web.StatusBadRequest, "missing host header")
+	ErrHostMismatch   os.Error = web.NewError(web.StatusBadRequest, "host header does not match request URI")
+	errDraining       os.Error = web.NewError(web.StatusServiceUnavailable, "server is draining")
+	errPipelineClosed os.Error = os.NewError("twister/server: connection closed by earlier response")
+	errAborted        os.Error = os.NewError("twister/server: response aborted")
 )
 
+// Default limits used when the corresponding Server field is zero.
+const (
+	DefaultMaxURILen         = 4096
+	DefaultMaxHeaderLineLen  = 4096
+	DefaultMaxHeaderValueLen = 4096
+	DefaultMaxHeaderCount    = 256
+	DefaultMaxHeaderBytes    = 65536
+
+	DefaultMaxPipelinedRequests = 16
+	DefaultMaxConcurrentStreams = 100
+	DefaultWriteBufferSize      = 4096
+)
+
+// Server defines parameters for running an HTTP server.
+type Server struct {
+	// The TCP network address to listen on.
+	Addr string
+
+	// The handler to invoke for requests.
+	Handler web.Handler
+
+	// The host name used in the request URL when the request does not
+	// specify a host.
+	ServerName string
+
+	// Secure is true if the listener returns TLS connections. Secure is
+	// implied when TLSConfig is set.
+	Secure bool
+
+	// TLSConfig is the TLS configuration used by ListenAndServe and
+	// ListenAndServeTLS. Use the configuration to select cipher suites,
+	// request client certificates and advertise protocols for next protocol
+	// negotiation. The verified client certificate chain is available to
+	// handlers through the request's TLS field.
+	TLSConfig *tls.Config
+
+	// By default, the server writes the "100 Continue" interim response to
+	// requests with the "Expect: 100-continue" header when the handler first
+	// reads the request body. If NoAutoContinue is true, then the server
+	// does not write the interim response automatically and the handler must
+	// call the request's Responder.Continue method before reading the body.
+	NoAutoContinue bool
+
+	// Limits on the size of the request line and header. The server responds
+	// with HTTP status 414 when the request URI is too long and with status
+	// 431 when the header exceeds a limit. The default value is used for a
+	// limit that is zero.
+	MaxURILen         int // Max length of request URI.
+	MaxHeaderLineLen  int // Max length of a single header line.
+	MaxHeaderValueLen int // Max length of a header value after continuation lines are joined.
+	MaxHeaderCount    int // Max number of header lines.
+	MaxHeaderBytes    int // Max total size of the header.
+
+	// MaxRequestBodyLen is the maximum number of request body bytes that
+	// handlers can read. If the request Content-Length exceeds the limit,
+	// then the server responds with HTTP status 413 without calling the
+	// handler. Otherwise, reads past the limit return the error
+	// web.ErrRequestEntityTooLarge. There is no limit if the value is zero.
+	MaxRequestBodyLen int
+
+	// Sizes of the buffers used to read requests and write responses. Use
+	// large buffers for workloads with large responses and small buffers to
+	// reduce memory use. Request lines and header lines longer than the read
+	// buffer are rejected. By default, the read buffer is large enough for
+	// the longest request line and header line allowed by the limits above
+	// and the write buffer is DefaultWriteBufferSize bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxPipelinedRequests is the maximum number of consecutive requests
+	// that the server handles from data already buffered from the
+	// connection. Clients pipeline requests by sending requests before the
+	// response to the previous request is received. The server handles
+	// pipelined requests one at a time, unless ConcurrentPipelining is set,
+	// and writes the responses in request order. When the limit is reached, the server closes the connection
+	// after the current response and the client must resend the remaining
+	// requests. The default value is used if the value is zero.
+	MaxPipelinedRequests int
+
+	// ConcurrentPipelining enables handling of pipelined requests while the
+	// handler for the previous request is running. When a request without
+	// a body is followed by data already buffered from the connection, the
+	// server runs the handler in a new goroutine and reads the next request.
+	// Responses are written in request order: a handler blocks on its first
+	// write to the network until the responses to the earlier requests are
+	// complete. Requests with a body or an Upgrade header are handled one at
+	// a time. Handlers for concurrent requests cannot hijack the connection.
+	ConcurrentPipelining bool
+
+	// MaxConcurrentStreams is the maximum number of concurrent SPDY streams
+	// on a connection. The server advertises the limit to the client in a
+	// SETTINGS frame and refuses streams over the limit. The default value
+	// is used if the value is zero.
+	MaxConcurrentStreams int
+
+	// HealthCheckPath is the path of the load balancer health check. When
+	// the server is draining, the server responds to requests for this path
+	// with HTTP status 503 instead of calling the handler.
+	HealthCheckPath string
+
+	// ReadTimeout and WriteTimeout are the maximum times in nanoseconds to
+	// wait for a read or write on a connection. The read timeout also
+	// limits the time that an idle connection is kept open between
+	// requests. The timeouts are cleared when a handler hijacks the
+	// connection. There is no timeout if the value is zero.
+	ReadTimeout  int64
+	WriteTimeout int64
+
+	// AllowedMethods is the list of methods advertised in the Allow header
+	// of the response to server-wide "OPTIONS *" requests. The server
+	// responds to these requests without calling the handler.
+	// DefaultAllowedMethods is used if the value is nil.
+	AllowedMethods []string
+
+	// OptionsHeader specifies additional header fields for the response to
+	// "OPTIONS *" requests. Use the header to advertise extensions supported
+	// by the server.
+	OptionsHeader web.StringsMap
+
+	// AcceptError is called with temporary errors returned from the
+	// listener's Accept method. The server retries Accept with exponential
+	// backoff after a temporary error and returns from Serve on all other
+	// errors. Set AcceptError to log the errors.
+	AcceptError func(err os.Error)
+
+	// ErrorLog receives the errors logged by the server, one message per
+	// call to Write. Use web.NewSyslogWriter to send the errors to syslog. If
+	// ErrorLog is nil, then errors are logged to standard error using the
+	// log package.
+	ErrorLog io.Writer
+
+	mu       sync.Mutex
+	active   int
+	conns    int
+	draining bool
+	drained  chan bool
+
+	// Free lists of buffers shared by the server's connections.
+	readBuffers  chan *readBuffer
+	writeBuffers chan *writeBuffer
+}
+
+// logError logs the operands to the server's error log. Spaces are added
+// between operands as in fmt.Sprintln.
+func (s *Server) logError(v ...interface{}) {
+	if s.ErrorLog == nil {
+		log.Stderr(v...)
+		return
+	}
+	io.WriteString(s.ErrorLog, fmt.Sprintln(v...))
+}
+
+// limits specifies the limits for parsing the request line and header.
+type limits struct {
+	maxURILen         int
+	maxHeaderLineLen  int
+	maxHeaderValueLen int
+	maxHeaderCount    int
+	maxHeaderBytes    int
+}
+
+var defaultLimits = limits{
+	maxURILen:         DefaultMaxURILen,
+	maxHeaderLineLen:  DefaultMaxHeaderLineLen,
+	maxHeaderValueLen: DefaultMaxHeaderValueLen,
+	maxHeaderCount:    DefaultMaxHeaderCount,
+	maxHeaderBytes:    DefaultMaxHeaderBytes,
+}
+
+func limit(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+// limits returns the server's parser limits with defaults applied.
+func (s *Server) limits() *limits {
+	return &limits{
+		maxURILen:         limit(s.MaxURILen, DefaultMaxURILen),
+		maxHeaderLineLen:  limit(s.MaxHeaderLineLen, DefaultMaxHeaderLineLen),
+		maxHeaderValueLen: limit(s.MaxHeaderValueLen, DefaultMaxHeaderValueLen),
+		maxHeaderCount:    limit(s.MaxHeaderCount, DefaultMaxHeaderCount),
+		maxHeaderBytes:    limit(s.MaxHeaderBytes, DefaultMaxHeaderBytes),
+	}
+}
+
+// readBufferSize returns a read buffer size large enough to hold the
+// longest request line and header line allowed by l.
+func (l *limits) readBufferSize() int {
+	// Allow for the method, the protocol version and the line terminator.
+	n := l.maxURILen + 64
+	if l.maxHeaderLineLen+2 > n {
+		n = l.maxHeaderLineLen + 2
+	}
+	if n < 4096 {
+		n = 4096
+	}
+	return n
+}
+
 type conn struct {
-	serverName         string
-	secure             bool
+	server             *Server
+	limits             *limits
 	netConn            net.Conn
 	br                 *bufio.Reader
+	fields             *headerFields
 	bw                 *bufio.Writer
+	wb                 *writeBuffer
 	chunked            bool
 	closeAfterResponse bool
 	hijacked           bool
 	req                *web.Request
 	requestAvail       int
 	requestErr         os.Error
+	requestRead        int
 	respondCalled      bool
 	responseAvail      int
 	responseErr        os.Error
 	write100Continue   bool
+
+	// Write timeout set on netConn by writeOut or zero if the server's write
+	// timeout is in effect.
+	writeTimeout int64
+
+	// Fields used when the server handles pipelined requests concurrently.
+	pipeline   *pipeline
+	prev       chan bool // closed when the previous response is complete
+	concurrent bool
+}
+
+// pipeline holds the state shared by the requests handled concurrently on a
+// connection.
+type pipeline struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+// close records that a response closed the connection. Responses to later
+// requests are not written.
+func (p *pipeline) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+}
+
+func (p *pipeline) isClosed() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// waitTurn waits for the responses to earlier requests on the connection to
+// complete. An error is returned if an earlier response closed the
+// connection.
+func (c *conn) waitTurn() os.Error {
+	if c.prev != nil {
+		<-c.prev
+		c.prev = nil
+	}
+	if c.pipeline.isClosed() {
+		return errPipelineClosed
+	}
+	return nil
 }
 
 func skipBytes(p []byte, f func(byte) bool) int {
@@ -79,14 +341,16 @@ func trimWSRight(p []byte) []byte {
 	return p[0:i]
 }
 
-var requestLineRegexp = regexp.MustCompile("^([_A-Za-z0-9]+) ([^ ]+) HTTP/([0-9]+)\\.([0-9]+)$")
+// requestLineRegexp matches the request line. The method pattern admits the
+// '-' used by extension methods such as the WebDAV VERSION-CONTROL method.
+var requestLineRegexp = regexp.MustCompile("^([-_A-Za-z0-9]+) ([^ ]+) HTTP/([0-9]+)\\.([0-9]+)$")
 
-func parseRequestLine(b *bufio.Reader) (method string, url string, version int, err os.Error) {
+func parseRequestLine(b *bufio.Reader, l *limits) (method string, url string, version int, err os.Error) {
 
 	p, err := b.ReadSlice('\n')
 	if err != nil {
 		if err == bufio.ErrBufferFull {
-			err = ErrLineTooLong
+			err = ErrURITooLong
 		}
 		return
 	}
@@ -113,25 +377,87 @@ func parseRequestLine(b *bufio.Reader) (method string, url string, version int,
 
 	version = web.ProtocolVersion(major, minor)
 
+	if len(m[2]) > l.maxURILen {
+		err = ErrURITooLong
+		return
+	}
+
 	url = string(m[2])
 
 	return
 }
 
-func parseHeader(b *bufio.Reader) (header web.StringsMap, err os.Error) {
+// headerField is a header line parsed from a request.
+type headerField struct {
+	key   string
+	value string
+}
+
+// The number of header lines stored by headerFields without allocating.
+const smallHeaderLen = 16
+
+// headerFields holds the header of a request while the header is parsed.
+// The fields are stored in an array for the common case of a request with a
+// small number of header lines. The headerFields is part of the pooled
+// readBuffer and is reused by every request read with that buffer.
+type headerFields struct {
+	small  [smallHeaderLen]headerField
+	fields []headerField
+}
+
+// reset removes all fields.
+func (h *headerFields) reset() {
+	for i := range h.fields {
+		h.fields[i] = headerField{}
+	}
+	h.fields = h.small[0:0]
+}
+
+// Append appends value to the values for key.
+func (h *headerFields) Append(key string, value string) {
+	if h.fields == nil {
+		h.fields = h.small[0:0]
+	}
+	n := len(h.fields)
+	if n == cap(h.fields) {
+		p := make([]headerField, n, 2*n)
+		copy(p, h.fields)
+		h.fields = p
+	}
+	h.fields = h.fields[0 : n+1]
+	h.fields[n] = headerField{key, value}
+}
+
+// StringsMap returns the fields as a web.StringsMap. The value slices for
+// keys with a single value are allocated from a single array.
+// StringsMap.Append does not modify the backing array of a slice.
+func (h *headerFields) StringsMap() web.StringsMap {
+	header := make(web.StringsMap, len(h.fields))
+	values := make([]string, len(h.fields))
+	for i, f := range h.fields {
+		if prior, found := header[f.key]; found {
+			// Repeated keys are rare. Copy to a new slice instead of
+			// overwriting the value of the next key in the array.
+			p := make([]string, len(prior)+1)
+			copy(p, prior)
+			p[len(prior)] = f.value
+			header[f.key] = p
+			continue
+		}
+		values[i] = f.value
+		header[f.key] = values[i : i+1]
+	}
+	return header
+}
 
-	const (
-		// Max size for header line
-		maxLineSize = 4096
-		// Max size for header value
-		maxValueSize = 4096
-		// Maximum number of headers 
-		maxHeaderCount = 256
-	)
+// parseHeader parses the request header into fields and returns the header
+// as a web.StringsMap.
+func parseHeader(b *bufio.Reader, l *limits, fields *headerFields) (header web.StringsMap, err os.Error) {
 
-	header = make(web.StringsMap)
+	fields.reset()
 	lastKey := ""
 	headerCount := 0
+	headerBytes := 0
 
 	for {
 		p, err := b.ReadSlice('\n')
@@ -144,6 +470,12 @@ func parseHeader(b *bufio.Reader) (header web.StringsMap, err os.Error) {
 			return nil, err
 		}
 
+		// Don't allow huge headers.
+		headerBytes += len(p)
+		if headerBytes > l.maxHeaderBytes {
+			return nil, ErrHeaderTooLarge
+		}
+
 		// remove line terminator
 		if len(p) >= 2 && p[len(p)-2] == '\r' {
 			// \r\n
@@ -159,7 +491,7 @@ func parseHeader(b *bufio.Reader) (header web.StringsMap, err os.Error) {
 		}
 
 		// Don't allow huge header lines.
-		if len(p) > maxLineSize {
+		if len(p) > l.maxHeaderLineLen {
 			return nil, ErrLineTooLong
 		}
 
@@ -172,20 +504,19 @@ func parseHeader(b *bufio.Reader) (header web.StringsMap, err os.Error) {
 			p = trimWSLeft(trimWSRight(p))
 
 			if len(p) > 0 {
-				values := header[lastKey]
-				value := values[len(values)-1]
-				value = value + " " + string(p)
-				if len(value) > maxValueSize {
+				f := &fields.fields[len(fields.fields)-1]
+				value := f.value + " " + string(p)
+				if len(value) > l.maxHeaderValueLen {
 					return nil, ErrHeaderTooLong
 				}
-				values[len(values)-1] = value
+				f.value = value
 			}
 
 		} else {
 
 			// New header
 			headerCount = headerCount + 1
-			if headerCount > maxHeaderCount {
+			if headerCount > l.maxHeaderCount {
 				return nil, ErrHeadersTooLong
 			}
 
@@ -208,38 +539,107 @@ func parseHeader(b *bufio.Reader) (header web.StringsMap, err os.Error) {
 
 			// Value 
 			p = trimWSLeft(p)
-			value := string(trimWSRight(p))
-			header.Append(key, value)
+			fields.Append(key, string(trimWSRight(p)))
 		}
 	}
+	header = fields.StringsMap()
+	fields.reset()
 	return header, nil
 }
 
+// parseAuthority parses the host:port request target used by the CONNECT
+// method.
+func parseAuthority(rawURL string) (*http.URL, os.Error) {
+	i := strings.LastIndex(rawURL, ":")
+	if i <= 0 || i == len(rawURL)-1 || strings.IndexAny(rawURL, "/?#@") >= 0 {
+		return nil, ErrBadRequestLine
+	}
+	if _, err := strconv.Atoi(rawURL[i+1:]); err != nil {
+		return nil, ErrBadRequestLine
+	}
+	return &http.URL{Raw: rawURL, RawAuthority: rawURL, Host: rawURL}, nil
+}
+
+// parseRequestTarget parses the request target in the request line. The
+// target is the authority for the CONNECT method and "*" for server-wide
+// OPTIONS requests. The path of the returned URL is "*" for server-wide
+// OPTIONS requests.
+func parseRequestTarget(method string, rawURL string) (*http.URL, os.Error) {
+	switch {
+	case method == "CONNECT":
+		return parseAuthority(rawURL)
+	case rawURL == "*":
+		if method != "OPTIONS" {
+			return nil, ErrBadRequestLine
+		}
+		return &http.URL{Raw: rawURL, Path: rawURL}, nil
+	}
+	return http.ParseURL(rawURL)
+}
+
+// reconcileHost sets the host in url from the Host header for origin-form
+// request targets and checks that the Host header matches the host in
+// absolute-form request targets. HTTP/1.1 requests must include the Host
+// header.
+func reconcileHost(url *http.URL, header web.StringsMap, version int) os.Error {
+	host, found := header.Get(web.HeaderHost)
+	if !found {
+		if version >= web.ProtocolVersion(1, 1) {
+			return ErrMissingHost
+		}
+		return nil
+	}
+	if url.Host == "" {
+		url.Host = host
+		return nil
+	}
+	if canonicalHost(url.Host, url.Scheme) != canonicalHost(host, url.Scheme) {
+		return ErrHostMismatch
+	}
+	if url.Path == "" && url.Scheme != "" {
+		url.Path = "/"
+	}
+	return nil
+}
+
+// canonicalHost returns host in lower case with the default port for scheme
+// removed.
+func canonicalHost(host string, scheme string) string {
+	host = strings.ToLower(host)
+	switch {
+	case scheme != "https" && strings.HasSuffix(host, ":80"):
+		host = host[0 : len(host)-3]
+	case scheme != "http" && strings.HasSuffix(host, ":443"):
+		host = host[0 : len(host)-4]
+	}
+	return host
+}
+
 func (c *conn) prepare() (err os.Error) {
 
-	method, rawURL, version, err := parseRequestLine(c.br)
+	method, rawURL, version, err := parseRequestLine(c.br, c.limits)
 	if err != nil {
 		return err
 	}
 
-	header, err := parseHeader(c.br)
+	header, err := parseHeader(c.br, c.limits, c.fields)
 	if err != nil {
 		return err
 	}
 
-	url, err := http.ParseURL(rawURL)
+	url, err := parseRequestTarget(method, rawURL)
 	if err != nil {
 		return err
 	}
 
+	if err := reconcileHost(url, header, version); err != nil {
+		return err
+	}
 	if url.Host == "" {
-		url.Host = header.GetDef(web.HeaderHost, "")
-		if url.Host == "" {
-			url.Host = c.serverName
-		}
+		url.Host = c.server.ServerName
 	}
 
-	if c.secure {
+	if c.server.Secure || c.server.TLSConfig != nil {
 		url.Scheme = "https"
 	} else {
 		url.Scheme = "http"
@@ -251,6 +651,11 @@ func (c *conn) prepare() (err os.Error) {
 	}
 	c.req = req
 
+	if tlsConn, ok := c.netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
 	c.requestAvail = req.ContentLength
 	if c.requestAvail < 0 {
 		c.requestAvail = 0
@@ -282,38 +687,120 @@ func (c requestReader) Read(p []byte) (int, os.Error) {
 	if c.requestErr != nil {
 		return 0, c.requestErr
 	}
-	if c.write100Continue {
-		c.write100Continue = false
-		io.WriteString(c.netConn, "HTTP/1.1 100 Continue\r\n\r\n")
+	if c.write100Continue && !c.server.NoAutoContinue {
+		c.Continue()
 	}
 	if c.requestAvail <= 0 {
 		c.requestErr = os.EOF
 		return 0, c.requestErr
 	}
+	if max := c.server.MaxRequestBodyLen; max > 0 {
+		if c.requestRead >= max {
+			c.requestErr = web.ErrRequestEntityTooLarge
+			return 0, c.requestErr
+		}
+		if len(p) > max-c.requestRead {
+			p = p[0 : max-c.requestRead]
+		}
+	}
 	if len(p) > c.requestAvail {
 		p = p[0:c.requestAvail]
 	}
 	var n int
 	n, c.requestErr = c.br.Read(p)
+	if isClosed(c.requestErr) {
+		c.requestErr = web.ErrClientClosed
+	}
 	c.requestAvail -= n
+	c.requestRead += n
 	return n, c.requestErr
 }
 
+func (c *conn) Continue() os.Error {
+	if c.hijacked || c.respondCalled {
+		return web.ErrInvalidState
+	}
+	if !c.write100Continue {
+		return nil
+	}
+	c.write100Continue = false
+	if err := c.waitTurn(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.netConn, "HTTP/1.1 100 Continue\r\n\r\n")
+	return err
+}
+
+// statusLines holds the status lines for the codes in web.StatusText indexed
+// by HTTP minor version and status code.
+var statusLines [2][600][]byte
+
+func init() {
+	for status, text := range web.StatusText {
+		if status < 100 || status >= len(statusLines[0]) {
+			continue
+		}
+		for minor, proto := range [...]string{"HTTP/1.0 ", "HTTP/1.1 "} {
+			statusLines[minor][status] = []byte(proto + strconv.Itoa(status) + " " + text + "\r\n")
+		}
+	}
+}
+
+// statusLine returns the response status line for status.
+func statusLine(status int, http11 bool) []byte {
+	minor := 0
+	if http11 {
+		minor = 1
+	}
+	if status >= 100 && status < len(statusLines[minor]) && statusLines[minor][status] != nil {
+		return statusLines[minor][status]
+	}
+	statusString := strconv.Itoa(status)
+	return []byte("HTTP/1." + strconv.Itoa(minor) + " " + statusString + " status code " + statusString + "\r\n")
+}
+
+var (
+	connectionCloseLine = []byte(web.HeaderConnection + ": close\r\n")
+	chunkedLine         = []byte(web.HeaderTransferEncoding + ": chunked\r\n")
+)
+
+// dateCache holds the Date header line for the current second.
+type dateCache struct {
+	mu  sync.Mutex
+	sec int64
+	p   []byte
+}
+
+// line returns the Date header line for the current time. The returned
+// slice must not be modified.
+func (dc *dateCache) line() []byte {
+	now := time.Seconds()
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if now != dc.sec || dc.p == nil {
+		dc.sec = now
+		dc.p = []byte(web.HeaderDate + ": " + time.SecondsToUTC(now).Format(web.TimeLayout) + "\r\n")
+	}
+	return dc.p
+}
+
+var responseDate dateCache
+
 func (c *conn) Respond(status int, header web.StringsMap) (body web.ResponseBody) {
 	if c.hijacked {
-		log.Stderr("twister: Respond called on hijacked connection")
+		c.server.logError("twister: Respond called on hijacked connection")
 		return nil
 	}
 	if c.respondCalled {
-		log.Stderr("twister: multiple calls to Respond")
+		c.server.logError("twister: multiple calls to Respond")
 		return nil
 	}
 	c.respondCalled = true
 	c.requestErr = web.ErrInvalidState
 
 	if _, found := header.Get(web.HeaderTransferEncoding); found {
-		log.Stderr("twister: transfer encoding not allowed")
-		header[web.HeaderTransferEncoding] = nil, false
+		c.server.logError("twister: transfer encoding not allowed")
+		header.Del(web.HeaderTransferEncoding)
 	}
 
 	if c.requestAvail > 0 {
@@ -324,8 +811,8 @@ func (c *conn) Respond(status int, header web.StringsMap) (body web.ResponseBody
 	c.responseAvail = 0
 
 	if status == web.StatusNotModified {
-		header[web.HeaderContentType] = nil, false
-		header[web.HeaderContentLength] = nil, false
+		header.Del(web.HeaderContentType)
+		header.Del(web.HeaderContentLength)
 		c.chunked = false
 	} else if s, found := header.Get(web.HeaderContentLength); found {
 		c.responseAvail, _ = strconv.Atoi(s)
@@ -335,85 +822,162 @@ func (c *conn) Respond(status int, header web.StringsMap) (body web.ResponseBody
 	}
 
 	if c.closeAfterResponse {
-		header.Set(web.HeaderConnection, "close")
+		header.Del(web.HeaderConnection)
 		c.chunked = false
 	}
 
+	var w io.Writer = identityWriter{c}
 	if c.chunked {
-		header.Set(web.HeaderTransferEncoding, "chunked")
+		w = chunkedWriter{c}
 	}
-
-	proto := "HTTP/1.0"
-	if c.req.ProtocolVersion >= web.ProtocolVersion(1, 1) {
-		proto = "HTTP/1.1"
+	c.wb, c.responseErr = c.server.getWriteBuffer(w, limit(c.server.WriteBufferSize, DefaultWriteBufferSize))
+	if c.responseErr != nil {
+		c.server.logError("twister: could not create writer", c.responseErr)
+		return nil
 	}
-	statusString := strconv.Itoa(status)
-	text, found := web.StatusText[status]
-	if !found {
-		text = "status code " + statusString
+	c.bw = c.wb.bw
+
+	// The response head is held in the output buffer until the first write
+	// of the body so that the head and body are sent to the network with a
+	// single write.
+	b := &c.wb.out
+	b.Write(statusLine(status, c.req.ProtocolVersion >= web.ProtocolVersion(1, 1)))
+	if !header.Has(web.HeaderDate) {
+		b.Write(responseDate.line())
 	}
-
-	var b bytes.Buffer
-	b.WriteString(proto)
-	b.WriteString(" ")
-	b.WriteString(statusString)
-	b.WriteString(" ")
-	b.WriteString(text)
-	b.WriteString("\r\n")
-	for key, values := range header {
-		for _, value := range values {
-			b.WriteString(key)
-			b.WriteString(": ")
-			b.WriteString(cleanHeaderValue(value))
-			b.WriteString("\r\n")
-		}
+	if c.closeAfterResponse {
+		b.Write(connectionCloseLine)
 	}
+	if c.chunked {
+		b.Write(chunkedLine)
+	}
+	header.WriteHttpHeader(b)
 	b.WriteString("\r\n")
 
-	if c.chunked {
-		c.bw = bufio.NewWriter(chunkedWriter{c})
-		_, c.responseErr = c.netConn.Write(b.Bytes())
-	} else {
-		c.bw = bufio.NewWriter(identityWriter{c})
-		c.bw.Write(b.Bytes())
+	return responseBody{c}
+}
+
+// responseBody is the response body returned from Respond. The buffered
+// writer is returned to the server's free list when the response is
+// finished. The responseBody wrapper prevents handlers from writing to the
+// buffer after it is reused by another response.
+type responseBody struct {
+	*conn
+}
+
+func (c responseBody) Write(p []byte) (int, os.Error) {
+	if c.bw == nil {
+		return 0, web.ErrInvalidState
+	}
+	return c.bw.Write(p)
+}
+
+func (c responseBody) Flush() os.Error {
+	if c.bw == nil {
+		return web.ErrInvalidState
+	}
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	if c.responseErr == nil {
+		c.responseErr = c.writeOut(nil)
 	}
+	return c.responseErr
+}
 
-	return c.bw
+// ReadFrom implements the io.ReaderFrom interface. ReadFrom flushes the
+// response body buffer and copies from src to the identity or chunked writer
+// without an intermediate buffer allocation.
+func (c responseBody) ReadFrom(src io.Reader) (int64, os.Error) {
+	if c.bw == nil {
+		return 0, web.ErrInvalidState
+	}
+	if err := c.bw.Flush(); err != nil {
+		return 0, err
+	}
+	return c.wb.sw.w.(io.ReaderFrom).ReadFrom(src)
 }
 
-// cleanHeaderValue replaces \r and \n with ' ' in header values to prevent
-// response splitting attacks.  
-func cleanHeaderValue(s string) string {
-	dirty := false
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if c == '\r' || c == '\n' {
-			dirty = true
-			break
+// copyBody copies from src to w using the connection's scratch buffer.
+func (c *conn) copyBody(w io.Writer, src io.Reader) (n int64, err os.Error) {
+	buf := c.wb.scratch()
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := w.Write(buf[0:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er == os.EOF {
+			return n, nil
 		}
+		if er != nil {
+			return n, er
+		}
+	}
+	panic("not reached")
+}
+
+// Writes larger than this are not copied to the output buffer.
+const maxCoalesceLen = 8192
+
+// writeOut writes the pending output followed by p to the network. Small
+// writes are coalesced with the pending output to reduce the number of
+// system calls.
+func (c *conn) writeOut(p []byte) os.Error {
+	if err := c.waitTurn(); err != nil {
+		c.wb.out.Reset()
+		return err
+	}
+	out := &c.wb.out
+	if out.Len() == 0 && len(p) == 0 {
+		return nil
 	}
-	if !dirty {
-		return s
+	if t := c.req.WriteTimeout; t != 0 && t != c.writeTimeout {
+		c.netConn.SetWriteTimeout(t)
+		c.writeTimeout = t
+	}
+	var err os.Error
+	if out.Len() == 0 {
+		_, err = c.netConn.Write(p)
+	} else {
+		if len(p) <= maxCoalesceLen {
+			out.Write(p)
+			p = nil
+		}
+		_, err = c.netConn.Write(out.Bytes())
+		out.Reset()
+		if err == nil && len(p) > 0 {
+			_, err = c.netConn.Write(p)
+		}
 	}
-	p := []byte(s)
-	for i := 0; i < len(p); i++ {
-		c := p[i]
-		if c == '\r' || c == '\n' {
-			p[i] = ' '
+	if err != nil {
+		// The client may have received part of the response. Close the
+		// connection after the response.
+		c.closeAfterResponse = true
+		if isTimeout(err) {
+			err = web.ErrWriteTimeout
+		} else if isClosed(err) {
+			err = web.ErrClientClosed
 		}
 	}
-	return string(p)
+	return err
 }
 
-func (c *conn) Hijack() (conn net.Conn, buf []byte, err os.Error) {
-	if c.respondCalled {
+func (c *conn) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
+	if c.respondCalled || c.hijacked || c.concurrent {
 		return nil, nil, web.ErrInvalidState
 	}
+	if err := c.waitTurn(); err != nil {
+		return nil, nil, err
+	}
 
 	conn = c.netConn
-	buf, err = c.br.Peek(c.br.Buffered())
-	if err != nil {
-		panic("twsited.server: unexpected error peeking at bufio")
+	br = c.br
+	if c.server.ReadTimeout > 0 || c.server.WriteTimeout > 0 {
+		conn.SetTimeout(0)
 	}
 
 	c.hijacked = true
@@ -426,18 +990,48 @@ func (c *conn) Hijack() (conn net.Conn, buf []byte, err os.Error) {
 	return
 }
 
+// Abort stops the response. Data buffered for the response is discarded and
+// the connection is closed without completing the response.
+func (c *conn) Abort() {
+	if c.hijacked {
+		return
+	}
+	c.respondCalled = true
+	c.responseErr = errAborted
+	c.closeAfterResponse = true
+}
+
 // Finish the HTTP request
 func (c *conn) finish() os.Error {
 	if !c.respondCalled {
-		c.req.Respond(web.StatusOK, web.HeaderContentType, "text/html charset=utf-8")
+		if c.requestErr == web.ErrRequestEntityTooLarge {
+			c.req.Error(web.StatusRequestEntityTooLarge, web.ErrRequestEntityTooLarge)
+		} else {
+			c.req.Respond(web.StatusOK, web.HeaderContentType, "text/html charset=utf-8")
+		}
 	}
+	if c.wb == nil {
+		if c.responseErr == errAborted {
+			return nil
+		}
+		return c.responseErr
+	}
+	c.bw.Flush()
 	if c.responseAvail != 0 {
 		c.closeAfterResponse = true
 	}
-	c.bw.Flush()
-	if c.chunked {
-		_, c.responseErr = io.WriteString(c.netConn, "0\r\n\r\n")
+	if c.responseErr == nil {
+		if c.chunked {
+			c.wb.out.WriteString("0\r\n\r\n")
+		}
+		c.responseErr = c.writeOut(nil)
+	}
+	if c.writeTimeout != 0 {
+		c.netConn.SetWriteTimeout(c.server.WriteTimeout)
+		c.writeTimeout = 0
 	}
+	c.server.putWriteBuffer(c.wb)
+	c.wb = nil
 	if c.responseErr == nil {
 		c.responseErr = web.ErrInvalidState
 	}
@@ -455,16 +1049,37 @@ func (c identityWriter) Write(p []byte) (int, os.Error) {
 	if c.responseErr != nil {
 		return 0, c.responseErr
 	}
-	var n int
-	n, c.responseErr = c.netConn.Write(p)
-	c.responseAvail -= n
-	return n, c.responseErr
+	if c.responseErr = c.writeOut(p); c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	c.responseAvail -= len(p)
+	return len(p), nil
+}
+
+// ReadFrom implements the io.ReaderFrom interface. A sendfile optimization
+// for *os.File sources on TCP connections belongs here.
+func (c identityWriter) ReadFrom(src io.Reader) (int64, os.Error) {
+	if c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	return c.copyBody(c, src)
 }
 
 type chunkedWriter struct {
 	*conn
 }
 
+// ReadFrom implements the io.ReaderFrom interface. Each read from src is
+// written as a chunk.
+func (c chunkedWriter) ReadFrom(src io.Reader) (int64, os.Error) {
+	if c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	return c.copyBody(c, src)
+}
+
+// Write writes p as a chunk. The CRLF following the chunk data is held in
+// the output buffer and sent with the next chunk header or the last chunk.
 func (c chunkedWriter) Write(p []byte) (int, os.Error) {
 	if c.responseErr != nil {
 		return 0, c.responseErr
@@ -472,69 +1087,474 @@ func (c chunkedWriter) Write(p []byte) (int, os.Error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	_, c.responseErr = io.WriteString(c.netConn, strconv.Itob(len(p), 16)+"\r\n")
-	if c.responseErr != nil {
+	out := &c.wb.out
+	out.WriteString(strconv.Itob(len(p), 16))
+	out.WriteString("\r\n")
+	if c.responseErr = c.writeOut(p); c.responseErr != nil {
 		return 0, c.responseErr
 	}
-	var n int
-	n, c.responseErr = c.netConn.Write(p)
-	if c.responseErr != nil {
-		return n, c.responseErr
+	out.WriteString("\r\n")
+	return len(p), nil
+}
+
+// parseErrorStatus returns the HTTP status for an error returned from
+// prepare or zero if the error is not a parse error.
+func parseErrorStatus(err os.Error) int {
+	if err == web.ErrBadFormat {
+		return web.StatusBadRequest
+	}
+	return web.ErrorStatus(err, 0)
+}
+
+// writeErrorResponse writes a minimal error response for a request that
+// could not be parsed.
+func writeErrorResponse(netConn net.Conn, status int) os.Error {
+	var b bytes.Buffer
+	b.Write(statusLine(status, true))
+	b.Write(responseDate.line())
+	b.WriteString("Connection: close\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(web.StatusText[status])
+	b.WriteString("\n")
+	_, err := netConn.Write(b.Bytes())
+	return err
+}
+
+// dispatch calls the handler for the request. If the handler panics, then
+// dispatch logs the panic and stack trace. If the response has not been
+// started, then dispatch responds with HTTP status 500 using respondPanic
+// and closes the connection after the response. Otherwise, dispatch returns
+// false.
+func (s *Server) dispatch(c *conn, draining bool) (ok bool) {
+	remoteAddr := c.req.RemoteAddr
+	defer func() {
+		if r := recover(); r != nil {
+			stack := web.Stack(3)
+			s.logError("twister: panic serving", remoteAddr, r, "\n", stack)
+			if c.respondCalled || c.hijacked {
+				return
+			}
+			c.closeAfterResponse = true
+			if s.respondPanic(c.req, r, stack) {
+				ok = true
+			} else if !c.respondCalled && c.waitTurn() == nil {
+				writeErrorResponse(c.netConn, web.StatusInternalServerError)
+			}
+		}
+	}()
+	s.serveRequest(c.req, draining)
+	return true
+}
+
+// respondPanic calls the request's error handler with HTTP status 500 for a
+// handler that panicked with value r. The stack trace of the panic is set in
+// the request with web.SetPanicStack. respondPanic returns false if the
+// error handler panics.
+func (s *Server) respondPanic(req *web.Request, r interface{}, stack string) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logError("twister: panic in error handler", req.RemoteAddr, r)
+			ok = false
+		}
+	}()
+	web.SetPanicStack(req, stack)
+	req.Error(web.StatusInternalServerError, web.NewError(web.StatusInternalServerError, fmt.Sprint("panic: ", r)))
+	return true
+}
+
+// serveRequest responds to health checks while draining, server-wide
+// "OPTIONS *" requests and requests with a body over the limit. Other
+// requests are passed to the handler. HTTP/1 connections and SPDY streams
+// call serveRequest from their dispatch functions.
+func (s *Server) serveRequest(req *web.Request, draining bool) {
+	max := s.MaxRequestBodyLen
+	switch {
+	case draining && s.HealthCheckPath != "" && req.URL.Path == s.HealthCheckPath:
+		req.Error(web.StatusServiceUnavailable, errDraining)
+	case req.Method == "OPTIONS" && req.URL.Path == "*":
+		s.respondOptions(req)
+	case max > 0 && req.ContentLength > max:
+		status := web.StatusRequestEntityTooLarge
+		if _, found := req.Header.Get(web.HeaderExpect); found {
+			status = web.StatusExpectationFailed
+		}
+		req.Error(status, web.ErrRequestEntityTooLarge)
+	default:
+		s.Handler.ServeWeb(req)
+	}
+}
+
+// DefaultAllowedMethods is the list of methods advertised in response to
+// "OPTIONS *" requests when Server.AllowedMethods is nil.
+var DefaultAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}
+
+// respondOptions responds to a server-wide "OPTIONS *" request with the
+// methods supported by the server and the server's options header.
+func (s *Server) respondOptions(req *web.Request) {
+	methods := s.AllowedMethods
+	if methods == nil {
+		methods = DefaultAllowedMethods
 	}
-	_, c.responseErr = io.WriteString(c.netConn, "\r\n")
-	return 0, c.responseErr
+	header := web.NewStringsMap(
+		web.HeaderAllow, strings.Join(methods, ", "),
+		web.HeaderContentLength, "0")
+	for key, values := range s.OptionsHeader {
+		for _, value := range values {
+			header.Append(key, value)
+		}
+	}
+	req.Responder.Respond(web.StatusOK, header)
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err os.Error) bool {
+	e, ok := err.(*net.OpError)
+	return ok && e.Error == os.EAGAIN
+}
+
+// isClosed returns true if err is a network error caused by the client
+// closing the connection.
+func isClosed(err os.Error) bool {
+	e, ok := err.(*net.OpError)
+	return ok && (e.Error == os.EPIPE || e.Error == os.ECONNRESET)
 }
 
-func serveConnection(serverName string, secure bool, handler web.Handler, netConn net.Conn) {
-	br := bufio.NewReader(netConn)
+func (s *Server) serveConnection(netConn net.Conn) {
+	s.mu.Lock()
+	s.conns += 1
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conns -= 1
+		s.mu.Unlock()
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			s.logError("twister: panic serving connection", r, "\n", web.Stack(3))
+			netConn.Close()
+		}
+	}()
+	if s.ReadTimeout > 0 {
+		netConn.SetReadTimeout(s.ReadTimeout)
+	}
+	if s.WriteTimeout > 0 {
+		netConn.SetWriteTimeout(s.WriteTimeout)
+	}
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == SPDYProtocol {
+			s.serveSPDY(netConn)
+			return
+		}
+	}
+	l := s.limits()
+	s.initPools()
+	readBufferSize := s.ReadBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = l.readBufferSize()
+	}
+	rb, err := s.getReadBuffer(netConn, readBufferSize)
+	if err != nil {
+		s.logError("twister/server: could not create reader", err)
+		netConn.Close()
+		return
+	}
+	maxPipelined := limit(s.MaxPipelinedRequests, DefaultMaxPipelinedRequests)
+	pipelined := 0
+	var p *pipeline
+	if s.ConcurrentPipelining {
+		p = new(pipeline)
+	}
+	var prev chan bool
 	for {
+		if p.isClosed() {
+			break
+		}
 		c := conn{
-			serverName: serverName,
-			secure:     secure,
-			netConn:    netConn,
-			br:         br}
+			server:   s,
+			limits:   l,
+			netConn:  netConn,
+			br:       rb.br,
+			fields:   &rb.fields,
+			pipeline: p,
+			prev:     prev}
+		if rb.br.Buffered() > 0 {
+			pipelined += 1
+		} else {
+			pipelined = 0
+		}
 		if err := c.prepare(); err != nil {
-			if err != os.EOF {
-				log.Stderr("twister/sever: prepare failed", err)
+			if status := parseErrorStatus(err); status != 0 {
+				if web.Development() {
+					s.logError("twister/server: bad request from", netConn.RemoteAddr(), err)
+				}
+				if c.waitTurn() == nil {
+					writeErrorResponse(netConn, status)
+				}
+			} else if err != os.EOF && !isTimeout(err) {
+				s.logError("twister/sever: prepare failed", err)
 			}
 			break
 		}
-		handler.ServeWeb(c.req)
+		if pipelined >= maxPipelined {
+			c.closeAfterResponse = true
+		}
+		draining := s.startRequest()
+		if draining {
+			c.closeAfterResponse = true
+		}
+		if p != nil && c.requestAvail == 0 && !c.closeAfterResponse && rb.br.Buffered() > 0 {
+			if _, found := c.req.Header.Get(web.HeaderUpgrade); !found {
+				done := make(chan bool)
+				c.concurrent = true
+				go s.serveConcurrent(&c, draining, done)
+				prev = done
+				continue
+			}
+		}
+		// Hijack clears c.req. Save the request for Finish.
+		req := c.req
+		if !s.dispatch(&c, draining) {
+			req.Finish()
+			s.endRequest()
+			netConn.Close()
+			return
+		}
 		if c.hijacked {
+			req.Finish()
+			s.endRequest()
 			return
 		}
-		if err := c.finish(); err != nil {
-			log.Stderr("twister/sever: finish failed", err)
+		err := c.finish()
+		req.Finish()
+		s.endRequest()
+		c.waitTurn()
+		prev = nil
+		if err != nil {
+			s.logError("twister/sever: finish failed", err)
 			break
 		}
 		if c.closeAfterResponse {
 			break
 		}
 	}
+	if prev != nil {
+		<-prev
+	}
 	netConn.Close()
+	s.putReadBuffer(rb)
+}
+
+// serveConcurrent handles a pipelined request while the server reads the
+// next request from the connection. The done channel is closed after the
+// response and the responses to all earlier requests are complete.
+func (s *Server) serveConcurrent(c *conn, draining bool, done chan bool) {
+	netConn := c.netConn
+	req := c.req
+	ok := false
+	defer func() {
+		if r := recover(); r != nil {
+			s.logError("twister: panic serving connection", r, "\n", web.Stack(3))
+			ok = false
+		}
+		req.Finish()
+		c.waitTurn()
+		if !ok || c.closeAfterResponse {
+			c.pipeline.close()
+			netConn.Close()
+		}
+		close(done)
+		s.endRequest()
+	}()
+	if !s.dispatch(c, draining) {
+		return
+	}
+	if err := c.finish(); err != nil {
+		s.logError("twister/sever: finish failed", err)
+		return
+	}
+	ok = true
+}
+
+// startRequest records the start of a request and returns true if the server
+// is draining.
+func (s *Server) startRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active += 1
+	return s.draining
+}
+
+// endRequest records the end of a request.
+func (s *Server) endRequest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active -= 1
+	if s.draining && s.active == 0 {
+		select {
+		case s.drained <- true:
+		default:
+		}
+	}
+}
+
+// Drain puts the server in draining mode. In draining mode, the server
+// responds to the health check path with HTTP status 503 and closes
+// connections after the current response instead of keeping them alive for
+// further requests. Drain returns a channel that receives a value when no
+// requests are in progress. The server continues to accept connections; stop
+// the server after the channel receives a value.
+func (s *Server) Drain() <-chan bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.draining {
+		s.draining = true
+		s.drained = make(chan bool, 1)
+		if s.active == 0 {
+			s.drained <- true
+		}
+	}
+	return s.drained
+}
+
+// Stats returns the number of requests in progress, the number of open
+// connections and whether the server is draining. Hijacked connections are
+// not counted.
+func (s *Server) Stats() (activeRequests int, connections int, draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active, s.conns, s.draining
 }
 
 // Serve accepts incoming HTTP connections on the listener l, creating a new
-// goroutine for each. The goroutines read requests and then call handler to
-// reply to them.
-func Serve(serverName string, secure bool, handler web.Handler, l net.Listener) os.Error {
+// goroutine for each. The goroutines read requests and then call the server's
+// handler to reply to them.
+func (s *Server) Serve(l net.Listener) os.Error {
+	var delay int64
 	for {
 		netConn, e := l.Accept()
 		if e != nil {
-			return e
+			if !isTemporary(e) {
+				return e
+			}
+			if s.AcceptError != nil {
+				s.AcceptError(e)
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			time.Sleep(delay)
+			continue
 		}
-		go serveConnection(serverName, secure, handler, netConn)
+		delay = 0
+		go s.serveConnection(netConn)
 	}
 	return nil
 }
 
-// ListenAndServe listens on the TCP network address addr and then calls Serve
-// with handler to handle requests on incoming connections.  
-func ListenAndServe(serverName string, addr string, handler web.Handler) os.Error {
-	l, e := net.Listen("tcp", addr)
+// Backoff limits in nanoseconds for temporary Accept errors.
+const (
+	minAcceptDelay = 5e6
+	maxAcceptDelay = 1e9
+)
+
+type temporaryError interface {
+	Temporary() bool
+}
+
+// isTemporary returns true if err is a temporary error such as running out
+// of file descriptors.
+func isTemporary(err os.Error) bool {
+	if t, ok := err.(temporaryError); ok {
+		return t.Temporary()
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Error
+	}
+	switch err {
+	case os.EMFILE, os.ENFILE, os.ENOBUFS, os.ENOMEM, os.EAGAIN, os.EINTR, os.ECONNABORTED:
+		return true
+	}
+	return false
+}
+
+// ListenAndServe listens on the TCP network address s.Addr and then calls
+// Serve to handle requests on incoming connections. If s.TLSConfig is set,
+// then the listener accepts TLS connections.
+func (s *Server) ListenAndServe() os.Error {
+	l, e := net.Listen("tcp", s.Addr)
 	if e != nil {
 		return e
 	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
 	defer l.Close()
-	return Serve(serverName, false, handler, l)
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS loads the certificate and private key from the named PEM
+// files, adds the certificate to s.TLSConfig and calls ListenAndServe.
+func (s *Server) ListenAndServeTLS(certFile string, keyFile string) os.Error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		*config = *s.TLSConfig
+	}
+	certs := make([]tls.Certificate, len(config.Certificates)+1)
+	certs[0] = cert
+	copy(certs[1:], config.Certificates)
+	config.Certificates = certs
+	s.TLSConfig = config
+	return s.ListenAndServe()
+}
+
+// AddCertificate loads the certificate and private key from the named PEM
+// files and adds the certificate to s.TLSConfig for the given server names.
+// The TLS listener selects the certificate matching the server name sent by
+// the client. The first certificate added to the configuration is used for
+// clients that do not send a server name. Use web.NewServerNameRouter to
+// select the handler for the server name.
+func (s *Server) AddCertificate(certFile string, keyFile string, names ...string) os.Error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{}
+	}
+	config := s.TLSConfig
+	certs := make([]tls.Certificate, len(config.Certificates)+1)
+	copy(certs, config.Certificates)
+	certs[len(certs)-1] = cert
+	config.Certificates = certs
+	if config.NameToCertificate == nil {
+		config.NameToCertificate = make(map[string]*tls.Certificate)
+	}
+	for _, name := range names {
+		config.NameToCertificate[strings.ToLower(name)] = &certs[len(certs)-1]
+	}
+	return nil
+}
+
+// Serve accepts incoming HTTP connections on the listener l, creating a new
+// goroutine for each. The goroutines read requests and then call handler to
+// reply to them.
+func Serve(serverName string, secure bool, handler web.Handler, l net.Listener) os.Error {
+	s := &Server{ServerName: serverName, Secure: secure, Handler: handler}
+	return s.Serve(l)
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls Serve
+// with handler to handle requests on incoming connections.  
+func ListenAndServe(serverName string, addr string, handler web.Handler) os.Error {
+	s := &Server{Addr: addr, ServerName: serverName, Handler: handler}
+	return s.ListenAndServe()
 }
@@ -0,0 +1,449 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readResponse reads a response with a Content-Length from br and returns
+// the response body.
+func readResponse(br *bufio.Reader) ([]byte, os.Error) {
+	contentLength := -1
+	for {
+		p, err := br.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		p = bytes.TrimSpace(p)
+		if len(p) == 0 {
+			break
+		}
+		if i := bytes.IndexByte(p, ':'); i > 0 && web.HeaderNameBytes(p[0:i]) == web.HeaderContentLength {
+			contentLength, _ = strconv.Atoi(string(bytes.TrimSpace(p[i+1:])))
+		}
+	}
+	if contentLength < 0 {
+		return nil, os.NewError("response without Content-Length")
+	}
+	body := make([]byte, contentLength)
+	_, err := io.ReadFull(br, body)
+	return body, err
+}
+
+var benchBody = []byte(strings.Repeat("Hello, World!\n", 64))
+
+// benchServe sends b.N requests on one connection to a server on the
+// loopback interface.
+func benchServe(b *testing.B, handler web.Handler, request string) {
+	b.StopTimer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err.String())
+	}
+	defer l.Close()
+	s := &Server{ServerName: "localhost", Handler: handler}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", "", l.Addr().String())
+	if err != nil {
+		panic(err.String())
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	p := []byte(request)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(p); err != nil {
+			panic(err.String())
+		}
+		if _, err := readResponse(br); err != nil {
+			panic(err.String())
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkServeBytes(b *testing.B) {
+	benchServe(b,
+		web.HandlerFunc(func(req *web.Request) {
+			req.RespondBytes(web.StatusOK, "text/plain; charset=utf-8", benchBody)
+		}),
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+}
+
+func BenchmarkServeRouter(b *testing.B) {
+	benchServe(b,
+		web.NewRouter().
+			Register("/", "GET", func(req *web.Request) { req.RespondText(web.StatusOK, "home") }).
+			Register("/posts/<id:[0-9]+>", "GET", func(req *web.Request) {
+				req.RespondBytes(web.StatusOK, "text/plain; charset=utf-8", benchBody)
+			}),
+		benchRequest)
+}
+
+func TestConcurrentPipelining(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	started := make(chan bool)
+	s := &Server{
+		ServerName:           "localhost",
+		ConcurrentPipelining: true,
+		Handler: web.NewRouter().
+			Register("/slow", "GET", func(req *web.Request) {
+				// Wait for the handler for the next request to start.
+				select {
+				case <-started:
+					req.RespondText(web.StatusOK, "slow")
+				case <-time.After(1e9):
+					req.RespondText(web.StatusOK, "timeout")
+				}
+			}).
+			Register("/fast", "GET", func(req *web.Request) {
+				close(started)
+				req.RespondText(web.StatusOK, "fast")
+			}),
+	}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", "", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\nGET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	for _, expected := range []string{"slow", "fast"} {
+		body, err := readResponse(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Errorf("body = %q, expected %q", body, expected)
+		}
+	}
+}
+
+// timeoutConn is a connection where every write times out.
+type timeoutConn struct {
+	net.Conn
+	writeTimeout int64
+}
+
+func (c *timeoutConn) Write(p []byte) (int, os.Error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Error: os.EAGAIN}
+}
+
+func (c *timeoutConn) SetWriteTimeout(ns int64) os.Error {
+	c.writeTimeout = ns
+	return nil
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := &Server{}
+	s.initPools()
+	netConn := &timeoutConn{}
+	url, _ := http.ParseURL("http://localhost/")
+	req, err := web.NewRequest("127.0.0.1:1234", "GET", url, web.ProtocolVersion(1, 1), web.NewStringsMap(web.HeaderHost, "localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conn{server: s, limits: s.limits(), netConn: netConn, req: req}
+	req.Responder = c
+	req.WriteTimeout = 1e9
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+	w.Write([]byte("hello"))
+	if err := w.Flush(); err != web.ErrWriteTimeout {
+		t.Errorf("Flush() = %v, expected %v", err, web.ErrWriteTimeout)
+	}
+	if netConn.writeTimeout != 1e9 {
+		t.Errorf("write timeout = %d, expected 1e9", netConn.writeTimeout)
+	}
+	if !c.closeAfterResponse {
+		t.Error("connection not closed after write timeout")
+	}
+	c.finish()
+	if netConn.writeTimeout != 0 {
+		t.Errorf("write timeout = %d after response, expected 0", netConn.writeTimeout)
+	}
+}
+
+func TestAbortResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &Server{
+		ServerName: "localhost",
+		Handler: web.LimitResponse(5)(web.HandlerFunc(func(req *web.Request) {
+			w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+			w.Write([]byte("hello"))
+			w.Flush()
+			w.Write([]byte("world"))
+		})),
+	}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", "", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection without writing the last chunk.
+	p, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Index(p, []byte("Transfer-Encoding: chunked")) < 0 || bytes.Index(p, []byte("5\r\nhello\r\n")) < 0 {
+		t.Errorf("response = %q, expected chunked response with hello", p)
+	}
+	if bytes.HasSuffix(p, []byte("0\r\n\r\n")) || bytes.Index(p, []byte("world")) >= 0 {
+		t.Errorf("response = %q, expected truncated response", p)
+	}
+}
+
+// fakeConn is a connection that reads from a string and records writes.
+type fakeConn struct {
+	net.Conn
+	r      io.Reader
+	w      bytes.Buffer
+	writes int
+	closed bool
+}
+
+func (c *fakeConn) Read(p []byte) (int, os.Error) { return c.r.Read(p) }
+
+func (c *fakeConn) Write(p []byte) (int, os.Error) {
+	c.writes += 1
+	return c.w.Write(p)
+}
+
+func (c *fakeConn) Close() os.Error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+// serveFake serves the requests in input on a fake connection and returns
+// the connection after the server is done with the connection.
+func serveFake(s *Server, input string) *fakeConn {
+	c := &fakeConn{r: bytes.NewBufferString(input)}
+	s.serveConnection(c)
+	return c
+}
+
+const (
+	getA      = "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	getB      = "GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	getHealth = "GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"
+)
+
+func TestDrainHealthCheck(t *testing.T) {
+	served := false
+	s := &Server{
+		ServerName:      "localhost",
+		HealthCheckPath: "/health",
+		Handler:         web.HandlerFunc(func(req *web.Request) { served = true }),
+	}
+	drained := s.Drain()
+	select {
+	case <-drained:
+	default:
+		t.Error("idle server not drained")
+	}
+	c := serveFake(s, getHealth+getA)
+	out := c.w.String()
+	if !strings.HasPrefix(out, "HTTP/1.1 503 ") || strings.Index(out, "\r\nConnection: close\r\n") < 0 {
+		t.Errorf("health check response = %q, expected 503 with Connection: close", out)
+	}
+	if served || strings.Count(out, "HTTP/1.1 ") != 1 || !c.closed {
+		t.Errorf("served = %v, closed = %v, response = %q, expected connection closed after health check", served, c.closed, out)
+	}
+}
+
+func TestDrainInFlight(t *testing.T) {
+	var drained <-chan bool
+	s := &Server{ServerName: "localhost"}
+	s.Handler = web.NewRouter().
+		Register("/a", "GET", func(req *web.Request) {
+			drained = s.Drain()
+			select {
+			case <-drained:
+				t.Error("drained while request in progress")
+			default:
+			}
+			req.RespondText(web.StatusOK, "a")
+		}).
+		Register("/b", "GET", func(req *web.Request) { req.RespondText(web.StatusOK, "b") })
+	c := serveFake(s, getA+getB+getA)
+	out := c.w.String()
+	i := strings.LastIndex(out, "HTTP/1.1 ")
+	if i <= 0 || strings.Count(out, "HTTP/1.1 ") != 2 {
+		t.Fatalf("response = %q, expected two responses", out)
+	}
+	if strings.Index(out[0:i], "Connection: close") >= 0 {
+		t.Errorf("first response = %q, expected keep-alive", out[0:i])
+	}
+	if !strings.HasSuffix(out, "b") || strings.Index(out[i:], "\r\nConnection: close\r\n") < 0 || !c.closed {
+		t.Errorf("second response = %q, expected b with Connection: close", out[i:])
+	}
+	select {
+	case <-drained:
+	default:
+		t.Error("server not drained after requests completed")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var log bytes.Buffer
+	s := &Server{
+		ServerName: "localhost",
+		ErrorLog:   &log,
+		Handler: web.NewRouter().
+			Register("/a", "GET", func(req *web.Request) { panic("before respond") }).
+			Register("/b", "GET", func(req *web.Request) {
+				req.Respond(web.StatusOK).Write([]byte("partial"))
+				panic("after respond")
+			}),
+	}
+	c := serveFake(s, getA+getB)
+	if out := c.w.String(); !strings.HasPrefix(out, "HTTP/1.1 500 ") || strings.Count(out, "HTTP/1.1 ") != 1 || !c.closed {
+		t.Errorf("response = %q, closed = %v, expected 500 and connection closed", out, c.closed)
+	}
+	c = serveFake(s, getB)
+	if out := c.w.String(); strings.Index(out, "500") >= 0 || !c.closed {
+		t.Errorf("response = %q, closed = %v, expected connection closed without 500", out, c.closed)
+	}
+	if strings.Count(log.String(), "panic serving") != 2 {
+		t.Errorf("error log = %q, expected two panics", log.String())
+	}
+}
+
+func TestPanicErrorHandler(t *testing.T) {
+	var status int
+	var stack string
+	s := &Server{
+		ServerName: "localhost",
+		ErrorLog:   new(bytes.Buffer),
+		Handler: web.SetErrorHandler(func(req *web.Request, s int, reason os.Error) {
+			status, stack = s, web.PanicStack(req)
+			req.Respond(s, web.HeaderContentType, "text/plain").Write([]byte("custom"))
+		})(web.HandlerFunc(func(req *web.Request) { panic("test") })),
+	}
+	c := serveFake(s, getA+getB)
+	if out := c.w.String(); !strings.HasPrefix(out, "HTTP/1.1 500 ") || strings.Index(out, "custom") < 0 || !c.closed {
+		t.Errorf("response = %q, closed = %v, expected custom 500 and connection closed", out, c.closed)
+	}
+	if status != web.StatusInternalServerError || strings.Index(stack, "TestPanicErrorHandler") < 0 {
+		t.Errorf("error handler called with %d, stack %q, expected 500 and stack of panic", status, stack)
+	}
+}
+
+type maxRequestBodyTest struct {
+	header string
+	body   string
+	status string
+}
+
+var maxRequestBodyTests = []maxRequestBodyTest{
+	maxRequestBodyTest{"Content-Length: 5\r\n", "hello", "200"},
+	maxRequestBodyTest{"Content-Length: 6\r\n", "hello!", "413"},
+	maxRequestBodyTest{"Content-Length: 6\r\nExpect: 100-continue\r\n", "", "417"},
+}
+
+func TestMaxRequestBodyLen(t *testing.T) {
+	for _, tt := range maxRequestBodyTests {
+		var body string
+		s := &Server{
+			ServerName:        "localhost",
+			MaxRequestBodyLen: 5,
+			Handler: web.HandlerFunc(func(req *web.Request) {
+				p, _ := req.BodyBytes(-1)
+				body = string(p)
+				req.RespondText(web.StatusOK, "ok")
+			}),
+		}
+		body = "not called"
+		c := serveFake(s, "POST / HTTP/1.1\r\nHost: localhost\r\n"+tt.header+"\r\n"+tt.body)
+		out := c.w.String()
+		if !strings.HasPrefix(out, "HTTP/1.1 "+tt.status+" ") {
+			t.Errorf("%q: response = %q, expected status %s", tt.header, out, tt.status)
+		}
+		if strings.Index(out, "100 Continue") >= 0 {
+			t.Errorf("%q: response = %q, unexpected 100 Continue", tt.header, out)
+		}
+		if tt.status == "200" && body != tt.body || tt.status != "200" && body != "not called" {
+			t.Errorf("%q: body = %q", tt.header, body)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	s := &Server{
+		ServerName: "localhost",
+		Handler: web.HandlerFunc(func(req *web.Request) {
+			req.RespondBytes(web.StatusOK, "text/plain", []byte("hello"))
+		}),
+	}
+	// The connection is closed after the response without reading to EOF,
+	// so the read buffer is eligible for reuse.
+	request := "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	for i := 0; i < 2; i++ {
+		c := serveFake(s, request)
+		if !strings.HasSuffix(c.w.String(), "\r\n\r\nhello") {
+			t.Errorf("response = %q", c.w.String())
+		}
+		// The response head and body are sent with a single write.
+		if c.writes != 1 {
+			t.Errorf("writes = %d, expected 1", c.writes)
+		}
+		// The buffers are returned to the free lists and reused.
+		if len(s.readBuffers) != 1 || len(s.writeBuffers) != 1 {
+			t.Errorf("connection %d: free read buffers = %d, free write buffers = %d, expected 1, 1",
+				i, len(s.readBuffers), len(s.writeBuffers))
+		}
+	}
+
+	// The chunk header is sent with the response head and the chunk data.
+	// The chunk trailer is sent with the last chunk.
+	s.Handler = web.HandlerFunc(func(req *web.Request) {
+		req.Respond(web.StatusOK, web.HeaderContentType, "text/plain").Write([]byte("hello"))
+	})
+	c := serveFake(s, getA)
+	if !strings.HasSuffix(c.w.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n") || c.writes != 2 {
+		t.Errorf("response = %q, writes = %d, expected chunked response in 2 writes", c.w.String(), c.writes)
+	}
+}
@@ -0,0 +1,615 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+// This file implements draft 2 of the SPDY protocol. The server uses SPDY
+// when the client selects the protocol "spdy/2" using TLS next protocol
+// negotiation. To enable SPDY, add "spdy/2" and "http/1.1" to
+// Server.TLSConfig.NextProtos.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SPDYProtocol is the next protocol negotiation name for SPDY draft 2.
+const SPDYProtocol = "spdy/2"
+
+const (
+	spdyVersion = 2
+
+	spdySynStream = 1
+	spdySynReply  = 2
+	spdyRstStream = 3
+	spdySettings  = 4
+	spdyNoop      = 5
+	spdyPing      = 6
+	spdyGoAway    = 7
+	spdyHeaders   = 8
+
+	spdyFlagFin = 1
+
+	spdyProtocolError = 1
+	spdyInvalidStream = 2
+	spdyRefusedStream = 3
+	spdyInternalError = 6
+
+	spdySettingsMaxConcurrentStreams = 4
+
+	spdyMaxFrameLen = 1 << 20
+)
+
+// spdyDictionary is the zlib dictionary for header blocks defined in draft 2.
+var spdyDictionary = []byte("optionsgetheadpostputdeletetraceacceptaccept-charsetaccept-encodingaccept-" +
+	"languageauthorizationexpectfromhostif-modified-sinceif-matchif-none-matchi" +
+	"f-rangeif-unmodifiedsincemax-forwardsproxy-authorizationrangerefererteuser" +
+	"-agent10010120020120220320420520630030130230330430530630740040140240340440" +
+	"5406407408409410411412413414415416417500501502503504505accept-rangesageeta" +
+	"glocationproxy-authenticatepublicretry-afterservervarywarningwww-authentic" +
+	"ateallowcontent-basecontent-encodingcache-controlconnectiondatetrailertran" +
+	"sfer-encodingupgradeviawarningcontent-languagecontent-lengthcontent-locati" +
+	"oncontent-md5content-rangecontent-typeetagexpireslast-modifiedset-cookieMo" +
+	"ndayTuesdayWednesdayThursdayFridaySaturdaySundayJanFebMarAprMayJunJulAugSe" +
+	"pOctNovDecchunkedtext/htmlimage/pngimage/jpgimage/gifapplication/xmlapplic" +
+	"ation/xhtmltext/plainpublicmax-agecharset=iso-8859-1utf-8gzipdeflateHTTP/1" +
+	".1statusversionurl\x00")
+
+// spdyHopHeaders are the headers that are not sent in SPDY header blocks.
+var spdyHopHeaders = map[string]bool{
+	web.HeaderConnection:       true,
+	"Keep-Alive":               true,
+	web.HeaderTransferEncoding: true,
+}
+
+var errSPDYStreamFinished = os.NewError("twister.spdy: stream finished")
+
+type flushWriter interface {
+	io.Writer
+	Flush() os.Error
+}
+
+type spdyConn struct {
+	server     *Server
+	netConn    net.Conn
+	br         *bufio.Reader
+	limits     *limits
+	maxStreams int
+
+	// Header decompression. Accessed by the reading goroutine only.
+	zbuf bytes.Buffer
+	zr   io.Reader
+
+	// Frame writing and header compression.
+	mu   sync.Mutex
+	bw   *bufio.Writer
+	cbuf bytes.Buffer
+	zw   flushWriter
+
+	streamsMu    sync.Mutex
+	streams      map[uint32]*spdyStream
+	lastStreamId uint32
+}
+
+type spdyStream struct {
+	conn          *spdyConn
+	id            uint32
+	req           *web.Request
+	body          *io.PipeWriter
+	bodyReader    *io.PipeReader
+	respondCalled bool
+	bw            *bufio.Writer
+	reset         bool
+}
+
+func (s *Server) serveSPDY(netConn net.Conn) {
+	sc := &spdyConn{
+		server:     s,
+		netConn:    netConn,
+		br:         bufio.NewReader(netConn),
+		bw:         bufio.NewWriter(netConn),
+		streams:    make(map[uint32]*spdyStream),
+		limits:     s.limits(),
+		maxStreams: limit(s.MaxConcurrentStreams, DefaultMaxConcurrentStreams),
+	}
+	zw, err := zlib.NewWriterDict(&sc.cbuf, zlib.BestCompression, spdyDictionary)
+	if err != nil {
+		s.logError("twister.spdy: could not create compressor", err)
+		netConn.Close()
+		return
+	}
+	sc.zw = zw.(flushWriter)
+	if err := sc.writeSettings(); err != nil {
+		netConn.Close()
+		return
+	}
+	sc.serve()
+}
+
+// writeSettings advertises the limit on concurrent streams. Draft 2
+// implementations encode the 24 bit setting ID in little-endian byte order.
+func (sc *spdyConn) writeSettings() os.Error {
+	var data [12]byte
+	binary.BigEndian.PutUint32(data[0:4], 1)
+	data[4] = spdySettingsMaxConcurrentStreams
+	binary.BigEndian.PutUint32(data[8:12], uint32(sc.maxStreams))
+	return sc.writeFrame(true, spdySettings, 0, data[:])
+}
+
+func (sc *spdyConn) serve() {
+	defer sc.close()
+	var head [8]byte
+	for {
+		if _, err := io.ReadFull(sc.br, head[:]); err != nil {
+			return
+		}
+		flags := head[4]
+		n := int(head[5])<<16 | int(head[6])<<8 | int(head[7])
+		if n > spdyMaxFrameLen {
+			return
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(sc.br, data); err != nil {
+			return
+		}
+		if head[0]&0x80 == 0 {
+			id := binary.BigEndian.Uint32(head[0:4])
+			sc.handleData(id, flags, data)
+			continue
+		}
+		version := int(binary.BigEndian.Uint16(head[0:2]) & 0x7fff)
+		if version != spdyVersion {
+			return
+		}
+		switch binary.BigEndian.Uint16(head[2:4]) {
+		case spdySynStream:
+			if err := sc.handleSynStream(flags, data); err != nil {
+				return
+			}
+		case spdyRstStream:
+			if len(data) >= 8 {
+				sc.resetStream(binary.BigEndian.Uint32(data[0:4]) & 0x7fffffff)
+			}
+		case spdyPing:
+			sc.writeFrame(true, spdyPing, 0, data)
+		case spdyGoAway:
+			return
+		case spdySettings, spdyNoop, spdyHeaders:
+			// Ignore.
+		}
+	}
+}
+
+// close closes the connection and aborts the request bodies of active
+// streams.
+func (sc *spdyConn) close() {
+	sc.streamsMu.Lock()
+	for _, st := range sc.streams {
+		if st.body != nil {
+			st.body.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}
+	sc.streamsMu.Unlock()
+	sc.netConn.Close()
+}
+
+func (sc *spdyConn) stream(id uint32) *spdyStream {
+	sc.streamsMu.Lock()
+	defer sc.streamsMu.Unlock()
+	return sc.streams[id]
+}
+
+func (sc *spdyConn) removeStream(id uint32) {
+	sc.streamsMu.Lock()
+	defer sc.streamsMu.Unlock()
+	sc.streams[id] = nil, false
+}
+
+func (sc *spdyConn) resetStream(id uint32) {
+	st := sc.stream(id)
+	if st == nil {
+		return
+	}
+	sc.mu.Lock()
+	st.reset = true
+	sc.mu.Unlock()
+	if st.body != nil {
+		st.body.CloseWithError(web.ErrClientClosed)
+	}
+}
+
+// handleData delivers a data frame to the stream's request body. SPDY draft 2
+// does not have flow control; the connection blocks until the handler reads
+// the data or the handler returns. Data for finished streams is dropped.
+func (sc *spdyConn) handleData(id uint32, flags byte, data []byte) {
+	st := sc.stream(id)
+	if st == nil && id%2 == 1 && id <= sc.lastStreamId {
+		return
+	}
+	if st == nil || st.body == nil {
+		sc.writeRstStream(id, spdyInvalidStream)
+		return
+	}
+	if len(data) > 0 {
+		st.body.Write(data)
+	}
+	if flags&spdyFlagFin != 0 {
+		st.body.Close()
+		st.body = nil
+	}
+}
+
+func (sc *spdyConn) handleSynStream(flags byte, data []byte) os.Error {
+	if len(data) < 10 {
+		return os.NewError("twister.spdy: short SYN_STREAM")
+	}
+	id := binary.BigEndian.Uint32(data[0:4]) & 0x7fffffff
+	header, err := sc.readHeaderBlock(data[10:], sc.limits)
+	if err != nil {
+		// The compression context is lost. Give up on the connection.
+		sc.writeRstStream(id, spdyProtocolError)
+		return err
+	}
+	if id%2 == 0 || id <= sc.lastStreamId {
+		sc.writeRstStream(id, spdyProtocolError)
+		return nil
+	}
+	sc.lastStreamId = id
+
+	sc.streamsMu.Lock()
+	n := len(sc.streams)
+	sc.streamsMu.Unlock()
+	if n >= sc.maxStreams {
+		sc.writeRstStream(id, spdyRefusedStream)
+		return nil
+	}
+
+	st := &spdyStream{conn: sc, id: id}
+	req, err := sc.newRequest(header)
+	if err != nil {
+		sc.writeRstStream(id, spdyProtocolError)
+		return nil
+	}
+	st.req = req
+	req.Responder = st
+	if flags&spdyFlagFin != 0 {
+		req.Body = bytes.NewBuffer(nil)
+	} else {
+		r, w := io.Pipe()
+		req.Body = r
+		st.body = w
+		st.bodyReader = r
+	}
+
+	sc.streamsMu.Lock()
+	sc.streams[id] = st
+	sc.streamsMu.Unlock()
+
+	go st.serve()
+	return nil
+}
+
+// readHeaderBlock decompresses and parses a name/value header block. The
+// header is checked against the limits l as the block is decoded so that a
+// small compressed block cannot force large allocations.
+func (sc *spdyConn) readHeaderBlock(p []byte, l *limits) (map[string]string, os.Error) {
+	sc.zbuf.Write(p)
+	if sc.zr == nil {
+		zr, err := zlib.NewReaderDict(&sc.zbuf, spdyDictionary)
+		if err != nil {
+			return nil, err
+		}
+		sc.zr = zr
+	}
+	var b [2]byte
+	size := 0
+	readString := func(max int, errTooLong os.Error) (string, os.Error) {
+		if _, err := io.ReadFull(sc.zr, b[:]); err != nil {
+			return "", err
+		}
+		n := int(binary.BigEndian.Uint16(b[:]))
+		if n > max {
+			return "", errTooLong
+		}
+		size += n
+		if size > l.maxHeaderBytes {
+			return "", ErrHeaderTooLarge
+		}
+		s := make([]byte, n)
+		if _, err := io.ReadFull(sc.zr, s); err != nil {
+			return "", err
+		}
+		return string(s), nil
+	}
+	if _, err := io.ReadFull(sc.zr, b[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(b[:]))
+	// Allow for the method, url and version.
+	if n > l.maxHeaderCount+3 {
+		return nil, ErrHeadersTooLong
+	}
+	header := make(map[string]string)
+	for i := 0; i < n; i++ {
+		name, err := readString(l.maxHeaderLineLen, ErrLineTooLong)
+		if err != nil {
+			return nil, err
+		}
+		max, errTooLong := l.maxHeaderValueLen, ErrHeaderTooLong
+		if name == "url" {
+			max, errTooLong = l.maxURILen, ErrURITooLong
+		}
+		value, err := readString(max, errTooLong)
+		if err != nil {
+			return nil, err
+		}
+		header[name] = value
+	}
+	return header, nil
+}
+
+func (sc *spdyConn) newRequest(nv map[string]string) (*web.Request, os.Error) {
+	method := nv["method"]
+	rawURL := nv["url"]
+	if method == "" || rawURL == "" {
+		return nil, ErrBadRequestLine
+	}
+	var major, minor int
+	if version := nv["version"]; strings.HasPrefix(version, "HTTP/") {
+		p := strings.Split(version[len("HTTP/"):], ".", 2)
+		if len(p) == 2 {
+			major, _ = strconv.Atoi(p[0])
+			minor, _ = strconv.Atoi(p[1])
+		}
+	}
+	if major == 0 {
+		return nil, ErrBadRequestLine
+	}
+
+	header := make(web.StringsMap)
+	for name, value := range nv {
+		switch name {
+		case "method", "url", "version":
+			continue
+		}
+		key := web.HeaderName(name)
+		for _, v := range strings.Split(value, "\x00", -1) {
+			header.Append(key, v)
+		}
+	}
+
+	url, err := http.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if url.Host == "" {
+		url.Host = header.GetDef(web.HeaderHost, sc.server.ServerName)
+	}
+	url.Scheme = "https"
+
+	req, err := web.NewRequest(sc.netConn.RemoteAddr().String(), method, url, web.ProtocolVersion(major, minor), header)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := sc.netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	return req, nil
+}
+
+// writeFrame writes a control frame or a data frame to the connection.
+func (sc *spdyConn) writeFrame(control bool, typeOrId uint32, flags byte, data []byte) os.Error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.writeFrameLocked(control, typeOrId, flags, data)
+}
+
+func (sc *spdyConn) writeFrameLocked(control bool, typeOrId uint32, flags byte, data []byte) os.Error {
+	var head [8]byte
+	if control {
+		binary.BigEndian.PutUint16(head[0:2], 0x8000|spdyVersion)
+		binary.BigEndian.PutUint16(head[2:4], uint16(typeOrId))
+	} else {
+		binary.BigEndian.PutUint32(head[0:4], typeOrId&0x7fffffff)
+	}
+	binary.BigEndian.PutUint32(head[4:8], uint32(len(data)))
+	head[4] = flags
+	sc.bw.Write(head[:])
+	sc.bw.Write(data)
+	return sc.bw.Flush()
+}
+
+func (sc *spdyConn) writeRstStream(id uint32, status uint32) {
+	var data [8]byte
+	binary.BigEndian.PutUint32(data[0:4], id)
+	binary.BigEndian.PutUint32(data[4:8], status)
+	sc.writeFrame(true, spdyRstStream, 0, data[:])
+}
+
+// spdyHeaderBlock returns the uncompressed name/value header block for nv.
+func spdyHeaderBlock(nv map[string]string) []byte {
+	var b bytes.Buffer
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], uint16(len(nv)))
+	b.Write(p[:])
+	for name, value := range nv {
+		binary.BigEndian.PutUint16(p[:], uint16(len(name)))
+		b.Write(p[:])
+		b.WriteString(name)
+		binary.BigEndian.PutUint16(p[:], uint16(len(value)))
+		b.Write(p[:])
+		b.WriteString(value)
+	}
+	return b.Bytes()
+}
+
+// writeSynReply compresses the header block and writes the SYN_REPLY frame.
+func (sc *spdyConn) writeSynReply(id uint32, nv map[string]string) os.Error {
+	var b bytes.Buffer
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[0:4], id)
+	b.Write(p[0:4])
+	b.Write([]byte{0, 0}) // unused
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cbuf.Reset()
+	sc.zw.Write(spdyHeaderBlock(nv))
+	if err := sc.zw.Flush(); err != nil {
+		return err
+	}
+	b.Write(sc.cbuf.Bytes())
+	return sc.writeFrameLocked(true, spdySynReply, 0, b.Bytes())
+}
+
+func (st *spdyStream) serve() {
+	s := st.conn.server
+	defer st.conn.removeStream(st.id)
+	draining := s.startRequest()
+	defer s.endRequest()
+	defer st.req.Finish()
+	ok := st.dispatch(draining)
+	if st.bodyReader != nil {
+		// Unblock the connection's read loop if the handler did not read
+		// the entire request body.
+		st.bodyReader.CloseWithError(errSPDYStreamFinished)
+	}
+	if !ok {
+		return
+	}
+	if !st.respondCalled {
+		st.req.Respond(web.StatusOK, web.HeaderContentType, "text/html; charset=utf-8")
+	}
+	if st.bw != nil && st.bw.Flush() == nil {
+		st.write(spdyFlagFin, nil)
+	}
+}
+
+// dispatch calls the handler for the stream's request. If the handler
+// panics, then dispatch logs the panic and stack trace. If the response has
+// not been started, then dispatch responds with HTTP status 500 using
+// respondPanic. Otherwise, dispatch resets the stream and returns false.
+func (st *spdyStream) dispatch(draining bool) (ok bool) {
+	s := st.conn.server
+	defer func() {
+		if r := recover(); r != nil {
+			stack := web.Stack(3)
+			s.logError("twister: panic serving", st.req.RemoteAddr, r, "\n", stack)
+			if !st.respondCalled && s.respondPanic(st.req, r, stack) {
+				ok = true
+				return
+			}
+			if st.respondCalled {
+				st.Abort()
+				return
+			}
+			st.Respond(web.StatusInternalServerError, web.NewStringsMap(web.HeaderContentType, "text/plain; charset=utf-8"))
+			st.write(spdyFlagFin, []byte(web.StatusText[web.StatusInternalServerError]+"\n"))
+		}
+	}()
+	s.serveRequest(st.req, draining)
+	return true
+}
+
+func (st *spdyStream) write(flags byte, p []byte) os.Error {
+	sc := st.conn
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st.reset {
+		return web.ErrClientClosed
+	}
+	return sc.writeFrameLocked(false, st.id, flags, p)
+}
+
+// Write writes p to the stream as a data frame.
+func (st *spdyStream) Write(p []byte) (int, os.Error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > spdyMaxFrameLen {
+			n = spdyMaxFrameLen
+		}
+		if err := st.write(0, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (st *spdyStream) Respond(status int, header web.StringsMap) web.ResponseBody {
+	if st.respondCalled {
+		st.conn.server.logError("twister: multiple calls to Respond")
+		return nil
+	}
+	st.respondCalled = true
+
+	text, found := web.StatusText[status]
+	if !found {
+		text = "status code " + strconv.Itoa(status)
+	}
+	nv := map[string]string{
+		"status":  strconv.Itoa(status) + " " + text,
+		"version": "HTTP/1.1",
+	}
+	for key, values := range header {
+		if spdyHopHeaders[key] {
+			continue
+		}
+		nv[strings.ToLower(key)] = strings.Join(values, "\x00")
+	}
+	if err := st.conn.writeSynReply(st.id, nv); err != nil {
+		st.conn.mu.Lock()
+		st.reset = true
+		st.conn.mu.Unlock()
+	}
+	st.bw = bufio.NewWriter(st)
+	return st.bw
+}
+
+// Abort resets the stream. The client detects that the response is
+// incomplete.
+func (st *spdyStream) Abort() {
+	st.respondCalled = true
+	st.conn.mu.Lock()
+	reset := st.reset
+	st.reset = true
+	st.conn.mu.Unlock()
+	if !reset {
+		st.conn.writeRstStream(st.id, spdyInternalError)
+	}
+}
+
+func (st *spdyStream) Continue() os.Error {
+	if st.respondCalled {
+		return web.ErrInvalidState
+	}
+	return nil
+}
+
+func (st *spdyStream) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, web.ErrInvalidState
+}
@@ -0,0 +1,341 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/garyburd/twister/web"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+type spdyFrame struct {
+	control  bool
+	typeOrId uint32
+	flags    byte
+	data     []byte
+}
+
+func readSPDYFrame(r io.Reader) (*spdyFrame, os.Error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &spdyFrame{control: head[0]&0x80 != 0, flags: head[4]}
+	if f.control {
+		f.typeOrId = uint32(binary.BigEndian.Uint16(head[2:4]))
+	} else {
+		f.typeOrId = binary.BigEndian.Uint32(head[0:4])
+	}
+	f.data = make([]byte, int(head[5])<<16|int(head[6])<<8|int(head[7]))
+	_, err := io.ReadFull(r, f.data)
+	return f, err
+}
+
+func newTestSPDYConn(w io.Writer) *spdyConn {
+	sc := &spdyConn{bw: bufio.NewWriter(w), streams: make(map[uint32]*spdyStream)}
+	zw, err := zlib.NewWriterDict(&sc.cbuf, zlib.BestCompression, spdyDictionary)
+	if err != nil {
+		panic(err.String())
+	}
+	sc.zw = zw.(flushWriter)
+	return sc
+}
+
+func TestSPDYFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sc := newTestSPDYConn(&buf)
+	sc.writeFrame(true, spdyPing, 0, []byte{0, 0, 0, 1})
+	sc.writeFrame(false, 3, spdyFlagFin, []byte("hello"))
+	nv := map[string]string{"status": "200 OK", "version": "HTTP/1.1", "content-type": "text/plain"}
+	if err := sc.writeSynReply(5, nv); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := readSPDYFrame(&buf)
+	if err != nil || !f.control || f.typeOrId != spdyPing || f.flags != 0 || string(f.data) != "\x00\x00\x00\x01" {
+		t.Errorf("ping frame = %v, %v", f, err)
+	}
+	f, err = readSPDYFrame(&buf)
+	if err != nil || f.control || f.typeOrId != 3 || f.flags != spdyFlagFin || string(f.data) != "hello" {
+		t.Errorf("data frame = %v, %v", f, err)
+	}
+	f, err = readSPDYFrame(&buf)
+	if err != nil || !f.control || f.typeOrId != spdySynReply || len(f.data) < 6 {
+		t.Fatalf("SYN_REPLY frame = %v, %v", f, err)
+	}
+	if id := binary.BigEndian.Uint32(f.data[0:4]); id != 5 {
+		t.Errorf("SYN_REPLY stream id = %d, expected 5", id)
+	}
+	header, err := (&spdyConn{}).readHeaderBlock(f.data[6:], &defaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != len(nv) {
+		t.Errorf("header = %v, expected %v", header, nv)
+	}
+	for name, value := range nv {
+		if header[name] != value {
+			t.Errorf("header %s = %q, expected %q", name, header[name], value)
+		}
+	}
+}
+
+// spdyClient writes frames to a SPDY connection.
+type spdyClient struct {
+	conn net.Conn
+	zbuf bytes.Buffer
+	zw   flushWriter
+}
+
+func (c *spdyClient) writeFrame(control bool, typeOrId uint32, flags byte, data []byte) os.Error {
+	var head [8]byte
+	if control {
+		binary.BigEndian.PutUint16(head[0:2], 0x8000|spdyVersion)
+		binary.BigEndian.PutUint16(head[2:4], uint16(typeOrId))
+	} else {
+		binary.BigEndian.PutUint32(head[0:4], typeOrId)
+	}
+	binary.BigEndian.PutUint32(head[4:8], uint32(len(data)))
+	head[4] = flags
+	if _, err := c.conn.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *spdyClient) writeSynStream(id uint32, flags byte, nv map[string]string) os.Error {
+	if c.zw == nil {
+		zw, err := zlib.NewWriterDict(&c.zbuf, zlib.BestCompression, spdyDictionary)
+		if err != nil {
+			return err
+		}
+		c.zw = zw.(flushWriter)
+	}
+	c.zbuf.Reset()
+	c.zw.Write(spdyHeaderBlock(nv))
+	if err := c.zw.Flush(); err != nil {
+		return err
+	}
+	data := make([]byte, 10+c.zbuf.Len())
+	binary.BigEndian.PutUint32(data[0:4], id)
+	copy(data[10:], c.zbuf.Bytes())
+	return c.writeFrame(true, spdySynStream, flags, data)
+}
+
+// startSPDY starts a SPDY connection to s on the loopback interface and
+// reads the SETTINGS frame sent by the server.
+func startSPDY(t *testing.T, s *Server) (*spdyClient, *bufio.Reader, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		netConn, err := l.Accept()
+		if err == nil {
+			s.serveSPDY(netConn)
+		}
+	}()
+	conn, err := net.Dial("tcp", "", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	conn.SetReadTimeout(2e9)
+	br := bufio.NewReader(conn)
+	f, err := readSPDYFrame(br)
+	if err != nil || !f.control || f.typeOrId != spdySettings || len(f.data) != 12 {
+		t.Fatalf("SETTINGS frame = %v, %v", f, err)
+	}
+	if f.data[4] != spdySettingsMaxConcurrentStreams {
+		t.Errorf("SETTINGS id = %d, expected %d", f.data[4], spdySettingsMaxConcurrentStreams)
+	}
+	if n := binary.BigEndian.Uint32(f.data[8:12]); int(n) != limit(s.MaxConcurrentStreams, DefaultMaxConcurrentStreams) {
+		t.Errorf("SETTINGS max concurrent streams = %d", n)
+	}
+	return &spdyClient{conn: conn}, br, func() {
+		conn.Close()
+		l.Close()
+	}
+}
+
+// readSynReply reads a SYN_REPLY frame and returns the decoded header.
+func readSynReply(t *testing.T, sc *spdyConn, br *bufio.Reader, id uint32) map[string]string {
+	f, err := readSPDYFrame(br)
+	if err != nil || !f.control || f.typeOrId != spdySynReply || len(f.data) < 6 {
+		t.Fatalf("SYN_REPLY frame = %v, %v", f, err)
+	}
+	if n := binary.BigEndian.Uint32(f.data[0:4]); n != id {
+		t.Errorf("SYN_REPLY stream id = %d, expected %d", n, id)
+	}
+	header, err := sc.readHeaderBlock(f.data[6:], &defaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestSPDYStreamLifecycle(t *testing.T) {
+	release := make(chan bool)
+	s := &Server{
+		ServerName: "localhost",
+		Handler: web.HandlerFunc(func(req *web.Request) {
+			// Return without reading the request body or responding.
+			<-release
+		}),
+	}
+	c, br, done := startSPDY(t, s)
+	defer done()
+
+	if err := c.writeSynStream(1, 0, map[string]string{"method": "POST", "url": "/", "version": "HTTP/1.1", "host": "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	// The read loop blocks on this frame until the handler returns.
+	c.writeFrame(false, 1, 0, []byte("abc"))
+	close(release)
+
+	header := readSynReply(t, &spdyConn{}, br, 1)
+	if header["status"] != "200 OK" || header["content-type"] != "text/html; charset=utf-8" {
+		t.Errorf("SYN_REPLY header = %v", header)
+	}
+	f, err := readSPDYFrame(br)
+	if err != nil || f.control || f.typeOrId != 1 || f.flags != spdyFlagFin {
+		t.Fatalf("final data frame = %v, %v", f, err)
+	}
+
+	// Data for the finished stream is dropped and the connection continues
+	// to process control frames.
+	c.writeFrame(false, 1, spdyFlagFin, []byte("def"))
+	c.writeFrame(true, spdyPing, 0, []byte{0, 0, 0, 1})
+	f, err = readSPDYFrame(br)
+	if err != nil || !f.control || f.typeOrId != spdyPing {
+		t.Errorf("frame after ping = %v, %v, expected PING", f, err)
+	}
+}
+
+func TestSPDYPanic(t *testing.T) {
+	var log bytes.Buffer
+	s := &Server{
+		ServerName: "localhost",
+		ErrorLog:   &log,
+		Handler: web.NewRouter().
+			Register("/a", "GET", func(req *web.Request) { panic("before respond") }).
+			Register("/b", "GET", func(req *web.Request) {
+				req.Respond(web.StatusOK).Write([]byte("partial"))
+				panic("after respond")
+			}),
+	}
+	c, br, done := startSPDY(t, s)
+	defer done()
+	sc := &spdyConn{}
+
+	c.writeSynStream(1, spdyFlagFin, map[string]string{"method": "GET", "url": "/a", "version": "HTTP/1.1", "host": "localhost"})
+	if header := readSynReply(t, sc, br, 1); header["status"] != "500 Internal Server Error" {
+		t.Errorf("SYN_REPLY header = %v, expected 500", header)
+	}
+	// The response is written by the request's error handler.
+	var body bytes.Buffer
+	for {
+		f, err := readSPDYFrame(br)
+		if err != nil || f.control || f.typeOrId != 1 {
+			t.Fatalf("data frame = %v, %v", f, err)
+		}
+		body.Write(f.data)
+		if f.flags&spdyFlagFin != 0 {
+			break
+		}
+	}
+	if body.String() != "Internal Server Error\n" {
+		t.Errorf("body = %q, expected Internal Server Error", body.String())
+	}
+
+	// The stream is reset when the response is started.
+	c.writeSynStream(3, spdyFlagFin, map[string]string{"method": "GET", "url": "/b", "version": "HTTP/1.1", "host": "localhost"})
+	readSynReply(t, sc, br, 3)
+	f, err := readSPDYFrame(br)
+	if err != nil || !f.control || f.typeOrId != spdyRstStream || binary.BigEndian.Uint32(f.data[0:4]) != 3 {
+		t.Fatalf("frame = %v, %v, expected RST_STREAM", f, err)
+	}
+	if status := binary.BigEndian.Uint32(f.data[4:8]); status != spdyInternalError {
+		t.Errorf("RST_STREAM status = %d, expected %d", status, spdyInternalError)
+	}
+	if n := bytes.Count(log.Bytes(), []byte("panic serving")); n != 2 {
+		t.Errorf("error log = %q, expected two panics", log.String())
+	}
+}
+
+func TestSPDYMaxConcurrentStreams(t *testing.T) {
+	release := make(chan bool)
+	s := &Server{
+		ServerName:           "localhost",
+		MaxConcurrentStreams: 1,
+		Handler:              web.HandlerFunc(func(req *web.Request) { <-release }),
+	}
+	c, br, done := startSPDY(t, s)
+	defer done()
+
+	nv := map[string]string{"method": "GET", "url": "/", "version": "HTTP/1.1", "host": "localhost"}
+	c.writeSynStream(1, spdyFlagFin, nv)
+	c.writeSynStream(3, spdyFlagFin, nv)
+	f, err := readSPDYFrame(br)
+	if err != nil || !f.control || f.typeOrId != spdyRstStream || binary.BigEndian.Uint32(f.data[0:4]) != 3 {
+		t.Fatalf("frame = %v, %v, expected RST_STREAM for stream 3", f, err)
+	}
+	if status := binary.BigEndian.Uint32(f.data[4:8]); status != spdyRefusedStream {
+		t.Errorf("RST_STREAM status = %d, expected %d", status, spdyRefusedStream)
+	}
+	close(release)
+	readSynReply(t, &spdyConn{}, br, 1)
+}
+
+type spdyHeaderLimitTest struct {
+	nv  map[string]string
+	err os.Error
+}
+
+func TestSPDYHeaderLimits(t *testing.T) {
+	l := &limits{
+		maxURILen:         8,
+		maxHeaderLineLen:  8,
+		maxHeaderValueLen: 8,
+		maxHeaderCount:    1,
+		maxHeaderBytes:    40,
+	}
+	tests := []spdyHeaderLimitTest{
+		spdyHeaderLimitTest{map[string]string{"method": "GET", "url": "/", "version": "HTTP/1.1", "host": "a"}, nil},
+		spdyHeaderLimitTest{map[string]string{"method": "GET", "url": "/", "version": "HTTP/1.1", "host": "a", "b": "c"}, ErrHeadersTooLong},
+		spdyHeaderLimitTest{map[string]string{"url": "/123456789"}, ErrURITooLong},
+		spdyHeaderLimitTest{map[string]string{"host": "123456789"}, ErrHeaderTooLong},
+		spdyHeaderLimitTest{map[string]string{"123456789": "a"}, ErrLineTooLong},
+		spdyHeaderLimitTest{map[string]string{"method": "12345678", "url": "12345678", "version": "12345678"}, ErrHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		// Use a new compression context for each test because the decoder
+		// stops reading at the first error.
+		w := newTestSPDYConn(nil)
+		w.zw.Write(spdyHeaderBlock(tt.nv))
+		w.zw.Flush()
+		_, err := (&spdyConn{}).readHeaderBlock(w.cbuf.Bytes(), l)
+		if err != tt.err {
+			t.Errorf("readHeaderBlock(%v) = %v, expected %v", tt.nv, err, tt.err)
+		}
+	}
+}
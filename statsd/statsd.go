@@ -0,0 +1,177 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+// The statsd package implements a web.MetricsRecorder that sends request
+// metrics to a statsd server.
+package statsd
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"net"
+	"os"
+	"rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Statsd servers receive UDP packets. Keep packets small enough to avoid
+// fragmentation.
+const maxPacketLen = 512
+
+// Recorder accumulates request counts, status class counts and latency
+// timers and periodically sends them to a statsd server. Use the recorder
+// with the web.Instrument handler.
+type Recorder struct {
+	// Prefix is prepended to the metric names.
+	Prefix string
+
+	// SampleRate is the fraction of requests that are recorded. All
+	// requests are recorded if the value is zero or greater than or equal
+	// to one.
+	SampleRate float64
+
+	conn     net.Conn
+	done     chan bool
+	mu       sync.Mutex
+	counters map[string]int64
+	timers   map[string][]int64
+}
+
+// New returns a recorder that sends metrics to the statsd server at addr
+// every interval nanoseconds. The metric names are prefix.requests,
+// prefix.status.2xx (and the other status classes) and prefix.latency.
+func New(addr string, prefix string, interval int64) (*Recorder, os.Error) {
+	conn, err := net.Dial("udp", "", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Prefix:   prefix,
+		conn:     conn,
+		done:     make(chan bool),
+		counters: make(map[string]int64),
+		timers:   make(map[string][]int64),
+	}
+	go r.run(interval)
+	return r, nil
+}
+
+func (r *Recorder) run(interval int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Recorder) sampled() bool {
+	return r.SampleRate <= 0 || r.SampleRate >= 1 || rand.Float64() < r.SampleRate
+}
+
+func (r *Recorder) RecordRequest(req *web.Request, status int, duration int64) {
+	if !r.sampled() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters["requests"] += 1
+	r.counters["status."+web.StatusClass(status)] += 1
+	r.timers["latency"] = appendInt64(r.timers["latency"], duration/1e6)
+}
+
+func appendInt64(s []int64, v int64) []int64 {
+	if len(s) == cap(s) {
+		t := make([]int64, len(s), 2*len(s)+8)
+		copy(t, s)
+		s = t
+	}
+	s = s[0 : len(s)+1]
+	s[len(s)-1] = v
+	return s
+}
+
+// packets formats the accumulated metrics as statsd packets and resets the
+// metrics.
+func (r *Recorder) packets() [][]byte {
+	r.mu.Lock()
+	counters, timers := r.counters, r.timers
+	r.counters = make(map[string]int64)
+	r.timers = make(map[string][]int64)
+	r.mu.Unlock()
+
+	rate := ""
+	if r.SampleRate > 0 && r.SampleRate < 1 {
+		rate = "|@" + strconv.Ftoa64(r.SampleRate, 'g', -1)
+	}
+	var packets [][]byte
+	var b bytes.Buffer
+	emit := func() {
+		p := make([][]byte, len(packets)+1)
+		copy(p, packets)
+		p[len(packets)] = []byte(b.String())
+		packets = p
+		b.Reset()
+	}
+	add := func(name, value, kind string) {
+		if r.Prefix != "" {
+			name = r.Prefix + "." + name
+		}
+		line := name + ":" + value + "|" + kind + rate
+		if b.Len() > 0 && b.Len()+1+len(line) > maxPacketLen {
+			emit()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	for name, n := range counters {
+		add(name, strconv.Itoa64(n), "c")
+	}
+	for name, values := range timers {
+		for _, v := range values {
+			add(name, strconv.Itoa64(v), "ms")
+		}
+	}
+	if b.Len() > 0 {
+		emit()
+	}
+	return packets
+}
+
+// Flush sends the accumulated metrics to the statsd server.
+func (r *Recorder) Flush() os.Error {
+	for _, p := range r.packets() {
+		if _, err := r.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close sends the accumulated metrics and stops the recorder.
+func (r *Recorder) Close() os.Error {
+	r.done <- true
+	err := r.Flush()
+	r.conn.Close()
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package statsd
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPackets(t *testing.T) {
+	r := &Recorder{
+		Prefix:     "app",
+		SampleRate: 0.5,
+		counters:   map[string]int64{"requests": 3, "status.2xx": 2},
+		timers:     map[string][]int64{"latency": []int64{5, 7}},
+	}
+	packets := r.packets()
+	if len(packets) != 1 {
+		t.Fatalf("len(packets) = %d, expected 1", len(packets))
+	}
+	lines := strings.Split(string(packets[0]), "\n", -1)
+	sort.SortStrings(lines)
+	expected := "app.latency:5|ms|@0.5 app.latency:7|ms|@0.5 app.requests:3|c|@0.5 app.status.2xx:2|c|@0.5"
+	if actual := strings.Join(lines, " "); actual != expected {
+		t.Errorf("packet = %q, expected %q", actual, expected)
+	}
+	if len(r.packets()) != 0 {
+		t.Errorf("metrics not reset")
+	}
+}
+
+func TestPacketSize(t *testing.T) {
+	r := &Recorder{counters: make(map[string]int64), timers: make(map[string][]int64)}
+	for i := 0; i < 200; i++ {
+		r.timers["latency"] = appendInt64(r.timers["latency"], int64(i))
+	}
+	n := 0
+	for _, p := range r.packets() {
+		if len(p) > maxPacketLen {
+			t.Errorf("packet length %d exceeds %d", len(p), maxPacketLen)
+		}
+		n += len(strings.Split(string(p), "\n", -1))
+	}
+	if n != 200 {
+		t.Errorf("sent %d values, expected 200", n)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// countingBody counts the bytes written to the response body and records
+// whether the client aborted the response.
+type countingBody struct {
+	ResponseBody
+	n       int
+	aborted *bool
+}
+
+func (b *countingBody) Write(p []byte) (int, os.Error) {
+	n, err := b.ResponseBody.Write(p)
+	b.n += n
+	if IsClientAbort(err) {
+		*b.aborted = true
+	}
+	return n, err
+}
+
+func (b *countingBody) Flush() os.Error {
+	err := b.ResponseBody.Flush()
+	if IsClientAbort(err) {
+		*b.aborted = true
+	}
+	return err
+}
+
+// abortRecordingBody records whether the client aborted the request while
+// the request body was read.
+type abortRecordingBody struct {
+	RequestBody
+	aborted *bool
+}
+
+func (b abortRecordingBody) Read(p []byte) (int, os.Error) {
+	n, err := b.RequestBody.Read(p)
+	if IsClientAbort(err) {
+		*b.aborted = true
+	}
+	return n, err
+}
+
+// logQuote returns s as a quoted string or "-" if s is empty.
+func logQuote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strconv.Quote(s)
+}
+
+// AccessLog returns middleware that calls handler and writes a line in the
+// Combined Log Format to w for each request. Each line is written with a
+// single call to w.Write. Use NewSyslogWriter to send the log to syslog.
+//
+// If the client closed the connection or stopped reading the response while
+// the handler was running, then the field "aborted" is appended to the line.
+func AccessLog(w io.Writer) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			t := time.LocalTime()
+			status := 0
+			aborted := false
+			var body *countingBody
+			if req.Body != nil {
+				req.Body = abortRecordingBody{req.Body, &aborted}
+			}
+			FilterResponse(req, func(s int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				status = s
+				rb := respond(s, header)
+				if rb == nil {
+					return nil
+				}
+				body = &countingBody{ResponseBody: rb, aborted: &aborted}
+				return body
+			})
+			handler.ServeWeb(req)
+
+			uri := req.URL.RawPath
+			if uri == "" {
+				uri = req.URL.Path
+				if req.URL.RawQuery != "" {
+					uri = uri + "?" + req.URL.RawQuery
+				}
+			}
+			referer, _ := req.Header.Get(HeaderReferer)
+			userAgent, _ := req.Header.Get(HeaderUserAgent)
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "%s - - [%s] %s ",
+				remoteHost(req),
+				t.Format("02/Jan/2006:15:04:05 -0700"),
+				strconv.Quote(fmt.Sprintf("%s %s HTTP/%d.%d", req.Method, uri, req.ProtocolVersion/1000, req.ProtocolVersion%1000)))
+			if status == 0 {
+				b.WriteString("-")
+			} else {
+				b.WriteString(strconv.Itoa(status))
+			}
+			if body == nil || body.n == 0 {
+				b.WriteString(" -")
+			} else {
+				b.WriteString(" ")
+				b.WriteString(strconv.Itoa(body.n))
+			}
+			fmt.Fprintf(&b, " %s %s", logQuote(referer), logQuote(userAgent))
+			if aborted {
+				b.WriteString(" aborted")
+			}
+			b.WriteString("\n")
+			w.Write(b.Bytes())
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bytes"
+	"http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var b bytes.Buffer
+	h := AccessLog(&b)(HandlerFunc(func(req *Request) {
+		req.Respond(StatusOK).Write([]byte("hello"))
+	}))
+	url, _ := http.ParseURL("/a?b=c")
+	h.ServeWeb(&Request{
+		Method:          "GET",
+		URL:             url,
+		ProtocolVersion: ProtocolVersion(1, 1),
+		RemoteAddr:      "10.0.0.1:1234",
+		Header:          NewStringsMap(HeaderUserAgent, "test"),
+		Responder:       &testResponder{},
+	})
+	line := b.String()
+	if !strings.HasPrefix(line, "10.0.0.1 - - [") || !strings.HasSuffix(line, `] "GET /a?b=c HTTP/1.1" 200 5 - "test"`+"\n") {
+		t.Errorf("unexpected log line %q", line)
+	}
+}
+
+// abortedResponder is a responder for a client that closed the connection.
+type abortedResponder struct {
+	testResponder
+}
+
+func (r *abortedResponder) Respond(status int, header StringsMap) ResponseBody {
+	r.testResponder.Respond(status, header)
+	return r
+}
+
+func (r *abortedResponder) Write(p []byte) (int, os.Error) { return 0, ErrClientClosed }
+
+func TestAccessLogAborted(t *testing.T) {
+	var b bytes.Buffer
+	h := AccessLog(&b)(HandlerFunc(func(req *Request) {
+		if _, err := req.Respond(StatusOK).Write([]byte("hello")); !IsClientAbort(err) {
+			t.Errorf("Write() = %v, expected client abort", err)
+		}
+	}))
+	url, _ := http.ParseURL("/")
+	h.ServeWeb(&Request{
+		Method:          "GET",
+		URL:             url,
+		ProtocolVersion: ProtocolVersion(1, 1),
+		RemoteAddr:      "10.0.0.1:1234",
+		Header:          NewStringsMap(),
+		Responder:       &abortedResponder{},
+	})
+	line := b.String()
+	if !strings.HasSuffix(line, `" 200 - - - aborted`+"\n") {
+		t.Errorf("unexpected log line %q", line)
+	}
+}
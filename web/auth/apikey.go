@@ -0,0 +1,158 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package auth
+
+import (
+	"github.com/garyburd/twister/web"
+	"os"
+	"sync"
+)
+
+var (
+	errMissingAPIKey  os.Error = &web.Error{Status: web.StatusUnauthorized, Message: "missing API key"}
+	errUnknownAPIKey  os.Error = &web.Error{Status: web.StatusUnauthorized, Message: "unknown API key"}
+	errDisabledAPIKey os.Error = &web.Error{Status: web.StatusForbidden, Message: "API key disabled"}
+)
+
+const (
+	// DefaultAPIKeyHeaderName is the default name of the request header
+	// that holds the API key.
+	DefaultAPIKeyHeaderName = "X-Api-Key"
+
+	// DefaultAPIKeyParamName is the default name of the request parameter
+	// that holds the API key.
+	DefaultAPIKeyParamName = "api_key"
+)
+
+// The key for the API key in the request Env.
+const apiKeyKey = "auth.apiKey"
+
+// APIKey describes an API key issued to a client.
+type APIKey struct {
+	// The key sent by the client.
+	Key string
+
+	// Owner identifies the owner of the key.
+	Owner string
+
+	// Requests with a disabled key are rejected with HTTP status 403.
+	Disabled bool
+
+	// Maximum number of requests per minute and per day. There is no limit
+	// if the value is zero.
+	RequestsPerMinute int
+	RequestsPerDay    int
+}
+
+// KeyStore is the interface to the storage of API keys.
+type KeyStore interface {
+	// LookupAPIKey returns the API key or nil if the key is not found.
+	LookupAPIKey(key string) (*APIKey, os.Error)
+}
+
+// MemoryKeyStore is a KeyStore that holds keys in memory.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+}
+
+// NewMemoryKeyStore returns a new empty in-memory key store.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]*APIKey)}
+}
+
+// Add adds the key to the store.
+func (s *MemoryKeyStore) Add(key *APIKey) *MemoryKeyStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Key] = key
+	return s
+}
+
+func (s *MemoryKeyStore) LookupAPIKey(key string) (*APIKey, os.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[key], nil
+}
+
+// APIKeyAuth authenticates requests using an API key sent in a request
+// header or parameter.
+type APIKeyAuth struct {
+	Store KeyStore
+
+	// Name of the request header that holds the key.
+	HeaderName string
+
+	// Name of the request parameter that holds the key. The parameter is
+	// checked when the header is not present. Set to "" to only accept the
+	// key in the header.
+	ParamName string
+}
+
+// NewAPIKeyAuth returns API key authentication using the keys in store and
+// the default header and parameter names.
+func NewAPIKeyAuth(store KeyStore) *APIKeyAuth {
+	return &APIKeyAuth{
+		Store:      store,
+		HeaderName: DefaultAPIKeyHeaderName,
+		ParamName:  DefaultAPIKeyParamName,
+	}
+}
+
+// authenticate returns the API key for the request.
+func (a *APIKeyAuth) authenticate(req *web.Request) (*APIKey, os.Error) {
+	s, found := req.Header.Get(a.HeaderName)
+	if !found && a.ParamName != "" {
+		s, found = req.Param.Get(a.ParamName)
+	}
+	if !found || s == "" {
+		return nil, errMissingAPIKey
+	}
+	key, err := a.Store.LookupAPIKey(s)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errUnknownAPIKey
+	}
+	if key.Disabled {
+		return nil, errDisabledAPIKey
+	}
+	return key, nil
+}
+
+// Handler returns a handler that authenticates the request using the API
+// key before calling handler. Requests with a missing or unknown key are
+// rejected with HTTP status 401. Requests with a disabled key are rejected
+// with HTTP status 403.
+func (a *APIKeyAuth) Handler(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		key, err := a.authenticate(req)
+		if err != nil {
+			req.Error(web.ErrorStatus(err, web.StatusInternalServerError), err)
+			return
+		}
+		req.Env[apiKeyKey] = key
+		handler.ServeWeb(req)
+	})
+}
+
+// CurrentAPIKey returns the API key that authenticated the request or nil if
+// the request was not authenticated by an APIKeyAuth.
+func CurrentAPIKey(req *web.Request) *APIKey {
+	key, _ := req.Env[apiKeyKey].(*APIKey)
+	return key
+}
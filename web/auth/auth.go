@@ -0,0 +1,242 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The auth package implements login sessions using a signed cookie.
+//
+// Install the handler returned by Handler in front of the application to set
+// the current user from the session cookie. Use LoginUser and LogoutUser in
+// the login and logout handlers and RequireLogin to protect handlers that
+// require a logged in user.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/garyburd/twister/web"
+	"http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errLoginRequired os.Error = &web.Error{Status: web.StatusForbidden, Message: "login required"}
+
+const (
+	// DefaultCookieName is the default name of the session cookie.
+	DefaultCookieName = "auth"
+
+	// DefaultMaxAge is the default lifetime of the session cookie in
+	// seconds.
+	DefaultMaxAge = 60 * 60 * 24 * 30
+
+	// DefaultLoginURL is the default URL of the login page.
+	DefaultLoginURL = "/login"
+
+	// NextParamName is the name of the login page parameter that holds the
+	// URL of the page that required the login.
+	NextParamName = "next"
+)
+
+// The key for the current user in the request Env.
+const userKey = "auth.user"
+
+// User is an authenticated user.
+type User interface {
+	// ID returns a string that uniquely identifies the user. The ID is
+	// stored in the session cookie.
+	ID() string
+}
+
+// Auth manages the session cookie.
+type Auth struct {
+	// Secret is the key used to sign the session cookie.
+	Secret []byte
+
+	// Lookup returns the user with the given ID or nil if the user does not
+	// exist.
+	Lookup func(id string) (User, os.Error)
+
+	// Name of the session cookie.
+	CookieName string
+
+	// Lifetime of the session cookie in seconds.
+	MaxAge int
+
+	// Secure is true if the session cookie should only be sent over TLS.
+	Secure bool
+
+	// LoginURL is the URL of the login page. RequireLogin redirects to this
+	// URL.
+	LoginURL string
+}
+
+// New returns a new Auth with the given secret and lookup function and with
+// the default settings.
+func New(secret []byte, lookup func(id string) (User, os.Error)) *Auth {
+	return &Auth{
+		Secret:     secret,
+		Lookup:     lookup,
+		CookieName: DefaultCookieName,
+		MaxAge:     DefaultMaxAge,
+		LoginURL:   DefaultLoginURL,
+	}
+}
+
+// encodeCookie returns the value of the session cookie for the user id and
+// XSRF token. The value is hex(id) "." expires "." xsrf signed with
+// web.SignCookieValue.
+func (a *Auth) encodeCookie(id string, expires int64, xsrf string) string {
+	value := hex.EncodeToString([]byte(id)) + "." + strconv.Itoa64(expires) + "." + xsrf
+	return web.SignCookieValue(a.Secret, a.CookieName, value)
+}
+
+// decodeCookie returns the user id and XSRF token from the verified session
+// cookie value. The ok result is false if the value is malformed or the
+// cookie expired.
+func decodeCookie(value string, now int64) (id string, xsrf string, ok bool) {
+	parts := strings.Split(value, ".", -1)
+	if len(parts) != 3 || parts[2] == "" {
+		return "", "", false
+	}
+	expires, err := strconv.Atoi64(parts[1])
+	if err != nil || expires < now {
+		return "", "", false
+	}
+	p, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+	return string(p), parts[2], true
+}
+
+// newXSRFToken returns a new random XSRF token for a session.
+func newXSRFToken() string {
+	p := make([]byte, 8)
+	if _, err := rand.Reader.Read(p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return hex.EncodeToString(p)
+}
+
+func (a *Auth) setCookie(req *web.Request, value string, maxAge int) {
+	c := web.Cookie{
+		Name:     a.CookieName,
+		Value:    value,
+		MaxAge:   maxAge,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.Secure,
+	}
+	s := c.String()
+	web.FilterRespond(req, func(status int, header web.StringsMap) (int, web.StringsMap) {
+		header.Append(web.HeaderSetCookie, s)
+		return status, header
+	})
+}
+
+// LoginUser sets the session cookie for user and makes user the current
+// user of the request. The XSRF token is bound to the new session so that a
+// token planted before login is not accepted after login. Call LoginUser
+// before responding to the request.
+func (a *Auth) LoginUser(req *web.Request, user User) {
+	xsrf := newXSRFToken()
+	a.setCookie(req, a.encodeCookie(user.ID(), time.Seconds()+int64(a.MaxAge), xsrf), a.MaxAge)
+	web.SetSessionXSRFToken(req, xsrf)
+	req.Env[userKey] = user
+	web.SetTemplateData(req, "user", user)
+}
+
+// LogoutUser deletes the session cookie and clears the current user of the
+// request. Call LogoutUser before responding to the request.
+func (a *Auth) LogoutUser(req *web.Request) {
+	a.setCookie(req, "", -1)
+	req.Env[userKey] = nil, false
+	web.SetTemplateData(req, "user", nil)
+}
+
+// CurrentUser returns the user that is logged in or nil if there is no
+// logged in user.
+func CurrentUser(req *web.Request) User {
+	if user, ok := req.Env[userKey].(User); ok {
+		return user
+	}
+	return nil
+}
+
+// Handler returns a handler that sets the current user from the session
+// cookie before calling handler. The current user is also set in the
+// template data with the key "user". The XSRF token stored in the session is
+// bound to the request with web.SetSessionXSRFToken. Install web.ProcessForm
+// behind this handler to check the session's XSRF token.
+func (a *Auth) Handler(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		// Use the first session cookie with a valid signature. Ignore other
+		// cookies with the same name set for other paths or domains.
+		if value, ok := req.SignedCookieValue(a.CookieName, a.Secret); ok {
+			if id, xsrf, ok := decodeCookie(value, time.Seconds()); ok {
+				user, err := a.Lookup(id)
+				if err != nil {
+					req.Error(web.StatusInternalServerError, err)
+					return
+				}
+				if user != nil {
+					req.Env[userKey] = user
+					web.SetTemplateData(req, "user", user)
+					web.SetSessionXSRFToken(req, xsrf)
+				}
+			}
+		}
+		handler.ServeWeb(req)
+	})
+}
+
+// RequireLogin returns a handler that calls handler if there is a logged in
+// user. Otherwise, GET and HEAD requests are redirected to the login URL
+// with the request path and query in the "next" parameter and other requests
+// are rejected with HTTP status 403. Install the handler behind the handler
+// returned by Handler.
+func (a *Auth) RequireLogin(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		if CurrentUser(req) != nil {
+			handler.ServeWeb(req)
+			return
+		}
+		if req.Method != "GET" && req.Method != "HEAD" {
+			req.Error(web.StatusForbidden, errLoginRequired)
+			return
+		}
+		next := req.URL.Path
+		if req.URL.RawQuery != "" {
+			next = next + "?" + req.URL.RawQuery
+		}
+		sep := "?"
+		if strings.Index(a.LoginURL, "?") >= 0 {
+			sep = "&"
+		}
+		req.Redirect(a.LoginURL+sep+NextParamName+"="+http.URLEscape(next), false)
+	})
+}
+
+// NextURL returns the "next" parameter set by RequireLogin. NextURL returns
+// "/" if the parameter is missing or does not refer to a path on this site.
+// Redirect to this URL after a successful login.
+func NextURL(req *web.Request) string {
+	next := req.Param.GetDef(NextParamName, "")
+	// Browsers treat '\' as '/', so "/\evil.com" is a protocol relative URL.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Index(next, "\\") >= 0 {
+		return "/"
+	}
+	return next
+}
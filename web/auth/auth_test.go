@@ -0,0 +1,320 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cookieTest struct {
+	name  string
+	value string
+	now   int64
+	id    string
+	ok    bool
+}
+
+var cookieTests = []cookieTest{
+	cookieTest{"valid", "626f62.1000.t1", 999, "bob", true},
+	cookieTest{"expired", "626f62.1000.t1", 1001, "", false},
+	cookieTest{"no xsrf", "626f62.1000.", 999, "", false},
+	cookieTest{"bad id", "xyz.1000.t1", 999, "", false},
+	cookieTest{"empty", "", 999, "", false},
+}
+
+func TestDecodeCookie(t *testing.T) {
+	for _, tt := range cookieTests {
+		id, _, ok := decodeCookie(tt.value, tt.now)
+		if ok != tt.ok || id != tt.id {
+			t.Errorf("%s: decodeCookie(%q) = %q, %v, expected %q, %v", tt.name, tt.value, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+type cookieSignatureTest struct {
+	name   string
+	cookie string
+	id     string
+}
+
+func TestHandlerCookieSignature(t *testing.T) {
+	a := New([]byte("secret"), func(id string) (User, os.Error) { return testUser(id), nil })
+	other := New([]byte("other"), nil)
+	now := time.Seconds()
+	valid := a.encodeCookie("bob", now+1000, "t1")
+	tests := []cookieSignatureTest{
+		cookieSignatureTest{"valid", valid, "bob"},
+		cookieSignatureTest{"other secret", other.encodeCookie("bob", now+1000, "t1"), ""},
+		cookieSignatureTest{"tampered", "616c696365" + valid[6:], ""},
+		cookieSignatureTest{"no signature", valid[0:strings.LastIndex(valid, ".")], ""},
+	}
+	for _, tt := range tests {
+		req := &web.Request{
+			Cookie: web.NewStringsMap(DefaultCookieName, tt.cookie),
+			Env:    make(map[string]interface{}),
+		}
+		id := ""
+		a.Handler(web.HandlerFunc(func(req *web.Request) {
+			if user := CurrentUser(req); user != nil {
+				id = user.ID()
+			}
+		})).ServeWeb(req)
+		if id != tt.id {
+			t.Errorf("%s: user = %q, expected %q", tt.name, id, tt.id)
+		}
+	}
+}
+
+func TestHandlerDuplicateCookies(t *testing.T) {
+	a := New([]byte("secret"), func(id string) (User, os.Error) { return testUser(id), nil })
+	other := New([]byte("other"), nil)
+	now := time.Seconds()
+	req := &web.Request{
+		Cookie: web.StringsMap{DefaultCookieName: []string{
+			other.encodeCookie("mallory", now+1000, "t1"),
+			a.encodeCookie("bob", now+1000, "t2"),
+		}},
+		Env: make(map[string]interface{}),
+	}
+	var user User
+	a.Handler(web.HandlerFunc(func(req *web.Request) { user = CurrentUser(req) })).ServeWeb(req)
+	if user == nil || user.ID() != "bob" {
+		t.Errorf("user = %v, expected bob", user)
+	}
+}
+
+type sessionXSRFTest struct {
+	sent   string
+	status int
+}
+
+var sessionXSRFTests = []sessionXSRFTest{
+	sessionXSRFTest{"t1", 0},
+	// The token in the XSRF cookie is not accepted when there is a session.
+	sessionXSRFTest{"planted0", web.StatusNotFound},
+}
+
+func TestSessionXSRF(t *testing.T) {
+	a := New([]byte("secret"), func(id string) (User, os.Error) { return testUser(id), nil })
+	cookie := DefaultCookieName + "=" + a.encodeCookie("bob", time.Seconds()+1000, "t1") + "; " + web.XSRFCookieName + "=planted0"
+	url, _ := http.ParseURL("http://example.com/")
+	for _, tt := range sessionXSRFTests {
+		req, err := web.NewRequest("127.0.0.1:1234", "POST", url, web.ProtocolVersion(1, 1), web.NewStringsMap(web.HeaderCookie, cookie))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Param.Set(web.XSRFParamName, tt.sent)
+		status := 0
+		req.ErrorHandler = func(req *web.Request, s int, reason os.Error) { status = s }
+		var before, after string
+		a.Handler(web.ProcessForm(1000, true)(web.HandlerFunc(func(req *web.Request) {
+			before = req.XSRFToken()
+			a.LoginUser(req, testUser("bob"))
+			after = req.XSRFToken()
+		}))).ServeWeb(req)
+		if status != tt.status {
+			t.Errorf("sent %s: status = %d, expected %d", tt.sent, status, tt.status)
+		}
+		if status != 0 {
+			continue
+		}
+		if before != "t1" || after == before || len(after) != 16 {
+			t.Errorf("sent %s: token before login = %q, after login = %q, expected t1 and a new token", tt.sent, before, after)
+		}
+		if data := web.TemplateData(req); data["xsrf"] != after {
+			t.Errorf("sent %s: template data xsrf = %v, expected %q", tt.sent, data["xsrf"], after)
+		}
+	}
+}
+
+type nextURLTest struct {
+	next     string
+	expected string
+}
+
+var nextURLTests = []nextURLTest{
+	nextURLTest{"", "/"},
+	nextURLTest{"/a?b=c", "/a?b=c"},
+	nextURLTest{"//evil.com/", "/"},
+	nextURLTest{"http://evil.com/", "/"},
+	nextURLTest{"/\\evil.com/", "/"},
+	nextURLTest{"/a\\b", "/"},
+}
+
+func TestNextURL(t *testing.T) {
+	for _, tt := range nextURLTests {
+		req := &web.Request{Param: web.NewStringsMap()}
+		if tt.next != "" {
+			req.Param.Set(NextParamName, tt.next)
+		}
+		if next := NextURL(req); next != tt.expected {
+			t.Errorf("NextURL(%q) = %q, expected %q", tt.next, next, tt.expected)
+		}
+	}
+}
+
+type testUser string
+
+func (u testUser) ID() string { return string(u) }
+
+type policyTest struct {
+	user       string
+	role       string
+	permission string
+	hasRole    bool
+	hasPerm    bool
+}
+
+var policyTests = []policyTest{
+	policyTest{"alice", "admin", "delete", true, true},
+	policyTest{"alice", "editor", "edit", false, true},
+	policyTest{"bob", "editor", "edit", true, true},
+	policyTest{"bob", "admin", "delete", false, false},
+	policyTest{"carol", "editor", "edit", false, false},
+}
+
+func TestAccessControl(t *testing.T) {
+	store := NewMemoryPolicyStore().
+		GrantRole("alice", "admin").
+		GrantRole("bob", "editor").
+		GrantPermission("admin", "edit").
+		GrantPermission("admin", "delete").
+		GrantPermission("editor", "edit")
+	ac := NewAccessControl(store)
+	for _, tt := range policyTests {
+		user := testUser(tt.user)
+		if ok, _ := ac.HasRole(user, tt.role); ok != tt.hasRole {
+			t.Errorf("HasRole(%s, %s) = %v, expected %v", tt.user, tt.role, ok, tt.hasRole)
+		}
+		if ok, _ := ac.HasPermission(user, tt.permission); ok != tt.hasPerm {
+			t.Errorf("HasPermission(%s, %s) = %v, expected %v", tt.user, tt.permission, ok, tt.hasPerm)
+		}
+	}
+}
+
+type signatureTest struct {
+	name   string
+	auth   string
+	date   string
+	body   string
+	target string
+	err    os.Error
+}
+
+func TestVerifySignature(t *testing.T) {
+	const now = 784111777
+	date := time.SecondsToUTC(now).Format(web.TimeLayout)
+	oldDate := time.SecondsToUTC(now - 3600).Format(web.TimeLayout)
+	secret := []byte("secret")
+	sig := Signature(secret, "POST", "/a?b=c", date, []byte("hello"))
+	v := NewSignatureVerifier(func(keyID string) ([]byte, os.Error) {
+		if keyID == "key" {
+			return secret, nil
+		}
+		return nil, nil
+	})
+	tests := []signatureTest{
+		signatureTest{"valid", "key:" + sig, date, "hello", "/a?b=c", nil},
+		signatureTest{"body", "key:" + sig, date, "world", "/a?b=c", errBadSignature},
+		signatureTest{"path", "key:" + sig, date, "hello", "/a?b=d", errBadSignature},
+		signatureTest{"key", "other:" + sig, date, "hello", "/a?b=c", errBadSignature},
+		signatureTest{"missing", "", date, "hello", "/a?b=c", errBadSignature},
+		signatureTest{"skew", "key:" + Signature(secret, "POST", "/a?b=c", oldDate, []byte("hello")), oldDate, "hello", "/a?b=c", errBadDate},
+	}
+	for _, tt := range tests {
+		url, err := http.ParseURL("http://example.com" + tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := web.NewStringsMap(web.HeaderDate, tt.date)
+		if tt.auth != "" {
+			header.Set(web.HeaderAuthorization, tt.auth)
+		}
+		req, err := web.NewRequest("127.0.0.1:1234", "POST", url, web.ProtocolVersion(1, 1), header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = bytes.NewBufferString(tt.body)
+		req.ContentLength = len(tt.body)
+		_, err = v.verify(req, now)
+		if err != tt.err {
+			t.Errorf("%s: err=%v, expected %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+type apiKeyTest struct {
+	name  string
+	kvs   []string
+	param string
+	owner string
+	err   os.Error
+}
+
+var apiKeyTests = []apiKeyTest{
+	apiKeyTest{"header", []string{DefaultAPIKeyHeaderName, "k1"}, "", "alice", nil},
+	apiKeyTest{"param", []string{}, "k1", "alice", nil},
+	apiKeyTest{"missing", []string{}, "", "", errMissingAPIKey},
+	apiKeyTest{"unknown", []string{DefaultAPIKeyHeaderName, "k3"}, "", "", errUnknownAPIKey},
+	apiKeyTest{"disabled", []string{DefaultAPIKeyHeaderName, "k2"}, "", "", errDisabledAPIKey},
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	a := NewAPIKeyAuth(NewMemoryKeyStore().
+		Add(&APIKey{Key: "k1", Owner: "alice"}).
+		Add(&APIKey{Key: "k2", Owner: "bob", Disabled: true}))
+	for _, tt := range apiKeyTests {
+		req := &web.Request{Header: web.NewStringsMap(tt.kvs...), Param: web.NewStringsMap()}
+		if tt.param != "" {
+			req.Param.Set(DefaultAPIKeyParamName, tt.param)
+		}
+		key, err := a.authenticate(req)
+		if err != tt.err {
+			t.Errorf("%s: err=%v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && key.Owner != tt.owner {
+			t.Errorf("%s: owner=%s, expected %s", tt.name, key.Owner, tt.owner)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	const now = 784111777
+	q := NewQuota(NewMemoryQuotaStore())
+	key := &APIKey{Key: "k", RequestsPerMinute: 2, RequestsPerDay: 100}
+	for i, expected := range []int{1, 0, 0} {
+		status, exceeded, err := q.check(key, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.remaining != expected || status.limit != 2 {
+			t.Errorf("%d: limit=%d remaining=%d, expected 2 %d", i, status.limit, status.remaining, expected)
+		}
+		if exceeded != (i == 2) {
+			t.Errorf("%d: exceeded=%v", i, exceeded)
+		}
+	}
+	status, _, _ := q.check(&APIKey{Key: "other"}, now)
+	if status != nil {
+		t.Errorf("status=%v for key without limits", status)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package auth
+
+import (
+	"github.com/garyburd/twister/web"
+	"os"
+	"sync"
+)
+
+var errForbidden os.Error = &web.Error{Status: web.StatusForbidden, Message: "access denied"}
+
+// PolicyStore is the interface to the storage of roles and permissions.
+// Implement this interface to load the policy from a database or directory
+// service.
+type PolicyStore interface {
+	// Roles returns the roles granted to the user.
+	Roles(user User) ([]string, os.Error)
+
+	// Permissions returns the permissions granted to the role.
+	Permissions(role string) ([]string, os.Error)
+}
+
+// MemoryPolicyStore is a PolicyStore that holds the policy in memory.
+type MemoryPolicyStore struct {
+	mu              sync.RWMutex
+	userRoles       map[string][]string
+	rolePermissions map[string][]string
+}
+
+// NewMemoryPolicyStore returns a new empty in-memory policy store.
+func NewMemoryPolicyStore() *MemoryPolicyStore {
+	return &MemoryPolicyStore{
+		userRoles:       make(map[string][]string),
+		rolePermissions: make(map[string][]string),
+	}
+}
+
+// appendString returns a copy of a with s appended.
+func appendString(a []string, s string) []string {
+	result := make([]string, len(a)+1)
+	copy(result, a)
+	result[len(a)] = s
+	return result
+}
+
+// GrantRole grants the role to the user with the given ID.
+func (s *MemoryPolicyStore) GrantRole(userID string, role string) *MemoryPolicyStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userRoles[userID] = appendString(s.userRoles[userID], role)
+	return s
+}
+
+// GrantPermission grants the permission to the role.
+func (s *MemoryPolicyStore) GrantPermission(role string, permission string) *MemoryPolicyStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rolePermissions[role] = appendString(s.rolePermissions[role], permission)
+	return s
+}
+
+func (s *MemoryPolicyStore) Roles(user User) ([]string, os.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.userRoles[user.ID()], nil
+}
+
+func (s *MemoryPolicyStore) Permissions(role string) ([]string, os.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rolePermissions[role], nil
+}
+
+// AccessControl enforces role and permission requirements using the policy
+// in a PolicyStore.
+type AccessControl struct {
+	Store PolicyStore
+
+	// Forbidden handles requests from users that do not have the required
+	// role or permission. If Forbidden is nil, then requests are rejected
+	// with HTTP status 403 using the request's error handler.
+	Forbidden web.Handler
+}
+
+// NewAccessControl returns access control for the policy in store.
+func NewAccessControl(store PolicyStore) *AccessControl {
+	return &AccessControl{Store: store}
+}
+
+// HasRole returns true if the user is granted the role.
+func (ac *AccessControl) HasRole(user User, role string) (bool, os.Error) {
+	roles, err := ac.Store.Roles(user)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasPermission returns true if a role granted to the user is granted the
+// permission.
+func (ac *AccessControl) HasPermission(user User, permission string) (bool, os.Error) {
+	roles, err := ac.Store.Roles(user)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		permissions, err := ac.Store.Permissions(role)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range permissions {
+			if p == permission {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// require returns a handler that calls handler if check returns true for the
+// current user.
+func (ac *AccessControl) require(check func(user User) (bool, os.Error), handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		ok := false
+		if user := CurrentUser(req); user != nil {
+			var err os.Error
+			ok, err = check(user)
+			if err != nil {
+				req.Error(web.StatusInternalServerError, err)
+				return
+			}
+		}
+		switch {
+		case ok:
+			handler.ServeWeb(req)
+		case ac.Forbidden != nil:
+			ac.Forbidden.ServeWeb(req)
+		default:
+			req.Error(web.StatusForbidden, errForbidden)
+		}
+	})
+}
+
+// RequireRole returns middleware that calls handler if the current user is
+// granted the role. Install the handler behind RequireLogin so that users
+// who are not logged in are sent to the login page.
+func (ac *AccessControl) RequireRole(role string) web.Middleware {
+	return func(handler web.Handler) web.Handler {
+		return ac.require(func(user User) (bool, os.Error) { return ac.HasRole(user, role) }, handler)
+	}
+}
+
+// RequirePermission returns middleware that calls handler if a role granted
+// to the current user is granted the permission. Install the handler behind
+// RequireLogin so that users who are not logged in are sent to the login
+// page.
+func (ac *AccessControl) RequirePermission(permission string) web.Middleware {
+	return func(handler web.Handler) web.Handler {
+		return ac.require(func(user User) (bool, os.Error) { return ac.HasPermission(user, permission) }, handler)
+	}
+}
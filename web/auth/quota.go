@@ -0,0 +1,169 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package auth
+
+import (
+	"github.com/garyburd/twister/web"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errQuotaExceeded os.Error = &web.Error{Status: web.StatusTooManyRequests, Message: "request quota exceeded"}
+
+// Headers that report the quota to the client.
+const (
+	HeaderRateLimitLimit     = "Ratelimit-Limit"
+	HeaderRateLimitRemaining = "Ratelimit-Remaining"
+	HeaderRateLimitReset     = "Ratelimit-Reset"
+)
+
+// QuotaStore is the interface to the storage of request counters.
+type QuotaStore interface {
+	// Increment increments the counter with the given name and returns the
+	// new value of the counter. The counter is deleted after ttl seconds.
+	Increment(name string, ttl int) (int, os.Error)
+}
+
+// MemoryQuotaStore is a QuotaStore that holds counters in memory.
+type MemoryQuotaStore struct {
+	mu       sync.Mutex
+	counters map[string]*quotaCounter
+	sweep    int64
+}
+
+type quotaCounter struct {
+	count   int
+	expires int64
+}
+
+// NewMemoryQuotaStore returns a new in-memory quota store.
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{counters: make(map[string]*quotaCounter)}
+}
+
+func (s *MemoryQuotaStore) Increment(name string, ttl int) (int, os.Error) {
+	now := time.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Delete expired counters once a minute.
+	if now >= s.sweep {
+		for k, c := range s.counters {
+			if c.expires <= now {
+				s.counters[k] = nil, false
+			}
+		}
+		s.sweep = now + 60
+	}
+	c := s.counters[name]
+	if c == nil || c.expires <= now {
+		c = &quotaCounter{expires: now + int64(ttl)}
+		s.counters[name] = c
+	}
+	c.count += 1
+	return c.count, nil
+}
+
+// Quota enforces the per minute and per day request limits of API keys.
+type Quota struct {
+	Store QuotaStore
+}
+
+// NewQuota returns quota enforcement using the counters in store.
+func NewQuota(store QuotaStore) *Quota {
+	return &Quota{Store: store}
+}
+
+// quotaLimit is a limit on the number of requests in a period of seconds.
+type quotaLimit struct {
+	limit  int
+	period int64
+}
+
+// quotaStatus is the state of the most restrictive limit for a request.
+type quotaStatus struct {
+	limit     int
+	remaining int
+	reset     int64
+}
+
+// check counts the request against the limits of key.
+func (q *Quota) check(key *APIKey, now int64) (status *quotaStatus, exceeded bool, err os.Error) {
+	limits := []quotaLimit{
+		quotaLimit{key.RequestsPerMinute, 60},
+		quotaLimit{key.RequestsPerDay, 60 * 60 * 24},
+	}
+	for _, l := range limits {
+		if l.limit <= 0 {
+			continue
+		}
+		window := now / l.period * l.period
+		name := key.Key + ":" + strconv.Itoa64(l.period) + ":" + strconv.Itoa64(window)
+		count, err := q.Store.Increment(name, int(l.period))
+		if err != nil {
+			return nil, false, err
+		}
+		remaining := l.limit - count
+		if remaining < 0 {
+			remaining = 0
+			exceeded = true
+		}
+		if status == nil || remaining < status.remaining {
+			status = &quotaStatus{l.limit, remaining, window + l.period - now}
+		}
+	}
+	return status, exceeded, nil
+}
+
+// Handler returns a handler that counts requests against the quota of the
+// current API key before calling handler. Responses include the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers for the
+// most restrictive limit. Requests over the quota are rejected with HTTP
+// status 429. Install the handler behind APIKeyAuth.
+func (q *Quota) Handler(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		key := CurrentAPIKey(req)
+		if key == nil {
+			handler.ServeWeb(req)
+			return
+		}
+		status, exceeded, err := q.check(key, time.Seconds())
+		if err != nil {
+			req.Error(web.StatusInternalServerError, err)
+			return
+		}
+		if status != nil {
+			limit := strconv.Itoa(status.limit)
+			remaining := strconv.Itoa(status.remaining)
+			reset := strconv.Itoa64(status.reset)
+			web.FilterRespond(req, func(s int, header web.StringsMap) (int, web.StringsMap) {
+				header.Set(HeaderRateLimitLimit, limit)
+				header.Set(HeaderRateLimitRemaining, remaining)
+				header.Set(HeaderRateLimitReset, reset)
+				if exceeded {
+					header.Set(web.HeaderRetryAfter, reset)
+				}
+				return s, header
+			})
+		}
+		if exceeded {
+			req.Error(web.StatusTooManyRequests, errQuotaExceeded)
+			return
+		}
+		handler.ServeWeb(req)
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/garyburd/twister/web"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errBadSignature os.Error = &web.Error{Status: web.StatusUnauthorized, Message: "bad request signature"}
+	errBadDate      os.Error = &web.Error{Status: web.StatusUnauthorized, Message: "missing or expired date"}
+)
+
+// DefaultMaxClockSkew is the default maximum difference in seconds between
+// the Date header of a signed request and the server's clock.
+const DefaultMaxClockSkew = 15 * 60
+
+// The key for the ID of the key that signed the request in the request Env.
+const signatureKeyIDKey = "auth.signatureKeyID"
+
+// Signature returns the signature of a request with the given method, path,
+// Date header and body. The path includes the query. The signature is the
+// hex encoded HMAC-SHA1 of the string
+//
+//  method "\n" path "\n" date "\n" hex(SHA1(body))
+//
+// using secret as the key. Clients send the signature in the Authorization
+// header as keyID ":" signature.
+func Signature(secret []byte, method string, path string, date string, body []byte) string {
+	bodyHash := sha1.New()
+	bodyHash.Write(body)
+	h := hmac.NewSHA1(secret)
+	h.Write([]byte(method + "\n" + path + "\n" + date + "\n" + hex.EncodeToString(bodyHash.Sum())))
+	return hex.EncodeToString(h.Sum())
+}
+
+// SignatureVerifier verifies requests signed with a shared secret.
+type SignatureVerifier struct {
+	// LookupKey returns the secret for the key ID or nil if the key ID is
+	// not known.
+	LookupKey func(keyID string) ([]byte, os.Error)
+
+	// MaxClockSkew is the maximum difference in seconds between the Date
+	// header of a request and the server's clock.
+	MaxClockSkew int64
+
+	// MaxBodyLen is the maximum length of a signed request body.
+	MaxBodyLen int
+}
+
+// NewSignatureVerifier returns a verifier that uses lookupKey to find the
+// secret for a key ID.
+func NewSignatureVerifier(lookupKey func(keyID string) ([]byte, os.Error)) *SignatureVerifier {
+	return &SignatureVerifier{
+		LookupKey:    lookupKey,
+		MaxClockSkew: DefaultMaxClockSkew,
+		MaxBodyLen:   web.DefaultMaxFormLen,
+	}
+}
+
+// verify checks the signature of the request and returns the key ID.
+func (v *SignatureVerifier) verify(req *web.Request, now int64) (string, os.Error) {
+	authorization := req.Header.GetDef(web.HeaderAuthorization, "")
+	i := strings.LastIndex(authorization, ":")
+	if i <= 0 {
+		return "", errBadSignature
+	}
+	keyID, sig := strings.TrimSpace(authorization[0:i]), strings.TrimSpace(authorization[i+1:])
+
+	date, found := req.Header.Get(web.HeaderDate)
+	if !found {
+		return "", errBadDate
+	}
+	t, err := web.ParseHTTPDate(date)
+	if err != nil {
+		return "", errBadDate
+	}
+	if skew := t.Seconds() - now; skew > v.MaxClockSkew || -skew > v.MaxClockSkew {
+		return "", errBadDate
+	}
+
+	secret, err := v.LookupKey(keyID)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errBadSignature
+	}
+
+	if err := req.BufferBody(v.MaxBodyLen); err != nil {
+		return "", err
+	}
+	body, err := req.BodyBytes(-1)
+	if err != nil {
+		return "", err
+	}
+	req.RewindBody()
+
+	path := req.URL.Path
+	if req.URL.RawQuery != "" {
+		path = path + "?" + req.URL.RawQuery
+	}
+	expected := Signature(secret, req.Method, path, date, body)
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(expected)) != 1 {
+		return "", errBadSignature
+	}
+	return keyID, nil
+}
+
+// Handler returns a handler that verifies the request signature before
+// calling handler. Requests with a missing or invalid signature or with a
+// Date header outside of the clock skew window are rejected with HTTP status
+// 401.
+func (v *SignatureVerifier) Handler(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		keyID, err := v.verify(req, time.Seconds())
+		if err != nil {
+			req.Error(web.ErrorStatus(err, web.StatusInternalServerError), err)
+			return
+		}
+		req.Env[signatureKeyIDKey] = keyID
+		handler.ServeWeb(req)
+	})
+}
+
+// SignatureKeyID returns the ID of the key that signed the request or "" if
+// the request was not verified by a SignatureVerifier.
+func SignatureKeyID(req *web.Request) string {
+	keyID, _ := req.Env[signatureKeyIDKey].(string)
+	return keyID
+}
@@ -0,0 +1,381 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore is the interface to the storage used by OutputCache.
+type CacheStore interface {
+	// Get returns the value for key or nil if the key is not found.
+	Get(key string) ([]byte, os.Error)
+
+	// Set stores the value for key. The value expires after ttl seconds.
+	Set(key string, value []byte, ttl int) os.Error
+}
+
+// MemoryCacheStore is a CacheStore that holds values in memory.
+type MemoryCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires int64
+}
+
+// NewMemoryCacheStore returns a new in-memory cache store.
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (s *MemoryCacheStore) Get(key string) ([]byte, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.entries[key]
+	if !found {
+		return nil, nil
+	}
+	if e.expires < time.Seconds() {
+		s.entries[key] = e, false
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (s *MemoryCacheStore) Set(key string, value []byte, ttl int) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryCacheEntry{value, time.Seconds() + int64(ttl)}
+	return nil
+}
+
+// Invalidate removes all values from the store.
+func (s *MemoryCacheStore) Invalidate() os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]memoryCacheEntry)
+	return nil
+}
+
+// Responses larger than this are not stored by OutputCache.
+const maxCachedResponseLen = 1 << 20
+
+// cacheRecorder copies the response body to a buffer.
+type cacheRecorder struct {
+	ResponseBody
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, os.Error) {
+	if !r.overflow {
+		if r.buf.Len()+len(p) > maxCachedResponseLen {
+			r.overflow = true
+			r.buf.Reset()
+		} else {
+			r.buf.Write(p)
+		}
+	}
+	return r.ResponseBody.Write(p)
+}
+
+// isCacheable returns true if a response with the given status and header
+// can be stored in a shared cache. The cache key does not include request
+// headers, so responses that vary by request header are not cached.
+func isCacheable(status int, header StringsMap) bool {
+	if status != StatusOK || header.Has(HeaderSetCookie) || header.Has(HeaderVary) {
+		return false
+	}
+	for _, value := range header[HeaderCacheControl] {
+		value = strings.ToLower(value)
+		if strings.Index(value, "private") >= 0 || strings.Index(value, "no-store") >= 0 || strings.Index(value, "no-cache") >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCredentials returns true if req has a cookie or authorization header.
+func hasCredentials(req *Request) bool {
+	return req.Header.Has(HeaderCookie) || req.Header.Has(HeaderAuthorization)
+}
+
+// isPublic returns true if the response header has the Cache-Control public
+// directive. A shared cache can use a public response for requests with
+// credentials.
+func isPublic(header StringsMap) bool {
+	for _, value := range header[HeaderCacheControl] {
+		if strings.Index(strings.ToLower(value), "public") >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCachedResponse encodes a response as a line with the status and the
+// time that the response becomes stale followed by the header and body.
+func encodeCachedResponse(status int, fresh int64, header StringsMap, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.Itoa(status))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa64(fresh))
+	b.WriteString("\r\n")
+	header.WriteHttpHeader(&b)
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// decodeCachedResponse decodes a response encoded by encodeCachedResponse.
+func decodeCachedResponse(p []byte) (status int, fresh int64, header StringsMap, body []byte, err os.Error) {
+	br := bufio.NewReader(bytes.NewBuffer(p))
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return 0, 0, nil, nil, ErrBadFormat
+	}
+	status, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	fresh, err = strconv.Atoi64(fields[1])
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	header = make(StringsMap)
+	n := len(line)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+		n += len(line)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return 0, 0, nil, nil, ErrBadFormat
+		}
+		header.Append(line[0:i], line[i+2:])
+	}
+	return status, fresh, header, p[n:], nil
+}
+
+// discardBody is a response body that discards the data written to it.
+type discardBody struct{}
+
+func (discardBody) Write(p []byte) (int, os.Error) { return len(p), nil }
+func (discardBody) Flush() os.Error                { return nil }
+
+// refreshResponder is the responder for requests made by OutputCacheStale
+// to refresh a stale response.
+type refreshResponder struct{}
+
+func (refreshResponder) Respond(status int, header StringsMap) ResponseBody {
+	return discardBody{}
+}
+
+func (refreshResponder) Continue() os.Error { return nil }
+
+func (refreshResponder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, ErrInvalidState
+}
+
+// copyStringsMap returns a copy of m with copies of the value slices.
+func copyStringsMap(m StringsMap) StringsMap {
+	result := make(StringsMap, len(m))
+	for key, values := range m {
+		p := make([]string, len(values))
+		copy(p, values)
+		result[key] = p
+	}
+	return result
+}
+
+// refreshRequest returns a GET request for refreshing the response to req.
+// The original request is completed before the refresh runs, so the refresh
+// request has its own copies of the URL and maps, an empty body and a
+// responder that discards the response.
+func refreshRequest(req *Request) *Request {
+	url := *req.URL
+	r := &Request{
+		Responder:       refreshResponder{},
+		Method:          "GET",
+		URL:             &url,
+		ProtocolVersion: req.ProtocolVersion,
+		RemoteAddr:      req.RemoteAddr,
+		Header:          copyStringsMap(req.Header),
+		Param:           copyStringsMap(req.Param),
+		Cookie:          copyStringsMap(req.Cookie),
+		Env:             make(map[string]interface{}, len(req.Env)),
+		ErrorHandler:    req.ErrorHandler,
+		Body:            bytes.NewBuffer(nil),
+		TLS:             req.TLS,
+		formParseErr:    req.formParseErr,
+	}
+	for k, v := range req.Env {
+		r.Env[k] = v
+	}
+	return r
+}
+
+// outputCache holds the state for the OutputCache middleware.
+type outputCache struct {
+	store CacheStore
+	ttl   int
+	stale int
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+}
+
+// serve calls the handler and stores the response if the response can be
+// cached. Responses to requests with credentials are stored only if the
+// response is public.
+func (c *outputCache) serve(handler Handler, req *Request, key string) {
+	credentials := hasCredentials(req)
+	var recorder *cacheRecorder
+	var status int
+	var header StringsMap
+	FilterResponse(req, func(s int, h StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+		if !isCacheable(s, h) || (credentials && !isPublic(h)) {
+			return respond(s, h)
+		}
+		// Copy the header before the server adds connection specific
+		// fields.
+		status = s
+		header = make(StringsMap)
+		for key, values := range h {
+			header[key] = values
+		}
+		w := respond(s, h)
+		if w == nil {
+			return nil
+		}
+		recorder = &cacheRecorder{ResponseBody: w}
+		return recorder
+	})
+	handler.ServeWeb(req)
+	if recorder != nil && !recorder.overflow {
+		fresh := time.Seconds() + int64(c.ttl)
+		c.store.Set(key, encodeCachedResponse(status, fresh, header, recorder.buf.Bytes()), c.ttl+c.stale)
+	}
+}
+
+// refresh starts a background refresh of the response for key unless a
+// refresh for key is already running.
+func (c *outputCache) refresh(handler Handler, req *Request, key string) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	r := refreshRequest(req)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Stderr("twister: panic refreshing cached response", key, err)
+			}
+			r.Finish()
+			c.mu.Lock()
+			c.refreshing[key] = false, false
+			c.mu.Unlock()
+		}()
+		c.serve(handler, r, key)
+	}()
+}
+
+func (c *outputCache) handler(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		if (req.Method != "GET" && req.Method != "HEAD") || Development() {
+			handler.ServeWeb(req)
+			return
+		}
+		key := req.URL.Host + req.URL.Path
+		if req.URL.RawQuery != "" {
+			key = key + "?" + req.URL.RawQuery
+		}
+		if p, err := c.store.Get(key); err == nil && p != nil {
+			status, fresh, header, body, err := decodeCachedResponse(p)
+			if err == nil && (!hasCredentials(req) || isPublic(header)) {
+				if c.stale > 0 && fresh <= time.Seconds() {
+					c.refresh(handler, req, key)
+				}
+				w := req.Responder.Respond(status, header)
+				if w != nil && req.Method != "HEAD" {
+					w.Write(body)
+				}
+				return
+			}
+		}
+		if req.Method != "GET" {
+			handler.ServeWeb(req)
+			return
+		}
+		c.serve(handler, req, key)
+	})
+}
+
+// OutputCache returns middleware that caches successful responses to GET
+// requests in store for ttl seconds. The cache key is the request host,
+// path and query. Responses that set cookies, that have a Vary header or that
+// are marked private by the Cache-Control header are not cached. Cached
+// responses are used for GET and HEAD requests. The key does not include the
+// request credentials, so requests with a Cookie or Authorization header
+// bypass the cache unless the response is marked public by the
+// Cache-Control header. The cache is disabled in development mode.
+func OutputCache(store CacheStore, ttl int) Middleware {
+	return OutputCacheStale(store, ttl, 0)
+}
+
+// OutputCacheStale returns middleware that caches responses like
+// OutputCache. After a response expires, the stale response is served for up
+// to stale seconds while the response is refreshed in the background. Only
+// one refresh runs at a time for a cache key.
+//
+// The refresh calls the handler with a copy of the request that triggered the
+// refresh. The copy has an empty body and a responder that discards the
+// response. Handlers that depend on the connection or on the response
+// written to the network should not be wrapped by OutputCacheStale.
+func OutputCacheStale(store CacheStore, ttl int, stale int) Middleware {
+	c := &outputCache{
+		store:      store,
+		ttl:        ttl,
+		stale:      stale,
+		refreshing: make(map[string]bool),
+	}
+	return func(handler Handler) Handler {
+		return c.handler(handler)
+	}
+}
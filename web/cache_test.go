@@ -0,0 +1,186 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheTestHandler counts calls and responds with the call number.
+type cacheTestHandler struct {
+	mu      sync.Mutex
+	n       int
+	block   bool
+	started chan bool
+	release chan bool
+}
+
+func (h *cacheTestHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+func (h *cacheTestHandler) ServeWeb(req *Request) {
+	h.mu.Lock()
+	h.n++
+	n := h.n
+	block := h.block && n > 1
+	h.mu.Unlock()
+	if block {
+		h.started <- true
+		<-h.release
+	}
+	req.Respond(StatusOK, HeaderContentType, "text/plain").Write([]byte(strconv.Itoa(n)))
+}
+
+func cacheTestGet(h Handler) string {
+	url, _ := http.ParseURL("/a?b=c")
+	r := &testResponder{}
+	h.ServeWeb(&Request{Method: "GET", URL: url, Responder: r})
+	return r.body.String()
+}
+
+func TestOutputCache(t *testing.T) {
+	th := &cacheTestHandler{}
+	h := OutputCache(NewMemoryCacheStore(), 60)(th)
+	for i := 0; i < 3; i++ {
+		if body := cacheTestGet(h); body != "1" {
+			t.Errorf("get %d returned %q, expected %q", i, body, "1")
+		}
+	}
+	if n := th.count(); n != 1 {
+		t.Errorf("handler called %d times, expected 1", n)
+	}
+}
+
+func TestOutputCacheVary(t *testing.T) {
+	n := 0
+	h := OutputCache(NewMemoryCacheStore(), 60)(HandlerFunc(func(req *Request) {
+		n++
+		req.Respond(StatusOK, HeaderContentType, "text/plain", HeaderVary, HeaderAcceptLanguage).Write([]byte(strconv.Itoa(n)))
+	}))
+	for i := 1; i <= 2; i++ {
+		if body := cacheTestGet(h); body != strconv.Itoa(i) {
+			t.Errorf("get %d returned %q, expected %q", i, body, strconv.Itoa(i))
+		}
+	}
+}
+
+func TestOutputCacheStale(t *testing.T) {
+	th := &cacheTestHandler{block: true, started: make(chan bool, 10), release: make(chan bool)}
+	// Responses are stale immediately.
+	h := OutputCacheStale(NewMemoryCacheStore(), 0, 60)(th)
+
+	if body := cacheTestGet(h); body != "1" {
+		t.Fatalf("first get returned %q", body)
+	}
+
+	// Stale responses are served while a single refresh runs.
+	for i := 0; i < 3; i++ {
+		if body := cacheTestGet(h); body != "1" {
+			t.Errorf("stale get %d returned %q, expected %q", i, body, "1")
+		}
+	}
+	<-th.started
+	if n := th.count(); n != 2 {
+		t.Errorf("handler called %d times, expected 2", n)
+	}
+	close(th.release)
+
+	for i := 0; ; i++ {
+		if body := cacheTestGet(h); body != "1" {
+			if body != "2" {
+				t.Errorf("get after refresh returned %q, expected %q", body, "2")
+			}
+			break
+		}
+		if i > 1000 {
+			t.Fatal("response not refreshed")
+		}
+		time.Sleep(1e6)
+	}
+}
+
+func TestRefreshRequest(t *testing.T) {
+	url, _ := http.ParseURL("/a?b=c")
+	req := &Request{
+		Method: "HEAD",
+		URL:    url,
+		Header: NewStringsMap(HeaderAccept, "text/html"),
+		Param:  NewStringsMap("b", "c"),
+		Cookie: NewStringsMap("d", "e"),
+		Env:    map[string]interface{}{"f": "g"},
+	}
+	r := refreshRequest(req)
+	if r.Method != "GET" || r.URL.Path != "/a" || r.Header.GetDef(HeaderAccept, "") != "text/html" ||
+		r.Param.GetDef("b", "") != "c" || r.Cookie.GetDef("d", "") != "e" || r.Env["f"] != "g" {
+		t.Errorf("refresh request = %+v", r)
+	}
+	r.URL.Path = "/x"
+	r.Header[HeaderAccept][0] = "x"
+	r.Param.Set("b", "x")
+	r.Cookie.Set("d", "x")
+	r.Env["f"] = "x"
+	if req.URL.Path != "/a" || req.Header.GetDef(HeaderAccept, "") != "text/html" ||
+		req.Param.GetDef("b", "") != "c" || req.Cookie.GetDef("d", "") != "e" || req.Env["f"] != "g" {
+		t.Errorf("original request modified, %+v", req)
+	}
+}
+
+type cacheCredentialsTest struct {
+	header   string
+	public   bool
+	expected []string
+}
+
+var cacheCredentialsTests = []cacheCredentialsTest{
+	cacheCredentialsTest{"", false, []string{"1", "1", "1"}},
+	cacheCredentialsTest{HeaderCookie, false, []string{"1", "2", "3"}},
+	cacheCredentialsTest{HeaderAuthorization, false, []string{"1", "2", "3"}},
+	cacheCredentialsTest{HeaderCookie, true, []string{"1", "1", "1"}},
+	cacheCredentialsTest{HeaderAuthorization, true, []string{"1", "1", "1"}},
+}
+
+func TestOutputCacheCredentials(t *testing.T) {
+	for _, tt := range cacheCredentialsTests {
+		n := 0
+		public := tt.public
+		h := OutputCache(NewMemoryCacheStore(), 60)(HandlerFunc(func(req *Request) {
+			n++
+			header := NewStringsMap(HeaderContentType, "text/plain")
+			if public {
+				header.Set(HeaderCacheControl, "public, max-age=60")
+			}
+			req.Responder.Respond(StatusOK, header).Write([]byte(strconv.Itoa(n)))
+		}))
+		url, _ := http.ParseURL("/a")
+		for i, expected := range tt.expected {
+			header := make(StringsMap)
+			if tt.header != "" {
+				header.Set(tt.header, "secret")
+			}
+			r := &testResponder{}
+			h.ServeWeb(&Request{Method: "GET", URL: url, Header: header, Responder: r})
+			if body := r.body.String(); body != expected {
+				t.Errorf("%s public=%v: get %d returned %q, expected %q", tt.header, tt.public, i, body, expected)
+			}
+		}
+	}
+}
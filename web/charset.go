@@ -0,0 +1,122 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"utf8"
+)
+
+var ErrUnknownCharset = os.NewError("unknown charset")
+
+// CharsetConverter converts text from a character set to UTF-8.
+type CharsetConverter interface {
+	ToUTF8(p []byte) ([]byte, os.Error)
+}
+
+// latin1Converter converts ISO-8859-1 text to UTF-8.
+type latin1Converter struct{}
+
+func (latin1Converter) ToUTF8(p []byte) ([]byte, os.Error) {
+	n := 0
+	for _, b := range p {
+		n += utf8.RuneLen(int(b))
+	}
+	q := make([]byte, n)
+	n = 0
+	for _, b := range p {
+		n += utf8.EncodeRune(int(b), q[n:])
+	}
+	return q, nil
+}
+
+var (
+	charsetsLock sync.RWMutex
+	charsets     = map[string]CharsetConverter{
+		"iso-8859-1": latin1Converter{},
+		"latin1":     latin1Converter{},
+	}
+)
+
+// RegisterCharset registers the converter for the named character set.
+// Form values submitted in the character set are converted to UTF-8 using
+// the converter. The ISO-8859-1 character set is registered by default.
+// Register converters for other character sets such as Shift_JIS using this
+// function.
+func RegisterCharset(name string, converter CharsetConverter) {
+	charsetsLock.Lock()
+	defer charsetsLock.Unlock()
+	charsets[strings.ToLower(name)] = converter
+}
+
+// isUTF8Charset returns true if text in the named charset does not need
+// conversion to UTF-8.
+func isUTF8Charset(name string) bool {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// lookupCharset returns the converter for the named character set or nil if
+// the character set is not registered.
+func lookupCharset(name string) CharsetConverter {
+	charsetsLock.RLock()
+	defer charsetsLock.RUnlock()
+	return charsets[strings.ToLower(name)]
+}
+
+// contentTypeParam returns the value of the named parameter in the
+// Content-Type header value s or "" if the parameter is not present.
+func contentTypeParam(s string, name string) string {
+	params := strings.Split(s, ";", -1)
+	for _, param := range params[1:] {
+		i := strings.Index(param, "=")
+		if i < 0 {
+			continue
+		}
+		if strings.ToLower(strings.TrimSpace(param[0:i])) != name {
+			continue
+		}
+		value := strings.TrimSpace(param[i+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		return value
+	}
+	return ""
+}
+
+// convertStringsMap converts the keys and values in src to UTF-8 and
+// appends the converted keys and values to dst.
+func convertStringsMap(dst StringsMap, src StringsMap, converter CharsetConverter) os.Error {
+	for key, values := range src {
+		k, err := converter.ToUTF8([]byte(key))
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			v, err := converter.ToUTF8([]byte(value))
+			if err != nil {
+				return err
+			}
+			dst.Append(string(k), string(v))
+		}
+	}
+	return nil
+}
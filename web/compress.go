@@ -0,0 +1,314 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressContentTypes is the list of content type prefixes
+// compressed by Compress when the policy does not specify content types.
+var DefaultCompressContentTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/x-javascript",
+	"application/xhtml+xml",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// DefaultMinCompressLen is the default minimum length of a compressed
+// response.
+const DefaultMinCompressLen = 256
+
+var errNotAcceptable os.Error = &Error{Status: StatusNotAcceptable, Message: "no acceptable content encoding"}
+
+// CompressPolicy specifies the responses compressed by Compress.
+type CompressPolicy struct {
+	// Responses with a Content-Length less than MinLen are not compressed.
+	// Responses without a Content-Length are always considered.
+	MinLen int
+
+	// Responses are compressed if the content type starts with one of
+	// these prefixes. Content types of already compressed formats such as
+	// images and archives should not be listed.
+	ContentTypes []string
+}
+
+// DefaultCompressPolicy compresses text responses of DefaultMinCompressLen
+// bytes or more.
+var DefaultCompressPolicy = &CompressPolicy{
+	MinLen:       DefaultMinCompressLen,
+	ContentTypes: DefaultCompressContentTypes,
+}
+
+// compressibleType returns true if the content type of a response with the
+// given header is compressed by the policy.
+func (p *CompressPolicy) compressibleType(header StringsMap) bool {
+	contentType := strings.ToLower(header.GetDef(HeaderContentType, ""))
+	for _, prefix := range p.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns true if a response with the given header should be
+// compressed.
+func (p *CompressPolicy) compressible(header StringsMap) bool {
+	if header.Has(HeaderContentEncoding) || header.Has(HeaderContentRange) {
+		return false
+	}
+	if s, found := header.Get(HeaderContentLength); found {
+		if n, err := strconv.Atoi(s); err == nil && n < p.MinLen {
+			return false
+		}
+	}
+	return p.compressibleType(header)
+}
+
+// addVary adds names to the Vary header unless the names are already listed.
+func addVary(header StringsMap, names ...string) {
+	listed := make(map[string]bool)
+	for _, value := range header[HeaderVary] {
+		for _, name := range strings.Split(value, ",", -1) {
+			listed[HeaderName(strings.TrimSpace(name))] = true
+		}
+	}
+	if listed["*"] {
+		return
+	}
+	for _, name := range names {
+		if !listed[name] {
+			header.Append(HeaderVary, name)
+			listed[name] = true
+		}
+	}
+}
+
+// negotiateEncoding returns the content coding to use for a response given
+// the value of the Accept-Encoding request header. The result is "gzip",
+// "deflate" or "identity". The result is "" if no coding is acceptable.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, item := range strings.Split(accept, ",", -1) {
+		params := strings.Split(item, ";", -1)
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		value := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.Atof64(param[2:]); err == nil {
+					value = v
+				}
+			}
+		}
+		q[coding] = value
+	}
+	star, hasStar := q["*"]
+	get := func(coding string, def float64) float64 {
+		if v, found := q[coding]; found {
+			return v
+		}
+		if hasStar {
+			return star
+		}
+		return def
+	}
+	identity := get("identity", 1)
+	if _, found := q["identity"]; !found && hasStar && star == 0 {
+		identity = 0
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range [...]string{"gzip", "deflate"} {
+		if v := get(coding, 0); v > bestQ {
+			best, bestQ = coding, v
+		}
+	}
+	if best != "" && bestQ >= identity {
+		return best
+	}
+	if identity > 0 {
+		return "identity"
+	}
+	return ""
+}
+
+// compressBody compresses the response body.
+type compressBody struct {
+	ResponseBody
+	zw io.WriteCloser
+}
+
+func (b *compressBody) Write(p []byte) (int, os.Error) {
+	return b.zw.Write(p)
+}
+
+// flusher is implemented by compressors that can write pending output
+// without ending the stream.
+type flusher interface {
+	Flush() os.Error
+}
+
+// Flush writes the data pending in the compressor to the response body and
+// flushes the response body.
+func (b *compressBody) Flush() os.Error {
+	if f, ok := b.zw.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return b.ResponseBody.Flush()
+}
+
+func (b *compressBody) close() os.Error {
+	if err := b.zw.Close(); err != nil {
+		return err
+	}
+	return b.ResponseBody.Flush()
+}
+
+// Compress returns middleware that compresses responses from handler using
+// the gzip or deflate content coding. The coding is selected using the
+// q-values in the request's Accept-Encoding header. Requests that do not
+// accept any supported coding or the identity coding are rejected with HTTP
+// status 406. Partial content responses are not compressed. The
+// Accept-Encoding request header is added to the Vary header of all
+// responses with a content type listed in the policy. If policy is nil, then
+// DefaultCompressPolicy is used.
+func Compress(policy *CompressPolicy) Middleware {
+	if policy == nil {
+		policy = DefaultCompressPolicy
+	}
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			encoding := negotiateEncoding(req.Header.GetDef(HeaderAcceptEncoding, ""))
+			if encoding == "" {
+				req.Error(StatusNotAcceptable, errNotAcceptable)
+				return
+			}
+			var body *compressBody
+			FilterResponse(req, func(status int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				if policy.compressibleType(header) {
+					// Shared caches must not serve this response to clients
+					// that accept a different coding.
+					addVary(header, HeaderAcceptEncoding)
+				}
+				if encoding == "identity" || req.Method == "HEAD" ||
+					status < 200 || status == StatusNoContent || status == StatusNotModified || status == StatusPartialContent ||
+					!policy.compressible(header) {
+					return respond(status, header)
+				}
+				header.Set(HeaderContentEncoding, encoding)
+				header.Del(HeaderContentLength)
+				w := respond(status, header)
+				if w == nil {
+					return nil
+				}
+				var zw io.WriteCloser
+				var err os.Error
+				if encoding == "gzip" {
+					zw, err = gzip.NewWriter(w)
+				} else {
+					zw, err = zlib.NewWriter(w)
+				}
+				if err != nil {
+					return w
+				}
+				body = &compressBody{w, zw}
+				return body
+			})
+			handler.ServeWeb(req)
+			if body != nil {
+				body.close()
+			}
+		})
+	}
+}
+
+var errUnsupportedEncoding os.Error = &Error{Status: StatusUnsupportedMediaType, Message: "unsupported content encoding"}
+
+// limitedBody returns ErrRequestEntityTooLarge when more than n bytes are
+// read from r.
+type limitedBody struct {
+	r io.Reader
+	n int
+}
+
+func (b *limitedBody) Read(p []byte) (int, os.Error) {
+	if b.n < 0 {
+		return 0, ErrRequestEntityTooLarge
+	}
+	if len(p) > b.n+1 {
+		p = p[0 : b.n+1]
+	}
+	n, err := b.r.Read(p)
+	b.n -= n
+	if b.n < 0 {
+		return 0, ErrRequestEntityTooLarge
+	}
+	return n, err
+}
+
+// DecompressRequest returns middleware that decompresses request bodies sent
+// with the gzip or deflate content coding before calling handler. The
+// Content-Encoding and Content-Length headers are removed from the request
+// and the request's ContentLength is set to -1. Reads return
+// ErrRequestEntityTooLarge after maxLen decompressed bytes. Requests with
+// other content codings are rejected with HTTP status 415.
+func DecompressRequest(maxLen int) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			encoding, found := req.Header.Get(HeaderContentEncoding)
+			if !found {
+				handler.ServeWeb(req)
+				return
+			}
+			var r io.Reader
+			var err os.Error
+			switch strings.ToLower(strings.TrimSpace(encoding)) {
+			case "identity":
+				handler.ServeWeb(req)
+				return
+			case "gzip", "x-gzip":
+				r, err = gzip.NewReader(req.Body)
+			case "deflate":
+				r, err = zlib.NewReader(req.Body)
+			default:
+				req.Error(StatusUnsupportedMediaType, errUnsupportedEncoding)
+				return
+			}
+			if err != nil {
+				req.Error(StatusBadRequest, err)
+				return
+			}
+			req.Body = &limitedBody{r, maxLen}
+			req.ContentLength = -1
+			req.Header.Del(HeaderContentEncoding)
+			req.Header.Del(HeaderContentLength)
+			handler.ServeWeb(req)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+type negotiateEncodingTest struct {
+	accept   string
+	expected string
+}
+
+var negotiateEncodingTests = []negotiateEncodingTest{
+	negotiateEncodingTest{"", "identity"},
+	negotiateEncodingTest{"gzip", "gzip"},
+	negotiateEncodingTest{"deflate", "deflate"},
+	negotiateEncodingTest{"gzip, deflate", "gzip"},
+	negotiateEncodingTest{"gzip;q=0.5, deflate", "deflate"},
+	negotiateEncodingTest{"gzip;q=0.5, identity", "identity"},
+	negotiateEncodingTest{"gzip;q=0", "identity"},
+	negotiateEncodingTest{"*", "gzip"},
+	negotiateEncodingTest{"*;q=0", ""},
+	negotiateEncodingTest{"*;q=0, identity", "identity"},
+	negotiateEncodingTest{"identity;q=0", ""},
+	negotiateEncodingTest{"br, identity;q=0, deflate;q=0.1", "deflate"},
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range negotiateEncodingTests {
+		if actual := negotiateEncoding(tt.accept); actual != tt.expected {
+			t.Errorf("negotiateEncoding(%q) = %q, expected %q", tt.accept, actual, tt.expected)
+		}
+	}
+}
+
+type compressibleTest struct {
+	kvs      []string
+	expected bool
+}
+
+var compressibleTests = []compressibleTest{
+	compressibleTest{[]string{HeaderContentType, "text/html; charset=utf-8"}, true},
+	compressibleTest{[]string{HeaderContentType, "image/png"}, false},
+	compressibleTest{[]string{HeaderContentType, "text/html", HeaderContentLength, "10"}, false},
+	compressibleTest{[]string{HeaderContentType, "text/html", HeaderContentLength, "1000"}, true},
+	compressibleTest{[]string{HeaderContentType, "text/html", HeaderContentEncoding, "gzip"}, false},
+	compressibleTest{[]string{HeaderContentType, "text/html", HeaderContentRange, "bytes 0-999/2000"}, false},
+}
+
+func TestCompressible(t *testing.T) {
+	for _, tt := range compressibleTests {
+		if actual := DefaultCompressPolicy.compressible(NewStringsMap(tt.kvs...)); actual != tt.expected {
+			t.Errorf("compressible(%v) = %v, expected %v", tt.kvs, actual, tt.expected)
+		}
+	}
+}
+
+type compressTest struct {
+	method   string
+	accept   string
+	status   int
+	encoding string
+}
+
+var compressTests = []compressTest{
+	compressTest{"GET", "gzip", StatusOK, "gzip"},
+	compressTest{"GET", "identity", StatusOK, ""},
+	compressTest{"HEAD", "gzip", StatusOK, ""},
+	compressTest{"GET", "gzip", StatusPartialContent, ""},
+}
+
+func TestCompress(t *testing.T) {
+	for _, tt := range compressTests {
+		h := Compress(nil)(HandlerFunc(func(req *Request) {
+			req.Respond(tt.status, HeaderContentType, "text/plain", HeaderVary, "Cookie").Write(bytes.Repeat([]byte("a"), 1000))
+		}))
+		r := &testResponder{}
+		h.ServeWeb(&Request{Method: tt.method, Header: NewStringsMap(HeaderAcceptEncoding, tt.accept), Responder: r})
+		if encoding := r.header.GetDef(HeaderContentEncoding, ""); encoding != tt.encoding {
+			t.Errorf("%s %s %d: Content-Encoding = %q, expected %q", tt.method, tt.accept, tt.status, encoding, tt.encoding)
+		}
+		if vary := r.header[HeaderVary]; len(vary) != 2 || vary[1] != HeaderAcceptEncoding {
+			t.Errorf("%s %s %d: Vary = %v, expected Cookie and Accept-Encoding", tt.method, tt.accept, tt.status, vary)
+		}
+	}
+}
+
+func TestDecompressRequest(t *testing.T) {
+	var b bytes.Buffer
+	zw, err := gzip.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(zw, "hello world")
+	zw.Close()
+	p := b.Bytes()
+
+	for _, maxLen := range []int{100, 5} {
+		req := &Request{
+			Header:        NewStringsMap(HeaderContentEncoding, "gzip"),
+			Body:          bytes.NewBuffer(p),
+			ContentLength: len(p),
+		}
+		var body []byte
+		DecompressRequest(maxLen)(HandlerFunc(func(req *Request) {
+			body, err = req.BodyBytes(-1)
+		})).ServeWeb(req)
+		if maxLen == 5 {
+			if err != ErrRequestEntityTooLarge {
+				t.Errorf("maxLen=%d, err=%v, expected %v", maxLen, err, ErrRequestEntityTooLarge)
+			}
+			continue
+		}
+		if err != nil || string(body) != "hello world" {
+			t.Errorf("maxLen=%d, body=%q, err=%v", maxLen, body, err)
+		}
+		if req.Header.Has(HeaderContentEncoding) || req.ContentLength != -1 {
+			t.Errorf("maxLen=%d, request not updated", maxLen)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// CookieValue returns the value of the named cookie. If the client sent more
+// than one cookie with the name, then the first value is returned. Browsers
+// send cookies with more specific paths first.
+func (req *Request) CookieValue(name string) (string, bool) {
+	return req.Cookie.Get(name)
+}
+
+// CookieValues returns all values of the named cookie in the order sent by
+// the client.
+func (req *Request) CookieValues(name string) []string {
+	return req.Cookie[name]
+}
+
+// Cookies returns the cookies in the Cookie request header in the order sent
+// by the client. Only the Name and Value fields of the cookies are set.
+func (req *Request) Cookies() []Cookie {
+	return parseCookies(req.Header[HeaderCookie])
+}
+
+func cookieSignature(key []byte, name string, value string) string {
+	h := hmac.NewSHA1(key)
+	io.WriteString(h, name)
+	io.WriteString(h, "=")
+	io.WriteString(h, value)
+	return hex.EncodeToString(h.Sum())
+}
+
+// SignCookieValue returns value with a signature computed from key, the
+// cookie name and value. Use the result as the value of the named cookie and
+// SignedCookieValue to get the value back from the request.
+func SignCookieValue(key []byte, name string, value string) string {
+	return value + "." + cookieSignature(key, name, value)
+}
+
+// SignedCookieValue returns the value of the named cookie set with a value
+// from SignCookieValue. If the client sent more than one cookie with the
+// name, then the first value with a valid signature is returned. The ok
+// result is false if no value has a valid signature.
+func (req *Request) SignedCookieValue(name string, key []byte) (value string, ok bool) {
+	for _, s := range req.Cookie[name] {
+		i := strings.LastIndex(s, ".")
+		if i < 0 {
+			continue
+		}
+		value, sig := s[0:i], s[i+1:]
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(cookieSignature(key, name, value))) == 1 {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	req := &Request{Header: NewStringsMap(HeaderCookie, "a=1; b=2; a=3")}
+	req.Cookie = parseCookieValues(req.Header[HeaderCookie])
+	if v, found := req.CookieValue("a"); !found || v != "1" {
+		t.Errorf("CookieValue(a) = %q, %v, expected 1, true", v, found)
+	}
+	if _, found := req.CookieValue("c"); found {
+		t.Errorf("CookieValue(c) found")
+	}
+	if v := req.CookieValues("a"); len(v) != 2 || v[0] != "1" || v[1] != "3" {
+		t.Errorf("CookieValues(a) = %q, expected [1 3]", v)
+	}
+	cookies := req.Cookies()
+	expected := []string{"a", "1", "b", "2", "a", "3"}
+	if len(cookies) != 3 {
+		t.Fatalf("Cookies() = %v, expected 3 cookies", cookies)
+	}
+	for i, c := range cookies {
+		if c.Name != expected[2*i] || c.Value != expected[2*i+1] {
+			t.Errorf("Cookies()[%d] = %s=%s, expected %s=%s", i, c.Name, c.Value, expected[2*i], expected[2*i+1])
+		}
+	}
+}
+
+func TestSignedCookieValue(t *testing.T) {
+	key := []byte("secret")
+	signed := SignCookieValue(key, "session", "a.b")
+	req := &Request{Cookie: StringsMap{"session": []string{
+		"forged",
+		SignCookieValue([]byte("other"), "session", "x"),
+		SignCookieValue(key, "other", "y"),
+		signed,
+	}}}
+	if v, ok := req.SignedCookieValue("session", key); !ok || v != "a.b" {
+		t.Errorf("SignedCookieValue() = %q, %v, expected a.b, true", v, ok)
+	}
+	req.Cookie = StringsMap{"session": []string{signed[0 : len(signed)-1]}}
+	if _, ok := req.SignedCookieValue("session", key); ok {
+		t.Errorf("SignedCookieValue() accepted truncated signature")
+	}
+}
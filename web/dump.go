@@ -0,0 +1,183 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultRedactedHeaders is the list of headers with values hidden by a
+// Dumper.
+var DefaultRedactedHeaders = []string{
+	HeaderAuthorization,
+	HeaderCookie,
+	HeaderProxyAuthorization,
+	HeaderSetCookie,
+}
+
+// Dumper writes requests and responses to a writer for debugging. Dumping
+// can be turned on and off while the server is running.
+type Dumper struct {
+	// MaxBodyLen is the maximum number of request and response body bytes
+	// written. Bodies are not written if the value is zero.
+	MaxBodyLen int
+
+	// Values of these headers are replaced with "[redacted]".
+	RedactedHeaders []string
+
+	mu      sync.Mutex
+	w       io.Writer
+	enabled bool
+}
+
+// NewDumper returns an enabled dumper that writes to w.
+func NewDumper(w io.Writer) *Dumper {
+	return &Dumper{w: w, enabled: true, RedactedHeaders: DefaultRedactedHeaders}
+}
+
+// SetEnabled turns dumping on or off.
+func (d *Dumper) SetEnabled(enabled bool) {
+	d.mu.Lock()
+	d.enabled = enabled
+	d.mu.Unlock()
+}
+
+// Enabled returns true if dumping is on.
+func (d *Dumper) Enabled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enabled
+}
+
+// bodyRecorder records the first n bytes written to or read from a body.
+type bodyRecorder struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (r *bodyRecorder) record(p []byte) {
+	if n := r.n - r.buf.Len(); n > 0 {
+		if len(p) > n {
+			p = p[0:n]
+		}
+		r.buf.Write(p)
+	}
+}
+
+type dumpRequestBody struct {
+	RequestBody
+	r *bodyRecorder
+}
+
+func (b dumpRequestBody) Read(p []byte) (int, os.Error) {
+	n, err := b.RequestBody.Read(p)
+	b.r.record(p[0:n])
+	return n, err
+}
+
+type dumpResponseBody struct {
+	ResponseBody
+	r *bodyRecorder
+}
+
+func (b dumpResponseBody) Write(p []byte) (int, os.Error) {
+	n, err := b.ResponseBody.Write(p)
+	b.r.record(p[0:n])
+	return n, err
+}
+
+func (d *Dumper) writeHeader(b *bytes.Buffer, prefix string, header StringsMap) {
+	redacted := make(map[string]bool)
+	for _, key := range d.RedactedHeaders {
+		redacted[key] = true
+	}
+	for _, key := range header.SortedKeys() {
+		for _, value := range header[key] {
+			if redacted[key] {
+				value = "[redacted]"
+			}
+			fmt.Fprintf(b, "%s%s: %s\n", prefix, key, value)
+		}
+	}
+}
+
+func writeDumpBody(b *bytes.Buffer, prefix string, r *bodyRecorder) {
+	if r == nil || r.buf.Len() == 0 {
+		return
+	}
+	// Separate the body from the header with a prefixed blank line.
+	b.WriteString(strings.TrimRight(prefix, " "))
+	b.WriteString("\n")
+	for _, line := range bytes.Split(r.buf.Bytes(), []byte{'\n'}, -1) {
+		b.WriteString(prefix)
+		b.Write(line)
+		b.WriteString("\n")
+	}
+}
+
+// Handler returns a handler that dumps the request and response when
+// dumping is enabled. The request line and header are prefixed with "> "
+// and the response status line and header are prefixed with "< ".
+func (d *Dumper) Handler(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		if !d.Enabled() {
+			handler.ServeWeb(req)
+			return
+		}
+		var requestBody, responseBody *bodyRecorder
+		if d.MaxBodyLen > 0 {
+			requestBody = &bodyRecorder{n: d.MaxBodyLen}
+			req.Body = dumpRequestBody{req.Body, requestBody}
+		}
+		status := 0
+		var responseHeader StringsMap
+		FilterResponse(req, func(s int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+			status = s
+			responseHeader = make(StringsMap)
+			for key, values := range header {
+				responseHeader[key] = values
+			}
+			w := respond(s, header)
+			if w == nil || d.MaxBodyLen <= 0 {
+				return w
+			}
+			responseBody = &bodyRecorder{n: d.MaxBodyLen}
+			return dumpResponseBody{w, responseBody}
+		})
+
+		handler.ServeWeb(req)
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "> %s %s HTTP/%d.%d\n", req.Method, req.URL.Raw, req.ProtocolVersion/1000, req.ProtocolVersion%1000)
+		d.writeHeader(&b, "> ", req.Header)
+		writeDumpBody(&b, "> ", requestBody)
+		if status != 0 {
+			fmt.Fprintf(&b, "< %d %s\n", status, StatusText[status])
+			d.writeHeader(&b, "< ", responseHeader)
+			writeDumpBody(&b, "< ", responseBody)
+		}
+		b.WriteString("\n")
+
+		d.mu.Lock()
+		d.w.Write(b.Bytes())
+		d.mu.Unlock()
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bytes"
+	"http"
+	"testing"
+)
+
+func TestDumper(t *testing.T) {
+	url, _ := http.ParseURL("/a?b=c")
+	req, err := NewRequest("127.0.0.1:1234", "POST", url, ProtocolVersion(1, 1),
+		NewStringsMap(HeaderCookie, "secret=1", HeaderContentLength, "5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = bytes.NewBufferString("hello")
+	responder := &testResponder{}
+	req.Responder = responder
+
+	var out bytes.Buffer
+	d := NewDumper(&out)
+	d.MaxBodyLen = 3
+	d.Handler(HandlerFunc(func(req *Request) {
+		req.BodyBytes(-1)
+		req.Respond(StatusOK, HeaderContentType, "text/plain").Write([]byte("world"))
+	})).ServeWeb(req)
+
+	expected := `> POST /a?b=c HTTP/1.1
+> Content-Length: 5
+> Cookie: [redacted]
+>
+> hel
+< 200 OK
+< Content-Type: text/plain
+<
+< wor
+
+`
+	if out.String() != expected {
+		t.Errorf("dump=\n%s\nexpected\n%s", out.String(), expected)
+	}
+	if responder.body.String() != "world" {
+		t.Errorf("body=%q, expected world", responder.body.String())
+	}
+
+	out.Reset()
+	d.SetEnabled(false)
+	d.Handler(HandlerFunc(func(req *Request) {})).ServeWeb(req)
+	if out.Len() != 0 {
+		t.Errorf("dump written when disabled")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"template"
+)
+
+// ErrorPages renders error responses using templates registered by HTTP
+// status code. Install the pages as the application's error handler using
+// SetErrorHandler:
+//
+//  pages := web.NewErrorPages(nil).Register(web.StatusNotFound, notFoundTempl)
+//  handler = web.SetErrorHandler(func(req *web.Request, status int, reason os.Error) {
+//      pages.HandleError(req, status, reason)
+//  })(handler)
+//
+// The templates are executed with a map containing the following keys:
+//
+//  status      The HTTP status code.
+//  statusText  The text for the HTTP status code.
+//  reason      The reason for the error. The reason is included for client
+//              errors (status < 500) and in debug mode.
+//  req         The request.
+//  debug       In debug mode, the stack trace and a dump of the request
+//              headers and parameters. The stack trace is the stack of the
+//              panic when the server calls the error handler for a panic.
+//              Empty otherwise.
+type ErrorPages struct {
+	// Debug enables the dump of the stack trace and request in error pages.
+	// Debug is implied in development mode. Do not enable Debug on
+	// production servers.
+	Debug bool
+
+	templates       map[int]*template.Template
+	defaultTemplate *template.Template
+}
+
+var defaultErrorTemplate = template.MustParse(`<html>
+<head><title>{status} {statusText|html}</title></head>
+<body>
+<h1>{status} {statusText|html}</h1>
+{.section reason}<p>{@|html}</p>{.end}
+{.section debug}<pre>{@|html}</pre>{.end}
+</body>
+</html>`, nil)
+
+// NewErrorPages returns error pages that use defaultTemplate for status
+// codes without a registered template. If defaultTemplate is nil, then a
+// simple built-in template is used.
+func NewErrorPages(defaultTemplate *template.Template) *ErrorPages {
+	if defaultTemplate == nil {
+		defaultTemplate = defaultErrorTemplate
+	}
+	return &ErrorPages{templates: make(map[int]*template.Template), defaultTemplate: defaultTemplate}
+}
+
+// Register sets the template for the given status code.
+func (ep *ErrorPages) Register(status int, t *template.Template) *ErrorPages {
+	ep.templates[status] = t
+	return ep
+}
+
+// HandleError responds to the request by executing the template for status.
+// HandleError has the signature of the request's ErrorHandler.
+func (ep *ErrorPages) HandleError(req *Request, status int, reason os.Error) {
+	t, found := ep.templates[status]
+	if !found {
+		t = ep.defaultTemplate
+	}
+	data := map[string]interface{}{
+		"status":     status,
+		"statusText": StatusText[status],
+		"reason":     "",
+		"req":        req,
+		"debug":      "",
+	}
+	debug := ep.Debug || Development()
+	if reason != nil && (status < 500 || debug) {
+		data["reason"] = reason.String()
+	}
+	if debug {
+		data["debug"] = debugDump(req, reason, 2)
+	}
+	w := req.Respond(status, HeaderContentType, "text/html; charset=utf-8")
+	if w != nil {
+		t.Execute(data, w)
+	}
+}
+
+// debugDump returns the detail and fields of reason if reason is an Error,
+// the stack trace of the panic or of the caller skip frames above debugDump
+// and a dump of the request header and parameters.
+func debugDump(req *Request, reason os.Error, skip int) string {
+	var b bytes.Buffer
+	var e *Error
+	switch r := reason.(type) {
+	case Error:
+		e = &r
+	case *Error:
+		e = r
+	}
+	if e != nil {
+		if e.Detail != "" {
+			fmt.Fprintf(&b, "Detail:\n  %s\n\n", e.Detail)
+		}
+		if len(e.Fields) > 0 {
+			b.WriteString("Fields:\n")
+			dumpStringsMap(&b, e.Fields)
+			b.WriteString("\n")
+		}
+	}
+	// Use the stack of the panic if the error is for a panic recovered by
+	// the server. Otherwise, use the stack of the call to the error handler.
+	stack := PanicStack(req)
+	if stack == "" {
+		stack = Stack(skip)
+	}
+	b.WriteString("Stack:\n")
+	b.WriteString(stack)
+	fmt.Fprintf(&b, "\nRequest:\n  %s %s\n", req.Method, req.URL.String())
+	b.WriteString("\nHeader:\n")
+	dumpStringsMap(&b, req.Header)
+	b.WriteString("\nParam:\n")
+	dumpStringsMap(&b, req.Param)
+	return b.String()
+}
+
+func dumpStringsMap(b *bytes.Buffer, m StringsMap) {
+	for _, key := range m.SortedKeys() {
+		for _, value := range m[key] {
+			fmt.Fprintf(b, "  %s: %s\n", key, value)
+		}
+	}
+}
+
+const panicStackKey = "web.panicStack"
+
+// SetPanicStack sets the stack trace of a panic recovered while handling the
+// request. Servers call SetPanicStack before calling the request's error
+// handler for the panic.
+func SetPanicStack(req *Request, stack string) {
+	req.Env[panicStackKey] = stack
+}
+
+// PanicStack returns the stack trace set by SetPanicStack or "" if the
+// handler did not panic.
+func PanicStack(req *Request) string {
+	stack, _ := req.Env[panicStackKey].(string)
+	return stack
+}
+
+// Stack returns a formatted stack trace of the calling goroutine starting
+// skip frames above the caller of Stack.
+func Stack(skip int) string {
+	var b bytes.Buffer
+	for i := skip + 1; ; i++ {
+		pc, file, line, ok := runtime.Caller(i)
+		if !ok {
+			break
+		}
+		name := "?"
+		if f := runtime.FuncForPC(pc); f != nil {
+			name = f.Name()
+		}
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", name, file, line)
+	}
+	return b.String()
+}
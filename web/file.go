@@ -0,0 +1,408 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"template"
+	"time"
+)
+
+var (
+	errNotRegularFile os.Error = &Error{Status: StatusNotFound, Message: "not a regular file"}
+	errBadFilePath    os.Error = &Error{Status: StatusNotFound, Message: "bad file path"}
+	errSymlink        os.Error = &Error{Status: StatusNotFound, Message: "symbolic link not allowed"}
+)
+
+// Policies for following symbolic links in DirectoryHandler.
+const (
+	// Follow symbolic links to files and directories within the root.
+	SymlinkWithinRoot = iota
+
+	// Do not follow symbolic links.
+	SymlinkDeny
+
+	// Follow all symbolic links.
+	SymlinkAllow
+)
+
+// maxSymlinks is the maximum number of symbolic links followed when
+// resolving a path.
+const maxSymlinks = 40
+
+// ServeFile responds to the request with the contents of the named file.
+// The content type is determined from the file name extension and the
+// contents of the file using ContentType.
+func ServeFile(req *Request, fname string) {
+	f, err := os.Open(fname, os.O_RDONLY, 0)
+	if err != nil {
+		req.Error(StatusNotFound, nil)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		req.Error(StatusNotFound, nil)
+		return
+	}
+	if !info.IsRegular() {
+		req.Error(StatusNotFound, errNotRegularFile)
+		return
+	}
+	serveFile(req, f, info)
+}
+
+func serveFile(req *Request, f *os.File, info *os.FileInfo) {
+	lastModified := info.Mtime_ns / 1e9
+	switch status := req.CheckLastModified(lastModified); status {
+	case StatusNotModified:
+		req.Respond(status)
+		return
+	case StatusPreconditionFailed:
+		req.Error(status, nil)
+		return
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[0:])
+	header := NewStringsMap(
+		HeaderContentType, ContentType(info.Name, buf[0:n]),
+		HeaderContentLength, strconv.Itoa64(info.Size),
+		HeaderLastModified, time.SecondsToUTC(lastModified).Format(TimeLayout))
+	w := req.Responder.Respond(StatusOK, header)
+	if w == nil || req.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(buf[0:n]); err != nil {
+		return
+	}
+	io.Copy(w, f)
+}
+
+// FileHandler returns a handler that serves the named file.
+func FileHandler(fname string) Handler {
+	return HandlerFunc(func(req *Request) { ServeFile(req, fname) })
+}
+
+// DefaultIndexNames is the default value of DirectoryHandler.IndexNames.
+var DefaultIndexNames = []string{"index.html"}
+
+// DirectoryHandler serves files from a directory. The handler serves the
+// file named by the "path" request parameter or the request URL path if the
+// parameter is not set. Register the handler with a pattern like
+// "/static/<path:.*>".
+//
+// Requests for a directory without a trailing slash are redirected to the
+// URL with a trailing slash. Requests for a directory are served with the
+// first file in IndexNames that exists in the directory. If there is no index
+// file and Listing is true, then the handler responds with a listing of the
+// directory. Otherwise, the handler responds with status 404.
+//
+// The path is cleaned after the path parameter is decoded. Paths that refer
+// to the parent of the root or that contain a backslash or NUL byte are
+// rejected with status 404.
+type DirectoryHandler struct {
+	// Root is the directory containing the files.
+	Root string
+
+	// IndexNames is the list of index file names. If IndexNames is nil,
+	// then DefaultIndexNames is used.
+	IndexNames []string
+
+	// Listing enables directory listings. The listing is sorted by the
+	// "sort" request parameter ("name", "size" or "modified") in the order
+	// specified by the "order" request parameter ("asc" or "desc"). Files
+	// with names that start with "." are not listed.
+	Listing bool
+
+	// SymlinkPolicy specifies how symbolic links are followed. Symbolic
+	// links are checked for the requested file and the path to the file. The
+	// root directory itself can be a symbolic link.
+	SymlinkPolicy int
+}
+
+// NewDirectoryHandler returns a handler for the files in root.
+func NewDirectoryHandler(root string) *DirectoryHandler {
+	return &DirectoryHandler{Root: root}
+}
+
+// filePath returns the path of the requested file relative to the root.
+func (h *DirectoryHandler) filePath(req *Request) (string, os.Error) {
+	p, found := req.Param.Get("path")
+	if !found {
+		p = req.URL.Path
+	}
+	// Reject bytes that some file systems interpret as path separators or
+	// terminators.
+	if strings.Index(p, "\\") >= 0 || strings.Index(p, "\x00") >= 0 {
+		return "", errBadFilePath
+	}
+	p, escape := CleanPath("/" + p)
+	if escape {
+		return "", errPathTraversal
+	}
+	return p, nil
+}
+
+// resolve returns the name of the file for path p relative to the root.
+// Symbolic links in the path are resolved according to the symbolic link
+// policy.
+func (h *DirectoryHandler) resolve(p string) (string, os.Error) {
+	root := strings.TrimRight(h.Root, "/")
+	if h.SymlinkPolicy == SymlinkAllow {
+		return root + p, nil
+	}
+	pending := strings.Split(strings.Trim(p, "/"), "/", -1)
+	resolved := ""
+	links := 0
+	for len(pending) > 0 {
+		segment := pending[0]
+		pending = pending[1:]
+		if segment == "" {
+			continue
+		}
+		fname := root + resolved + "/" + segment
+		info, err := os.Lstat(fname)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsSymlink() {
+			resolved = resolved + "/" + segment
+			continue
+		}
+		if h.SymlinkPolicy == SymlinkDeny {
+			return "", errSymlink
+		}
+		links += 1
+		if links > maxSymlinks {
+			return "", errSymlink
+		}
+		target, err := os.Readlink(fname)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			// Convert absolute targets within the root to paths relative
+			// to the root.
+			if target != root && !strings.HasPrefix(target, root+"/") {
+				return "", errSymlink
+			}
+			target = target[len(root):]
+		} else {
+			target = resolved + "/" + target
+		}
+		target, escape := CleanPath(target)
+		if escape {
+			return "", errSymlink
+		}
+		// Resolve the link target from the root followed by the remaining
+		// segments.
+		segments := strings.Split(strings.Trim(target, "/"), "/", -1)
+		t := make([]string, len(segments)+len(pending))
+		copy(t, segments)
+		copy(t[len(segments):], pending)
+		pending = t
+		resolved = ""
+	}
+	return root + resolved, nil
+}
+
+func (h *DirectoryHandler) ServeWeb(req *Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		req.Respond(StatusMethodNotAllowed, HeaderAllow, "GET, HEAD")
+		return
+	}
+	p, err := h.filePath(req)
+	if err != nil {
+		req.Error(StatusNotFound, err)
+		return
+	}
+	fname, err := h.resolve(p)
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			// Do not expose file system paths in the response.
+			err = nil
+		}
+		req.Error(StatusNotFound, err)
+		return
+	}
+	f, err := os.Open(fname, os.O_RDONLY, 0)
+	if err != nil {
+		req.Error(StatusNotFound, nil)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		req.Error(StatusNotFound, nil)
+		return
+	}
+	switch {
+	case info.IsRegular():
+		serveFile(req, f, info)
+	case info.IsDirectory():
+		h.serveDirectory(req, f, p)
+	default:
+		req.Error(StatusNotFound, errNotRegularFile)
+	}
+}
+
+func (h *DirectoryHandler) serveDirectory(req *Request, dir *os.File, p string) {
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		addSlash(req)
+		return
+	}
+	indexNames := h.IndexNames
+	if indexNames == nil {
+		indexNames = DefaultIndexNames
+	}
+	for _, name := range indexNames {
+		fname, err := h.resolve(strings.TrimRight(p, "/") + "/" + name)
+		if err != nil {
+			continue
+		}
+		f, err := os.Open(fname, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.IsRegular() {
+			serveFile(req, f, info)
+			return
+		}
+	}
+	if !h.Listing {
+		req.Error(StatusNotFound, nil)
+		return
+	}
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		req.Error(StatusInternalServerError, err)
+		return
+	}
+	serveListing(req, p, infos)
+}
+
+// fileInfoSorter sorts directories before files and then by the sort key.
+type fileInfoSorter struct {
+	infos []os.FileInfo
+	key   string
+	desc  bool
+}
+
+func (s *fileInfoSorter) Len() int      { return len(s.infos) }
+func (s *fileInfoSorter) Swap(i, j int) { s.infos[i], s.infos[j] = s.infos[j], s.infos[i] }
+
+func (s *fileInfoSorter) Less(i, j int) bool {
+	a, b := &s.infos[i], &s.infos[j]
+	if a.IsDirectory() != b.IsDirectory() {
+		return a.IsDirectory()
+	}
+	if s.desc {
+		a, b = b, a
+	}
+	switch s.key {
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "modified":
+		if a.Mtime_ns != b.Mtime_ns {
+			return a.Mtime_ns < b.Mtime_ns
+		}
+	}
+	return a.Name < b.Name
+}
+
+// escapePathSegment escapes a file name for use in a URL path.
+func escapePathSegment(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexRune("-_.~!$&'()*+,;=:@", int(c)) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte("0123456789ABCDEF"[c>>4])
+			b.WriteByte("0123456789ABCDEF"[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+func serveListing(req *Request, p string, infos []os.FileInfo) {
+	s := &fileInfoSorter{key: req.Param.GetDef("sort", "name"), desc: req.Param.GetDef("order", "") == "desc"}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name, ".") {
+			continue
+		}
+		t := make([]os.FileInfo, len(s.infos)+1)
+		copy(t, s.infos)
+		t[len(s.infos)] = info
+		s.infos = t
+	}
+	sort.Sort(s)
+
+	var b bytes.Buffer
+	title := []byte("Index of " + p)
+	b.WriteString("<html>\n<head><title>")
+	template.HTMLEscape(&b, title)
+	b.WriteString("</title></head>\n<body>\n<h1>")
+	template.HTMLEscape(&b, title)
+	b.WriteString("</h1>\n<table>\n<tr>")
+	for _, column := range []string{"name", "size", "modified"} {
+		order := "asc"
+		if column == s.key && !s.desc {
+			order = "desc"
+		}
+		b.WriteString("<th><a href=\"?sort=")
+		b.WriteString(column)
+		b.WriteString("&amp;order=")
+		b.WriteString(order)
+		b.WriteString("\">")
+		b.WriteString(strings.ToUpper(column[0:1]) + column[1:])
+		b.WriteString("</a></th>")
+	}
+	b.WriteString("</tr>\n")
+	if p != "/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, info := range s.infos {
+		name := info.Name
+		size := strconv.Itoa64(info.Size)
+		if info.IsDirectory() {
+			name += "/"
+			size = "-"
+		}
+		b.WriteString("<tr><td><a href=\"")
+		b.WriteString(escapePathSegment(info.Name))
+		if info.IsDirectory() {
+			b.WriteString("/")
+		}
+		b.WriteString("\">")
+		template.HTMLEscape(&b, []byte(name))
+		b.WriteString("</a></td><td>")
+		b.WriteString(size)
+		b.WriteString("</td><td>")
+		b.WriteString(time.SecondsToUTC(info.Mtime_ns / 1e9).Format(TimeLayout))
+		b.WriteString("</td></tr>\n")
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	req.RespondBytes(StatusOK, "text/html; charset=utf-8", b.Bytes())
+}
@@ -0,0 +1,186 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"http"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func createTestFiles(t *testing.T, files map[string]string) string {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	root := tempFileName(dir, "twister-file-test-")
+	for name, content := range files {
+		fname := root + "/" + name
+		if err := os.MkdirAll(fname[0:strings.LastIndex(fname, "/")], 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func serveTestFile(h Handler, rawURL string) *testResponder {
+	url, _ := http.ParseURL(rawURL)
+	r := &testResponder{}
+	param := make(StringsMap)
+	if url.RawQuery != "" {
+		param, _ = http.ParseQuery(url.RawQuery)
+	}
+	h.ServeWeb(&Request{
+		Method:       "GET",
+		URL:          url,
+		Header:       make(StringsMap),
+		Param:        param,
+		Responder:    r,
+		ErrorHandler: defaultErrorHandler,
+	})
+	return r
+}
+
+func TestDirectoryHandler(t *testing.T) {
+	root := createTestFiles(t, map[string]string{
+		"index.html": "<html>home</html>",
+		"a.txt":      "hello",
+		"sub/b.txt":  "b",
+		"sub/c.txt":  "ccc",
+		"sub/.hide":  "hidden",
+	})
+	defer os.RemoveAll(root)
+
+	h := NewDirectoryHandler(root)
+	if r := serveTestFile(h, "/"); r.status != StatusOK || r.body.String() != "<html>home</html>" {
+		t.Errorf("/ = %d %q, expected index.html", r.status, r.body.String())
+	}
+	r := serveTestFile(h, "/a.txt")
+	if r.status != StatusOK || r.body.String() != "hello" || r.header.GetDef(HeaderContentType, "") != "text/plain; charset=utf-8" {
+		t.Errorf("/a.txt = %d %q %v", r.status, r.body.String(), r.header)
+	}
+	if r := serveTestFile(h, "/sub"); r.status != StatusMovedPermanently || r.header.GetDef(HeaderLocation, "") != "/sub/" {
+		t.Errorf("/sub = %d %v, expected redirect to /sub/", r.status, r.header)
+	}
+	if r := serveTestFile(h, "/sub/"); r.status != StatusNotFound {
+		t.Errorf("/sub/ without listing = %d, expected 404", r.status)
+	}
+	if r := serveTestFile(h, "/missing.txt"); r.status != StatusNotFound {
+		t.Errorf("/missing.txt = %d, expected 404", r.status)
+	}
+
+	h.IndexNames = []string{"missing.html", "c.txt"}
+	if r := serveTestFile(h, "/sub/"); r.status != StatusOK || r.body.String() != "ccc" {
+		t.Errorf("/sub/ with index c.txt = %d %q", r.status, r.body.String())
+	}
+
+	h.IndexNames = []string{}
+	h.Listing = true
+	r = serveTestFile(h, "/sub/")
+	body := r.body.String()
+	if r.status != StatusOK || strings.Index(body, "b.txt") > strings.Index(body, "c.txt") || strings.Index(body, ".hide") >= 0 {
+		t.Errorf("/sub/ listing = %d %q", r.status, body)
+	}
+	r = serveTestFile(h, "/sub/?sort=size&order=desc")
+	body = r.body.String()
+	if r.status != StatusOK || strings.Index(body, "b.txt") < strings.Index(body, "c.txt") {
+		t.Errorf("/sub/ listing by size desc = %d %q", r.status, body)
+	}
+}
+
+func TestDirectoryHandlerTraversal(t *testing.T) {
+	dir := createTestFiles(t, map[string]string{
+		"secret.txt":   "secret",
+		"root/a.txt":   "hello",
+		"root/b/c.txt": "c",
+	})
+	defer os.RemoveAll(dir)
+
+	r := NewRouter()
+	r.Register("/static/<path:.*>", "GET", NewDirectoryHandler(dir+"/root"))
+	for _, rawURL := range []string{
+		"/static/../secret.txt",
+		"/static/%2e%2e/secret.txt",
+		"/static/..%2fsecret.txt",
+		"/static/..%2Fsecret.txt",
+		"/static/b/..%2f..%2fsecret.txt",
+		"/static/%252e%252e/secret.txt",
+		"/static/..%5csecret.txt",
+		"/static/a.txt%00.html",
+	} {
+		resp := serveTestFile(r, rawURL)
+		if resp.status != StatusNotFound || strings.Index(resp.body.String(), "secret") >= 0 {
+			t.Errorf("%s = %d %q, expected 404", rawURL, resp.status, resp.body.String())
+		}
+	}
+	if resp := serveTestFile(r, "/static/b/../a.txt"); resp.status != StatusOK || resp.body.String() != "hello" {
+		t.Errorf("/static/b/../a.txt = %d %q, expected hello", resp.status, resp.body.String())
+	}
+}
+
+type symlinkPolicyTest struct {
+	policy int
+	path   string
+	status int
+}
+
+var symlinkPolicyTests = []symlinkPolicyTest{
+	symlinkPolicyTest{SymlinkWithinRoot, "/a.txt", StatusOK},
+	symlinkPolicyTest{SymlinkWithinRoot, "/link-in", StatusOK},
+	symlinkPolicyTest{SymlinkWithinRoot, "/link-dir/c.txt", StatusOK},
+	symlinkPolicyTest{SymlinkWithinRoot, "/link-abs", StatusOK},
+	symlinkPolicyTest{SymlinkWithinRoot, "/link-out", StatusNotFound},
+	symlinkPolicyTest{SymlinkWithinRoot, "/b/link-up/secret.txt", StatusNotFound},
+	symlinkPolicyTest{SymlinkWithinRoot, "/link-loop", StatusNotFound},
+	symlinkPolicyTest{SymlinkDeny, "/a.txt", StatusOK},
+	symlinkPolicyTest{SymlinkDeny, "/link-in", StatusNotFound},
+	symlinkPolicyTest{SymlinkDeny, "/link-dir/c.txt", StatusNotFound},
+	symlinkPolicyTest{SymlinkAllow, "/link-in", StatusOK},
+	symlinkPolicyTest{SymlinkAllow, "/link-out", StatusOK},
+}
+
+func TestDirectoryHandlerSymlinks(t *testing.T) {
+	dir := createTestFiles(t, map[string]string{
+		"secret.txt":   "secret",
+		"root/a.txt":   "hello",
+		"root/b/c.txt": "c",
+	})
+	defer os.RemoveAll(dir)
+	root := dir + "/root"
+	for _, link := range [][2]string{
+		[2]string{"a.txt", "link-in"},
+		[2]string{"b", "link-dir"},
+		[2]string{root + "/a.txt", "link-abs"},
+		[2]string{"../secret.txt", "link-out"},
+		[2]string{"../..", "b/link-up"},
+		[2]string{"link-loop", "link-loop"},
+	} {
+		if err := os.Symlink(link[0], root+"/"+link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range symlinkPolicyTests {
+		h := &DirectoryHandler{Root: root, SymlinkPolicy: tt.policy}
+		if resp := serveTestFile(h, tt.path); resp.status != tt.status {
+			t.Errorf("policy=%d %s = %d, expected %d", tt.policy, tt.path, resp.status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// autoFlushBody flushes the response body after a number of bytes are
+// written and periodically while there is unflushed data.
+type autoFlushBody struct {
+	ResponseBody
+	mu      sync.Mutex
+	n       int
+	pending int
+	stopped bool
+	done    chan bool
+}
+
+func (b *autoFlushBody) Write(p []byte) (int, os.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.ResponseBody.Write(p)
+	b.pending += n
+	if err == nil && b.n > 0 && b.pending >= b.n {
+		err = b.flush()
+	}
+	return n, err
+}
+
+func (b *autoFlushBody) flush() os.Error {
+	b.pending = 0
+	return b.ResponseBody.Flush()
+}
+
+func (b *autoFlushBody) Flush() os.Error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+func (b *autoFlushBody) run(interval int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			if !b.stopped && b.pending > 0 {
+				b.flush()
+			}
+			b.mu.Unlock()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// stop stops the periodic flush. The body is not flushed after stop
+// returns.
+func (b *autoFlushBody) stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.mu.Unlock()
+	if b.done != nil {
+		close(b.done)
+	}
+}
+
+// AutoFlush returns middleware that flushes the response body after every n
+// bytes written by the handler and every interval nanoseconds while written
+// data is not flushed. Zero disables the corresponding trigger. Use AutoFlush
+// for progressive rendering and long-poll handlers. AutoFlush must be
+// installed inside middleware that transforms the response body, such as
+// Compress, so that the flush passes through the transformation.
+func AutoFlush(n int, interval int64) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			var body *autoFlushBody
+			// Stop the periodic flush when the handler panics.
+			defer func() {
+				if body != nil {
+					body.stop()
+				}
+			}()
+			FilterResponse(req, func(status int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				w := respond(status, header)
+				if w == nil {
+					return nil
+				}
+				body = &autoFlushBody{ResponseBody: w, n: n}
+				if interval > 0 {
+					body.done = make(chan bool)
+					go body.run(interval)
+				}
+				return body
+			})
+			handler.ServeWeb(req)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// flushResponder records the length of the body at each flush.
+type flushResponder struct {
+	testResponder
+	flushes []int
+}
+
+func (r *flushResponder) Respond(status int, header StringsMap) ResponseBody {
+	r.testResponder.Respond(status, header)
+	return r
+}
+
+func (r *flushResponder) Flush() os.Error {
+	tmp := make([]int, len(r.flushes)+1)
+	copy(tmp, r.flushes)
+	tmp[len(r.flushes)] = r.body.Len()
+	r.flushes = tmp
+	return nil
+}
+
+func TestAutoFlushBytes(t *testing.T) {
+	h := AutoFlush(4, 0)(HandlerFunc(func(req *Request) {
+		w := req.Respond(StatusOK)
+		w.Write([]byte("ab"))
+		w.Write([]byte("cd"))
+		w.Write([]byte("ef"))
+		w.Flush()
+		w.Write([]byte("gh"))
+	}))
+	r := &flushResponder{}
+	h.ServeWeb(&Request{Responder: r})
+	if len(r.flushes) != 2 || r.flushes[0] != 4 || r.flushes[1] != 6 {
+		t.Errorf("flushes = %v, expected [4 6]", r.flushes)
+	}
+}
+
+func TestAutoFlushInterval(t *testing.T) {
+	h := AutoFlush(0, 1e6)(HandlerFunc(func(req *Request) {
+		w := req.Respond(StatusOK)
+		w.Write([]byte("ab"))
+		time.Sleep(50e6)
+	}))
+	r := &flushResponder{}
+	h.ServeWeb(&Request{Responder: r})
+	if len(r.flushes) != 1 || r.flushes[0] != 2 {
+		t.Errorf("flushes = %v, expected [2]", r.flushes)
+	}
+}
+
+func TestAutoFlushPanic(t *testing.T) {
+	h := AutoFlush(0, 10e6)(HandlerFunc(func(req *Request) {
+		w := req.Respond(StatusOK)
+		w.Write([]byte("ab"))
+		panic("test")
+	}))
+	r := &flushResponder{}
+	func() {
+		defer func() {
+			recover()
+		}()
+		h.ServeWeb(&Request{Responder: r})
+	}()
+	time.Sleep(50e6)
+	if len(r.flushes) != 0 {
+		t.Errorf("flushes = %v, expected none after panic", r.flushes)
+	}
+}
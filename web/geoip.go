@@ -0,0 +1,139 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// GeoLocation is the location of a client.
+type GeoLocation struct {
+	// Country is the ISO 3166-1 alpha-2 country code in upper case.
+	Country string
+
+	// Region is the country specific region code.
+	Region string
+}
+
+// GeoResolver is the interface to a GeoIP database. Applications adapt their
+// GeoIP database of choice to this interface.
+type GeoResolver interface {
+	// Resolve returns the location of the IP address or nil if the location
+	// is not known.
+	Resolve(ip string) (*GeoLocation, os.Error)
+}
+
+// GeoResolverFunc is a type adapter to allow the use of ordinary functions as
+// GeoIP resolvers.
+type GeoResolverFunc func(ip string) (*GeoLocation, os.Error)
+
+// Resolve calls f(ip).
+func (f GeoResolverFunc) Resolve(ip string) (*GeoLocation, os.Error) { return f(ip) }
+
+const geoLocationKey = "web.geo"
+
+// GeoIP returns middleware that resolves the location of the client using
+// resolver and calls handler. Use RequestGeoLocation to get the location.
+// Resolver errors are logged and the request is handled with an unknown
+// location.
+func GeoIP(resolver GeoResolver) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			loc, err := resolver.Resolve(remoteHost(req))
+			if err != nil {
+				log.Stderr("twister: geoip", req.RemoteAddr, err)
+				loc = nil
+			}
+			if loc != nil {
+				if req.Env == nil {
+					req.Env = make(map[string]interface{})
+				}
+				req.Env[geoLocationKey] = loc
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+// RequestGeoLocation returns the location of the client set by the GeoIP
+// handler or nil if the location is not known.
+func RequestGeoLocation(req *Request) *GeoLocation {
+	loc, _ := req.Env[geoLocationKey].(*GeoLocation)
+	return loc
+}
+
+// requestCountry returns the country of the client or "" if not known.
+func requestCountry(req *Request) string {
+	if loc := RequestGeoLocation(req); loc != nil {
+		return strings.ToUpper(loc.Country)
+	}
+	return ""
+}
+
+// CountryRouter dispatches HTTP requests to a handler using the country of
+// the client. Install the router behind the GeoIP handler.
+type CountryRouter struct {
+	defaultHandler Handler
+	handlers       map[string]Handler
+}
+
+// NewCountryRouter allocates and initializes a new CountryRouter. Requests
+// from unregistered or unknown countries are dispatched to defaultHandler.
+func NewCountryRouter(defaultHandler Handler) *CountryRouter {
+	if defaultHandler == nil {
+		defaultHandler = NotFoundHandler()
+	}
+	return &CountryRouter{defaultHandler: defaultHandler, handlers: make(map[string]Handler)}
+}
+
+// Register a handler for the given ISO 3166-1 alpha-2 country codes.
+func (router *CountryRouter) Register(handler Handler, countries ...string) *CountryRouter {
+	for _, country := range countries {
+		router.handlers[strings.ToUpper(country)] = handler
+	}
+	return router
+}
+
+// ServeWeb dispatches the request to a registered handler.
+func (router *CountryRouter) ServeWeb(req *Request) {
+	if handler, found := router.handlers[requestCountry(req)]; found {
+		handler.ServeWeb(req)
+		return
+	}
+	router.defaultHandler.ServeWeb(req)
+}
+
+// BlockCountries returns middleware that responds with HTTP status 403 to
+// requests from the given countries and calls handler for other requests.
+// Requests from unknown countries are allowed. Install the handler behind the
+// GeoIP handler.
+func BlockCountries(countries ...string) Middleware {
+	blocked := make(map[string]bool)
+	for _, country := range countries {
+		blocked[strings.ToUpper(country)] = true
+	}
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			if blocked[requestCountry(req)] {
+				req.Error(StatusForbidden, NewError(StatusForbidden, "access denied", "country", requestCountry(req)))
+				return
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"os"
+	"testing"
+)
+
+var testGeoResolver = GeoResolverFunc(func(ip string) (*GeoLocation, os.Error) {
+	switch ip {
+	case "10.0.0.1":
+		return &GeoLocation{Country: "US", Region: "CA"}, nil
+	case "10.0.0.2":
+		return &GeoLocation{Country: "fr"}, nil
+	case "10.0.0.3":
+		return nil, os.NewError("lookup failed")
+	}
+	return nil, nil
+})
+
+type geoIPTest struct {
+	addr   string
+	status int
+	body   string
+}
+
+var geoIPTests = []geoIPTest{
+	geoIPTest{"10.0.0.1:1234", StatusOK, "us"},
+	geoIPTest{"10.0.0.2:1234", StatusForbidden, ""},
+	geoIPTest{"10.0.0.3:1234", StatusOK, "default"},
+	geoIPTest{"10.0.0.4:1234", StatusOK, "default"},
+}
+
+func TestGeoIP(t *testing.T) {
+	text := func(s string) Handler {
+		return HandlerFunc(func(req *Request) {
+			w := req.Respond(StatusOK)
+			w.Write([]byte(s))
+		})
+	}
+	router := NewCountryRouter(text("default")).Register(text("us"), "us")
+	h := Chain(GeoIP(testGeoResolver), BlockCountries("FR"))(router)
+	for _, tt := range geoIPTests {
+		r := &testResponder{}
+		h.ServeWeb(&Request{RemoteAddr: tt.addr, Responder: r, ErrorHandler: defaultErrorHandler})
+		if r.status != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.addr, r.status, tt.status)
+			continue
+		}
+		if tt.status == StatusOK && r.body.String() != tt.body {
+			t.Errorf("%s: body %q, expected %q", tt.addr, r.body.String(), tt.body)
+		}
+	}
+}
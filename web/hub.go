@@ -0,0 +1,195 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"sync"
+)
+
+// DefaultHubQueueSize is the default size of the send queue for connections
+// registered with a hub.
+const DefaultHubQueueSize = 64
+
+// HubConn is a connection managed by a hub. WebSocketConn and StreamConn
+// implement HubConn.
+type HubConn interface {
+	// Send sends a message to the peer.
+	Send(p []byte) os.Error
+
+	// Close closes the connection.
+	Close() os.Error
+
+	// EnableSendQueue enables a send queue with room for size messages and
+	// the given policy for a full queue.
+	EnableSendQueue(size int, policy int)
+}
+
+// Hub broadcasts messages to a set of connections. Connections
+// can subscribe to topics to receive the messages published to the topic.
+// The methods of a hub can be called from multiple goroutines.
+//
+// The hub enables the send queue on registered connections so that a slow
+// peer does not delay delivery to other peers. Connections that fail are
+// closed and unregistered.
+type Hub struct {
+	// Size of the send queue for registered connections.
+	QueueSize int
+
+	// Policy for a full send queue, SendQueueDrop or SendQueueClose.
+	QueuePolicy int
+
+	once     sync.Once
+	requests chan hubRequest
+}
+
+const (
+	hubRegister = iota
+	hubUnregister
+	hubSubscribe
+	hubUnsubscribe
+	hubBroadcast
+	hubPublish
+)
+
+type hubRequest struct {
+	op      int
+	conn    HubConn
+	topic   string
+	message []byte
+}
+
+// NewHub returns a new hub with the default queue size and the drop policy.
+func NewHub() *Hub {
+	return &Hub{QueueSize: DefaultHubQueueSize, QueuePolicy: SendQueueDrop}
+}
+
+func (h *Hub) send(r hubRequest) {
+	h.once.Do(func() {
+		h.requests = make(chan hubRequest)
+		go h.run()
+	})
+	h.requests <- r
+}
+
+// Register adds the connection to the hub.
+func (h *Hub) Register(conn HubConn) {
+	size := h.QueueSize
+	if size <= 0 {
+		size = DefaultHubQueueSize
+	}
+	conn.EnableSendQueue(size, h.QueuePolicy)
+	h.send(hubRequest{op: hubRegister, conn: conn})
+}
+
+// Unregister removes the connection and the connection's subscriptions from
+// the hub. Unregister does not close the connection.
+func (h *Hub) Unregister(conn HubConn) {
+	h.send(hubRequest{op: hubUnregister, conn: conn})
+}
+
+// Subscribe subscribes the connection to the topic. The connection is
+// registered if it is not already registered.
+func (h *Hub) Subscribe(conn HubConn, topic string) {
+	h.Register(conn)
+	h.send(hubRequest{op: hubSubscribe, conn: conn, topic: topic})
+}
+
+// Unsubscribe unsubscribes the connection from the topic.
+func (h *Hub) Unsubscribe(conn HubConn, topic string) {
+	h.send(hubRequest{op: hubUnsubscribe, conn: conn, topic: topic})
+}
+
+func copyMessage(p []byte) []byte {
+	q := make([]byte, len(p))
+	copy(q, p)
+	return q
+}
+
+// Broadcast sends the message to all registered connections.
+func (h *Hub) Broadcast(p []byte) {
+	h.send(hubRequest{op: hubBroadcast, message: copyMessage(p)})
+}
+
+// Publish sends the message to the connections subscribed to the topic.
+func (h *Hub) Publish(topic string, p []byte) {
+	h.send(hubRequest{op: hubPublish, topic: topic, message: copyMessage(p)})
+}
+
+func (h *Hub) run() {
+	// conns maps registered connections to their subscribed topics.
+	conns := make(map[HubConn]map[string]bool)
+	// topics maps topics to the subscribed connections.
+	topics := make(map[string]map[HubConn]bool)
+
+	unregister := func(conn HubConn) {
+		for topic, _ := range conns[conn] {
+			subscribers := topics[topic]
+			subscribers[conn] = false, false
+			if len(subscribers) == 0 {
+				topics[topic] = nil, false
+			}
+		}
+		conns[conn] = nil, false
+	}
+
+	deliver := func(conn HubConn, p []byte) {
+		err := conn.Send(p)
+		if err == nil || (err == ErrSendQueueFull && h.QueuePolicy == SendQueueDrop) {
+			return
+		}
+		conn.Close()
+		unregister(conn)
+	}
+
+	for r := range h.requests {
+		switch r.op {
+		case hubRegister:
+			if _, found := conns[r.conn]; !found {
+				conns[r.conn] = make(map[string]bool)
+			}
+		case hubUnregister:
+			unregister(r.conn)
+		case hubSubscribe:
+			if subscriptions, found := conns[r.conn]; found {
+				subscriptions[r.topic] = true
+				subscribers := topics[r.topic]
+				if subscribers == nil {
+					subscribers = make(map[HubConn]bool)
+					topics[r.topic] = subscribers
+				}
+				subscribers[r.conn] = true
+			}
+		case hubUnsubscribe:
+			if subscriptions, found := conns[r.conn]; found {
+				subscriptions[r.topic] = false, false
+				if subscribers := topics[r.topic]; subscribers != nil {
+					subscribers[r.conn] = false, false
+					if len(subscribers) == 0 {
+						topics[r.topic] = nil, false
+					}
+				}
+			}
+		case hubBroadcast:
+			for conn, _ := range conns {
+				deliver(conn, r.message)
+			}
+		case hubPublish:
+			for conn, _ := range topics[r.topic] {
+				deliver(conn, r.message)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// testHubConn records the messages sent to the connection.
+type testHubConn struct {
+	name     string
+	messages []string
+	err      os.Error
+	closed   bool
+	size     int
+}
+
+func (c *testHubConn) Send(p []byte) os.Error {
+	if c.err != nil {
+		return c.err
+	}
+	n := len(c.messages)
+	messages := make([]string, n+1)
+	copy(messages, c.messages)
+	messages[n] = string(p)
+	c.messages = messages
+	return nil
+}
+
+func (c *testHubConn) Close() os.Error {
+	c.closed = true
+	return nil
+}
+
+func (c *testHubConn) EnableSendQueue(size int, policy int) {
+	c.size = size
+}
+
+func (c *testHubConn) String() string {
+	return c.name + ":" + strings.Join(c.messages, ",")
+}
+
+// syncHub waits for the hub to process all previous requests. The hub's run
+// loop receives a request only after the previous request is processed.
+func syncHub(h *Hub) {
+	h.send(hubRequest{op: -1})
+}
+
+func TestHubRegister(t *testing.T) {
+	h := NewHub()
+	a := &testHubConn{name: "a"}
+	b := &testHubConn{name: "b"}
+	h.Register(a)
+	h.Register(b)
+	h.Register(a)
+	h.Broadcast([]byte("1"))
+	h.Unregister(b)
+	h.Broadcast([]byte("2"))
+	syncHub(h)
+	if s := a.String(); s != "a:1,2" {
+		t.Errorf("a = %s, expected a:1,2", s)
+	}
+	if s := b.String(); s != "b:1" {
+		t.Errorf("b = %s, expected b:1", s)
+	}
+	if a.size != DefaultHubQueueSize || a.closed || b.closed {
+		t.Errorf("size = %d, closed = %v, %v, expected queue enabled and connections open", a.size, a.closed, b.closed)
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	h := NewHub()
+	a := &testHubConn{name: "a"}
+	b := &testHubConn{name: "b"}
+	c := &testHubConn{name: "c"}
+	h.Subscribe(a, "x")
+	h.Subscribe(b, "x")
+	h.Subscribe(b, "y")
+	h.Register(c)
+	h.Publish("x", []byte("1"))
+	h.Publish("y", []byte("2"))
+	h.Publish("z", []byte("3"))
+	h.Unsubscribe(b, "x")
+	h.Publish("x", []byte("4"))
+	h.Unregister(b)
+	h.Publish("y", []byte("5"))
+	syncHub(h)
+	for _, conn := range []*testHubConn{a, b, c} {
+		expected := map[string]string{"a": "a:1,4", "b": "b:1,2", "c": "c:"}[conn.name]
+		if s := conn.String(); s != expected {
+			t.Errorf("%s = %s, expected %s", conn.name, s, expected)
+		}
+	}
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	for _, policy := range []int{SendQueueDrop, SendQueueClose} {
+		h := &Hub{QueuePolicy: policy}
+		slow := &testHubConn{name: "slow", err: ErrSendQueueFull}
+		fast := &testHubConn{name: "fast"}
+		h.Subscribe(slow, "x")
+		h.Subscribe(fast, "x")
+		h.Publish("x", []byte("1"))
+		syncHub(h)
+		slow.err = nil
+		h.Publish("x", []byte("2"))
+		syncHub(h)
+		if s := fast.String(); s != "fast:1,2" {
+			t.Errorf("policy %d: fast = %s, expected fast:1,2", policy, s)
+		}
+		expected := "slow:2"
+		if policy == SendQueueClose {
+			expected = "slow:"
+		}
+		if s := slow.String(); s != expected || slow.closed != (policy == SendQueueClose) {
+			t.Errorf("policy %d: slow = %s, closed = %v, expected %s", policy, s, slow.closed, expected)
+		}
+	}
+
+	// Connections that fail with other errors are removed for either policy.
+	h := NewHub()
+	failed := &testHubConn{name: "failed", err: os.EPIPE}
+	h.Register(failed)
+	h.Broadcast([]byte("1"))
+	syncHub(h)
+	failed.err = nil
+	h.Broadcast([]byte("2"))
+	syncHub(h)
+	if s := failed.String(); s != "failed:" || !failed.closed {
+		t.Errorf("failed = %s, closed = %v, expected removed and closed", s, failed.closed)
+	}
+}
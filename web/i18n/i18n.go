@@ -0,0 +1,290 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The i18n package implements message catalogs for translating application
+// text.
+//
+// A catalog holds the messages for each locale. Load the messages from a
+// directory of JSON files named by locale:
+//
+//  c := i18n.NewCatalog("en")
+//  if err := c.LoadDir("messages"); err != nil {
+//      log.Exit(err)
+//  }
+//
+// where messages/fr.json contains:
+//
+//  {
+//      "greeting": "Bonjour %s",
+//      "items": ["%d article", "%d articles"]
+//  }
+//
+// A message is a format for fmt.Sprintf or an array of plural forms. Use the
+// web.SelectLocale middleware to select the locale for a request and T to
+// translate text for the request's locale:
+//
+//  t := c.T(req)
+//  t("greeting", name)
+package i18n
+
+import (
+	"fmt"
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PluralRules maps primary language subtags to functions that return the
+// index of the plural form for a count. Languages not in the map use the
+// rule for English.
+var PluralRules = map[string]func(n int) int{
+	"en": pluralOne,
+	"de": pluralOne,
+	"es": pluralOne,
+	"it": pluralOne,
+	"nl": pluralOne,
+	"pt": pluralOne,
+	"fr": func(n int) int {
+		if n > 1 {
+			return 1
+		}
+		return 0
+	},
+	"ja": pluralNone,
+	"ko": pluralNone,
+	"zh": pluralNone,
+	"ru": pluralSlavic,
+	"uk": pluralSlavic,
+	"pl": func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+			return 1
+		}
+		return 2
+	},
+}
+
+func pluralOne(n int) int {
+	if n != 1 {
+		return 1
+	}
+	return 0
+}
+
+func pluralNone(n int) int {
+	return 0
+}
+
+func pluralSlavic(n int) int {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return 0
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+		return 1
+	}
+	return 2
+}
+
+// primaryLanguage returns the lowercase primary language subtag of locale.
+func primaryLanguage(locale string) string {
+	for i := 0; i < len(locale); i++ {
+		if locale[i] == '-' || locale[i] == '_' {
+			locale = locale[0:i]
+			break
+		}
+	}
+	return strings.ToLower(locale)
+}
+
+// Catalog holds translated messages for a set of locales.
+type Catalog struct {
+	fallback string
+
+	mu       sync.RWMutex
+	messages map[string]map[string][]string
+}
+
+// NewCatalog returns an empty catalog. Messages missing from a locale are
+// taken from the fallback locale.
+func NewCatalog(fallback string) *Catalog {
+	return &Catalog{fallback: fallback, messages: make(map[string]map[string][]string)}
+}
+
+// Add adds the message with the given key to the locale. A message has one
+// form or a form for each plural category of the locale's language.
+func (c *Catalog) Add(locale string, key string, forms ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.messages[locale]
+	if m == nil {
+		m = make(map[string][]string)
+		c.messages[locale] = m
+	}
+	m[key] = forms
+}
+
+// LoadFile adds the messages in the named JSON file to the locale. The file
+// contains an object mapping keys to a string or an array of plural forms.
+func (c *Catalog) LoadFile(locale string, fname string) os.Error {
+	p, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return os.NewError("i18n: " + fname + ": " + err.String())
+	}
+	for key, value := range v {
+		switch value := value.(type) {
+		case string:
+			c.Add(locale, key, value)
+		case []interface{}:
+			forms := make([]string, len(value))
+			for i, form := range value {
+				s, ok := form.(string)
+				if !ok {
+					return os.NewError("i18n: " + fname + ": bad plural form for " + key)
+				}
+				forms[i] = s
+			}
+			c.Add(locale, key, forms...)
+		default:
+			return os.NewError("i18n: " + fname + ": bad message for " + key)
+		}
+	}
+	return nil
+}
+
+// LoadDir loads the files with the extension ".json" in the named directory.
+// The locale is the file name without the extension.
+func (c *Catalog) LoadDir(dir string) os.Error {
+	f, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsRegular() || path.Ext(info.Name) != ".json" {
+			continue
+		}
+		locale := info.Name[0 : len(info.Name)-len(".json")]
+		if err := c.LoadFile(locale, path.Join(dir, info.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the forms of the message for the key and the locale where
+// the message was found. The message is taken from the locale, the primary
+// language of the locale and the fallback locale in that order.
+func (c *Catalog) lookup(locale string, key string) ([]string, string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, l := range [...]string{locale, primaryLanguage(locale), c.fallback} {
+		if forms, found := c.messages[l][key]; found && len(forms) > 0 {
+			return forms, l, true
+		}
+	}
+	return nil, "", false
+}
+
+// missing returns the text for a key that is not in the catalog. In
+// development mode, the key is marked so that missing translations are easy
+// to find.
+func missing(key string) string {
+	if web.Development() {
+		return "!" + key + "!"
+	}
+	return key
+}
+
+func format(s string, args []interface{}) string {
+	if len(args) == 0 {
+		return s
+	}
+	return fmt.Sprintf(s, args...)
+}
+
+// Translate returns the message for the key in the locale formatted with
+// args. If the key is not in the catalog, then the key is returned.
+func (c *Catalog) Translate(locale string, key string, args ...interface{}) string {
+	forms, _, found := c.lookup(locale, key)
+	if !found {
+		return missing(key)
+	}
+	return format(forms[0], args)
+}
+
+// TranslatePlural returns the plural form of the message for the count n in
+// the locale formatted with args. The plural form is selected using the rule
+// for the language of the message. A message taken from the fallback locale
+// uses the fallback locale's rule.
+func (c *Catalog) TranslatePlural(locale string, key string, n int, args ...interface{}) string {
+	forms, l, found := c.lookup(locale, key)
+	if !found {
+		return missing(key)
+	}
+	rule := PluralRules[primaryLanguage(l)]
+	if rule == nil {
+		rule = pluralOne
+	}
+	i := rule(n)
+	if i >= len(forms) {
+		i = len(forms) - 1
+	}
+	return format(forms[i], args)
+}
+
+// T returns a function that translates messages for the locale selected by
+// web.SelectLocale. If the first argument is an int, then the argument is
+// used as the count to select the plural form.
+func (c *Catalog) T(req *web.Request) func(key string, args ...interface{}) string {
+	locale := web.RequestLocale(req)
+	return func(key string, args ...interface{}) string {
+		if len(args) > 0 {
+			if n, ok := args[0].(int); ok {
+				return c.TranslatePlural(locale, key, n, args...)
+			}
+		}
+		return c.Translate(locale, key, args...)
+	}
+}
+
+// Messages returns a map from key to the first form of each message
+// available in the locale. Pass the map to templates as template data to
+// translate text in templates.
+func (c *Catalog) Messages(locale string) map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]string)
+	for _, l := range [...]string{c.fallback, primaryLanguage(locale), locale} {
+		for key, forms := range c.messages[l] {
+			if len(forms) > 0 {
+				result[key] = forms[0]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package i18n
+
+import (
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type translateTest struct {
+	locale   string
+	key      string
+	n        int
+	expected string
+}
+
+var translateTests = []translateTest{
+	translateTest{"fr", "greeting", -1, "Bonjour Gopher"},
+	translateTest{"fr-CA", "greeting", -1, "Bonjour Gopher"},
+	translateTest{"de", "greeting", -1, "Hello Gopher"},
+	translateTest{"fr", "welcome", -1, "Welcome Gopher"},
+	translateTest{"en", "items", 1, "1 item"},
+	translateTest{"en", "items", 0, "0 items"},
+	translateTest{"fr", "items", 0, "0 article"},
+	translateTest{"fr", "items", 2, "2 articles"},
+	translateTest{"ru", "files", 1, "1 файл"},
+	translateTest{"ru", "files", 3, "3 файла"},
+	translateTest{"ru", "files", 11, "11 файлов"},
+	translateTest{"ru", "files", 21, "21 файл"},
+	translateTest{"ja", "items", 2, "2 items"},
+	translateTest{"ru", "items", 21, "21 items"},
+}
+
+func newTestCatalog(t *testing.T) *Catalog {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	dir = dir + "/twister-i18n-test-" + strconv.Itoa64(time.Nanoseconds())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"en.json": `{"greeting": "Hello %s", "welcome": "Welcome %s", "items": ["%d item", "%d items"]}`,
+		"fr.json": `{"greeting": "Bonjour %s", "items": ["%d article", "%d articles"]}`,
+		"ru.json": `{"files": ["%d файл", "%d файла", "%d файлов"]}`,
+		"README":  `not a catalog`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCatalog("en")
+	if err := c.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTranslate(t *testing.T) {
+	c := newTestCatalog(t)
+	for _, tt := range translateTests {
+		var actual string
+		if tt.n < 0 {
+			actual = c.Translate(tt.locale, tt.key, "Gopher")
+		} else {
+			actual = c.TranslatePlural(tt.locale, tt.key, tt.n, tt.n)
+		}
+		if actual != tt.expected {
+			t.Errorf("%s %s %d = %q, expected %q", tt.locale, tt.key, tt.n, actual, tt.expected)
+		}
+	}
+}
+
+func TestT(t *testing.T) {
+	c := newTestCatalog(t)
+	web.SelectLocale("en", "fr")(web.HandlerFunc(func(req *web.Request) {
+		tr := c.T(req)
+		if s := tr("items", 2); s != "2 articles" {
+			t.Errorf("items = %q, expected %q", s, "2 articles")
+		}
+		if s := tr("greeting", "Gopher"); s != "Bonjour Gopher" {
+			t.Errorf("greeting = %q, expected %q", s, "Bonjour Gopher")
+		}
+	})).ServeWeb(&web.Request{
+		Header: web.NewStringsMap(web.HeaderAcceptLanguage, "fr"),
+		Param:  web.NewStringsMap(),
+		Cookie: web.NewStringsMap(),
+		Env:    make(map[string]interface{}),
+	})
+	m := c.Messages("fr")
+	if m["greeting"] != "Bonjour %s" || m["welcome"] != "Welcome %s" {
+		t.Errorf("Messages(fr) = %v", m)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	c := NewCatalog("en")
+	defer web.SetRunMode(web.RunMode())
+	web.SetRunMode(web.RunModeProduction)
+	if s := c.Translate("fr", "missing"); s != "missing" {
+		t.Errorf("production missing = %q, expected %q", s, "missing")
+	}
+	web.SetRunMode(web.RunModeDevelopment)
+	if s := c.Translate("fr", "missing"); s != "!missing!" {
+		t.Errorf("development missing = %q, expected %q", s, "!missing!")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errIPDenied os.Error = &Error{Status: StatusForbidden, Message: "access denied"}
+
+// ipNet is an IP network in 16 byte form.
+type ipNet struct {
+	ip   net.IP
+	mask []byte
+}
+
+func (n *ipNet) contains(ip net.IP) bool {
+	for i := 0; i < net.IPv6len; i++ {
+		if ip[i]&n.mask[i] != n.ip[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCIDR parses an IP address or network in CIDR notation such as
+// "192.168.0.0/16" or "2001:db8::/32".
+func parseCIDR(s string) (*ipNet, os.Error) {
+	addr, bits := s, -1
+	if i := strings.Index(s, "/"); i >= 0 {
+		var err os.Error
+		addr = s[0:i]
+		bits, err = strconv.Atoi(s[i+1:])
+		if err != nil {
+			return nil, os.NewError("bad CIDR " + s)
+		}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, os.NewError("bad IP address " + s)
+	}
+	ip = ip.To16()
+	maxBits := 8 * net.IPv6len
+	if strings.Index(addr, ":") < 0 {
+		// IPv4 addresses are stored in the IPv4-in-IPv6 form.
+		maxBits = 8 * net.IPv4len
+	}
+	if bits < 0 {
+		bits = maxBits
+	}
+	if bits > maxBits {
+		return nil, os.NewError("bad CIDR " + s)
+	}
+	bits += 8*net.IPv6len - maxBits
+	mask := make([]byte, net.IPv6len)
+	for i := 0; i < net.IPv6len; i++ {
+		switch {
+		case bits >= 8:
+			mask[i] = 0xff
+			bits -= 8
+		case bits > 0:
+			mask[i] = byte(0xff << uint(8-bits))
+			bits = 0
+		}
+	}
+	n := &ipNet{ip: make(net.IP, net.IPv6len), mask: mask}
+	for i := 0; i < net.IPv6len; i++ {
+		n.ip[i] = ip[i] & mask[i]
+	}
+	return n, nil
+}
+
+// IPList is a list of IP networks. The list can be updated while the server
+// is running.
+type IPList struct {
+	mu   sync.RWMutex
+	nets []*ipNet
+}
+
+// NewIPList returns a list of the given IP addresses and networks in CIDR
+// notation.
+func NewIPList(cidrs ...string) (*IPList, os.Error) {
+	l := &IPList{}
+	if err := l.Set(cidrs...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Set replaces the networks in the list.
+func (l *IPList) Set(cidrs ...string) os.Error {
+	nets := make([]*ipNet, len(cidrs))
+	for i, cidr := range cidrs {
+		n, err := parseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		nets[i] = n
+	}
+	l.mu.Lock()
+	l.nets = nets
+	l.mu.Unlock()
+	return nil
+}
+
+// Add adds a network to the list.
+func (l *IPList) Add(cidr string) os.Error {
+	n, err := parseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nets := make([]*ipNet, len(l.nets)+1)
+	copy(nets, l.nets)
+	nets[len(l.nets)] = n
+	l.nets = nets
+	return nil
+}
+
+// Len returns the number of networks in the list.
+func (l *IPList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.nets)
+}
+
+// Contains returns true if the IP address s is in a network in the list.
+func (l *IPList) Contains(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, n := range l.nets {
+		if n.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter restricts access by the client's IP address.
+type IPFilter struct {
+	// Requests from addresses in Deny are rejected.
+	Deny *IPList
+
+	// If Allow is not nil, then requests from addresses not in Allow are
+	// rejected.
+	Allow *IPList
+}
+
+// Allowed returns true if the IP address s is allowed.
+func (f *IPFilter) Allowed(s string) bool {
+	if f.Deny != nil && f.Deny.Contains(s) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow.Contains(s) {
+		return false
+	}
+	return true
+}
+
+// Handler returns a handler that rejects requests from addresses that are
+// not allowed with HTTP status 403 and calls handler for other requests.
+// Install the handler behind RealIP when the server is behind a proxy.
+func (f *IPFilter) Handler(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		if !f.Allowed(remoteHost(req)) {
+			req.Error(StatusForbidden, errIPDenied)
+			return
+		}
+		handler.ServeWeb(req)
+	})
+}
+
+// RealIP returns middleware that sets the request's RemoteAddr to the client
+// address in the X-Forwarded-For header when the request is received from a
+// trusted proxy. Addresses added to the header by trusted proxies are
+// skipped.
+func RealIP(trusted *IPList) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			if trusted.Contains(remoteHost(req)) {
+				// Join the header lines before walking the list from the
+				// right. Proxies can append a line instead of extending
+				// the last one.
+				addrs := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",", -1)
+				for i := len(addrs) - 1; i >= 0; i-- {
+					addr := strings.TrimSpace(addrs[i])
+					if net.ParseIP(addr) == nil {
+						break
+					}
+					req.RemoteAddr = addr
+					if !trusted.Contains(addr) {
+						break
+					}
+				}
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+type ipListTest struct {
+	cidr     string
+	ip       string
+	expected bool
+}
+
+var ipListTests = []ipListTest{
+	ipListTest{"10.0.0.0/8", "10.1.2.3", true},
+	ipListTest{"10.0.0.0/8", "11.1.2.3", false},
+	ipListTest{"192.168.1.0/25", "192.168.1.127", true},
+	ipListTest{"192.168.1.0/25", "192.168.1.128", false},
+	ipListTest{"192.168.1.5", "192.168.1.5", true},
+	ipListTest{"192.168.1.5", "192.168.1.6", false},
+	ipListTest{"0.0.0.0/0", "1.2.3.4", true},
+	ipListTest{"0.0.0.0/0", "::1", false},
+	ipListTest{"2001:db8::/32", "2001:db8:1::1", true},
+	ipListTest{"2001:db8::/32", "2001:db9::1", false},
+	ipListTest{"10.0.0.0/8", "bogus", false},
+}
+
+func TestIPList(t *testing.T) {
+	for _, tt := range ipListTests {
+		l, err := NewIPList(tt.cidr)
+		if err != nil {
+			t.Errorf("NewIPList(%q) returned %v", tt.cidr, err)
+			continue
+		}
+		if actual := l.Contains(tt.ip); actual != tt.expected {
+			t.Errorf("%s contains %s = %v, expected %v", tt.cidr, tt.ip, actual, tt.expected)
+		}
+	}
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0/8", "10.0.0.0/x"} {
+		if _, err := NewIPList(cidr); err == nil {
+			t.Errorf("NewIPList(%q) did not return error", cidr)
+		}
+	}
+}
+
+type ipFilterTest struct {
+	addr   string
+	status int
+}
+
+var ipFilterTests = []ipFilterTest{
+	ipFilterTest{"10.0.0.1:1234", StatusOK},
+	ipFilterTest{"10.0.0.13:1234", StatusForbidden},
+	ipFilterTest{"192.168.0.1:1234", StatusForbidden},
+}
+
+func TestIPFilter(t *testing.T) {
+	allow, _ := NewIPList("10.0.0.0/8")
+	deny, _ := NewIPList("10.0.0.13")
+	f := &IPFilter{Allow: allow, Deny: deny}
+	h := f.Handler(HandlerFunc(func(req *Request) { req.Respond(StatusOK) }))
+	for _, tt := range ipFilterTests {
+		r := &testResponder{}
+		h.ServeWeb(&Request{RemoteAddr: tt.addr, Responder: r, ErrorHandler: defaultErrorHandler})
+		if r.status != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.addr, r.status, tt.status)
+		}
+	}
+	deny.Set()
+	if !f.Allowed("10.0.0.13") {
+		t.Errorf("address denied after update")
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, _ := NewIPList("127.0.0.1", "10.0.0.0/8")
+	var addr string
+	h := RealIP(trusted)(HandlerFunc(func(req *Request) { addr = remoteHost(req) }))
+	h.ServeWeb(&Request{RemoteAddr: "127.0.0.1:1234", Header: NewStringsMap("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.2")})
+	if addr != "5.6.7.8" {
+		t.Errorf("trusted proxy, addr = %q, expected 5.6.7.8", addr)
+	}
+	h.ServeWeb(&Request{RemoteAddr: "8.8.8.8:1234", Header: NewStringsMap("X-Forwarded-For", "1.2.3.4")})
+	if addr != "8.8.8.8" {
+		t.Errorf("untrusted proxy, addr = %q, expected 8.8.8.8", addr)
+	}
+	header := NewStringsMap("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	header.Append("X-Forwarded-For", "10.0.0.2")
+	h.ServeWeb(&Request{RemoteAddr: "127.0.0.1:1234", Header: header})
+	if addr != "5.6.7.8" {
+		t.Errorf("multiple header lines, addr = %q, expected 5.6.7.8", addr)
+	}
+}
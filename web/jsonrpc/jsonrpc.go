@@ -0,0 +1,279 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The jsonrpc package implements JSON-RPC 1.0 and 2.0 services over HTTP POST
+// requests and WebSocket connections.
+//
+// Register functions with a Server and use the server as a handler:
+//
+//  s := jsonrpc.NewServer().
+//      Register("echo", func(req *web.Request, params interface{}) (interface{}, os.Error) {
+//          return params, nil
+//      })
+//  router.Register("/rpc", "POST", s)
+//
+// Call ServeWebSocket from a handler to serve calls over a WebSocket
+// connection.
+//
+// A request body or WebSocket message contains a single call or, in JSON-RPC
+// 2.0, a batch of calls encoded as a JSON array. The server responds to
+// calls with an id and does not respond to notifications.
+package jsonrpc
+
+import (
+	"github.com/garyburd/twister/web"
+	"json"
+	"os"
+	"sync"
+)
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+)
+
+// DefaultMaxRequestLen is the default maximum length of a POST request body.
+const DefaultMaxRequestLen = 1 << 20
+
+// Error is the error object returned to the client. Functions return an
+// *Error to set the code and data of the error object. Other errors are
+// returned to the client with code InternalError and the error string as the
+// message.
+type Error struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func (e *Error) String() string {
+	return e.Message
+}
+
+var (
+	errParse          = &Error{Code: ParseError, Message: "parse error"}
+	errInvalidRequest = &Error{Code: InvalidRequest, Message: "invalid request"}
+	errMethodNotFound = &Error{Code: MethodNotFound, Message: "method not found"}
+	errInvalidParams  = &Error{Code: InvalidParams, Message: "invalid params"}
+)
+
+// Func is the type of a JSON-RPC method. The params argument is the decoded
+// params member of the call: a []interface{} for positional params, a
+// map[string]interface{} for named params or nil if the call does not have
+// params. The result is encoded with json.Marshal.
+type Func func(req *web.Request, params interface{}) (result interface{}, err os.Error)
+
+// Server dispatches JSON-RPC calls to registered functions.
+type Server struct {
+	// MaxRequestLen is the maximum length of a POST request body. The
+	// default value is used if the value is zero. The maximum length of a
+	// WebSocket message is set on the connection.
+	MaxRequestLen int
+
+	mu      sync.RWMutex
+	methods map[string]Func
+}
+
+// NewServer returns a new server with no methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]Func)}
+}
+
+// Register registers f as the method with the given name. Register returns
+// the server to allow chaining.
+func (s *Server) Register(name string, f Func) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[name] = f
+	return s
+}
+
+func (s *Server) method(name string) Func {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.methods[name]
+}
+
+// errorObject returns the JSON-RPC error object for err.
+func errorObject(err os.Error) map[string]interface{} {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: InternalError, Message: err.String()}
+	}
+	obj := map[string]interface{}{"code": e.Code, "message": e.Message}
+	if e.Data != nil {
+		obj["data"] = e.Data
+	}
+	return obj
+}
+
+// response returns the response object for a call. JSON-RPC 2.0 responses
+// have the "jsonrpc" member and one of the "result" or "error" members.
+// JSON-RPC 1.0 responses have both the "result" and "error" members.
+func response(version2 bool, id interface{}, result interface{}, err os.Error) map[string]interface{} {
+	r := map[string]interface{}{"id": id}
+	if version2 {
+		r["jsonrpc"] = "2.0"
+		if err != nil {
+			r["error"] = errorObject(err)
+		} else {
+			r["result"] = result
+		}
+	} else {
+		if err != nil {
+			r["result"] = nil
+			r["error"] = errorObject(err)
+		} else {
+			r["result"] = result
+			r["error"] = nil
+		}
+	}
+	return r
+}
+
+// call invokes the method for the decoded call v and returns the response
+// object or nil if the call is a notification.
+func (s *Server) call(req *web.Request, v interface{}) map[string]interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return response(true, nil, nil, errInvalidRequest)
+	}
+	version2 := m["jsonrpc"] == "2.0"
+	id, hasId := m["id"]
+	name, ok := m["method"].(string)
+	if !ok {
+		return response(version2, id, nil, errInvalidRequest)
+	}
+	var result interface{}
+	var err os.Error
+	switch params := m["params"].(type) {
+	case nil, []interface{}, map[string]interface{}:
+		if f := s.method(name); f == nil {
+			err = errMethodNotFound
+		} else {
+			result, err = f(req, params)
+		}
+	default:
+		err = errInvalidParams
+	}
+	// JSON-RPC 2.0 notifications do not have an id. JSON-RPC 1.0
+	// notifications have a null id.
+	if !hasId || (!version2 && id == nil) {
+		return nil
+	}
+	return response(version2, id, result, err)
+}
+
+// Call handles the single call or batch of calls encoded in p and returns
+// the encoded response. Call returns nil if there is no response because
+// the request contains notifications only.
+func (s *Server) Call(req *web.Request, p []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return encode(response(true, nil, nil, errParse))
+	}
+	batch, ok := v.([]interface{})
+	if !ok {
+		r := s.call(req, v)
+		if r == nil {
+			return nil
+		}
+		return encode(r)
+	}
+	if len(batch) == 0 {
+		return encode(response(true, nil, nil, errInvalidRequest))
+	}
+	responses := make([]interface{}, 0, len(batch))
+	for _, c := range batch {
+		if r := s.call(req, c); r != nil {
+			responses = responses[0 : len(responses)+1]
+			responses[len(responses)-1] = r
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return encode(responses)
+}
+
+// encode encodes v. If a result cannot be encoded, then encode returns an
+// internal error response.
+func encode(v interface{}) []byte {
+	p, err := json.Marshal(v)
+	if err != nil {
+		p, _ = json.Marshal(response(true, nil, nil, err))
+	}
+	return p
+}
+
+// ServeWeb handles a POST request containing a call or a batch of calls. The
+// server responds with status 204 if the request contains notifications
+// only.
+func (s *Server) ServeWeb(req *web.Request) {
+	if req.Method != "POST" {
+		req.Respond(web.StatusMethodNotAllowed, web.HeaderAllow, "POST")
+		return
+	}
+	maxLen := s.MaxRequestLen
+	if maxLen == 0 {
+		maxLen = DefaultMaxRequestLen
+	}
+	p, err := req.BodyBytes(maxLen)
+	if err != nil {
+		req.Error(web.ErrorStatus(err, web.StatusBadRequest), err)
+		return
+	}
+	p = s.Call(req, p)
+	if p == nil {
+		req.Respond(web.StatusNoContent)
+		return
+	}
+	req.RespondBytes(web.StatusOK, "application/json; charset=utf-8", p)
+}
+
+// ServeConn handles calls received on conn until the client closes the
+// connection or an error occurs. Each message contains a call or a batch of
+// calls. Calls are handled in the order received.
+func (s *Server) ServeConn(req *web.Request, conn *web.WebSocketConn) os.Error {
+	for {
+		p, err := conn.Receive()
+		if err == os.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p = s.Call(req, p); p != nil {
+			if err := conn.Send(p); err != nil {
+				return err
+			}
+		}
+	}
+	panic("not reached")
+}
+
+// ServeWebSocket upgrades the request to the WebSocket protocol and handles
+// calls on the connection with ServeConn.
+func (s *Server) ServeWebSocket(req *web.Request) {
+	conn, err := web.WebSocketUpgrade(req)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	defer conn.Close()
+	s.ServeConn(req, conn)
+}
@@ -0,0 +1,127 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package jsonrpc
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"github.com/garyburd/twister/web/webtest"
+	"json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newTestServer() *Server {
+	return NewServer().
+		Register("echo", func(req *web.Request, params interface{}) (interface{}, os.Error) {
+			return params, nil
+		}).
+		Register("fail", func(req *web.Request, params interface{}) (interface{}, os.Error) {
+			return nil, &Error{Code: 42, Message: "failed", Data: "data"}
+		}).
+		Register("error", func(req *web.Request, params interface{}) (interface{}, os.Error) {
+			return nil, os.NewError("broken")
+		})
+}
+
+type callTest struct {
+	request  string
+	response string
+}
+
+var callTests = []callTest{
+	callTest{`{"jsonrpc": "2.0", "method": "echo", "params": [1, "a"], "id": 1}`,
+		`{"jsonrpc": "2.0", "result": [1, "a"], "id": 1}`},
+	callTest{`{"jsonrpc": "2.0", "method": "echo", "params": {"a": 1}, "id": "x"}`,
+		`{"jsonrpc": "2.0", "result": {"a": 1}, "id": "x"}`},
+	callTest{`{"method": "echo", "params": [1], "id": 2}`,
+		`{"result": [1], "error": null, "id": 2}`},
+	callTest{`{"jsonrpc": "2.0", "method": "echo", "params": [1]}`, ``},
+	callTest{`{"method": "echo", "params": [1], "id": null}`, ``},
+	callTest{`{"jsonrpc": "2.0", "method": "missing", "id": 3}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "method not found"}, "id": 3}`},
+	callTest{`{"jsonrpc": "2.0", "method": "echo", "params": 1, "id": 4}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32602, "message": "invalid params"}, "id": 4}`},
+	callTest{`{"jsonrpc": "2.0", "method": "fail", "id": 5}`,
+		`{"jsonrpc": "2.0", "error": {"code": 42, "message": "failed", "data": "data"}, "id": 5}`},
+	callTest{`{"method": "error", "params": [], "id": 6}`,
+		`{"result": null, "error": {"code": -32603, "message": "broken"}, "id": 6}`},
+	callTest{`{"jsonrpc": "2.0", "method": 1, "id": 7}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "invalid request"}, "id": 7}`},
+	callTest{`{"jsonrpc": "2.0", "method"`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "parse error"}, "id": null}`},
+	callTest{`[]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "invalid request"}, "id": null}`},
+	callTest{`[1]`,
+		`[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "invalid request"}, "id": null}]`},
+	callTest{`[{"jsonrpc": "2.0", "method": "echo", "params": [1], "id": 1}, {"jsonrpc": "2.0", "method": "echo"}, {"jsonrpc": "2.0", "method": "missing", "id": 2}]`,
+		`[{"jsonrpc": "2.0", "result": [1], "id": 1}, {"jsonrpc": "2.0", "error": {"code": -32601, "message": "method not found"}, "id": 2}]`},
+	callTest{`[{"jsonrpc": "2.0", "method": "echo"}]`, ``},
+}
+
+func TestCall(t *testing.T) {
+	s := newTestServer()
+	for _, tt := range callTests {
+		p := s.Call(nil, []byte(tt.request))
+		if tt.response == "" {
+			if p != nil {
+				t.Errorf("Call(%s) = %s, expected no response", tt.request, p)
+			}
+			continue
+		}
+		var actual, expected interface{}
+		if err := json.Unmarshal(p, &actual); err != nil {
+			t.Errorf("Call(%s) = %s, %v", tt.request, p, err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(tt.response), &expected); err != nil {
+			t.Fatalf("bad test response %s, %v", tt.response, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Call(%s) = %s, expected %s", tt.request, p, tt.response)
+		}
+	}
+}
+
+type serveTest struct {
+	method string
+	body   string
+	status int
+}
+
+var serveTests = []serveTest{
+	serveTest{"POST", `{"jsonrpc": "2.0", "method": "echo", "id": 1}`, web.StatusOK},
+	serveTest{"POST", `{"jsonrpc": "2.0", "method": "echo"}`, web.StatusNoContent},
+	serveTest{"GET", ``, web.StatusMethodNotAllowed},
+}
+
+func TestServeWeb(t *testing.T) {
+	s := newTestServer()
+	for _, tt := range serveTests {
+		r := &webtest.Responder{}
+		s.ServeWeb(&web.Request{
+			Method:        tt.method,
+			Header:        web.NewStringsMap(),
+			Responder:     r,
+			ErrorHandler:  func(req *web.Request, status int, reason os.Error) { req.Respond(status) },
+			ContentLength: len(tt.body),
+			Body:          bytes.NewBufferString(tt.body),
+		})
+		if r.Status != tt.status {
+			t.Errorf("%s %s status = %d, expected %d", tt.method, tt.body, r.Status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// ErrResponseTooLarge is returned from writes to a response body that
+// exceed the limit set by LimitResponse.
+var ErrResponseTooLarge = os.NewError("response too large")
+
+// limitedResponseBody fails writes after the limit is reached.
+type limitedResponseBody struct {
+	ResponseBody
+	req      *Request
+	n        int
+	maxLen   int
+	exceeded bool
+}
+
+func (b *limitedResponseBody) Write(p []byte) (int, os.Error) {
+	if b.exceeded {
+		return 0, ErrResponseTooLarge
+	}
+	if b.n+len(p) > b.maxLen {
+		b.exceeded = true
+		log.Stderr("twister: response to", b.req.Method, b.req.URL, "exceeds limit of", b.maxLen, "bytes")
+		AbortResponse(b.req)
+		return 0, ErrResponseTooLarge
+	}
+	n, err := b.ResponseBody.Write(p)
+	b.n += n
+	return n, err
+}
+
+// LimitResponse returns middleware that limits the size of response bodies
+// to maxLen bytes. If the Content-Length header exceeds the limit, then the
+// response is replaced with an empty response with HTTP status 500.
+// Otherwise, the response is aborted at the first write past the limit and
+// the write returns ErrResponseTooLarge. The server closes the connection
+// without completing an aborted response, so the client can detect that the
+// response was truncated. Violations are logged.
+func LimitResponse(maxLen int) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			FilterResponse(req, func(status int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				body := &limitedResponseBody{req: req, maxLen: maxLen}
+				if s, found := header.Get(HeaderContentLength); found {
+					if n, err := strconv.Atoi(s); err == nil && n > maxLen {
+						log.Stderr("twister: response to", req.Method, req.URL, "has Content-Length", n, "exceeding limit of", maxLen, "bytes")
+						status = StatusInternalServerError
+						header = NewStringsMap(HeaderContentLength, "0")
+						body.exceeded = true
+					}
+				}
+				w := respond(status, header)
+				if w == nil {
+					return nil
+				}
+				body.ResponseBody = w
+				return body
+			})
+			handler.ServeWeb(req)
+		})
+	}
+}
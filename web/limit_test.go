@@ -0,0 +1,81 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"http"
+	"os"
+	"testing"
+)
+
+type limitResponseTest struct {
+	header []string
+	writes []string
+	status int
+	body   string
+}
+
+var limitResponseTests = []limitResponseTest{
+	limitResponseTest{nil, []string{"hello"}, StatusOK, "hello"},
+	limitResponseTest{nil, []string{"hel", "lo", "!"}, StatusOK, "hello"},
+	limitResponseTest{[]string{HeaderContentLength, "6"}, []string{"hello!"}, StatusInternalServerError, ""},
+	limitResponseTest{[]string{HeaderContentLength, "5"}, []string{"hello"}, StatusOK, "hello"},
+}
+
+func TestLimitResponse(t *testing.T) {
+	for _, tt := range limitResponseTests {
+		var errs []os.Error
+		h := LimitResponse(5)(HandlerFunc(func(req *Request) {
+			w := req.Respond(StatusOK, tt.header...)
+			errs = make([]os.Error, len(tt.writes))
+			for i, s := range tt.writes {
+				_, errs[i] = w.Write([]byte(s))
+			}
+		}))
+		r := &testResponder{}
+		url, _ := http.ParseURL("/")
+		h.ServeWeb(&Request{Method: "GET", URL: url, Responder: r})
+		if r.status != tt.status || r.body.String() != tt.body {
+			t.Errorf("%v %v: status=%d body=%q, expected %d %q", tt.header, tt.writes, r.status, r.body.String(), tt.status, tt.body)
+		}
+		if len(tt.writes) == 3 && errs[2] != ErrResponseTooLarge {
+			t.Errorf("write past limit returned %v", errs[2])
+		}
+	}
+}
+
+type abortResponder struct {
+	testResponder
+	aborted bool
+}
+
+func (r *abortResponder) Abort() { r.aborted = true }
+
+func TestLimitResponseAbort(t *testing.T) {
+	h := LimitResponse(5)(HandlerFunc(func(req *Request) {
+		FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) { return status, header })
+		w := req.Respond(StatusOK)
+		w.Write([]byte("hello"))
+		if _, err := w.Write([]byte("!")); err != ErrResponseTooLarge {
+			t.Errorf("write past limit returned %v", err)
+		}
+	}))
+	r := &abortResponder{}
+	url, _ := http.ParseURL("/")
+	h.ServeWeb(&Request{Method: "GET", URL: url, Responder: r})
+	if !r.aborted {
+		t.Error("response not aborted")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Names of the request parameter and cookie used by SelectLocale.
+const (
+	LocaleParamName  = "lang"
+	LocaleCookieName = "lang"
+)
+
+// Lifetime in seconds of the locale cookie.
+const localeCookieMaxAge = 365 * 24 * 60 * 60
+
+// The key for the request locale in the request Env.
+const localeKey = "web.locale"
+
+// normalizeLocale returns tag in lowercase with "-" as the subtag separator.
+func normalizeLocale(tag string) string {
+	return strings.Map(func(c int) int {
+		if c == '_' {
+			return '-'
+		}
+		return c
+	}, strings.ToLower(strings.TrimSpace(tag)))
+}
+
+// primaryLanguage returns the primary language subtag of a normalized tag.
+func primaryLanguage(tag string) string {
+	if i := strings.Index(tag, "-"); i >= 0 {
+		return tag[0:i]
+	}
+	return tag
+}
+
+// matchLocale returns the supported locale matching tag or "" if there is no
+// match. A locale matches if it is equal to the tag or has the same primary
+// language.
+func matchLocale(tag string, supported []string) string {
+	tag = normalizeLocale(tag)
+	if tag == "" || tag == "*" {
+		return ""
+	}
+	for _, s := range supported {
+		if normalizeLocale(s) == tag {
+			return s
+		}
+	}
+	lang := primaryLanguage(tag)
+	for _, s := range supported {
+		if primaryLanguage(normalizeLocale(s)) == lang {
+			return s
+		}
+	}
+	return ""
+}
+
+// negotiateLocale returns the supported locale with the highest q-value in
+// the Accept-Language header value or "" if no supported locale is
+// acceptable.
+func negotiateLocale(accept string, supported []string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",", -1) {
+		params := strings.Split(item, ";", -1)
+		value := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.Atof64(param[2:]); err == nil {
+					value = v
+				}
+			}
+		}
+		if value > bestQ {
+			if locale := matchLocale(params[0], supported); locale != "" {
+				best, bestQ = locale, value
+			}
+		}
+	}
+	return best
+}
+
+// SelectLocale returns middleware that selects the locale for the request
+// from the supported locales. The locale is taken from, in order of
+// precedence, the LocaleParamName request parameter, the LocaleCookieName
+// cookie and the Accept-Language header. The first supported locale is
+// selected if there is no match. A locale matches a requested language tag
+// if the locale is equal to the tag or has the same primary language. When
+// the locale is selected with the request parameter, the middleware sets the
+// cookie to persist the choice. The Accept-Language and Cookie request headers
+// are added to the Vary header of the response. Use RequestLocale to get the selected
+// locale. The locale is also set in the template data with the key
+// "locale".
+func SelectLocale(supported ...string) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			locale := ""
+			setCookie := ""
+			if s, found := req.Param.Get(LocaleParamName); found {
+				if locale = matchLocale(s, supported); locale != "" {
+					c := Cookie{
+						Name:   LocaleCookieName,
+						Value:  locale,
+						Path:   "/",
+						MaxAge: localeCookieMaxAge,
+					}
+					setCookie = c.String()
+				}
+			}
+			FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+				addVary(header, HeaderAcceptLanguage, HeaderCookie)
+				if setCookie != "" {
+					header.Append(HeaderSetCookie, setCookie)
+				}
+				return status, header
+			})
+			if locale == "" {
+				if s, found := req.CookieValue(LocaleCookieName); found {
+					locale = matchLocale(s, supported)
+				}
+			}
+			if locale == "" {
+				locale = negotiateLocale(req.Header.GetDef(HeaderAcceptLanguage, ""), supported)
+			}
+			if locale == "" && len(supported) > 0 {
+				locale = supported[0]
+			}
+			req.Env[localeKey] = locale
+			SetTemplateData(req, "locale", locale)
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+// RequestLocale returns the locale selected by SelectLocale or "" if the
+// request was not handled by SelectLocale.
+func RequestLocale(req *Request) string {
+	locale, _ := req.Env[localeKey].(string)
+	return locale
+}
@@ -0,0 +1,78 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+type selectLocaleTest struct {
+	param     string
+	cookie    string
+	accept    string
+	locale    string
+	setCookie bool
+}
+
+var selectLocaleTests = []selectLocaleTest{
+	selectLocaleTest{"", "", "", "en-US", false},
+	selectLocaleTest{"", "", "fr-CA, fr;q=0.9, en;q=0.8", "fr", false},
+	selectLocaleTest{"", "", "de, pt;q=0.5, fr;q=0.8", "fr", false},
+	selectLocaleTest{"", "", "pt-br", "pt-BR", false},
+	selectLocaleTest{"", "", "en-GB", "en-US", false},
+	selectLocaleTest{"", "", "fr;q=0, de", "en-US", false},
+	selectLocaleTest{"", "pt_BR", "fr", "pt-BR", false},
+	selectLocaleTest{"", "xx", "fr", "fr", false},
+	selectLocaleTest{"fr", "pt-BR", "en", "fr", true},
+	selectLocaleTest{"xx", "pt-BR", "en", "pt-BR", false},
+}
+
+func TestSelectLocale(t *testing.T) {
+	for _, tt := range selectLocaleTests {
+		req := &Request{
+			Header: NewStringsMap(),
+			Param:  NewStringsMap(),
+			Cookie: NewStringsMap(),
+			Env:    make(map[string]interface{}),
+		}
+		if tt.param != "" {
+			req.Param.Set(LocaleParamName, tt.param)
+		}
+		if tt.cookie != "" {
+			req.Cookie.Set(LocaleCookieName, tt.cookie)
+		}
+		if tt.accept != "" {
+			req.Header.Set(HeaderAcceptLanguage, tt.accept)
+		}
+		r := &testResponder{}
+		req.Responder = r
+		var locale string
+		SelectLocale("en-US", "fr", "pt-BR")(HandlerFunc(func(req *Request) {
+			locale = RequestLocale(req)
+			req.Respond(StatusOK)
+		})).ServeWeb(req)
+		if locale != tt.locale {
+			t.Errorf("param=%q cookie=%q accept=%q, locale = %q, expected %q", tt.param, tt.cookie, tt.accept, locale, tt.locale)
+		}
+		setCookie := r.header.GetDef(HeaderSetCookie, "")
+		if tt.setCookie != (setCookie != "") || (tt.setCookie && !strings.HasPrefix(setCookie, LocaleCookieName+"="+tt.locale+";")) {
+			t.Errorf("param=%q, Set-Cookie = %q", tt.param, setCookie)
+		}
+		if vary := strings.Join(r.header[HeaderVary], ", "); vary != "Accept-Language, Cookie" {
+			t.Errorf("param=%q cookie=%q accept=%q, Vary = %q", tt.param, tt.cookie, tt.accept, vary)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLongPollSize is the default number of events retained by a
+	// LongPoll.
+	DefaultLongPollSize = 64
+
+	// DefaultLongPollTimeout is the default time in nanoseconds that a
+	// LongPoll parks a request.
+	DefaultLongPollTimeout = 30e9
+)
+
+// LongPoll is a handler that implements long-polling for browsers that do
+// not support WebSockets. The handler parks the request until an event is
+// published or the timeout elapses.
+//
+// Each event is assigned an increasing id. Clients send the "since" request
+// parameter with the id returned in the previous response. Because the
+// recent events are retained, a client that disconnects while an event is
+// published receives the event when it polls again. A request without the
+// "since" parameter waits for the next event.
+//
+// The default response is a JSON object with the id to send in the next
+// request in the "next" field and the array of events in the "events"
+// field. The events array is empty if the timeout elapsed.
+//
+// The methods of a LongPoll can be called from multiple goroutines.
+type LongPoll struct {
+	// Size is the number of recent events retained for clients that are
+	// not parked when the event is published.
+	Size int
+
+	// Timeout is the maximum time in nanoseconds that a request is parked.
+	Timeout int64
+
+	// Render responds to the request with the events. If Render is nil, then
+	// the response is JSON.
+	Render func(req *Request, next int64, events []interface{})
+
+	mu     sync.Mutex
+	first  int64 // id of events[0]
+	events []interface{}
+	wake   chan bool // closed when an event is published
+}
+
+// NewLongPoll returns a new long-poll handler with the default size and
+// timeout.
+func NewLongPoll() *LongPoll {
+	return &LongPoll{Size: DefaultLongPollSize, Timeout: DefaultLongPollTimeout}
+}
+
+// Publish adds the event to the queue, wakes all parked requests and returns
+// the id of the event.
+func (lp *LongPoll) Publish(event interface{}) int64 {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	size := lp.Size
+	if size <= 0 {
+		size = DefaultLongPollSize
+	}
+	n := len(lp.events) + 1
+	if n > size {
+		n = size
+	}
+	events := make([]interface{}, n)
+	copy(events, lp.events[len(lp.events)-(n-1):])
+	events[n-1] = event
+	lp.first += int64(len(lp.events) + 1 - n)
+	lp.events = events
+	if lp.wake != nil {
+		close(lp.wake)
+		lp.wake = nil
+	}
+	return lp.first + int64(n-1)
+}
+
+// pending returns the events after since and the id of the next event. If
+// there are no events after since, then pending also returns the channel
+// that is closed on the next publish.
+func (lp *LongPoll) pending(since int64) (int64, []interface{}, chan bool) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	next := lp.first + int64(len(lp.events))
+	if since < 0 || since > next {
+		since = next
+	}
+	if since < lp.first {
+		since = lp.first
+	}
+	if since < next {
+		return next, lp.events[since-lp.first:], nil
+	}
+	if lp.wake == nil {
+		lp.wake = make(chan bool)
+	}
+	return next, nil, lp.wake
+}
+
+// Wait returns the events with ids greater than or equal to since. If there
+// are no such events, then Wait waits up to timeout nanoseconds for an event
+// to be published. If since is negative, then Wait waits for the next event.
+// Wait returns the id to pass as since in the next call to Wait.
+func (lp *LongPoll) Wait(since int64, timeout int64) (next int64, events []interface{}) {
+	next, events, wake := lp.pending(since)
+	if wake == nil {
+		return next, events
+	}
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	select {
+	case <-wake:
+		next, events, _ = lp.pending(next)
+	case <-ticker.C:
+	}
+	return next, events
+}
+
+func (lp *LongPoll) ServeWeb(req *Request) {
+	since := int64(-1)
+	if s, found := req.Param.Get("since"); found {
+		if n, err := strconv.Atoi64(s); err == nil {
+			since = n
+		}
+	}
+	timeout := lp.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLongPollTimeout
+	}
+	next, events := lp.Wait(since, timeout)
+	if events == nil {
+		events = []interface{}{}
+	}
+	if lp.Render != nil {
+		lp.Render(req, next, events)
+		return
+	}
+	p, err := json.Marshal(map[string]interface{}{"next": next, "events": events})
+	if err != nil {
+		req.Error(StatusInternalServerError, err)
+		return
+	}
+	w := req.Respond(StatusOK,
+		HeaderContentType, "application/json; charset=utf-8",
+		HeaderContentLength, strconv.Itoa(len(p)),
+		HeaderCacheControl, "no-cache")
+	if w != nil {
+		w.Write(p)
+	}
+}
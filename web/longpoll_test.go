@@ -0,0 +1,73 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"json"
+	"testing"
+	"time"
+)
+
+func TestLongPollWait(t *testing.T) {
+	lp := &LongPoll{Size: 3}
+	if next, events := lp.Wait(-1, 1e6); next != 0 || len(events) != 0 {
+		t.Errorf("Wait(-1) = %d, %v, expected timeout", next, events)
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			next, events := lp.Wait(-1, 5e9)
+			if next != 1 || len(events) != 1 || events[0] != "a" {
+				t.Errorf("parked Wait = %d, %v, expected 1, [a]", next, events)
+			}
+			done <- true
+		}()
+	}
+	time.Sleep(10e6)
+	if id := lp.Publish("a"); id != 0 {
+		t.Errorf("Publish = %d, expected 0", id)
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	lp.Publish("b")
+	lp.Publish("c")
+	lp.Publish("d")
+	if next, events := lp.Wait(0, 1e6); next != 4 || len(events) != 3 || events[0] != "b" || events[2] != "d" {
+		t.Errorf("Wait(0) = %d, %v, expected 4, [b c d]", next, events)
+	}
+	if next, events := lp.Wait(3, 1e6); next != 4 || len(events) != 1 || events[0] != "d" {
+		t.Errorf("Wait(3) = %d, %v, expected 4, [d]", next, events)
+	}
+}
+
+func TestLongPollHandler(t *testing.T) {
+	lp := NewLongPoll()
+	lp.Publish("hello")
+	r := &testResponder{}
+	lp.ServeWeb(&Request{Method: "GET", Param: NewStringsMap("since", "0"), Responder: r})
+	var v struct {
+		Next   int64
+		Events []string
+	}
+	if err := json.Unmarshal(r.body.Bytes(), &v); err != nil {
+		t.Fatalf("response = %d %q, %v", r.status, r.body.String(), err)
+	}
+	if r.status != StatusOK || v.Next != 1 || len(v.Events) != 1 || v.Events[0] != "hello" {
+		t.Errorf("response = %d %q", r.status, r.body.String())
+	}
+}
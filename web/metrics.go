@@ -0,0 +1,85 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// MetricsRecorder receives a measurement for each request handled by the
+// Instrument handler.
+type MetricsRecorder interface {
+	// RecordRequest records a request. The status is zero if the handler
+	// did not respond or hijacked the connection. The duration is in
+	// nanoseconds.
+	RecordRequest(req *Request, status int, duration int64)
+}
+
+// Instrument returns middleware that calls handler and records the request
+// with each of the recorders.
+func Instrument(recorders ...MetricsRecorder) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			start := time.Nanoseconds()
+			status := 0
+			FilterRespond(req, func(s int, header StringsMap) (int, StringsMap) {
+				status = s
+				return s, header
+			})
+			handler.ServeWeb(req)
+			duration := time.Nanoseconds() - start
+			for _, r := range recorders {
+				r.RecordRequest(req, status, duration)
+			}
+		})
+	}
+}
+
+// StatusClass returns the class of an HTTP status code as "1xx" through "5xx"
+// or "other" for unknown status codes.
+func StatusClass(status int) string {
+	if status < 100 || status >= 600 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// ExpvarRecorder is a metrics recorder that publishes request counts and
+// total latency as expvar variables.
+type ExpvarRecorder struct {
+	requests *expvar.Int
+	status   *expvar.Map
+	latency  *expvar.Int
+}
+
+// NewExpvarRecorder returns a recorder that publishes the variables
+// name.requests, name.status and name.latency_ms. The status variable maps
+// status classes to counts.
+func NewExpvarRecorder(name string) *ExpvarRecorder {
+	return &ExpvarRecorder{
+		requests: expvar.NewInt(name + ".requests"),
+		status:   expvar.NewMap(name + ".status"),
+		latency:  expvar.NewInt(name + ".latency_ms"),
+	}
+}
+
+func (r *ExpvarRecorder) RecordRequest(req *Request, status int, duration int64) {
+	r.requests.Add(1)
+	r.status.Add(StatusClass(status), 1)
+	r.latency.Add(duration / 1e6)
+}
@@ -0,0 +1,58 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"testing"
+)
+
+type statusClassTest struct {
+	status int
+	class  string
+}
+
+var statusClassTests = []statusClassTest{
+	statusClassTest{StatusOK, "2xx"},
+	statusClassTest{StatusNotModified, "3xx"},
+	statusClassTest{StatusNotFound, "4xx"},
+	statusClassTest{StatusBadGateway, "5xx"},
+	statusClassTest{0, "other"},
+}
+
+func TestStatusClass(t *testing.T) {
+	for _, tt := range statusClassTests {
+		if class := StatusClass(tt.status); class != tt.class {
+			t.Errorf("StatusClass(%d) = %q, expected %q", tt.status, class, tt.class)
+		}
+	}
+}
+
+type testRecorder struct {
+	status int
+}
+
+func (r *testRecorder) RecordRequest(req *Request, status int, duration int64) {
+	r.status = status
+}
+
+func TestInstrument(t *testing.T) {
+	r := &testRecorder{}
+	h := Instrument(r)(HandlerFunc(func(req *Request) { req.Respond(StatusNotFound) }))
+	h.ServeWeb(&Request{Responder: &testResponder{}})
+	if r.status != StatusNotFound {
+		t.Errorf("recorded status %d, expected %d", r.status, StatusNotFound)
+	}
+}
@@ -15,10 +15,40 @@
 package web
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"json"
+	"os"
+	"template"
 )
 
+// Middleware wraps a handler with additional behavior. The bundled
+// middleware functions return values of this type.
+type Middleware func(handler Handler) Handler
+
+// Chain returns middleware that applies the given middleware in order. The
+// first middleware is the outermost. The expression
+//
+//  web.Chain(a, b, c)(handler)
+//
+// is equivalent to a(b(c(handler))). Use Chain to write the middleware for
+// an application as a list:
+//
+//  h := web.Chain(
+//      web.SetErrorHandler(errorHandler),
+//      web.NormalizePath(web.PathRedirect),
+//      web.ProcessForm(10000, true),
+//  )(router)
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		return handler
+	}
+}
+
 type respondFilter struct {
 	Responder
 	filter func(status int, header StringsMap) (int, StringsMap)
@@ -28,6 +58,12 @@ func (rf *respondFilter) Respond(status int, header StringsMap) ResponseBody {
 	return rf.Responder.Respond(rf.filter(status, header))
 }
 
+func (rf *respondFilter) Abort() {
+	if a, ok := rf.Responder.(aborter); ok {
+		a.Abort()
+	}
+}
+
 // FilterRespond replaces the request's responder with one that filters the
 // arguments to Respond through the supplied filter. This function is intended
 // to be used by middleware.
@@ -35,72 +71,273 @@ func FilterRespond(req *Request, filter func(status int, header StringsMap) (int
 	req.Responder = &respondFilter{req.Responder, filter}
 }
 
-// SetErrorHandler returns a handler that sets the request's error handler to the supplied handler.
-func SetErrorHandler(errorHandler func(req *Request, status int, message string), handler Handler) Handler {
-	return HandlerFunc(func(req *Request) {
-		req.ErrorHandler = errorHandler
-		handler.ServeWeb(req)
+type responseFilter struct {
+	Responder
+	filter func(status int, header StringsMap, respond func(status int, header StringsMap) ResponseBody) ResponseBody
+}
+
+func (rf *responseFilter) Respond(status int, header StringsMap) ResponseBody {
+	return rf.filter(status, header, func(status int, header StringsMap) ResponseBody {
+		return rf.Responder.Respond(status, header)
 	})
 }
 
+func (rf *responseFilter) Abort() {
+	if a, ok := rf.Responder.(aborter); ok {
+		a.Abort()
+	}
+}
+
+// FilterResponse replaces the request's responder with one that calls filter
+// with the arguments to Respond and the function that commits the response
+// to the network. The filter can modify the status and header before calling
+// respond and can wrap the response body returned from respond. The filter
+// returns the response body for the handler. The filter must call respond
+// exactly once. A response body returned by the filter must propagate calls
+// to Flush as described in the documentation for ResponseBody. This function
+// is intended to be used by middleware that transforms the response body.
+func FilterResponse(req *Request, filter func(status int, header StringsMap, respond func(status int, header StringsMap) ResponseBody) ResponseBody) {
+	req.Responder = &responseFilter{req.Responder, filter}
+}
+
+// SetErrorHandler returns middleware that sets the request's error handler to the supplied handler.
+func SetErrorHandler(errorHandler func(req *Request, status int, reason os.Error)) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			req.ErrorHandler = errorHandler
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+// ExpectContinue returns middleware that calls check before the request body
+// is read. If check returns a status other than StatusContinue, then the
+// handler responds with the status and reason. A client that sent the
+// "Expect: 100-continue" header does not upload the request body in this
+// case. Otherwise, the handler writes the "100 Continue" interim response if
+// the client is waiting for one and calls through to handler.
+//
+// Use ExpectContinue to reject unauthorized or oversized requests before
+// the client sends the body.
+func ExpectContinue(check func(req *Request) (status int, reason os.Error)) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			if status, reason := check(req); status != StatusContinue {
+				req.Error(status, reason)
+				return
+			}
+			if err := req.Responder.Continue(); err != nil {
+				return
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+var errPathTraversal os.Error = &Error{Status: StatusBadRequest, Message: "path refers to parent of root"}
+
+// Policies for paths that are not in canonical form.
+const (
+	// Replace the request path with the canonical path.
+	PathRewrite = iota
+
+	// Redirect GET and HEAD requests to the canonical path. The path is
+	// rewritten for other methods.
+	PathRedirect
+
+	// Respond with HTTP status 400.
+	PathReject
+)
+
+// NormalizePath returns middleware that converts the request path to
+// canonical form using CleanPath before calling handler. The policy
+// specifies how to handle requests with a path that is not canonical.
+// Requests with a path that refers to the parent of the root are rejected
+// with HTTP status 400 regardless of the policy. Install this handler in
+// front of routers and file handlers.
+func NormalizePath(policy int) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			clean, escape := CleanPath(req.URL.Path)
+			if escape {
+				req.Error(StatusBadRequest, errPathTraversal)
+				return
+			}
+			if clean != req.URL.Path {
+				switch {
+				case policy == PathReject:
+					req.Error(StatusBadRequest, ErrBadFormat)
+					return
+				case policy == PathRedirect && (req.Method == "GET" || req.Method == "HEAD"):
+					if req.URL.RawQuery != "" {
+						clean = clean + "?" + req.URL.RawQuery
+					}
+					req.Redirect(clean, true)
+					return
+				}
+				req.URL.Path = clean
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+var errBadXSRFToken os.Error = &Error{Status: StatusNotFound, Message: "bad xsrf token"}
+
 const (
 	XSRFCookieName = "xsrf"
 	XSRFParamName  = "xsrf"
+
+	// Clients that do not submit forms can send the XSRF token in this
+	// request header.
+	XSRFHeaderName = "X-Xsrf-Token"
 )
 
-// ProcessForm returns a handler that checks the request body length, parses
-// url encoded forms and optionaly checks for XRSF.
-func ProcessForm(maxRequestBodyLen int, checkXSRF bool, handler Handler) Handler {
-	return HandlerFunc(func(req *Request) {
+// The keys for the session XSRF token and the XSRF check in the request Env.
+const (
+	xsrfSessionKey = "web.xsrfSession"
+	xsrfCheckedKey = "web.xsrfChecked"
+)
+
+// SetSessionXSRFToken binds the XSRF token for the request to a session. A
+// session subsystem such as the auth package calls SetSessionXSRFToken with
+// the token stored in the session before ProcessForm runs. ProcessForm then
+// checks the token from the session instead of the token in the XSRF cookie.
+// Call SetSessionXSRFToken with a new token when the session changes, for
+// example on login, to rotate the token. After ProcessForm runs, the new
+// token replaces the token returned from XSRFToken and set in the template
+// data.
+func SetSessionXSRFToken(req *Request, token string) {
+	req.Env[xsrfSessionKey] = token
+	if _, found := req.Env[xsrfCheckedKey]; found {
+		req.Param.Set(XSRFParamName, token)
+		SetTemplateData(req, "xsrf", token)
+	}
+}
+
+// ProcessForm returns middleware that checks the request body length, parses
+// url encoded forms and optionaly checks for XRSF. When checking for XSRF,
+// the token is set in the template data with the key "xsrf". The token is
+// taken from the session set with SetSessionXSRFToken or from the XSRF cookie
+// if there is no session. Install ProcessForm behind the session handler.
+func ProcessForm(maxRequestBodyLen int, checkXSRF bool) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
 
-		if req.ContentLength > maxRequestBodyLen {
-			status := StatusRequestEntityTooLarge
-			if _, found := req.Header.Get(HeaderExpect); found {
-				status = StatusExpectationFailed
+			if req.ContentLength > maxRequestBodyLen {
+				status := StatusRequestEntityTooLarge
+				if _, found := req.Header.Get(HeaderExpect); found {
+					status = StatusExpectationFailed
+				}
+				req.Error(status, ErrRequestEntityTooLarge)
+				return
 			}
-			req.Error(status, "Request entity too large.")
-			return
-		}
 
-		if err := req.ParseForm(); err != nil {
-			req.Error(StatusBadRequest, "Error reading or parsing form.")
-			return
-		}
+			if err := req.parseForm(maxRequestBodyLen); err != nil {
+				req.Error(ErrorStatus(err, StatusBadRequest), err)
+				return
+			}
 
-		if checkXSRF {
-			const tokenLen = 8
-			token, found := req.Cookie.Get(XSRFCookieName)
+			if checkXSRF {
+				const tokenLen = 8
+				token, _ := req.Env[xsrfSessionKey].(string)
+				if token == "" {
+					var found bool
+					token, found = req.CookieValue(XSRFCookieName)
 
-			// Create new XSRF token?
-			if !found || len(token) != tokenLen {
-				p := make([]byte, tokenLen/2)
-				_, err := rand.Reader.Read(p)
-				if err != nil {
-					panic("twister: rand read failed")
-				}
-				token = hex.EncodeToString(p)
-				c := Cookie{
-					Name:     XSRFCookieName,
-					Value:    token,
-					Path:     "/",
-					HttpOnly: true,
+					// Create new XSRF token?
+					if !found || len(token) != tokenLen {
+						p := make([]byte, tokenLen/2)
+						_, err := rand.Reader.Read(p)
+						if err != nil {
+							panic("twister: rand read failed")
+						}
+						token = hex.EncodeToString(p)
+						c := Cookie{
+							Name:     XSRFCookieName,
+							Value:    token,
+							Path:     "/",
+							HttpOnly: true,
+						}
+						value := c.String()
+						FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+							header.Append(HeaderSetCookie, value)
+							return status, header
+						})
+					}
 				}
-				value := c.String()
-				FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
-					header.Append(HeaderSetCookie, value)
-					return status, header
-				})
-			}
+				SetTemplateData(req, "xsrf", token)
+				req.Env[xsrfCheckedKey] = true
 
-			if token != req.Param.GetDef(XSRFParamName, "") {
-				req.Param.Set(XSRFParamName, token)
-				if req.Method == "POST" || req.Method == "PUT" {
-					req.Error(StatusNotFound, "Bad token")
-					return
+				sent, found := req.Param.Get(XSRFParamName)
+				if !found {
+					sent = req.Header.GetDef(XSRFHeaderName, "")
+				}
+				if token != sent {
+					req.Param.Set(XSRFParamName, token)
+					if req.Method == "POST" || req.Method == "PUT" {
+						req.Error(StatusNotFound, errBadXSRFToken)
+						return
+					}
 				}
 			}
+
+			handler.ServeWeb(req)
+		})
+	}
+}
+
+// XSRFToken returns the XSRF token for the request. The token is set by
+// ProcessForm when XSRF checking is enabled.
+func (req *Request) XSRFToken() string {
+	return req.Param.GetDef(XSRFParamName, "")
+}
+
+// XSRFFormHTML returns a hidden form input element containing the XSRF token.
+// Include the element in forms that are submitted with the POST or PUT
+// method.
+func (req *Request) XSRFFormHTML() string {
+	var b bytes.Buffer
+	b.WriteString(`<input type="hidden" name="`)
+	template.HTMLEscape(&b, []byte(XSRFParamName))
+	b.WriteString(`" value="`)
+	template.HTMLEscape(&b, []byte(req.XSRFToken()))
+	b.WriteString(`">`)
+	return b.String()
+}
+
+// XSRFTokenHandler returns a handler that responds with the XSRF token as a
+// JSON object of the form {"xsrf": token}. Single-page applications fetch
+// the token from this handler and send the token back in the request header
+// named by XSRFHeaderName. Install the handler behind ProcessForm.
+func XSRFTokenHandler() Handler {
+	return HandlerFunc(func(req *Request) {
+		p, err := json.Marshal(map[string]string{XSRFParamName: req.XSRFToken()})
+		if err != nil {
+			req.Error(StatusInternalServerError, err)
+			return
+		}
+		w := req.Respond(StatusOK,
+			HeaderContentType, "application/json; charset=utf-8",
+			HeaderCacheControl, "no-cache")
+		if w != nil {
+			w.Write(p)
 		}
+	})
+}
 
+// ExposeXSRFToken returns a handler that adds the XSRF token to the response
+// header named by XSRFHeaderName before calling handler. Install the handler
+// behind ProcessForm.
+func ExposeXSRFToken(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		token := req.XSRFToken()
+		if token != "" {
+			FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+				header.Set(XSRFHeaderName, token)
+				return status, header
+			})
+		}
 		handler.ServeWeb(req)
 	})
 }
@@ -0,0 +1,135 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"sync"
+	"utf8"
+)
+
+var (
+	mimeTypesLock sync.RWMutex
+	mimeTypes     = map[string]string{
+		".css":  "text/css; charset=utf-8",
+		".gif":  "image/gif",
+		".gz":   "application/x-gzip",
+		".htm":  "text/html; charset=utf-8",
+		".html": "text/html; charset=utf-8",
+		".ico":  "image/x-icon",
+		".jpeg": "image/jpeg",
+		".jpg":  "image/jpeg",
+		".js":   "application/x-javascript",
+		".json": "application/json",
+		".pdf":  "application/pdf",
+		".png":  "image/png",
+		".svg":  "image/svg+xml",
+		".swf":  "application/x-shockwave-flash",
+		".txt":  "text/plain; charset=utf-8",
+		".xml":  "text/xml; charset=utf-8",
+		".zip":  "application/zip",
+	}
+)
+
+// TypeByExtension returns the MIME type for the file extension ext or "" if
+// the extension is not registered. The extension includes the leading dot
+// and is matched without regard to case.
+func TypeByExtension(ext string) string {
+	mimeTypesLock.RLock()
+	defer mimeTypesLock.RUnlock()
+	return mimeTypes[strings.ToLower(ext)]
+}
+
+// AddExtensionType registers the MIME type for the file extension ext. The
+// extension includes the leading dot.
+func AddExtensionType(ext string, mimeType string) {
+	mimeTypesLock.Lock()
+	defer mimeTypesLock.Unlock()
+	mimeTypes[strings.ToLower(ext)] = mimeType
+}
+
+type signature struct {
+	prefix   string
+	mimeType string
+}
+
+var signatures = []signature{
+	signature{"\x89PNG\r\n\x1a\n", "image/png"},
+	signature{"GIF87a", "image/gif"},
+	signature{"GIF89a", "image/gif"},
+	signature{"\xff\xd8\xff", "image/jpeg"},
+	signature{"%PDF-", "application/pdf"},
+	signature{"PK\x03\x04", "application/zip"},
+	signature{"\x1f\x8b", "application/x-gzip"},
+}
+
+var htmlPrefixes = []string{"<!doctype html", "<html", "<head", "<body"}
+
+// DetectContentType returns the MIME type of data from the first bytes of
+// data. DetectContentType returns "application/octet-stream" if the type
+// cannot be determined.
+func DetectContentType(data []byte) string {
+	if len(data) > 512 {
+		data = data[0:512]
+	}
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, []byte(sig.prefix)) {
+			return sig.mimeType
+		}
+	}
+	trimmed := bytes.ToLower(bytes.TrimSpace(data))
+	for _, prefix := range htmlPrefixes {
+		if bytes.HasPrefix(trimmed, []byte(prefix)) {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if looksLikeText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// looksLikeText returns true if data is UTF-8 encoded text without control
+// characters other than whitespace. An incomplete rune at the end of data is
+// ignored.
+func looksLikeText(data []byte) bool {
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			return true
+		}
+		rune, size := utf8.DecodeRune(data)
+		if rune == utf8.RuneError && size == 1 {
+			return false
+		}
+		if rune < ' ' && rune != '\t' && rune != '\r' && rune != '\n' && rune != '\f' {
+			return false
+		}
+		data = data[size:]
+	}
+	return true
+}
+
+// ContentType returns the MIME type for a file with the given name and
+// contents. The type is determined from the file extension if the extension
+// is registered. Otherwise, the type is determined from data using
+// DetectContentType.
+func ContentType(name string, data []byte) string {
+	if mimeType := TypeByExtension(path.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	return DetectContentType(data)
+}
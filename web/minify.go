@@ -0,0 +1,353 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxMinifyLen is the default maximum length of a response body
+// minified by the Minify middleware.
+const DefaultMaxMinifyLen = 1 << 20
+
+// DefaultMaxMinifyCacheEntries is the default maximum number of entries in
+// a Minifier cache.
+const DefaultMaxMinifyCacheEntries = 1000
+
+// Minifier removes comments and redundant whitespace from HTML, CSS and
+// JavaScript. The minifier caches the result by a hash of the input so that
+// repeated responses are not minified again.
+type Minifier struct {
+	// MaxLen is the maximum length of a response body to minify. Longer
+	// bodies are written unchanged. The default value is used if the value
+	// is zero.
+	MaxLen int
+
+	// MaxCacheEntries is the maximum number of cached results. The cache is
+	// cleared when full. The default value is used if the value is zero.
+	MaxCacheEntries int
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// NewMinifier returns a new minifier.
+func NewMinifier() *Minifier {
+	return &Minifier{cache: make(map[string][]byte)}
+}
+
+// minifyFunc returns the minify function for the content type or nil if
+// the content type is not supported.
+func minifyFunc(contentType string) func([]byte) []byte {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[0:i]
+	}
+	switch strings.ToLower(strings.TrimSpace(contentType)) {
+	case "text/html":
+		return minifyHTML
+	case "text/css":
+		return minifyCSS
+	case "application/javascript", "application/x-javascript", "text/javascript":
+		return minifyJS
+	}
+	return nil
+}
+
+// Minify returns the minified version of p for the given content type. If
+// the content type is not supported, then p is returned.
+func (m *Minifier) Minify(contentType string, p []byte) []byte {
+	f := minifyFunc(contentType)
+	if f == nil {
+		return p
+	}
+	h := sha1.New()
+	h.Write([]byte(contentType))
+	h.Write(p)
+	key := hex.EncodeToString(h.Sum())
+
+	m.mu.Lock()
+	result, found := m.cache[key]
+	m.mu.Unlock()
+	if found {
+		return result
+	}
+
+	result = f(p)
+
+	maxEntries := m.MaxCacheEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxMinifyCacheEntries
+	}
+	m.mu.Lock()
+	if len(m.cache) >= maxEntries {
+		m.cache = make(map[string][]byte)
+	}
+	m.cache[key] = result
+	m.mu.Unlock()
+	return result
+}
+
+// isHTMLSpace returns true if b is whitespace in HTML and CSS.
+func isHTMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// isCSSPunct returns true if whitespace around c is not significant in CSS.
+func isCSSPunct(c byte) bool {
+	return c == '{' || c == '}' || c == ';' || c == ',' || c == '>'
+}
+
+// minifyCSS removes comments and whitespace that is not significant.
+func minifyCSS(p []byte) []byte {
+	var b bytes.Buffer
+	space := false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '"' || c == '\'':
+			if space && b.Len() > 0 && !isCSSPunct(b.Bytes()[b.Len()-1]) {
+				b.WriteByte(' ')
+			}
+			space = false
+			j := i + 1
+			for j < len(p) && p[j] != c {
+				if p[j] == '\\' {
+					j += 1
+				}
+				j += 1
+			}
+			if j >= len(p) {
+				j = len(p) - 1
+			}
+			b.Write(p[i : j+1])
+			i = j
+		case c == '/' && i+1 < len(p) && p[i+1] == '*':
+			j := bytes.Index(p[i+2:], []byte("*/"))
+			if j < 0 {
+				i = len(p)
+			} else {
+				i += j + 3
+			}
+			space = true
+		case isHTMLSpace(c):
+			space = true
+		default:
+			if space && b.Len() > 0 && !isCSSPunct(c) && !isCSSPunct(b.Bytes()[b.Len()-1]) {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteByte(c)
+		}
+	}
+	return b.Bytes()
+}
+
+// minifyJS removes leading and trailing whitespace, blank lines and lines
+// containing only a // comment. Line breaks are kept so that automatic
+// semicolon insertion is not affected.
+func minifyJS(p []byte) []byte {
+	var b bytes.Buffer
+	for _, line := range bytes.Split(p, []byte("\n"), -1) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("//")) {
+			continue
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Elements with content that is copied unchanged by minifyHTML.
+var htmlRawElements = []string{"pre", "textarea", "script", "style"}
+
+// hasTagPrefix returns true if p starts with "<" + name followed by a space,
+// "/" or ">". The comparison is case insensitive.
+func hasTagPrefix(p []byte, name string) bool {
+	n := len(name) + 1
+	if len(p) <= n || p[0] != '<' || strings.ToLower(string(p[1:n])) != name {
+		return false
+	}
+	return isHTMLSpace(p[n]) || p[n] == '>' || p[n] == '/'
+}
+
+// copyHTMLTag writes the tag at the start of p to b and returns the number of
+// bytes consumed. Runs of whitespace between attributes are collapsed to a
+// single space. Quoted attribute values are copied unchanged. If p does not
+// start with a tag, then only the "<" is consumed.
+func copyHTMLTag(b *bytes.Buffer, p []byte) int {
+	b.WriteByte('<')
+	if len(p) < 2 || !(p[1] == '/' || p[1] == '!' || ('a' <= p[1] && p[1] <= 'z') || ('A' <= p[1] && p[1] <= 'Z')) {
+		return 1
+	}
+	i := 1
+	for i < len(p) && p[i] != '>' {
+		c := p[i]
+		switch {
+		case c == '"' || c == '\'':
+			j := bytes.IndexByte(p[i+1:], c)
+			if j < 0 {
+				j = len(p) - i - 2
+			}
+			b.Write(p[i : i+j+2])
+			i += j + 2
+		case isHTMLSpace(c):
+			for i < len(p) && isHTMLSpace(p[i]) {
+				i += 1
+			}
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+			i += 1
+		}
+	}
+	if i < len(p) {
+		b.WriteByte('>')
+		i += 1
+	}
+	return i
+}
+
+// minifyHTML removes comments and collapses runs of whitespace. The content
+// of pre, textarea, script and style elements, conditional comments and
+// quoted attribute values are not changed.
+func minifyHTML(p []byte) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(p); {
+		c := p[i]
+		switch {
+		case isHTMLSpace(c):
+			j := i
+			newline := false
+			for j < len(p) && isHTMLSpace(p[j]) {
+				newline = newline || p[j] == '\n'
+				j += 1
+			}
+			if newline {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(' ')
+			}
+			i = j
+			continue
+		case c == '<' && bytes.HasPrefix(p[i:], []byte("<!--")) && !bytes.HasPrefix(p[i:], []byte("<!--[")):
+			j := bytes.Index(p[i+4:], []byte("-->"))
+			if j < 0 {
+				i = len(p)
+			} else {
+				i += j + 7
+			}
+			continue
+		case c == '<':
+			for _, name := range htmlRawElements {
+				if hasTagPrefix(p[i:], name) {
+					j := bytes.Index(bytes.ToLower(p[i:]), []byte("</"+name))
+					if j < 0 {
+						j = len(p) - i
+					}
+					b.Write(p[i : i+j])
+					i += j
+					break
+				}
+			}
+			if i < len(p) && p[i] == '<' {
+				i += copyHTMLTag(&b, p[i:])
+			}
+			continue
+		}
+		b.WriteByte(c)
+		i += 1
+	}
+	return b.Bytes()
+}
+
+// minifyBody buffers the response body for minification.
+type minifyBody struct {
+	ResponseBody
+	buf      bytes.Buffer
+	maxLen   int
+	overflow bool
+}
+
+func (b *minifyBody) Write(p []byte) (int, os.Error) {
+	if b.overflow {
+		return b.ResponseBody.Write(p)
+	}
+	if b.buf.Len()+len(p) > b.maxLen {
+		b.overflow = true
+		if _, err := b.ResponseBody.Write(b.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		b.buf.Reset()
+		return b.ResponseBody.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Flush stops minification of the response. The buffered data is written
+// as is so that streamed responses are not held until the handler returns.
+func (b *minifyBody) Flush() os.Error {
+	if !b.overflow {
+		b.overflow = true
+		if _, err := b.ResponseBody.Write(b.buf.Bytes()); err != nil {
+			return err
+		}
+		b.buf.Reset()
+	}
+	return b.ResponseBody.Flush()
+}
+
+// Minify returns middleware that minifies HTML, CSS and JavaScript response
+// bodies. Responses with a Content-Encoding are not changed. Responses
+// flushed by the handler are sent without minification. If m is nil, then a
+// new minifier is used.
+func Minify(m *Minifier) Middleware {
+	if m == nil {
+		m = NewMinifier()
+	}
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			var body *minifyBody
+			var contentType string
+			FilterResponse(req, func(status int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				contentType = header.GetDef(HeaderContentType, "")
+				if header.Has(HeaderContentEncoding) || minifyFunc(contentType) == nil {
+					return respond(status, header)
+				}
+				header.Del(HeaderContentLength)
+				w := respond(status, header)
+				if w == nil {
+					return nil
+				}
+				maxLen := m.MaxLen
+				if maxLen <= 0 {
+					maxLen = DefaultMaxMinifyLen
+				}
+				body = &minifyBody{ResponseBody: w, maxLen: maxLen}
+				return body
+			})
+			handler.ServeWeb(req)
+			if body != nil && !body.overflow {
+				body.ResponseBody.Write(m.Minify(contentType, body.buf.Bytes()))
+				body.ResponseBody.Flush()
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+type minifyTest struct {
+	contentType string
+	in          string
+	out         string
+}
+
+var minifyTests = []minifyTest{
+	minifyTest{"text/css", "a  b , c {\n  color : red ;\n}\n/* comment */\np:hover{}", "a b,c{color : red;}p:hover{}"},
+	minifyTest{"text/css", "a { content: \"x  /* y */\" }", "a{content: \"x  /* y */\"}"},
+	minifyTest{"application/javascript", "  var a = 1;\n\n  // comment\n  f(a);  \n", "var a = 1;\nf(a);\n"},
+	minifyTest{"text/html; charset=utf-8", "<p>\n  a   b\n</p><!-- c --><!--[if IE]>x<![endif]-->", "<p>\na b\n</p><!--[if IE]>x<![endif]-->"},
+	minifyTest{"text/html", "<PRE>a\n\n  b</PRE>  <textarea> x  y </textarea>", "<PRE>a\n\n  b</PRE> <textarea> x  y </textarea>"},
+	minifyTest{"text/html", "<input  type=text\n  value=\"a  b\" title='c \n d'>  x < y", "<input type=text value=\"a  b\" title='c \n d'> x < y"},
+	minifyTest{"text/html", "<p title=\"a  b", "<p title=\"a  b"},
+	minifyTest{"text/plain", "a  b", "a  b"},
+}
+
+func TestMinify(t *testing.T) {
+	m := NewMinifier()
+	for _, tt := range minifyTests {
+		for i := 0; i < 2; i++ {
+			if out := string(m.Minify(tt.contentType, []byte(tt.in))); out != tt.out {
+				t.Errorf("Minify(%q, %q) = %q, expected %q", tt.contentType, tt.in, out, tt.out)
+			}
+		}
+	}
+}
+
+func TestMinifyMiddleware(t *testing.T) {
+	h := Minify(nil)(HandlerFunc(func(req *Request) {
+		w := req.Respond(StatusOK, HeaderContentType, "text/css", HeaderContentLength, "11")
+		w.Write([]byte("a {\n"))
+		w.Write([]byte("  b: c\n}"))
+	}))
+	r := &testResponder{}
+	h.ServeWeb(&Request{Responder: r})
+	if r.body.String() != "a{b: c}" || r.header.Has(HeaderContentLength) {
+		t.Errorf("body = %q, header = %v", r.body.String(), r.header)
+	}
+}
+
+func TestMinifyFlush(t *testing.T) {
+	h := Minify(nil)(HandlerFunc(func(req *Request) {
+		w := req.Respond(StatusOK, HeaderContentType, "text/css")
+		w.Write([]byte("a {\n"))
+		w.Flush()
+		w.Write([]byte("  b: c\n}"))
+	}))
+	r := &testResponder{}
+	h.ServeWeb(&Request{Responder: r})
+	if r.body.String() != "a {\n  b: c\n}" {
+		t.Errorf("body = %q, expected unminified body", r.body.String())
+	}
+}
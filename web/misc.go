@@ -15,13 +15,26 @@
 package web
 
 import (
+	"container/vector"
 	"strings"
 	"os"
+	"time"
 )
 
 // TimeLayout is the time layout used for HTTP headers and other values.
 const TimeLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
 
+// ParseHTTPDate parses a date in one of the three formats allowed by RFC
+// 2616: RFC 1123, RFC 850 and ANSI C asctime.
+func ParseHTTPDate(s string) (*time.Time, os.Error) {
+	for _, layout := range []string{TimeLayout, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return nil, ErrBadFormat
+}
+
 // Octet tyeps from RFC 2616
 
 var (
@@ -67,7 +80,8 @@ func IsSpaceByte(c byte) bool {
 	return isSpace[c]
 }
 
-// HTTP status codes from RFC 2606
+// HTTP status codes from RFC 2606, the WebDAV extensions from RFC 4918 and
+// RFC 6585
 
 const (
 	StatusContinue                     = 100
@@ -79,6 +93,7 @@ const (
 	StatusNoContent                    = 204
 	StatusResetContent                 = 205
 	StatusPartialContent               = 206
+	StatusMultiStatus                  = 207
 	StatusMultipleChoices              = 300
 	StatusMovedPermanently             = 301
 	StatusFound                        = 302
@@ -104,12 +119,18 @@ const (
 	StatusUnsupportedMediaType         = 415
 	StatusRequestedRangeNotSatisfiable = 416
 	StatusExpectationFailed            = 417
+	StatusUnprocessableEntity          = 422
+	StatusLocked                       = 423
+	StatusFailedDependency             = 424
+	StatusTooManyRequests              = 429
+	StatusRequestHeaderFieldsTooLarge  = 431
 	StatusInternalServerError          = 500
 	StatusNotImplemented               = 501
 	StatusBadGateway                   = 502
 	StatusServiceUnavailable           = 503
 	StatusGatewayTimeout               = 504
 	StatusHTTPVersionNotSupported      = 505
+	StatusInsufficientStorage          = 507
 )
 
 var StatusText = map[int]string{
@@ -122,6 +143,7 @@ var StatusText = map[int]string{
 	StatusNoContent:                    "No Content",
 	StatusResetContent:                 "Reset Content",
 	StatusPartialContent:               "Partial Content",
+	StatusMultiStatus:                  "Multi-Status",
 	StatusMultipleChoices:              "Multiple Choices",
 	StatusMovedPermanently:             "Moved Permanently",
 	StatusFound:                        "Found",
@@ -147,12 +169,18 @@ var StatusText = map[int]string{
 	StatusUnsupportedMediaType:         "Unsupported Media Type",
 	StatusRequestedRangeNotSatisfiable: "Requested Range Not Satisfiable",
 	StatusExpectationFailed:            "Expectation Failed",
+	StatusUnprocessableEntity:          "Unprocessable Entity",
+	StatusLocked:                       "Locked",
+	StatusFailedDependency:             "Failed Dependency",
+	StatusTooManyRequests:              "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge:  "Request Header Fields Too Large",
 	StatusInternalServerError:          "Internal Server Error",
 	StatusNotImplemented:               "Not Implemented",
 	StatusBadGateway:                   "Bad Gateway",
 	StatusServiceUnavailable:           "Service Unavailable",
 	StatusGatewayTimeout:               "Gateway Timeout",
 	StatusHTTPVersionNotSupported:      "HTTP Version Not Supported",
+	StatusInsufficientStorage:          "Insufficient Storage",
 }
 
 // Canonical header name constants.
@@ -167,6 +195,7 @@ const (
 	HeaderAuthorization        = "Authorization"
 	HeaderCacheControl         = "Cache-Control"
 	HeaderConnection           = "Connection"
+	HeaderContentDisposition   = "Content-Disposition"
 	HeaderContentEncoding      = "Content-Encoding"
 	HeaderContentLanguage      = "Content-Language"
 	HeaderContentLength        = "Content-Length"
@@ -175,13 +204,17 @@ const (
 	HeaderContentRange         = "Content-Range"
 	HeaderContentType          = "Content-Type"
 	HeaderCookie               = "Cookie"
+	HeaderDAV                  = "Dav"
 	HeaderDate                 = "Date"
+	HeaderDepth                = "Depth"
+	HeaderDestination          = "Destination"
 	HeaderETag                 = "Etag"
 	HeaderEtag                 = "Etag"
 	HeaderExpect               = "Expect"
 	HeaderExpires              = "Expires"
 	HeaderFrom                 = "From"
 	HeaderHost                 = "Host"
+	HeaderIf                   = "If"
 	HeaderIfMatch              = "If-Match"
 	HeaderIfModifiedSince      = "If-Modified-Since"
 	HeaderIfNoneMatch          = "If-None-Match"
@@ -189,8 +222,10 @@ const (
 	HeaderIfUnmodifiedSince    = "If-Unmodified-Since"
 	HeaderLastModified         = "Last-Modified"
 	HeaderLocation             = "Location"
+	HeaderLockToken            = "Lock-Token"
 	HeaderMaxForwards          = "Max-Forwards"
 	HeaderOrigin               = "Origin"
+	HeaderOverwrite            = "Overwrite"
 	HeaderPragma               = "Pragma"
 	HeaderProxyAuthenticate    = "Proxy-Authenticate"
 	HeaderProxyAuthorization   = "Proxy-Authorization"
@@ -201,8 +236,10 @@ const (
 	HeaderSecWebSocketKey2     = "Sec-Websocket-Key2"
 	HeaderSecWebSocketProtocol = "Sec-Websocket-Protocol"
 	HeaderServer               = "Server"
+	HeaderServerTiming         = "Server-Timing"
 	HeaderSetCookie            = "Set-Cookie"
 	HeaderTE                   = "Te"
+	HeaderTimeout              = "Timeout"
 	HeaderTrailer              = "Trailer"
 	HeaderTransferEncoding     = "Transfer-Encoding"
 	HeaderUpgrade              = "Upgrade"
@@ -211,6 +248,7 @@ const (
 	HeaderVia                  = "Via"
 	HeaderWWWAuthenticate      = "Www-Authenticate"
 	HeaderWarning              = "Warning"
+	HeaderXResponseTime        = "X-Response-Time"
 )
 
 // HeaderName returns the canonical format of the header name s. 
@@ -220,8 +258,19 @@ func HeaderName(name string) string {
 }
 
 // HeaderNameBytes returns the canonical format for the header name specified
-// by the bytes in p. This function modifies the contents p.
+// by the bytes in p. This function may modify the contents of p. The name is
+// returned without allocating a new string if the name is one of the
+// commonly used request or response headers.
 func HeaderNameBytes(p []byte) string {
+	// Look up common names before converting to canonical format. Most
+	// clients send common names in canonical format or lowercase.
+	if len(p) < len(internedHeaderNames) {
+		for _, name := range internedHeaderNames[len(p)] {
+			if equalFoldBytesString(p, name) {
+				return name
+			}
+		}
+	}
 	upper := true
 	for i, c := range p {
 		if upper {
@@ -238,6 +287,114 @@ func HeaderNameBytes(p []byte) string {
 	return string(p)
 }
 
+// internedHeaderNames is a table of common request and response header names
+// indexed by the length of the name.
+var internedHeaderNames [32][]string
+
+func init() {
+	for _, name := range []string{
+		HeaderAccept,
+		HeaderAcceptCharset,
+		HeaderAcceptEncoding,
+		HeaderAcceptLanguage,
+		HeaderAuthorization,
+		HeaderCacheControl,
+		HeaderConnection,
+		HeaderContentLength,
+		HeaderContentType,
+		HeaderCookie,
+		HeaderExpect,
+		HeaderHost,
+		HeaderIfMatch,
+		HeaderIfModifiedSince,
+		HeaderIfNoneMatch,
+		HeaderIfRange,
+		HeaderIfUnmodifiedSince,
+		HeaderOrigin,
+		HeaderPragma,
+		HeaderRange,
+		HeaderReferer,
+		HeaderTE,
+		HeaderUpgrade,
+		HeaderUserAgent,
+		HeaderVia,
+		"Keep-Alive",
+		"X-Forwarded-For",
+		"X-Requested-With",
+		HeaderAge,
+		HeaderContentEncoding,
+		HeaderDate,
+		HeaderETag,
+		HeaderExpires,
+		HeaderLastModified,
+		HeaderLocation,
+		HeaderServer,
+		HeaderSetCookie,
+		HeaderTransferEncoding,
+		HeaderVary,
+	} {
+		v := vector.StringVector(internedHeaderNames[len(name)])
+		v.Push(name)
+		internedHeaderNames[len(name)] = v
+	}
+}
+
+// equalFoldBytesString returns true if p and s are equal under ASCII case
+// folding.
+func equalFoldBytesString(p []byte, s string) bool {
+	if len(p) != len(s) {
+		return false
+	}
+	for i := 0; i < len(p); i++ {
+		c, d := p[i], s[i]
+		if c == d {
+			continue
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if 'A' <= d && d <= 'Z' {
+			d += 'a' - 'A'
+		}
+		if c != d {
+			return false
+		}
+	}
+	return true
+}
+
+// CleanPath returns the canonical form of the URL path p. CleanPath removes
+// empty and "." segments, resolves ".." segments and preserves a trailing
+// slash. The returned path always starts with "/". The escape flag is true
+// if a ".." segment refers to the parent of the root.
+func CleanPath(p string) (clean string, escape bool) {
+	segments := strings.Split(p, "/", -1)
+	out := make([]string, 0, len(segments))
+	for _, s := range segments {
+		switch s {
+		case "", ".":
+			// skip
+		case "..":
+			if len(out) == 0 {
+				escape = true
+			} else {
+				out = out[0 : len(out)-1]
+			}
+		default:
+			out = out[0 : len(out)+1]
+			out[len(out)-1] = s
+		}
+	}
+	clean = "/" + strings.Join(out, "/")
+	if len(out) > 0 && len(segments) > 1 {
+		switch segments[len(segments)-1] {
+		case "", ".", "..":
+			clean += "/"
+		}
+	}
+	return clean, escape
+}
+
 // ProtocolVersion combines HTTP major and minor protocol numbers into a single
 // integer for easy comparision.
 func ProtocolVersion(major int, minor int) int {
@@ -261,48 +418,101 @@ func dehex(c byte) byte {
 	return notHex
 }
 
+// ParseUrlEncodedForm parses the URL-encoded form s and appends the values
+// to the supplied map. Pairs are separated by '&' or ';', '+' is decoded as a
+// space and a key without '=' is added with an empty value. If strict is
+// true, then ParseUrlEncodedForm returns ErrBadFormat on an invalid percent
+// escape. Otherwise, invalid escapes are treated as literal text.
+func ParseUrlEncodedForm(s string, m StringsMap, strict bool) os.Error {
+	return parseUrlEncodedFormBytes([]byte(s), m, strict)
+}
+
 // parseUrlEncodedFormBytes parses the URL-encoded form and appends the values to
 // the supplied map. This function modifies the contents of p.
-func parseUrlEncodedFormBytes(p []byte, m StringsMap) os.Error {
-	key := ""
+func parseUrlEncodedFormBytes(p []byte, m StringsMap, strict bool) os.Error {
+	for len(p) > 0 {
+		i := 0
+		for i < len(p) && p[i] != '&' && p[i] != ';' {
+			i += 1
+		}
+		pair := p[0:i]
+		if i < len(p) {
+			i += 1
+		}
+		p = p[i:]
+
+		i = 0
+		for i < len(pair) && pair[i] != '=' {
+			i += 1
+		}
+		key, err := unescapeFormBytes(pair[0:i], strict)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			continue
+		}
+		value := ""
+		if i < len(pair) {
+			value, err = unescapeFormBytes(pair[i+1:], strict)
+			if err != nil {
+				return err
+			}
+		}
+		m.Append(key, value)
+	}
+	return nil
+}
+
+// unescapeFormBytes decodes '+' and percent escapes in p. This function
+// modifies the contents of p.
+func unescapeFormBytes(p []byte, strict bool) (string, os.Error) {
 	j := 0
 	for i := 0; i < len(p); {
 		switch p[i] {
-		case '=':
-			key = string(p[0:j])
-			j = 0
-			i += 1
-		case '&':
-			m.Append(key, string(p[0:j]))
-			key = ""
-			j = 0
+		case '+':
+			p[j] = ' '
+			j += 1
 			i += 1
 		case '%':
-			if i+2 >= len(p) {
-				return ErrBadFormat
+			if i+2 < len(p) {
+				a := dehex(p[i+1])
+				b := dehex(p[i+2])
+				if a != notHex && b != notHex {
+					p[j] = a<<4 | b
+					j += 1
+					i += 3
+					continue
+				}
 			}
-			a := dehex(p[i+1])
-			b := dehex(p[i+2])
-			if a == notHex || b == notHex {
-				return ErrBadFormat
+			if strict {
+				return "", ErrBadFormat
 			}
-			p[j] = a<<4 | b
+			p[j] = '%'
 			j += 1
-			i += 3
+			i += 1
 		default:
 			p[j] = p[i]
 			j += 1
 			i += 1
 		}
 	}
-	if key != "" {
-		m.Append(key, string(p[0:j]))
-	}
-	return nil
+	return string(p[0:j]), nil
 }
 
-func parseCookieValues(values []string) StringsMap {
-	m := make(StringsMap)
+// parseCookies returns the cookies in the Cookie header values in the order
+// that the cookies appear in the header.
+func parseCookies(values []string) []Cookie {
+	var cookies []Cookie
+	add := func(name, value string) {
+		if len(cookies) == cap(cookies) {
+			tmp := make([]Cookie, len(cookies), 2*len(cookies)+4)
+			copy(tmp, cookies)
+			cookies = tmp
+		}
+		cookies = cookies[0 : len(cookies)+1]
+		cookies[len(cookies)-1] = Cookie{Name: name, Value: value}
+	}
 	for _, s := range values {
 		key := ""
 		begin := 0
@@ -321,8 +531,7 @@ func parseCookieValues(values []string) StringsMap {
 				end = begin
 			case ';':
 				if len(key) > 0 && key[0] != '$' && begin < end {
-					value := s[begin:end]
-					m.Append(key, value)
+					add(key, s[begin:end])
 				}
 				key = ""
 				begin = i + 1
@@ -332,9 +541,17 @@ func parseCookieValues(values []string) StringsMap {
 			}
 		}
 		if len(key) > 0 && key[0] != '$' && begin < end {
-			m.Append(key, s[begin:end])
+			add(key, s[begin:end])
 		}
 	}
+	return cookies
+}
+
+func parseCookieValues(values []string) StringsMap {
+	m := make(StringsMap)
+	for _, c := range parseCookies(values) {
+		m.Append(c.Name, c.Value)
+	}
 	return m
 }
 
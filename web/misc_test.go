@@ -15,6 +15,7 @@
 package web
 
 import (
+	"os"
 	"testing"
 	"reflect"
 )
@@ -46,25 +47,222 @@ func TestParseCookieValues(t *testing.T) {
 }
 
 type ParseUrlEncodedFormTest struct {
-	s string
-	m StringsMap
+	s      string
+	strict bool
+	m      StringsMap
+	err    os.Error
 }
 
 var ParseUrlEncodedFormTests = []ParseUrlEncodedFormTest{
-	ParseUrlEncodedFormTest{"a=", StringsMap{"a": []string{""}}},
-	ParseUrlEncodedFormTest{"a=b", StringsMap{"a": []string{"b"}}},
-	ParseUrlEncodedFormTest{"a=b&c=d", StringsMap{"a": []string{"b"}, "c": []string{"d"}}},
-	ParseUrlEncodedFormTest{"a=b&a=c", StringsMap{"a": []string{"b", "c"}}},
-	ParseUrlEncodedFormTest{"a=Hello%20World", StringsMap{"a": []string{"Hello World"}}},
+	ParseUrlEncodedFormTest{"", true, StringsMap{}, nil},
+	ParseUrlEncodedFormTest{"a=", true, StringsMap{"a": []string{""}}, nil},
+	ParseUrlEncodedFormTest{"a=b", true, StringsMap{"a": []string{"b"}}, nil},
+	ParseUrlEncodedFormTest{"a=b&c=d", true, StringsMap{"a": []string{"b"}, "c": []string{"d"}}, nil},
+	ParseUrlEncodedFormTest{"a=b&a=c", true, StringsMap{"a": []string{"b", "c"}}, nil},
+	ParseUrlEncodedFormTest{"a=Hello%20World", true, StringsMap{"a": []string{"Hello World"}}, nil},
+	ParseUrlEncodedFormTest{"a=Hello+World", true, StringsMap{"a": []string{"Hello World"}}, nil},
+	ParseUrlEncodedFormTest{"a%2Bb=c%2bd", true, StringsMap{"a+b": []string{"c+d"}}, nil},
+	ParseUrlEncodedFormTest{"a=b;c=d", true, StringsMap{"a": []string{"b"}, "c": []string{"d"}}, nil},
+	ParseUrlEncodedFormTest{"a=b=c", true, StringsMap{"a": []string{"b=c"}}, nil},
+	ParseUrlEncodedFormTest{"a", true, StringsMap{"a": []string{""}}, nil},
+	ParseUrlEncodedFormTest{"a=b&c", true, StringsMap{"a": []string{"b"}, "c": []string{""}}, nil},
+	ParseUrlEncodedFormTest{"a=b&&c=d&", true, StringsMap{"a": []string{"b"}, "c": []string{"d"}}, nil},
+	ParseUrlEncodedFormTest{"=b&c=d", true, StringsMap{"c": []string{"d"}}, nil},
+	ParseUrlEncodedFormTest{"a=%2", true, StringsMap{}, ErrBadFormat},
+	ParseUrlEncodedFormTest{"a=%zz", true, StringsMap{}, ErrBadFormat},
+	ParseUrlEncodedFormTest{"a=%2", false, StringsMap{"a": []string{"%2"}}, nil},
+	ParseUrlEncodedFormTest{"a=100%&b=%zz", false, StringsMap{"a": []string{"100%"}, "b": []string{"%zz"}}, nil},
 }
 
 func TestParseUrlEncodedForm(t *testing.T) {
 	for _, pt := range ParseUrlEncodedFormTests {
-		p := []byte(pt.s)
 		m := make(StringsMap)
-		parseUrlEncodedFormBytes(p, m)
-		if !reflect.DeepEqual(pt.m, m) {
-			t.Errorf("form=%s,\nexpected %q\nactual   %q", pt.s, pt.m, m)
+		err := ParseUrlEncodedForm(pt.s, m, pt.strict)
+		if err != pt.err {
+			t.Errorf("form=%s strict=%v, expected error %v, actual %v", pt.s, pt.strict, pt.err, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(pt.m, m) {
+			t.Errorf("form=%s strict=%v,\nexpected %q\nactual   %q", pt.s, pt.strict, pt.m, m)
+		}
+	}
+}
+
+type HeaderNameTest struct {
+	s        string
+	expected string
+}
+
+var HeaderNameTests = []HeaderNameTest{
+	HeaderNameTest{"content-type", "Content-Type"},
+	HeaderNameTest{"CONTENT-LENGTH", "Content-Length"},
+	HeaderNameTest{"x-forwarded-for", "X-Forwarded-For"},
+	HeaderNameTest{"x-custom-header", "X-Custom-Header"},
+	HeaderNameTest{"te", "Te"},
+	HeaderNameTest{"set-cookie", "Set-Cookie"},
+	HeaderNameTest{"ETAG", "Etag"},
+	HeaderNameTest{"x-Requested-with", "X-Requested-With"},
+}
+
+func TestHeaderName(t *testing.T) {
+	for _, ht := range HeaderNameTests {
+		actual := HeaderName(ht.s)
+		if actual != ht.expected {
+			t.Errorf("HeaderName(%q) = %q, expected %q", ht.s, actual, ht.expected)
+		}
+	}
+}
+
+func TestStringsMapAppendCopies(t *testing.T) {
+	backing := []string{"a", "b"}
+	m := StringsMap{"k": backing[0:1]}
+	m.Append("k", "c")
+	if backing[1] != "b" {
+		t.Errorf("Append modified backing array, backing[1] = %q", backing[1])
+	}
+	if !reflect.DeepEqual(m["k"], []string{"a", "c"}) {
+		t.Errorf("Append, actual %q expected %q", m["k"], []string{"a", "c"})
+	}
+}
+
+type CleanPathTest struct {
+	p      string
+	clean  string
+	escape bool
+}
+
+var CleanPathTests = []CleanPathTest{
+	CleanPathTest{"/", "/", false},
+	CleanPathTest{"", "/", false},
+	CleanPathTest{"/a/b", "/a/b", false},
+	CleanPathTest{"/a/b/", "/a/b/", false},
+	CleanPathTest{"//a//b", "/a/b", false},
+	CleanPathTest{"/a/./b", "/a/b", false},
+	CleanPathTest{"/a/b/.", "/a/b/", false},
+	CleanPathTest{"/a/../b", "/b", false},
+	CleanPathTest{"/a/b/..", "/a/", false},
+	CleanPathTest{"/a/..", "/", false},
+	CleanPathTest{"/..", "/", true},
+	CleanPathTest{"/a/../../etc/passwd", "/etc/passwd", true},
+	CleanPathTest{"a/b", "/a/b", false},
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, ct := range CleanPathTests {
+		clean, escape := CleanPath(ct.p)
+		if clean != ct.clean || escape != ct.escape {
+			t.Errorf("CleanPath(%q) = %q, %v, expected %q, %v", ct.p, clean, escape, ct.clean, ct.escape)
+		}
+	}
+}
+
+var parseHTTPDateTests = []string{
+	"Sun, 06 Nov 1994 08:49:37 GMT",
+	"Sunday, 06-Nov-94 08:49:37 GMT",
+	"Sun Nov  6 08:49:37 1994",
+}
+
+func TestParseHTTPDate(t *testing.T) {
+	const expected = 784111777
+	for _, s := range parseHTTPDateTests {
+		tm, err := ParseHTTPDate(s)
+		if err != nil {
+			t.Errorf("ParseHTTPDate(%q) returned error %v", s, err)
+			continue
+		}
+		if tm.Seconds() != expected {
+			t.Errorf("ParseHTTPDate(%q) = %d, expected %d", s, tm.Seconds(), expected)
 		}
 	}
+	if _, err := ParseHTTPDate("yesterday"); err != ErrBadFormat {
+		t.Errorf("ParseHTTPDate(yesterday) returned %v, expected ErrBadFormat", err)
+	}
+}
+
+type DetectContentTypeTest struct {
+	data     string
+	expected string
+}
+
+var DetectContentTypeTests = []DetectContentTypeTest{
+	DetectContentTypeTest{"\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+	DetectContentTypeTest{"GIF89a...", "image/gif"},
+	DetectContentTypeTest{"  <!DOCTYPE HTML><html>", "text/html; charset=utf-8"},
+	DetectContentTypeTest{"<html><body>", "text/html; charset=utf-8"},
+	DetectContentTypeTest{"Hello, world\n", "text/plain; charset=utf-8"},
+	DetectContentTypeTest{"caf\xc3\xa9", "text/plain; charset=utf-8"},
+	DetectContentTypeTest{"\x00\x01\x02", "application/octet-stream"},
+	DetectContentTypeTest{"caf\xe9 bar", "application/octet-stream"},
+}
+
+func TestDetectContentType(t *testing.T) {
+	for _, dt := range DetectContentTypeTests {
+		actual := DetectContentType([]byte(dt.data))
+		if actual != dt.expected {
+			t.Errorf("DetectContentType(%q) = %q, expected %q", dt.data, actual, dt.expected)
+		}
+	}
+}
+
+func TestTypeByExtension(t *testing.T) {
+	if actual := TypeByExtension(".PNG"); actual != "image/png" {
+		t.Errorf("TypeByExtension(.PNG) = %q", actual)
+	}
+	AddExtensionType(".twister", "application/x-twister")
+	if actual := ContentType("a.twister", nil); actual != "application/x-twister" {
+		t.Errorf("ContentType(a.twister) = %q", actual)
+	}
+}
+
+type ParseRangeTest struct {
+	header string
+	size   int64
+	ranges []ByteRange
+	err    os.Error
+}
+
+var ParseRangeTests = []ParseRangeTest{
+	ParseRangeTest{"bytes=0-499", 1000, []ByteRange{ByteRange{0, 500}}, nil},
+	ParseRangeTest{"bytes=500-999", 1000, []ByteRange{ByteRange{500, 500}}, nil},
+	ParseRangeTest{"bytes=500-", 1000, []ByteRange{ByteRange{500, 500}}, nil},
+	ParseRangeTest{"bytes=-200", 1000, []ByteRange{ByteRange{800, 200}}, nil},
+	ParseRangeTest{"bytes=-2000", 1000, []ByteRange{ByteRange{0, 1000}}, nil},
+	ParseRangeTest{"bytes=900-2000", 1000, []ByteRange{ByteRange{900, 100}}, nil},
+	ParseRangeTest{"bytes=0-0, -1", 1000, []ByteRange{ByteRange{0, 1}, ByteRange{999, 1}}, nil},
+	ParseRangeTest{"bytes=1000-", 1000, nil, ErrUnsatisfiableRange},
+	ParseRangeTest{"bytes=0-1", 0, nil, ErrUnsatisfiableRange},
+	ParseRangeTest{"bytes=5-4", 1000, nil, ErrBadFormat},
+	ParseRangeTest{"bytes=a-b", 1000, nil, ErrBadFormat},
+	ParseRangeTest{"bytes=10", 1000, nil, ErrBadFormat},
+	ParseRangeTest{"items=0-1", 1000, nil, ErrBadFormat},
+}
+
+func TestParseRange(t *testing.T) {
+	for _, rt := range ParseRangeTests {
+		ranges, err := ParseRange(rt.header, rt.size)
+		if err != rt.err {
+			t.Errorf("ParseRange(%q, %d) error = %v, expected %v", rt.header, rt.size, err, rt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(ranges, rt.ranges) {
+			t.Errorf("ParseRange(%q, %d) = %v, expected %v", rt.header, rt.size, ranges, rt.ranges)
+		}
+	}
+	if s := (ByteRange{0, 500}).ContentRange(1000); s != "bytes 0-499/1000" {
+		t.Errorf("ContentRange = %q", s)
+	}
+}
+
+func BenchmarkHeaderNameCommon(b *testing.B) {
+	p := []byte("accept-encoding")
+	for i := 0; i < b.N; i++ {
+		HeaderNameBytes(p)
+	}
+}
+
+func BenchmarkHeaderNameUncommon(b *testing.B) {
+	p := []byte("x-custom-header")
+	for i := 0; i < b.N; i++ {
+		HeaderNameBytes(p)
+	}
 }
@@ -0,0 +1,553 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var errBadMultipart os.Error = &Error{Status: StatusBadRequest, Message: "bad multipart body"}
+
+// UploadPolicy specifies how ProcessMultipart handles uploaded files.
+type UploadPolicy struct {
+	// MaxMemory is the maximum number of bytes of an uploaded file that are
+	// held in memory. Larger files are written to a temporary file. The
+	// value also limits the size of form fields. The default value is used
+	// if the value is zero.
+	MaxMemory int
+
+	// TempDir is the directory for temporary files. If TempDir is "", then
+	// the directory in the TMPDIR environment variable or /tmp is used.
+	TempDir string
+
+	// MaxFileSize is the maximum size of an uploaded file in bytes. There is
+	// no limit if the value is zero.
+	MaxFileSize int64
+
+	// MaxFiles is the maximum number of files in a request. There is no
+	// limit if the value is zero.
+	MaxFiles int
+
+	// AllowedContentTypes is the list of content types accepted for
+	// uploaded files. A type of the form "image/*" matches all subtypes. All
+	// types are accepted if the list is empty.
+	AllowedContentTypes []string
+
+	// AllowedExtensions is the list of file name extensions accepted for
+	// uploaded files. The extensions include the leading dot and are matched
+	// without regard to case. All extensions are accepted if the list is
+	// empty.
+	AllowedExtensions []string
+
+	// MaxParts is the maximum number of parts, form fields and files, in a
+	// request. The default value is used if the value is zero.
+	MaxParts int
+
+	// MaxFormBytes is the maximum total size in bytes of the form fields in
+	// a request. The default value is used if the value is zero.
+	MaxFormBytes int
+}
+
+// Default values for UploadPolicy fields.
+const (
+	DefaultMaxUploadMemory   = 1 << 16
+	DefaultMaxUploadParts    = 1000
+	DefaultMaxUploadFormSize = 1 << 20
+	DefaultMaxUploadFileSize = 32 << 20
+	DefaultMaxUploadFiles    = 16
+)
+
+// DefaultUploadPolicy is used by ProcessMultipart when the policy is nil.
+// The policy limits the size and number of files.
+var DefaultUploadPolicy = &UploadPolicy{
+	MaxFileSize: DefaultMaxUploadFileSize,
+	MaxFiles:    DefaultMaxUploadFiles,
+}
+
+func (policy *UploadPolicy) maxMemory() int {
+	if policy.MaxMemory <= 0 {
+		return DefaultMaxUploadMemory
+	}
+	return policy.MaxMemory
+}
+
+func (policy *UploadPolicy) maxParts() int {
+	if policy.MaxParts <= 0 {
+		return DefaultMaxUploadParts
+	}
+	return policy.MaxParts
+}
+
+func (policy *UploadPolicy) maxFormBytes() int {
+	if policy.MaxFormBytes <= 0 {
+		return DefaultMaxUploadFormSize
+	}
+	return policy.MaxFormBytes
+}
+
+func (policy *UploadPolicy) tempDir() string {
+	if policy.TempDir != "" {
+		return policy.TempDir
+	}
+	if dir := os.Getenv("TMPDIR"); dir != "" {
+		return dir
+	}
+	return "/tmp"
+}
+
+// checkFile returns an error if a file with the given name and content type
+// is not allowed by the policy. The argument n is the number of files before
+// this file in the request.
+func (policy *UploadPolicy) checkFile(n int, name, filename, contentType string) os.Error {
+	if policy.MaxFiles > 0 && n >= policy.MaxFiles {
+		return NewError(StatusRequestEntityTooLarge, "too many files",
+			"field", name, "filename", filename, "maxFiles", strconv.Itoa(policy.MaxFiles))
+	}
+	if len(policy.AllowedContentTypes) > 0 {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";", 2)[0]))
+		allowed := false
+		for _, t := range policy.AllowedContentTypes {
+			t = strings.ToLower(t)
+			if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[0:len(t)-1])) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return NewError(StatusUnsupportedMediaType, "content type not allowed",
+				"field", name, "filename", filename, "contentType", contentType)
+		}
+	}
+	if len(policy.AllowedExtensions) > 0 {
+		ext := strings.ToLower(path.Ext(filename))
+		allowed := false
+		for _, e := range policy.AllowedExtensions {
+			if ext != "" && strings.ToLower(e) == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return NewError(StatusUnsupportedMediaType, "file extension not allowed",
+				"field", name, "filename", filename)
+		}
+	}
+	return nil
+}
+
+// UploadedFile is a file uploaded in a multipart/form-data request body.
+// Small files are held in memory. Larger files are held in a temporary file
+// that is removed when the handler returns. Use MoveTo to keep the file.
+type UploadedFile struct {
+	Name        string     // Name of the form field.
+	Filename    string     // File name sent by the client.
+	ContentType string     // Content type sent by the client.
+	Header      StringsMap // Part header.
+	Size        int64      // Size of the file in bytes.
+
+	data []byte
+	path string
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() os.Error { return nil }
+
+// Open returns a reader for the file contents.
+func (f *UploadedFile) Open() (io.ReadCloser, os.Error) {
+	if f.path == "" {
+		if f.data == nil {
+			return nil, ErrInvalidState
+		}
+		return nopCloser{bytes.NewBuffer(f.data)}, nil
+	}
+	return os.Open(f.path, os.O_RDONLY, 0)
+}
+
+// tempFileName returns a new random file name in dir.
+func tempFileName(dir, prefix string) string {
+	p := make([]byte, 8)
+	if _, err := rand.Reader.Read(p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return dir + "/" + prefix + hex.EncodeToString(p)
+}
+
+// MoveTo moves the file to path. The file is renamed if the file is held
+// in a temporary file on the same file system as path. Otherwise, the file
+// is written to a temporary file in the directory of path and then renamed
+// to path. After MoveTo returns successfully, the uploaded file is owned by
+// the caller and is no longer available through the UploadedFile.
+func (f *UploadedFile) MoveTo(path string) os.Error {
+	if f.path != "" {
+		if err := os.Rename(f.path, path); err == nil {
+			f.path = ""
+			return nil
+		}
+	}
+	dir := "."
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir = path[0:i]
+	}
+	tmp := tempFileName(dir, ".upload-")
+	w, err := os.Open(tmp, os.O_WRONLY|os.O_CREAT|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r, err := f.Open()
+	if err == nil {
+		_, err = io.Copy(w, r)
+		r.Close()
+	}
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.remove()
+	return nil
+}
+
+// remove releases the file contents.
+func (f *UploadedFile) remove() {
+	if f.path != "" {
+		os.Remove(f.path)
+	}
+	f.path = ""
+	f.data = nil
+}
+
+// spoolWriter holds data in memory up to a limit and then in a temporary
+// file.
+type spoolWriter struct {
+	policy *UploadPolicy
+	buf    bytes.Buffer
+	file   *os.File
+	path   string
+	n      int64
+	tooBig os.Error
+}
+
+func (w *spoolWriter) Write(p []byte) (int, os.Error) {
+	w.n += int64(len(p))
+	if w.policy.MaxFileSize > 0 && w.n > w.policy.MaxFileSize {
+		return 0, w.tooBig
+	}
+	if w.file == nil && w.buf.Len()+len(p) > w.policy.maxMemory() {
+		path := tempFileName(w.policy.tempDir(), "twister-upload-")
+		file, err := os.Open(path, os.O_WRONLY|os.O_CREAT|os.O_EXCL, 0600)
+		if err != nil {
+			return 0, err
+		}
+		w.file = file
+		w.path = path
+		if _, err := w.file.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+	}
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// limitedBuffer is a buffer that rejects writes past a limit with the error
+// tooBig.
+type limitedBuffer struct {
+	bytes.Buffer
+	maxLen int
+	tooBig os.Error
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, os.Error) {
+	if b.Len()+len(p) > b.maxLen {
+		return 0, b.tooBig
+	}
+	return b.Buffer.Write(p)
+}
+
+// multipartReader reads the parts of a multipart body.
+type multipartReader struct {
+	br    *bufio.Reader
+	delim string // --boundary
+	close string // --boundary--
+}
+
+var crlf = []byte("\r\n")
+
+// isDelimiter returns whether line is a delimiter line and whether the
+// delimiter is the close delimiter.
+func (mr *multipartReader) isDelimiter(line []byte) (delim bool, close bool) {
+	if len(line) > len(mr.close)+64 {
+		return false, false
+	}
+	s := strings.TrimRight(string(line), " \t\r\n")
+	return s == mr.delim || s == mr.close, s == mr.close
+}
+
+// skipPreamble reads to the first delimiter. It returns true if the first
+// delimiter is the close delimiter.
+func (mr *multipartReader) skipPreamble() (bool, os.Error) {
+	for {
+		line, err := mr.br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return false, errBadMultipart
+		}
+		if delim, close := mr.isDelimiter(line); delim {
+			return close, nil
+		}
+	}
+	panic("unreachable")
+}
+
+// readHeader reads a part header.
+func (mr *multipartReader) readHeader() (StringsMap, os.Error) {
+	header := make(StringsMap)
+	for i := 0; ; i++ {
+		line, err := mr.br.ReadSlice('\n')
+		if err != nil || i > 32 {
+			return nil, errBadMultipart
+		}
+		s := strings.TrimRight(string(line), "\r\n")
+		if s == "" {
+			return header, nil
+		}
+		j := strings.Index(s, ":")
+		if j <= 0 {
+			return nil, errBadMultipart
+		}
+		header.Append(HeaderName(s[0:j]), strings.TrimSpace(s[j+1:]))
+	}
+	panic("unreachable")
+}
+
+// copyPart copies the part body to w. It returns true if the part is the
+// last part.
+func (mr *multipartReader) copyPart(w io.Writer) (bool, os.Error) {
+	// The line break before a delimiter belongs to the delimiter. Hold the
+	// line break until the next line is read.
+	pendingCRLF := false
+	lineStart := true
+	for {
+		line, err := mr.br.ReadSlice('\n')
+		full := err == bufio.ErrBufferFull
+		if err != nil && !full {
+			return false, errBadMultipart
+		}
+		if lineStart && !full {
+			if delim, close := mr.isDelimiter(line); delim {
+				return close, nil
+			}
+		}
+		if pendingCRLF {
+			if _, err := w.Write(crlf); err != nil {
+				return false, err
+			}
+		}
+		pendingCRLF = !full && bytes.HasSuffix(line, crlf)
+		if pendingCRLF {
+			line = line[0 : len(line)-2]
+		}
+		if _, err := w.Write(line); err != nil {
+			return false, err
+		}
+		lineStart = !full
+	}
+	panic("unreachable")
+}
+
+const uploadedFilesKey = "web.files"
+
+// parseMultipart parses a multipart/form-data request body. Form fields are
+// added to the request parameters. The uploaded files are returned in the
+// order received and stored in the request environment. The number of parts
+// and the size of the form fields are checked against the policy as the
+// body is read.
+func parseMultipart(req *Request, policy *UploadPolicy) ([]*UploadedFile, os.Error) {
+	if req.Env == nil {
+		req.Env = make(map[string]interface{})
+	}
+	boundary := contentTypeParam(req.Header.GetDef(HeaderContentType, ""), "boundary")
+	if boundary == "" {
+		return nil, errBadMultipart
+	}
+	mr := &multipartReader{
+		br:    bufio.NewReader(req.Body),
+		delim: "--" + boundary,
+		close: "--" + boundary + "--",
+	}
+	var files []*UploadedFile
+	byName := make(map[string][]*UploadedFile)
+	req.Env[uploadedFilesKey] = byName
+
+	parts := 0
+	formBytes := 0
+	last, err := mr.skipPreamble()
+	for !last && err == nil {
+		parts += 1
+		if parts > policy.maxParts() {
+			err = NewError(StatusRequestEntityTooLarge, "too many parts",
+				"maxParts", strconv.Itoa(policy.maxParts()))
+			break
+		}
+		var header StringsMap
+		header, err = mr.readHeader()
+		if err != nil {
+			break
+		}
+		disposition := header.GetDef(HeaderContentDisposition, "")
+		name := contentTypeParam(disposition, "name")
+		filename, isFile := "", strings.Index(disposition, "filename=") >= 0
+		if isFile {
+			filename = contentTypeParam(disposition, "filename")
+		}
+		if !isFile {
+			b := &limitedBuffer{maxLen: policy.maxMemory(), tooBig: ErrRequestEntityTooLarge}
+			if n := policy.maxFormBytes() - formBytes; n < b.maxLen {
+				b.maxLen = n
+				b.tooBig = NewError(StatusRequestEntityTooLarge, "form too large",
+					"field", name, "maxFormBytes", strconv.Itoa(policy.maxFormBytes()))
+			}
+			last, err = mr.copyPart(b)
+			if err == nil {
+				formBytes += b.Len()
+				req.Param.Append(name, b.String())
+			}
+			continue
+		}
+		f := &UploadedFile{
+			Name:        name,
+			Filename:    filename,
+			ContentType: header.GetDef(HeaderContentType, "application/octet-stream"),
+			Header:      header,
+		}
+		err = policy.checkFile(len(files), name, filename, f.ContentType)
+		if err != nil {
+			break
+		}
+		w := &spoolWriter{
+			policy: policy,
+			tooBig: NewError(StatusRequestEntityTooLarge, "file too large",
+				"field", name, "filename", filename, "maxFileSize", strconv.Itoa64(policy.MaxFileSize)),
+		}
+		last, err = mr.copyPart(w)
+		if w.file != nil {
+			w.file.Close()
+			f.path = w.path
+		} else {
+			f.data = w.buf.Bytes()
+		}
+		f.Size = w.n
+		// Append the file before checking the error so that a partially
+		// written temporary file is removed.
+		files = appendUploadedFile(files, f)
+		byName[name] = appendUploadedFile(byName[name], f)
+	}
+	return files, err
+}
+
+func appendUploadedFile(s []*UploadedFile, f *UploadedFile) []*UploadedFile {
+	t := make([]*UploadedFile, len(s)+1)
+	copy(t, s)
+	t[len(s)] = f
+	return t
+}
+
+const uploadErrorKey = "web.uploadError"
+
+// RequestUploadError returns the error that caused ProcessMultipart to
+// reject the request body or nil if the body was not rejected. Error pages
+// and logging middleware wrapping ProcessMultipart can use the fields of the
+// error to report the violation.
+func RequestUploadError(req *Request) *Error {
+	e, _ := req.Env[uploadErrorKey].(*Error)
+	return e
+}
+
+// RequestFiles returns the files uploaded in the named form field.
+func RequestFiles(req *Request, name string) []*UploadedFile {
+	byName, _ := req.Env[uploadedFilesKey].(map[string][]*UploadedFile)
+	return byName[name]
+}
+
+// RequestFile returns the first file uploaded in the named form field or nil
+// if there is no such file.
+func RequestFile(req *Request, name string) *UploadedFile {
+	files := RequestFiles(req, name)
+	if len(files) == 0 {
+		return nil
+	}
+	return files[0]
+}
+
+// ProcessMultipart returns middleware that parses multipart/form-data
+// request bodies. Form fields are added to the request parameters and
+// uploaded files are available through RequestFile and RequestFiles.
+// Temporary files are removed when the handler returns unless the handler
+// moves the file with MoveTo. If policy is nil, then DefaultUploadPolicy is
+// used.
+//
+// Requests that violate the policy are rejected before the handler is
+// called. Too many parts, too many files, form fields larger than the
+// maximum form size or a file larger than the maximum size are rejected
+// with status 413. A file with a content type or extension that is
+// not allowed is rejected with status 415. The violation is available
+// through RequestUploadError.
+func ProcessMultipart(policy *UploadPolicy) Middleware {
+	if policy == nil {
+		policy = DefaultUploadPolicy
+	}
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			if req.ContentType != "multipart/form-data" || (req.Method != "POST" && req.Method != "PUT") {
+				handler.ServeWeb(req)
+				return
+			}
+			files, err := parseMultipart(req, policy)
+			defer func() {
+				for _, f := range files {
+					f.remove()
+				}
+			}()
+			if err != nil {
+				if e, ok := err.(*Error); ok {
+					req.Env[uploadErrorKey] = e
+				}
+				req.Error(ErrorStatus(err, StatusBadRequest), err)
+				return
+			}
+			handler.ServeWeb(req)
+		})
+	}
+}
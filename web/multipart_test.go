@@ -0,0 +1,190 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const multipartTestBody = "preamble\r\n" +
+	"--xxx\r\n" +
+	"Content-Disposition: form-data; name=\"a\"\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--xxx\r\n" +
+	"Content-Disposition: form-data; name=\"small\"; filename=\"small.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line1\r\nline2\n\r\n" +
+	"--xxx\r\n" +
+	"Content-Disposition: form-data; name=\"large\"; filename=\"large.txt\"\r\n" +
+	"\r\n" +
+	"0123456789abcdefghij\r\n" +
+	"--xxx--\r\n" +
+	"epilogue"
+
+func newMultipartTestRequest(body string) *Request {
+	return &Request{
+		Method:        "POST",
+		Header:        NewStringsMap(HeaderContentType, "multipart/form-data; boundary=xxx"),
+		Param:         make(StringsMap),
+		ContentType:   "multipart/form-data",
+		ContentLength: len(body),
+		Body:          bytes.NewBufferString(body),
+		Responder:     &testResponder{},
+		ErrorHandler:  defaultErrorHandler,
+	}
+}
+
+func readUploadedFile(t *testing.T, f *UploadedFile) string {
+	r, err := f.Open()
+	if err != nil {
+		t.Fatalf("open %s: %v", f.Name, err)
+	}
+	defer r.Close()
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", f.Name, err)
+	}
+	return string(p)
+}
+
+func TestProcessMultipart(t *testing.T) {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	policy := &UploadPolicy{MaxMemory: 16, TempDir: dir}
+
+	var small, large *UploadedFile
+	var largePath string
+	h := ProcessMultipart(policy)(HandlerFunc(func(req *Request) {
+		if v := req.Param.GetDef("a", ""); v != "hello" {
+			t.Errorf("param a = %q, expected hello", v)
+		}
+		small = RequestFile(req, "small")
+		large = RequestFile(req, "large")
+		if small == nil || large == nil {
+			t.Fatalf("missing files small=%v large=%v", small, large)
+		}
+		if s := readUploadedFile(t, small); s != "line1\r\nline2\n" {
+			t.Errorf("small = %q", s)
+		}
+		if small.Filename != "small.txt" || small.ContentType != "text/plain" || small.Size != 13 {
+			t.Errorf("small = %+v", small)
+		}
+		if small.path != "" {
+			t.Errorf("small file spooled to disk")
+		}
+		if s := readUploadedFile(t, large); s != "0123456789abcdefghij" {
+			t.Errorf("large = %q", s)
+		}
+		largePath = large.path
+		if !strings.HasPrefix(largePath, dir+"/") {
+			t.Errorf("large path = %q, expected file in %s", largePath, dir)
+		}
+		req.Respond(StatusOK)
+	}))
+	h.ServeWeb(newMultipartTestRequest(multipartTestBody))
+
+	if _, err := os.Stat(largePath); err == nil {
+		t.Errorf("temporary file %s not removed", largePath)
+	}
+}
+
+func TestUploadedFileMoveTo(t *testing.T) {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	policy := &UploadPolicy{MaxMemory: 16, TempDir: dir}
+	dst := tempFileName(dir, "twister-test-")
+	defer os.Remove(dst)
+
+	h := ProcessMultipart(policy)(HandlerFunc(func(req *Request) {
+		if err := RequestFile(req, "large").MoveTo(dst); err != nil {
+			t.Fatalf("MoveTo returned %v", err)
+		}
+		req.Respond(StatusOK)
+	}))
+	h.ServeWeb(newMultipartTestRequest(multipartTestBody))
+
+	p, err := ioutil.ReadFile(dst)
+	if err != nil || string(p) != "0123456789abcdefghij" {
+		t.Errorf("moved file = %q, %v", p, err)
+	}
+}
+
+func TestProcessMultipartBadBody(t *testing.T) {
+	h := ProcessMultipart(nil)(HandlerFunc(func(req *Request) {
+		t.Errorf("handler called for bad body")
+	}))
+	tr := &testResponder{}
+	req := newMultipartTestRequest("--xxx\r\n\r\nno close delimiter")
+	req.Responder = tr
+	h.ServeWeb(req)
+	if tr.status != StatusBadRequest {
+		t.Errorf("status = %d, expected %d", tr.status, StatusBadRequest)
+	}
+}
+
+type uploadPolicyTest struct {
+	policy UploadPolicy
+	status int
+}
+
+var uploadPolicyTests = []uploadPolicyTest{
+	uploadPolicyTest{UploadPolicy{}, StatusOK},
+	uploadPolicyTest{UploadPolicy{MaxFiles: 2}, StatusOK},
+	uploadPolicyTest{UploadPolicy{MaxFiles: 1}, StatusRequestEntityTooLarge},
+	uploadPolicyTest{UploadPolicy{MaxFileSize: 20}, StatusOK},
+	uploadPolicyTest{UploadPolicy{MaxFileSize: 19}, StatusRequestEntityTooLarge},
+	uploadPolicyTest{UploadPolicy{MaxFileSize: 19, MaxMemory: 4}, StatusRequestEntityTooLarge},
+	uploadPolicyTest{UploadPolicy{AllowedContentTypes: []string{"text/plain", "application/octet-stream"}}, StatusOK},
+	uploadPolicyTest{UploadPolicy{AllowedContentTypes: []string{"text/*", "application/*"}}, StatusOK},
+	uploadPolicyTest{UploadPolicy{AllowedContentTypes: []string{"text/*"}}, StatusUnsupportedMediaType},
+	uploadPolicyTest{UploadPolicy{AllowedExtensions: []string{".TXT"}}, StatusOK},
+	uploadPolicyTest{UploadPolicy{AllowedExtensions: []string{".jpg", ".png"}}, StatusUnsupportedMediaType},
+	uploadPolicyTest{UploadPolicy{MaxParts: 3}, StatusOK},
+	uploadPolicyTest{UploadPolicy{MaxParts: 2}, StatusRequestEntityTooLarge},
+	uploadPolicyTest{UploadPolicy{MaxFormBytes: 5}, StatusOK},
+	uploadPolicyTest{UploadPolicy{MaxFormBytes: 4}, StatusRequestEntityTooLarge},
+}
+
+func TestUploadPolicy(t *testing.T) {
+	for _, tt := range uploadPolicyTests {
+		policy := tt.policy
+		h := ProcessMultipart(&policy)(HandlerFunc(func(req *Request) {
+			req.Respond(StatusOK)
+		}))
+		req := newMultipartTestRequest(multipartTestBody)
+		tr := &testResponder{}
+		req.Responder = tr
+		h.ServeWeb(req)
+		if tr.status != tt.status {
+			t.Errorf("%+v: status = %d, expected %d", tt.policy, tr.status, tt.status)
+		}
+		e := RequestUploadError(req)
+		if (tt.status == StatusOK) != (e == nil) {
+			t.Errorf("%+v: RequestUploadError = %v", tt.policy, e)
+		} else if e != nil && e.Status != tt.status {
+			t.Errorf("%+v: RequestUploadError status = %d, expected %d", tt.policy, e.Status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsatisfiableRange is returned by ParseRange when none of the
+// requested ranges overlap the resource. Respond with HTTP status 416 and
+// the Content-Range header set to UnsatisfiedContentRange(size).
+var ErrUnsatisfiableRange = os.NewError("requested range not satisfiable")
+
+// ByteRange specifies a range of bytes in a resource.
+type ByteRange struct {
+	Start  int64 // Offset of the first byte in the range.
+	Length int64 // Number of bytes in the range.
+}
+
+// ContentRange returns the value of the Content-Range header for the range
+// in a resource with the given size.
+func (r ByteRange) ContentRange(size int64) string {
+	return "bytes " + strconv.Itoa64(r.Start) + "-" + strconv.Itoa64(r.Start+r.Length-1) + "/" + strconv.Itoa64(size)
+}
+
+// UnsatisfiedContentRange returns the value of the Content-Range header for
+// a 416 response for a resource with the given size.
+func UnsatisfiedContentRange(size int64) string {
+	return "bytes */" + strconv.Itoa64(size)
+}
+
+// ParseRange parses the value of a Range header as defined in section 14.35
+// of RFC 2616 for a resource with the given size. The returned ranges are
+// clipped to the size of the resource. Ranges that do not overlap the
+// resource are dropped. ParseRange returns ErrBadFormat if the header
+// cannot be parsed and ErrUnsatisfiableRange if no range overlaps the
+// resource.
+func ParseRange(header string, size int64) ([]ByteRange, os.Error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, ErrBadFormat
+	}
+	specs := strings.Split(header[len(prefix):], ",", -1)
+	ranges := make([]ByteRange, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, ErrBadFormat
+		}
+		first := strings.TrimSpace(spec[0:i])
+		last := strings.TrimSpace(spec[i+1:])
+		var r ByteRange
+		if first == "" {
+			// Suffix range: the last n bytes.
+			n, err := strconv.Atoi64(last)
+			if err != nil || n < 0 {
+				return nil, ErrBadFormat
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = ByteRange{size - n, n}
+		} else {
+			start, err := strconv.Atoi64(first)
+			if err != nil || start < 0 {
+				return nil, ErrBadFormat
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.Atoi64(last)
+				if err != nil || end < start {
+					return nil, ErrBadFormat
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = ByteRange{start, end - start + 1}
+		}
+		if r.Length <= 0 {
+			continue
+		}
+		ranges = ranges[0 : len(ranges)+1]
+		ranges[len(ranges)-1] = r
+	}
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	return ranges, nil
+}
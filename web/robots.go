@@ -0,0 +1,93 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default lifetimes in seconds of the responses from RobotsHandler and
+// FaviconHandler in client and proxy caches.
+const (
+	DefaultRobotsMaxAge  = 24 * 60 * 60
+	DefaultFaviconMaxAge = 7 * 24 * 60 * 60
+)
+
+// bytesHandler serves a fixed response body.
+type bytesHandler struct {
+	contentType  string
+	body         []byte
+	maxAge       int
+	lastModified int64
+}
+
+func (h *bytesHandler) ServeWeb(req *Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		req.Respond(StatusMethodNotAllowed, HeaderAllow, "GET, HEAD")
+		return
+	}
+	header := NewStringsMap(
+		HeaderCacheControl, "public, max-age="+strconv.Itoa(h.maxAge),
+		HeaderLastModified, time.SecondsToUTC(h.lastModified).Format(TimeLayout))
+	switch status := req.CheckLastModified(h.lastModified); status {
+	case StatusNotModified:
+		req.Responder.Respond(status, header)
+		return
+	case StatusPreconditionFailed:
+		req.Error(status, nil)
+		return
+	}
+	header.Set(HeaderContentType, h.contentType)
+	header.Set(HeaderContentLength, strconv.Itoa(len(h.body)))
+	w := req.Responder.Respond(StatusOK, header)
+	if w != nil && req.Method != "HEAD" {
+		w.Write(h.body)
+	}
+}
+
+// RobotsHandler returns a handler that serves rules as the contents of
+// robots.txt. Register the handler for the path "/robots.txt":
+//
+//  router.Register("/robots.txt", "GET", web.RobotsHandler("User-agent: *\nDisallow: /admin/\n"))
+//
+// The response can be cached by clients and proxies for
+// DefaultRobotsMaxAge seconds.
+func RobotsHandler(rules string) Handler {
+	return &bytesHandler{
+		contentType:  "text/plain; charset=utf-8",
+		body:         []byte(rules),
+		maxAge:       DefaultRobotsMaxAge,
+		lastModified: time.Seconds(),
+	}
+}
+
+// FaviconHandler returns a handler that serves icon as the site's favicon.
+// The content type is determined from the contents of the icon. Use
+// ioutil.ReadFile to load the icon from a file. The response can be cached
+// by clients and proxies for DefaultFaviconMaxAge seconds.
+func FaviconHandler(icon []byte) Handler {
+	contentType := DetectContentType(icon)
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = "image/x-icon"
+	}
+	return &bytesHandler{
+		contentType:  contentType,
+		body:         icon,
+		maxAge:       DefaultFaviconMaxAge,
+		lastModified: time.Seconds(),
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func serveBytesHandler(h Handler, method string, kvs ...string) *testResponder {
+	r := &testResponder{}
+	h.ServeWeb(&Request{
+		Method:       method,
+		Header:       NewStringsMap(kvs...),
+		Responder:    r,
+		ErrorHandler: defaultErrorHandler,
+	})
+	return r
+}
+
+func TestRobotsHandler(t *testing.T) {
+	h := RobotsHandler("User-agent: *\nDisallow: /admin/\n")
+	r := serveBytesHandler(h, "GET")
+	if r.status != StatusOK || r.body.String() != "User-agent: *\nDisallow: /admin/\n" {
+		t.Errorf("status = %d, body = %q", r.status, r.body.String())
+	}
+	if v := r.header.GetDef(HeaderContentType, ""); v != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", v)
+	}
+	if v := r.header.GetDef(HeaderCacheControl, ""); v != "public, max-age=86400" {
+		t.Errorf("Cache-Control = %q", v)
+	}
+
+	lastModified := r.header.GetDef(HeaderLastModified, "")
+	r = serveBytesHandler(h, "GET", HeaderIfModifiedSince, lastModified)
+	if r.status != StatusNotModified || r.body.Len() != 0 {
+		t.Errorf("conditional GET status = %d, body = %q", r.status, r.body.String())
+	}
+	r = serveBytesHandler(h, "HEAD")
+	if r.status != StatusOK || r.body.Len() != 0 {
+		t.Errorf("HEAD status = %d, body = %q", r.status, r.body.String())
+	}
+	r = serveBytesHandler(h, "POST")
+	if r.status != StatusMethodNotAllowed {
+		t.Errorf("POST status = %d", r.status)
+	}
+}
+
+func TestFaviconHandler(t *testing.T) {
+	r := serveBytesHandler(FaviconHandler([]byte("\x89PNG\r\n\x1a\n....")), "GET")
+	if v := r.header.GetDef(HeaderContentType, ""); v != "image/png" {
+		t.Errorf("png Content-Type = %q", v)
+	}
+	r = serveBytesHandler(FaviconHandler([]byte("\x00\x00\x01\x00....")), "GET",
+		HeaderIfModifiedSince, time.SecondsToUTC(time.Seconds()-3600).Format(TimeLayout))
+	if v := r.header.GetDef(HeaderContentType, ""); r.status != StatusOK || v != "image/x-icon" {
+		t.Errorf("ico status = %d, Content-Type = %q", r.status, v)
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"utf8"
 	"flag"
 	"strings"
-	"http"
+	"os"
+	"sort"
+	"sync"
 )
 
 // Router dispatches HTTP requests to a handler using the path component of the
@@ -41,32 +43,157 @@ import (
 // The pattern must begin with the character '/'.
 //
 // A router dispatches requests by matching the path component of the request
-// URL against the route patterns in the order that the routes were registered.
+// URL against the route patterns. Routes are ordered by comparing the path
+// segments of the patterns from left to right. At the first segment where one
+// pattern has a parameter and the other does not, the pattern without the
+// parameter is matched first. Other routes are matched in the order that the
+// routes were registered. For example, "/users/new" is matched before
+// "/users/<id>" regardless of the registration order. Call StrictOrder to
+// match all routes in the order that the routes were registered.
+//
 // If a matching route is found, then the router searches the route for a
 // handler using the request method, "GET" if the request method is "HEAD" and
-// "*". If a handler is not found, the router responds with HTTP status 405. If
-// a route is not found, then the router responds with HTTP status 404.
+// "*". A handler registered for "HEAD" takes precedence over the "GET" handler
+// for HEAD requests. Call HeadFallback(false) to disable the use of "GET"
+// handlers for HEAD requests. If a handler is not found, then the router
+// continues with the next matching route. If no matching route has a handler
+// for the request, then the router responds with HTTP status 405 and an Allow
+// header with the methods of the matching routes. If a route is not found,
+// then the router responds with HTTP status 404.
 //
 // The handler can access the path parameters in the request Param.
 //
+// Patterns are matched against the request path with percent escapes decoded
+// except for the escapes of '/' and '%'. An encoded slash ("%2F") does not
+// separate path segments. The router's encoded slash policy specifies how
+// encoded slashes in path parameters are decoded. The parameter values
+// before decoding are available through RawPathParam.
+//
 // If a pattern ends with '/', then the router redirects the URL without the
 // trailing slash to the URL with the trailing slash.
 //
 type Router struct {
-	routes vector.Vector
+	routes       vector.Vector
+	middleware   []Middleware
+	encodedSlash int
+	strictOrder  bool
+	noHeadGet    bool
+
+	mu      sync.Mutex
+	matcher *routeMatcher
 }
 
 type route struct {
+	pattern  string
 	addSlash bool
+	expr     string
 	regexp   *regexp.Regexp
 	names    []string
+	dynamic  []bool // Segments with parameters.
 	handlers map[string]Handler
 }
 
+// staticBefore returns true if route a has a segment without parameters at
+// the first segment where a and b differ in having parameters.
+func staticBefore(a, b *route) bool {
+	for i := 0; i < len(a.dynamic) && i < len(b.dynamic); i++ {
+		if a.dynamic[i] != b.dynamic[i] {
+			return !a.dynamic[i]
+		}
+	}
+	return false
+}
+
+// routeMatcher matches a path against all routes with a single regexp. The
+// regexp is an alternation of the route regexps with each route regexp
+// enclosed in a group.
+type routeMatcher struct {
+	routes []*route // Routes in match order.
+	regexp *regexp.Regexp
+	groups []int // Index of the enclosing group for each route.
+}
+
+// countGroups returns the number of capturing groups in the regular
+// expression expr.
+func countGroups(expr string) int {
+	n := 0
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case c == '\\':
+			i += 1
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// A ']' at the start of the class is a literal.
+			if i+1 < len(expr) && expr[i+1] == '^' {
+				i += 1
+			}
+			if i+1 < len(expr) && expr[i+1] == ']' {
+				i += 1
+			}
+		case c == '(':
+			if i+1 >= len(expr) || expr[i+1] != '?' || strings.HasPrefix(expr[i+1:], "?P<") {
+				n += 1
+			}
+		}
+	}
+	return n
+}
+
+func newRouteMatcher(routes []*route) *routeMatcher {
+	var buf bytes.Buffer
+	groups := make([]int, len(routes))
+	n := 1
+	for i, r := range routes {
+		if i > 0 {
+			buf.WriteString("|")
+		}
+		buf.WriteString("(")
+		buf.WriteString(r.expr)
+		buf.WriteString(")")
+		groups[i] = n
+		n += 1 + countGroups(r.expr)
+	}
+	return &routeMatcher{routes, regexp.MustCompile(buf.String()), groups}
+}
+
+// match returns the index of the first route that matches path and the
+// submatches for that route. If no route matches, then match returns -1.
+// Every route regexp matches the entire path and alternatives are tried in
+// order, so the group set in the combined match is the first matching route.
+func (m *routeMatcher) match(path string) (int, []string) {
+	a := m.regexp.FindStringSubmatchIndex(path)
+	if len(a) == 0 {
+		return -1, nil
+	}
+	for i, g := range m.groups {
+		if a[2*g] < 0 {
+			continue
+		}
+		end := len(a) / 2
+		if i+1 < len(m.groups) {
+			end = m.groups[i+1]
+		}
+		values := make([]string, end-g)
+		for j := range values {
+			if k := 2 * (g + j); a[k] >= 0 {
+				values[j] = path[a[k]:a[k+1]]
+			}
+		}
+		return i, values
+	}
+	return -1, nil
+}
+
 var parameterRegexp = regexp.MustCompile("<([A-Za-z0-9]+)(:[^>]*)?>")
 
-// compilePattern compiles the pattern to a regexp and array of paramter names.
-func compilePattern(pattern string, addSlash bool) (*regexp.Regexp, []string) {
+// compilePattern compiles the pattern to a regular expression and array of
+// paramter names.
+func compilePattern(pattern string, addSlash bool) (string, []string) {
 	var buf bytes.Buffer
 	names := make([]string, 8)
 	i := 0
@@ -101,7 +228,7 @@ func compilePattern(pattern string, addSlash bool) (*regexp.Regexp, []string) {
 		buf.WriteString("?")
 	}
 	buf.WriteString("$")
-	return regexp.MustCompile(buf.String()), names[0:i]
+	return buf.String(), names[0:i]
 }
 
 // Register the route with the given pattern and handlers. The structure of the
@@ -111,6 +238,10 @@ func compilePattern(pattern string, addSlash bool) (*regexp.Regexp, []string) {
 //
 // where method is a string and handler is a Handler or a
 // func(*Request). Use "*" to match all methods.
+//
+// Any method token is accepted, including the WebDAV methods PROPFIND,
+// PROPPATCH, MKCOL, COPY, MOVE, LOCK and UNLOCK. Methods are converted to
+// uppercase to match the method in the request.
 func (router *Router) Register(pattern string, handlers ...interface{}) *Router {
 	if pattern == "" || pattern[0] != '/' {
 		panic("twister: Invalid route pattern " + pattern)
@@ -119,35 +250,204 @@ func (router *Router) Register(pattern string, handlers ...interface{}) *Router
 		panic("twister: Invalid handlers for pattern " + pattern +
 			". Structure of handlers is [method handler]+.")
 	}
-	r := route{}
+	r := route{pattern: pattern}
 	r.addSlash = pattern[len(pattern)-1] == '/'
-	r.regexp, r.names = compilePattern(pattern, r.addSlash)
+	r.expr, r.names = compilePattern(pattern, r.addSlash)
+	r.regexp = regexp.MustCompile(r.expr)
+	segments := strings.Split(pattern[1:], "/", -1)
+	r.dynamic = make([]bool, len(segments))
+	for i, segment := range segments {
+		r.dynamic[i] = strings.Index(segment, "<") >= 0
+	}
 	r.handlers = make(map[string]Handler)
 	for i := 0; i < len(handlers); i += 2 {
 		method, ok := handlers[i].(string)
-		if !ok {
+		if !ok || !isMethod(method) {
 			panic("twister: Bad method for pattern " + pattern)
 		}
+		method = strings.ToUpper(method)
+		var h Handler
 		switch handler := handlers[i+1].(type) {
 		case Handler:
-			r.handlers[method] = handler
+			h = handler
 		case func(*Request):
-			r.handlers[method] = HandlerFunc(handler)
+			h = HandlerFunc(handler)
 		default:
 			panic("twister: Bad handler for pattern " + pattern + " and method " + method)
 		}
+		r.handlers[method] = Chain(router.middleware...)(h)
 	}
+	router.mu.Lock()
 	router.routes.Push(&r)
+	router.matcher = nil
+	router.mu.Unlock()
+	return router
+}
+
+// Use adds middleware to the handlers for routes registered after the call
+// to Use. The middleware is applied in order with the first middleware
+// outermost.
+func (router *Router) Use(middleware ...Middleware) *Router {
+	m := make([]Middleware, len(router.middleware)+len(middleware))
+	copy(m, router.middleware)
+	copy(m[len(router.middleware):], middleware)
+	router.middleware = m
+	return router
+}
+
+// Policies for encoded slashes in path parameters.
+const (
+	// Decode "%2F" to '/'.
+	EncodedSlashDecode = iota
+
+	// Respond with HTTP status 404.
+	EncodedSlashReject
+
+	// Keep "%2F" in the value. The escape "%25" is also kept so that the
+	// value can be decoded unambiguously.
+	EncodedSlashKeep
+)
+
+// EncodedSlashes sets the policy for encoded slashes in path parameters.
+// The default policy is EncodedSlashDecode.
+func (router *Router) EncodedSlashes(policy int) *Router {
+	router.encodedSlash = policy
+	return router
+}
+
+// unescapePath decodes the percent escapes in s except for escapes of the
+// bytes in keep. Retained escapes are converted to uppercase.
+func unescapePath(s string, keep string) (string, os.Error) {
+	if strings.Index(s, "%") < 0 {
+		return s, nil
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return "", ErrBadFormat
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if strings.IndexRune(keep, int(c)) >= 0 {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		} else {
+			b.WriteByte(c)
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// matchPath returns the request path with the escapes of '/' and '%'
+// retained. The path is taken from the raw URL unless middleware rewrote the
+// decoded path.
+func matchPath(req *Request) string {
+	if raw := req.URL.RawPath; raw != "" {
+		if i := strings.Index(raw, "?"); i >= 0 {
+			raw = raw[0:i]
+		}
+		if p, err := unescapePath(raw, "/%"); err == nil {
+			if decoded, _ := unescapePath(p, ""); decoded == req.URL.Path {
+				return p
+			}
+		}
+	}
+	return strings.Replace(req.URL.Path, "%", "%25", -1)
+}
+
+// StrictOrder specifies whether routes are matched in the order that the
+// routes were registered. Use strict order for compatibility with routers
+// that depend on the registration order for routes with static segments.
+func (router *Router) StrictOrder(strict bool) *Router {
+	router.mu.Lock()
+	router.strictOrder = strict
+	router.matcher = nil
+	router.mu.Unlock()
 	return router
 }
 
+// HeadFallback specifies whether the router uses the handler for GET when a
+// route does not have a handler for HEAD. The fallback is enabled by default.
+func (router *Router) HeadFallback(fallback bool) *Router {
+	router.noHeadGet = !fallback
+	return router
+}
+
+// getMatcher returns the matcher for the registered routes.
+func (router *Router) getMatcher() *routeMatcher {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	if router.matcher == nil {
+		routes := make([]*route, 0, router.routes.Len())
+		for i := 0; i < router.routes.Len(); i++ {
+			r := router.routes.At(i).(*route)
+			// Insert the route before the first route with a parameter
+			// where r has a static segment.
+			j := len(routes)
+			if !router.strictOrder {
+				for j = 0; j < len(routes); j++ {
+					if staticBefore(r, routes[j]) {
+						break
+					}
+				}
+			}
+			routes = routes[0 : len(routes)+1]
+			copy(routes[j+1:], routes[j:])
+			routes[j] = r
+		}
+		router.matcher = newRouteMatcher(routes)
+	}
+	return router.matcher
+}
+
+// isMethod returns true if s is "*" or a valid method token.
+func isMethod(s string) bool {
+	if s == "*" {
+		return true
+	}
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !IsTokenByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 type routerError struct {
-	status  int
-	message string
+	status int
+	reason os.Error
+	allow  []string // Methods for the Allow header.
 }
 
 func (re *routerError) ServeWeb(req *Request) {
-	req.Error(re.status, re.message)
+	if len(re.allow) > 0 {
+		allow := strings.Join(re.allow, ", ")
+		FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+			header.Set(HeaderAllow, allow)
+			return status, header
+		})
+	}
+	req.Error(re.status, re.reason)
 }
 
 // addSlash redirects to the request URL with a trailing slash.
@@ -160,50 +460,127 @@ func addSlash(req *Request) {
 }
 
 // Given the path componennt of the request URL and the request method, find
-// the handler and path parameters.
-func (router *Router) find(path string, method string) (Handler, []string, []string) {
-	for i := 0; i < router.routes.Len(); i++ {
-		r := router.routes.At(i).(*route)
-		values := r.regexp.FindStringSubmatch(path)
-		if len(values) == 0 {
-			continue
+// the handler, path parameter names, decoded values and raw values. The path
+// has the escapes of '/' and '%' retained.
+//
+// The path is matched against all routes with a single regexp. The route
+// regexps after the first matching route are run only when that route does
+// not have a handler for the method.
+func (router *Router) find(path string, method string) (Handler, []string, []string, []string) {
+	matcher := router.getMatcher()
+	k, matched := matcher.match(path)
+	if k < 0 {
+		return &routerError{404, nil, nil}, nil, nil, nil
+	}
+	allow := make(map[string]bool)
+	for i := k; i < len(matcher.routes); i++ {
+		r := matcher.routes[i]
+		raw := matched
+		if i != k {
+			raw = r.regexp.FindStringSubmatch(path)
+			if len(raw) == 0 {
+				continue
+			}
 		}
 		if r.addSlash && path[len(path)-1] != '/' {
-			return HandlerFunc(addSlash), nil, nil
+			return HandlerFunc(addSlash), nil, nil, nil
 		}
-		values = values[1:]
-		for j := 0; j < len(values); j++ {
-			if value, e := http.URLUnescape(values[j]); e != nil {
-				return &routerError{400, "Bad request."}, nil, nil
-			} else {
-				values[j] = value
+		raw = raw[1:]
+		values := make([]string, len(raw))
+		for j := 0; j < len(raw); j++ {
+			switch {
+			case router.encodedSlash == EncodedSlashKeep:
+				values[j] = raw[j]
+			case router.encodedSlash == EncodedSlashReject && strings.Index(raw[j], "%2F") >= 0:
+				return &routerError{404, errEncodedSlash, nil}, nil, nil, nil
+			default:
+				values[j], _ = unescapePath(raw[j], "")
 			}
 		}
 		if handler := r.handlers[method]; handler != nil {
-			return handler, r.names, values
+			return handler, r.names, values, raw
 		}
-		if method == "HEAD" {
+		if method == "HEAD" && !router.noHeadGet {
 			if handler := r.handlers["GET"]; handler != nil {
-				return handler, r.names, values
+				return handler, r.names, values, raw
 			}
 		}
 		if handler := r.handlers["*"]; handler != nil {
-			return handler, r.names, values
+			return handler, r.names, values, raw
+		}
+		// Continue with the next route that matches the path. Respond with
+		// status 405 if no route has a handler for the method.
+		for m, _ := range r.handlers {
+			allow[m] = true
+			if m == "GET" && !router.noHeadGet {
+				allow["HEAD"] = true
+			}
 		}
-		return &routerError{405, "Method not supported."}, nil, nil
 	}
-	return &routerError{404, "Not found."}, nil, nil
+	methods := make([]string, 0, len(allow))
+	for m, _ := range allow {
+		methods = methods[0 : len(methods)+1]
+		methods[len(methods)-1] = m
+	}
+	sort.SortStrings(methods)
+	return &routerError{405, errMethodNotAllowed, methods}, nil, nil, nil
+}
+
+var errEncodedSlash os.Error = &Error{Status: StatusNotFound, Message: "encoded slash in path parameter"}
+
+const rawPathParamKey = "web.rawPathParam"
+
+// RawPathParam returns the value of the named path parameter set by Router
+// before the parameter was decoded. The escapes of '/' and '%' are retained
+// in the value. Other percent escapes are decoded.
+func RawPathParam(req *Request, name string) string {
+	m, _ := req.Env[rawPathParamKey].(StringsMap)
+	return m.GetDef(name, "")
 }
 
 // ServeWeb dispatches the request to a registered handler.
 func (router *Router) ServeWeb(req *Request) {
-	handler, names, values := router.find(req.URL.Path, req.Method)
-	for i := 0; i < len(names); i++ {
-		req.Param.Set(names[i], values[i])
+	handler, names, values, raw := router.find(matchPath(req), req.Method)
+	if len(names) > 0 {
+		if req.Env == nil {
+			req.Env = make(map[string]interface{})
+		}
+		rawParam, _ := req.Env[rawPathParamKey].(StringsMap)
+		if rawParam == nil {
+			rawParam = make(StringsMap)
+			req.Env[rawPathParamKey] = rawParam
+		}
+		for i := 0; i < len(names); i++ {
+			req.Param.Set(names[i], values[i])
+			rawParam.Set(names[i], raw[i])
+		}
 	}
 	handler.ServeWeb(req)
 }
 
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	Pattern string
+	Methods []string // Sorted methods with registered handlers.
+}
+
+// Routes returns the registered routes in the order that the routes are
+// matched.
+func (router *Router) Routes() []RouteInfo {
+	routes := router.getMatcher().routes
+	result := make([]RouteInfo, len(routes))
+	for i, r := range routes {
+		methods := make([]string, 0, len(r.handlers))
+		for method, _ := range r.handlers {
+			methods = methods[0 : len(methods)+1]
+			methods[len(methods)-1] = method
+		}
+		sort.SortStrings(methods)
+		result[i] = RouteInfo{r.pattern, methods}
+	}
+	return result
+}
+
 // NewRouter allocates and initializes a new Router. 
 func NewRouter() *Router {
 	return &Router{}
@@ -214,11 +591,35 @@ func NewRouter() *Router {
 // To enable debugging on localhost, the router overrides the request host with
 // the value of the hostOverride flag if set.
 //
-// If a registered handler is not found, then the router dispatches to a
-// default handler. 
+// A host pattern is a host name, a wildcard of the form "*.example.com" or
+// "*". The wildcard "*.example.com" matches subdomains of example.com and
+// "*" matches all hosts. The router dispatches to the handler registered for
+// the exact host if any. Otherwise, the router tries the wildcard patterns
+// in the order that the patterns were registered. If no pattern matches,
+// then the router dispatches to the default handler.
+//
+// The router stores the matched pattern in the request environment. Use
+// HostPattern to get the pattern.
 type HostRouter struct {
 	defaultHandler Handler
 	handlers       map[string]Handler
+	wildcards      vector.Vector
+	serverName     bool
+}
+
+type wildcardHost struct {
+	pattern string
+	suffix  string
+	handler Handler
+}
+
+const hostPatternKey = "web.hostPattern"
+
+// HostPattern returns the host pattern matched by HostRouter or "" if the
+// request was dispatched to the default handler.
+func HostPattern(req *Request) string {
+	pattern, _ := req.Env[hostPatternKey].(string)
+	return pattern
 }
 
 // NewHostRouter allocates and initializes a new HostRouter.
@@ -229,25 +630,120 @@ func NewHostRouter(defaultHandler Handler) *HostRouter {
 	return &HostRouter{defaultHandler: defaultHandler, handlers: make(map[string]Handler)}
 }
 
-// Register a handler for the given host.
-func (router *HostRouter) Register(host string, handler Handler) *HostRouter {
-	router.handlers[strings.ToLower(host)] = handler
+// NewServerNameRouter allocates and initializes a new HostRouter that
+// dispatches using the server name sent by the client in the TLS handshake
+// instead of the host header. Requests received without TLS or without a
+// server name are dispatched to the default handler.
+func NewServerNameRouter(defaultHandler Handler) *HostRouter {
+	router := NewHostRouter(defaultHandler)
+	router.serverName = true
+	return router
+}
+
+// Register a handler for the given host pattern.
+func (router *HostRouter) Register(pattern string, handler Handler) *HostRouter {
+	pattern = strings.ToLower(pattern)
+	switch {
+	case pattern == "*":
+		router.wildcards.Push(&wildcardHost{pattern, "", handler})
+	case strings.HasPrefix(pattern, "*."):
+		router.wildcards.Push(&wildcardHost{pattern, pattern[1:], handler})
+	case strings.Index(pattern, "*") >= 0:
+		panic("twister: Invalid host pattern " + pattern)
+	default:
+		router.handlers[pattern] = handler
+	}
 	return router
 }
 
 var hostOverride = flag.String("hostOverride", "", "Override request host in HostRouter")
 
+// find returns the handler and matched pattern for host.
+func (router *HostRouter) find(host string) (Handler, string) {
+	if handler, found := router.handlers[host]; found {
+		return handler, host
+	}
+	if host != "" {
+		for i := 0; i < router.wildcards.Len(); i++ {
+			w := router.wildcards.At(i).(*wildcardHost)
+			if strings.HasSuffix(host, w.suffix) {
+				return w.handler, w.pattern
+			}
+		}
+	}
+	return router.defaultHandler, ""
+}
+
 // ServeWeb dispatches the request to a registered handler.
 func (router *HostRouter) ServeWeb(req *Request) {
 	var host string
-	if len(*hostOverride) == 0 {
-		host = strings.ToLower(req.URL.Host)
-	} else {
+	switch {
+	case len(*hostOverride) != 0:
 		host = *hostOverride
+	case router.serverName:
+		if req.TLS != nil {
+			host = strings.ToLower(req.TLS.ServerName)
+		}
+	default:
+		host = strings.ToLower(req.URL.Host)
 	}
-	if handler, found := router.handlers[host]; found {
-		handler.ServeWeb(req)
-	} else {
-		router.defaultHandler.ServeWeb(req)
-	}
+	handler, pattern := router.find(host)
+	req.Env[hostPatternKey] = pattern
+	handler.ServeWeb(req)
+}
+
+// CanonicalHostHandler returns a handler that permanently redirects requests
+// to the same path and query on the given host. Use the handler as the
+// default handler of a HostRouter to redirect alternate host names to the
+// canonical host name.
+func CanonicalHostHandler(host string) Handler {
+	return HandlerFunc(func(req *Request) {
+		url := req.URL.Scheme + "://" + host + req.URL.Path
+		if req.URL.RawQuery != "" {
+			url = url + "?" + req.URL.RawQuery
+		}
+		req.Redirect(url, true)
+	})
+}
+
+// SwapHandler is a handler that forwards requests to a handler that can be
+// replaced while the server is running. Use SwapHandler to replace a router
+// with a router rebuilt from configuration:
+//
+//  routes := web.NewSwapHandler(buildRouter())
+//  ...
+//  // On reload:
+//  routes.Swap(buildRouter())
+//
+// Requests in progress when the handler is replaced complete with the
+// previous handler.
+type SwapHandler struct {
+	mu      sync.RWMutex
+	handler Handler
+}
+
+// NewSwapHandler returns a swap handler that forwards requests to handler.
+func NewSwapHandler(handler Handler) *SwapHandler {
+	return &SwapHandler{handler: handler}
+}
+
+// Swap replaces the handler and returns the previous handler.
+func (sh *SwapHandler) Swap(handler Handler) Handler {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	previous := sh.handler
+	sh.handler = handler
+	return previous
+}
+
+// Handler returns the current handler.
+func (sh *SwapHandler) Handler() Handler {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.handler
+}
+
+// ServeWeb forwards the request to the current handler.
+func (sh *SwapHandler) ServeWeb(req *Request) {
+	sh.Handler().ServeWeb(req)
 }
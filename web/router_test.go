@@ -15,6 +15,9 @@
 package web
 
 import (
+	"http"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -28,9 +31,10 @@ func TestRouter(t *testing.T) {
 	r.Register("/a", "GET", rhandler("a-get"), "*", rhandler("a-*"))
 	r.Register("/b", "GET", rhandler("b-get"), "POST", rhandler("b-post"))
 	r.Register("/c", "*", rhandler("c-*"))
+	r.Register("/d", "PROPFIND", rhandler("d-propfind"), "mkcol", rhandler("d-mkcol"))
 
 	expectHandler := func(method string, path string, expectedName string, names []string, values []string) {
-		handler, names, values := r.find(path, method)
+		handler, names, values, _ := r.find(path, method)
 		rhandler, ok := handler.(rhandler)
 		if !ok {
 			t.Errorf("Unexpected handler type for %s %s", method, path)
@@ -42,7 +46,7 @@ func TestRouter(t *testing.T) {
 	}
 
 	expectError := func(method string, path string, status int) {
-		handler, _, _ := r.find(path, method)
+		handler, _, _, _ := r.find(path, method)
 		re, ok := handler.(*routerError)
 		if !ok {
 			t.Errorf("Unexpected handler type for %s %s", method, path)
@@ -70,4 +74,345 @@ func TestRouter(t *testing.T) {
 
 	expectHandler("GET", "/c", "c-*", nil, nil)
 	expectHandler("HEAD", "/c", "c-*", nil, nil)
+
+	expectHandler("PROPFIND", "/d", "d-propfind", nil, nil)
+	expectHandler("MKCOL", "/d", "d-mkcol", nil, nil)
+	expectError("GET", "/d", 405)
+}
+
+func TestHostRouter(t *testing.T) {
+	r := NewHostRouter(rhandler("default"))
+	r.Register("example.com", rhandler("example"))
+	r.Register("*.api.example.com", rhandler("api"))
+	r.Register("*.example.com", rhandler("sub"))
+	r.Register("Www.Example.com", rhandler("www"))
+
+	expect := func(host string, expectedName string, expectedPattern string) {
+		handler, pattern := r.find(host)
+		if name := string(handler.(rhandler)); name != expectedName {
+			t.Errorf("Unexpected handler for %s, actual %s expected %s", host, name, expectedName)
+		}
+		if pattern != expectedPattern {
+			t.Errorf("Unexpected pattern for %s, actual %s expected %s", host, pattern, expectedPattern)
+		}
+	}
+
+	expect("example.com", "example", "example.com")
+	expect("www.example.com", "www", "www.example.com")
+	expect("v1.api.example.com", "api", "*.api.example.com")
+	expect("foo.example.com", "sub", "*.example.com")
+	expect("other.com", "default", "")
+	expect("", "default", "")
+
+	r.Register("*", rhandler("any"))
+	expect("other.com", "any", "*")
+}
+
+func TestHostPattern(t *testing.T) {
+	var pattern string
+	r := NewHostRouter(nil)
+	r.Register("*.example.com", HandlerFunc(func(req *Request) { pattern = HostPattern(req) }))
+	url, _ := http.ParseURL("http://www.example.com/")
+	req := &Request{URL: url, Param: make(StringsMap), Env: make(map[string]interface{})}
+	r.ServeWeb(req)
+	if pattern != "*.example.com" {
+		t.Errorf("HostPattern() = %q, expected *.example.com", pattern)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	h := func(req *Request) {}
+	r := NewRouter().
+		Register("/a", "POST", h, "GET", h).
+		Register("/b/<id>", "*", h)
+	routes := r.Routes()
+	if len(routes) != 2 ||
+		routes[0].Pattern != "/a" || strings.Join(routes[0].Methods, ",") != "GET,POST" ||
+		routes[1].Pattern != "/b/<id>" || strings.Join(routes[1].Methods, ",") != "*" {
+		t.Errorf("Routes() = %v", routes)
+	}
+}
+
+func TestSwapHandler(t *testing.T) {
+	var served string
+	handler := func(name string) Handler {
+		return HandlerFunc(func(req *Request) { served = name })
+	}
+	sh := NewSwapHandler(handler("a"))
+	sh.ServeWeb(&Request{})
+	if served != "a" {
+		t.Errorf("served %q, expected a", served)
+	}
+	sh.Swap(handler("b"))
+	sh.ServeWeb(&Request{})
+	if served != "b" {
+		t.Errorf("served %q after swap, expected b", served)
+	}
+}
+
+func TestChainAndUse(t *testing.T) {
+	var trace string
+	mark := func(name string) Middleware {
+		return func(handler Handler) Handler {
+			return HandlerFunc(func(req *Request) {
+				trace += name
+				handler.ServeWeb(req)
+			})
+		}
+	}
+	final := HandlerFunc(func(req *Request) { trace += "h" })
+	Chain(mark("a"), mark("b"))(final).ServeWeb(&Request{})
+	if trace != "abh" {
+		t.Errorf("Chain trace = %q, expected abh", trace)
+	}
+
+	r := NewRouter().
+		Register("/before", "GET", final).
+		Use(mark("a"), mark("b")).
+		Register("/after", "GET", final)
+	for _, tt := range []string{"/before:h", "/after:abh"} {
+		i := strings.Index(tt, ":")
+		trace = ""
+		url, _ := http.ParseURL(tt[0:i])
+		r.ServeWeb(&Request{Method: "GET", URL: url, Param: make(StringsMap)})
+		if trace != tt[i+1:] {
+			t.Errorf("%s trace = %q, expected %q", tt[0:i], trace, tt[i+1:])
+		}
+	}
+}
+
+type encodedSlashTest struct {
+	policy   int
+	path     string
+	status   int
+	value    string
+	rawValue string
+}
+
+var encodedSlashTests = []encodedSlashTest{
+	encodedSlashTest{EncodedSlashDecode, "/files/a%2Fb", 200, "a/b", "a%2Fb"},
+	encodedSlashTest{EncodedSlashDecode, "/files/a%252Fb", 200, "a%2Fb", "a%252Fb"},
+	encodedSlashTest{EncodedSlashDecode, "/files/caf%C3%A9", 200, "café", "café"},
+	encodedSlashTest{EncodedSlashDecode, "/files/a/b", 404, "", ""},
+	encodedSlashTest{EncodedSlashKeep, "/files/a%2fb", 200, "a%2Fb", "a%2Fb"},
+	encodedSlashTest{EncodedSlashKeep, "/files/100%25", 200, "100%25", "100%25"},
+	encodedSlashTest{EncodedSlashReject, "/files/a%2Fb", 404, "", ""},
+	encodedSlashTest{EncodedSlashReject, "/files/a%20b", 200, "a b", "a b"},
+}
+
+func TestEncodedSlashes(t *testing.T) {
+	for _, tt := range encodedSlashTests {
+		status := 200
+		value := ""
+		r := NewRouter().EncodedSlashes(tt.policy)
+		r.Register("/files/<name>", "GET", func(req *Request) {
+			value = req.Param.GetDef("name", "")
+			if raw := RawPathParam(req, "name"); raw != tt.rawValue {
+				t.Errorf("policy=%d path=%s, raw value = %q, expected %q", tt.policy, tt.path, raw, tt.rawValue)
+			}
+		})
+		url, _ := http.ParseURL(tt.path)
+		r.ServeWeb(&Request{
+			Method:       "GET",
+			URL:          url,
+			Param:        make(StringsMap),
+			ErrorHandler: func(req *Request, s int, reason os.Error) { status = s },
+		})
+		if status != tt.status {
+			t.Errorf("policy=%d path=%s, status = %d, expected %d", tt.policy, tt.path, status, tt.status)
+		}
+		if value != tt.value {
+			t.Errorf("policy=%d path=%s, value = %q, expected %q", tt.policy, tt.path, value, tt.value)
+		}
+	}
+}
+
+type countGroupsTest struct {
+	expr string
+	n    int
+}
+
+var countGroupsTests = []countGroupsTest{
+	countGroupsTest{"^/a$", 0},
+	countGroupsTest{"^/a/([^/]+)$", 1},
+	countGroupsTest{"^/a/((foo|bar))$", 2},
+	countGroupsTest{`^/a/\(([^)(]+)\)$`, 1},
+	countGroupsTest{"^/a/([](]+)$", 1},
+	countGroupsTest{"^/a/(?:x)(y)$", 1},
+}
+
+func TestCountGroups(t *testing.T) {
+	for _, tt := range countGroupsTests {
+		if n := countGroups(tt.expr); n != tt.n {
+			t.Errorf("countGroups(%q) = %d, expected %d", tt.expr, n, tt.n)
+		}
+	}
+}
+
+func TestRouterPriority(t *testing.T) {
+	r := NewRouter()
+	r.Register("/a/<x:(foo|bar)>", "GET", rhandler("a-x"))
+	r.Register("/a/<y>", "GET", rhandler("a-y"))
+	r.Register("/a/<z:[a-z]+>/<w>", "GET", rhandler("a-zw"))
+	r.Register("/b/", "GET", rhandler("b"))
+
+	for _, tt := range []string{"/a/foo a-x x=foo", "/a/baz a-y y=baz", "/a/foo/bar a-zw w=bar", "/a/bar a-x x=bar"} {
+		f := strings.Fields(tt)
+		handler, names, values, _ := r.find(f[0], "GET")
+		if h, _ := handler.(rhandler); string(h) != f[1] {
+			t.Errorf("%s: handler = %v, expected %s", f[0], handler, f[1])
+			continue
+		}
+		param := make(StringsMap)
+		for i, name := range names {
+			param.Set(name, values[i])
+		}
+		i := strings.Index(f[2], "=")
+		if v := param.GetDef(f[2][0:i], ""); v != f[2][i+1:] {
+			t.Errorf("%s: %s = %q, expected %q", f[0], f[2][0:i], v, f[2][i+1:])
+		}
+	}
+
+	if handler, _, _, _ := r.find("/c", "GET"); handler.(*routerError).status != 404 {
+		t.Errorf("/c did not return 404")
+	}
+}
+
+func TestRouterStaticFirst(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		r := NewRouter().StrictOrder(strict)
+		r.Register("/users/<id>", "GET", rhandler("user"))
+		r.Register("/users/<id>/edit", "GET", rhandler("user-edit"))
+		r.Register("/users/new", "GET", rhandler("new"))
+		r.Register("/<section>/new", "GET", rhandler("section-new"))
+
+		expected := "new"
+		if strict {
+			expected = "user"
+		}
+		handler, _, _, _ := r.find("/users/new", "GET")
+		if h, _ := handler.(rhandler); string(h) != expected {
+			t.Errorf("strict=%v, /users/new handler = %v, expected %s", strict, handler, expected)
+		}
+		handler, _, _, _ = r.find("/posts/new", "GET")
+		if h, _ := handler.(rhandler); string(h) != "section-new" {
+			t.Errorf("strict=%v, /posts/new handler = %v, expected section-new", strict, handler)
+		}
+	}
+
+	r := NewRouter()
+	r.Register("/<a>/x", "GET", rhandler("a"))
+	r.Register("/b/<c>", "GET", rhandler("b"))
+	r.Register("/b/x", "GET", rhandler("bx"))
+	var patterns []string
+	for _, ri := range r.Routes() {
+		patterns = appendString(patterns, ri.Pattern)
+	}
+	if s := strings.Join(patterns, " "); s != "/b/x /b/<c> /<a>/x" {
+		t.Errorf("Routes() = %s, expected /b/x /b/<c> /<a>/x", s)
+	}
+}
+
+func appendString(s []string, v string) []string {
+	t := make([]string, len(s)+1)
+	copy(t, s)
+	t[len(s)] = v
+	return t
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	r := NewRouter()
+	r.Register("/items/<id>", "GET", rhandler("item-get"))
+	r.Register("/items/<name:[a-z]+>", "POST", rhandler("named-post"), "DELETE", rhandler("named-delete"))
+
+	handler, _, _, _ := r.find("/items/abc", "POST")
+	if h, _ := handler.(rhandler); string(h) != "named-post" {
+		t.Errorf("POST handler = %v, expected named-post", handler)
+	}
+	handler, _, _, _ = r.find("/items/abc", "PUT")
+	re, ok := handler.(*routerError)
+	if !ok || re.status != 405 {
+		t.Fatalf("PUT handler = %v, expected 405", handler)
+	}
+	if s := strings.Join(re.allow, ", "); s != "DELETE, GET, HEAD, POST" {
+		t.Errorf("allow = %q, expected %q", s, "DELETE, GET, HEAD, POST")
+	}
+	handler, _, _, _ = r.find("/items/123", "POST")
+	if re, ok := handler.(*routerError); !ok || strings.Join(re.allow, ", ") != "GET, HEAD" {
+		t.Errorf("POST /items/123 handler = %v, expected 405 with GET, HEAD", handler)
+	}
+
+	tr := &testResponder{}
+	re.ServeWeb(&Request{Responder: tr, ErrorHandler: defaultErrorHandler})
+	if v := tr.header.GetDef(HeaderAllow, ""); tr.status != 405 || v != "DELETE, GET, HEAD, POST" {
+		t.Errorf("status = %d, Allow = %q", tr.status, v)
+	}
+}
+
+func TestRouterHeadFallback(t *testing.T) {
+	r := NewRouter()
+	r.Register("/a", "GET", rhandler("a-get"), "HEAD", rhandler("a-head"))
+	r.Register("/b", "GET", rhandler("b-get"))
+
+	for _, fallback := range []bool{true, false} {
+		r.HeadFallback(fallback)
+		handler, _, _, _ := r.find("/a", "HEAD")
+		if h, _ := handler.(rhandler); string(h) != "a-head" {
+			t.Errorf("fallback=%v, HEAD /a handler = %v, expected a-head", fallback, handler)
+		}
+		handler, _, _, _ = r.find("/b", "HEAD")
+		h, _ := handler.(rhandler)
+		if fallback && string(h) != "b-get" {
+			t.Errorf("fallback=%v, HEAD /b handler = %v, expected b-get", fallback, handler)
+		}
+		if re, ok := handler.(*routerError); !fallback && (!ok || re.status != 405 || strings.Join(re.allow, ", ") != "GET") {
+			t.Errorf("fallback=%v, HEAD /b handler = %v, expected 405 with GET", fallback, handler)
+		}
+	}
+}
+
+// newBenchRouter returns a router with routes similar to a typical
+// application.
+func newBenchRouter() *Router {
+	r := NewRouter()
+	for _, section := range []string{"users", "posts", "comments", "tags", "images", "search", "admin", "api"} {
+		r.Register("/"+section, "GET", rhandler(section+"-list"), "POST", rhandler(section+"-create"))
+		r.Register("/"+section+"/<id:[0-9]+>", "GET", rhandler(section+"-get"), "PUT", rhandler(section+"-put"))
+		r.Register("/"+section+"/<id:[0-9]+>/edit", "GET", rhandler(section+"-edit"))
+	}
+	r.Register("/static/<path:.*>", "GET", rhandler("static"))
+	r.Register("/", "GET", rhandler("home"))
+	return r
+}
+
+func BenchmarkRouterStatic(b *testing.B) {
+	r := newBenchRouter()
+	r.find("/", "GET")
+	for i := 0; i < b.N; i++ {
+		r.find("/api", "GET")
+	}
+}
+
+func BenchmarkRouterParam(b *testing.B) {
+	r := newBenchRouter()
+	r.find("/", "GET")
+	for i := 0; i < b.N; i++ {
+		r.find("/api/1234/edit", "GET")
+	}
+}
+
+func BenchmarkRouterNotFound(b *testing.B) {
+	r := newBenchRouter()
+	r.find("/", "GET")
+	for i := 0; i < b.N; i++ {
+		r.find("/missing/path", "GET")
+	}
+}
+
+func BenchmarkRouterLastRoute(b *testing.B) {
+	r := newBenchRouter()
+	r.find("/", "GET")
+	for i := 0; i < b.N; i++ {
+		r.find("/", "GET")
+	}
 }
@@ -0,0 +1,78 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"flag"
+	"os"
+	"sync"
+)
+
+// Run modes.
+const (
+	// In development mode, error pages include debugging information,
+	// template files are reloaded when changed, the server logs bad
+	// requests and the output cache is disabled.
+	RunModeDevelopment = "development"
+
+	// Production mode is the default.
+	RunModeProduction = "production"
+)
+
+// RunModeEnv is the name of the environment variable used to set the run
+// mode when the runMode flag is not set.
+const RunModeEnv = "TWISTER_RUN_MODE"
+
+var runModeFlag = flag.String("runMode", "", "Run mode: development or production. The default is $"+RunModeEnv+" or production.")
+
+var (
+	runModeMu  sync.Mutex
+	runModeSet string
+)
+
+// RunMode returns the application's run mode. The mode is the value set by
+// SetRunMode, the runMode flag or the TWISTER_RUN_MODE environment variable
+// in that order of precedence. The default is RunModeProduction.
+func RunMode() string {
+	runModeMu.Lock()
+	defer runModeMu.Unlock()
+	switch {
+	case runModeSet != "":
+		return runModeSet
+	case *runModeFlag == RunModeDevelopment:
+		return RunModeDevelopment
+	case *runModeFlag == "" && os.Getenv(RunModeEnv) == RunModeDevelopment:
+		return RunModeDevelopment
+	}
+	return RunModeProduction
+}
+
+// SetRunMode sets the application's run mode.
+func SetRunMode(mode string) os.Error {
+	if mode != RunModeDevelopment && mode != RunModeProduction {
+		return os.NewError("twister: unknown run mode " + mode)
+	}
+	runModeMu.Lock()
+	runModeSet = mode
+	runModeMu.Unlock()
+	return nil
+}
+
+// Development returns true if the application is running in development
+// mode.
+func Development() bool {
+	return RunMode() == RunModeDevelopment
+}
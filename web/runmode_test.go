@@ -0,0 +1,35 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"testing"
+)
+
+func TestRunMode(t *testing.T) {
+	defer SetRunMode(RunModeProduction)
+	if err := SetRunMode("staging"); err == nil {
+		t.Errorf("SetRunMode(staging) did not return error")
+	}
+	SetRunMode(RunModeDevelopment)
+	if !Development() || RunMode() != RunModeDevelopment {
+		t.Errorf("run mode %s after setting development", RunMode())
+	}
+	SetRunMode(RunModeProduction)
+	if Development() {
+		t.Errorf("development after setting production")
+	}
+}
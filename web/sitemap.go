@@ -0,0 +1,175 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"strconv"
+	"strings"
+	"template"
+	"time"
+)
+
+// MaxSitemapURLs is the maximum number of URLs in a sitemap file. Larger
+// sitemaps are split into files listed in a sitemap index.
+const MaxSitemapURLs = 50000
+
+// SitemapURL is a page in a sitemap.
+type SitemapURL struct {
+	// Loc is the absolute URL of the page.
+	Loc string
+
+	// LastMod is the time that the page was last modified in seconds since
+	// the epoch. The time is omitted from the sitemap if the value is zero.
+	LastMod int64
+}
+
+// SitemapHandler serves a sitemap generated from a list of URLs. If the list
+// has more than MaxSitemapURLs URLs, then the handler serves a sitemap index
+// at the registered path and the sitemap files at the registered path with
+// the query "page=n" for n = 1, 2, .... The response is gzip compressed if
+// the client accepts the gzip coding.
+type SitemapHandler struct {
+	// URLs returns the URLs in the sitemap.
+	URLs func(req *Request) ([]SitemapURL, os.Error)
+}
+
+// NewSitemapHandler returns a handler for the sitemap with the URLs
+// returned by urls.
+func NewSitemapHandler(urls func(req *Request) ([]SitemapURL, os.Error)) *SitemapHandler {
+	return &SitemapHandler{URLs: urls}
+}
+
+// NewRouteSitemapHandler returns a handler for a sitemap containing the
+// routes in router without parameters that accept GET requests. The host
+// and scheme of the URLs are taken from the sitemap request.
+func NewRouteSitemapHandler(router *Router) *SitemapHandler {
+	return NewSitemapHandler(func(req *Request) ([]SitemapURL, os.Error) {
+		base := req.URL.Scheme + "://" + req.URL.Host
+		var urls []SitemapURL
+		for _, route := range router.Routes() {
+			if strings.Index(route.Pattern, "<") >= 0 || !hasGetMethod(route.Methods) {
+				continue
+			}
+			if len(urls) == cap(urls) {
+				t := make([]SitemapURL, len(urls), 2*len(urls)+8)
+				copy(t, urls)
+				urls = t
+			}
+			urls = urls[0 : len(urls)+1]
+			urls[len(urls)-1] = SitemapURL{Loc: base + route.Pattern}
+		}
+		return urls, nil
+	})
+}
+
+func hasGetMethod(methods []string) bool {
+	for _, m := range methods {
+		if m == "GET" || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSitemapURL writes a url or sitemap element to b.
+func writeSitemapURL(b *bytes.Buffer, element string, loc string, lastMod int64) {
+	b.WriteString("<" + element + "><loc>")
+	template.HTMLEscape(b, []byte(loc))
+	b.WriteString("</loc>")
+	if lastMod != 0 {
+		b.WriteString("<lastmod>")
+		b.WriteString(time.SecondsToUTC(lastMod).Format("2006-01-02T15:04:05Z"))
+		b.WriteString("</lastmod>")
+	}
+	b.WriteString("</" + element + ">\n")
+}
+
+func (h *SitemapHandler) ServeWeb(req *Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		req.Respond(StatusMethodNotAllowed, HeaderAllow, "GET, HEAD")
+		return
+	}
+	urls, err := h.URLs(req)
+	if err != nil {
+		req.Error(StatusInternalServerError, err)
+		return
+	}
+	pages := (len(urls) + MaxSitemapURLs - 1) / MaxSitemapURLs
+
+	var b bytes.Buffer
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	if s, found := req.Param.Get("page"); found {
+		page, err := strconv.Atoi(s)
+		if err != nil || page < 1 || page > pages {
+			req.Error(StatusNotFound, nil)
+			return
+		}
+		end := page * MaxSitemapURLs
+		if end > len(urls) {
+			end = len(urls)
+		}
+		urls = urls[(page-1)*MaxSitemapURLs : end]
+		pages = 1
+	}
+	if pages > 1 {
+		base := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path + "?page="
+		b.WriteString("<sitemapindex xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n")
+		for page := 1; page <= pages; page++ {
+			end := page * MaxSitemapURLs
+			if end > len(urls) {
+				end = len(urls)
+			}
+			var lastMod int64
+			for _, u := range urls[(page-1)*MaxSitemapURLs : end] {
+				if u.LastMod > lastMod {
+					lastMod = u.LastMod
+				}
+			}
+			writeSitemapURL(&b, "sitemap", base+strconv.Itoa(page), lastMod)
+		}
+		b.WriteString("</sitemapindex>\n")
+	} else {
+		b.WriteString("<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n")
+		for _, u := range urls {
+			writeSitemapURL(&b, "url", u.Loc, u.LastMod)
+		}
+		b.WriteString("</urlset>\n")
+	}
+
+	header := NewStringsMap(
+		HeaderContentType, "application/xml; charset=utf-8",
+		HeaderVary, HeaderAcceptEncoding)
+	body := b.Bytes()
+	if negotiateEncoding(req.Header.GetDef(HeaderAcceptEncoding, "")) == "gzip" {
+		var zb bytes.Buffer
+		zw, err := gzip.NewWriter(&zb)
+		if err != nil {
+			req.Error(StatusInternalServerError, err)
+			return
+		}
+		zw.Write(body)
+		zw.Close()
+		body = zb.Bytes()
+		header.Set(HeaderContentEncoding, "gzip")
+	}
+	header.Set(HeaderContentLength, strconv.Itoa(len(body)))
+	w := req.Responder.Respond(StatusOK, header)
+	if w != nil && req.Method != "HEAD" {
+		w.Write(body)
+	}
+}
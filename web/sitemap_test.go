@@ -0,0 +1,106 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"compress/gzip"
+	"http"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func serveSitemap(h Handler, rawURL string, kvs ...string) *testResponder {
+	r := &testResponder{}
+	url, _ := http.ParseURL(rawURL)
+	req, _ := NewRequest("127.0.0.1:1234", "GET", url, ProtocolVersion(1, 1), NewStringsMap(kvs...))
+	req.Responder = r
+	h.ServeWeb(req)
+	return r
+}
+
+func TestSitemap(t *testing.T) {
+	h := NewSitemapHandler(func(req *Request) ([]SitemapURL, os.Error) {
+		return []SitemapURL{
+			SitemapURL{Loc: "http://example.com/"},
+			SitemapURL{Loc: "http://example.com/a?b=1&c=2", LastMod: 1288569600},
+		}, nil
+	})
+	r := serveSitemap(h, "http://example.com/sitemap.xml")
+	expected := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n" +
+		"<url><loc>http://example.com/</loc></url>\n" +
+		"<url><loc>http://example.com/a?b=1&amp;c=2</loc><lastmod>2010-11-01T00:00:00Z</lastmod></url>\n" +
+		"</urlset>\n"
+	if r.status != StatusOK || r.body.String() != expected {
+		t.Errorf("status = %d, body = %q, expected %q", r.status, r.body.String(), expected)
+	}
+
+	r = serveSitemap(h, "http://example.com/sitemap.xml", HeaderAcceptEncoding, "gzip")
+	if v := r.header.GetDef(HeaderContentEncoding, ""); v != "gzip" {
+		t.Fatalf("Content-Encoding = %q, expected gzip", v)
+	}
+	zr, err := gzip.NewReader(&r.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(zr)
+	if err != nil || string(p) != expected {
+		t.Errorf("gzip body = %q, %v", p, err)
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	urls := make([]SitemapURL, MaxSitemapURLs+1)
+	for i := range urls {
+		urls[i].Loc = "http://example.com/p"
+	}
+	urls[MaxSitemapURLs].LastMod = 1288569600
+	h := NewSitemapHandler(func(req *Request) ([]SitemapURL, os.Error) { return urls, nil })
+
+	r := serveSitemap(h, "http://example.com/sitemap.xml")
+	expected := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<sitemapindex xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n" +
+		"<sitemap><loc>http://example.com/sitemap.xml?page=1</loc></sitemap>\n" +
+		"<sitemap><loc>http://example.com/sitemap.xml?page=2</loc><lastmod>2010-11-01T00:00:00Z</lastmod></sitemap>\n" +
+		"</sitemapindex>\n"
+	if r.body.String() != expected {
+		t.Errorf("index = %q, expected %q", r.body.String(), expected)
+	}
+	r = serveSitemap(h, "http://example.com/sitemap.xml?page=2")
+	if n := strings.Count(r.body.String(), "<url>"); n != 1 {
+		t.Errorf("page 2 has %d urls, expected 1", n)
+	}
+	r = serveSitemap(h, "http://example.com/sitemap.xml?page=3")
+	if r.status != StatusNotFound {
+		t.Errorf("page 3 status = %d, expected 404", r.status)
+	}
+}
+
+func TestRouteSitemap(t *testing.T) {
+	router := NewRouter().
+		Register("/", "GET", rhandler("home")).
+		Register("/about", "*", rhandler("about")).
+		Register("/users/<id>", "GET", rhandler("user")).
+		Register("/login", "POST", rhandler("login"))
+	r := serveSitemap(NewRouteSitemapHandler(router), "http://example.com/sitemap.xml")
+	body := r.body.String()
+	if strings.Count(body, "<url>") != 2 ||
+		strings.Index(body, "<loc>http://example.com/</loc>") < 0 ||
+		strings.Index(body, "<loc>http://example.com/about</loc>") < 0 {
+		t.Errorf("unexpected sitemap %q", body)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"utf8"
+)
+
+// Streaming transports.
+const (
+	// Write messages to the response body of an XMLHttpRequest. Each message
+	// is written as a JavaScript string literal on a line by itself. The
+	// client parses the complete lines in responseText as the response
+	// grows.
+	StreamXHR = iota
+
+	// Write messages to a hidden iframe as script elements that call the
+	// function named by the "callback" request parameter in the parent
+	// window with the message as the argument.
+	StreamIFrame
+)
+
+// DefaultMaxStreamLen is the default number of bytes written to a streaming
+// response before the connection is closed. Clients reconnect when the
+// response ends. The limit bounds the memory used by the client to hold the
+// response.
+const DefaultMaxStreamLen = 1 << 20
+
+// Browsers do not process a streamed response until some amount of data is
+// received. The padding is written at the start of the response.
+var streamPadding = strings.Repeat(" ", 2048)
+
+var errBadCallback os.Error = &Error{Status: StatusBadRequest, Message: "bad callback"}
+
+// StreamConn is a streaming connection to a browser that does not support
+// WebSockets. Messages are sent on the response to a long-lived request.
+// Messages from the client are sent as separate requests to the
+// application. Send and Close can be called concurrently.
+//
+// Use StreamConn with a Hub to serve WebSocket and streaming clients with
+// the same code:
+//
+//  func streamHandler(req *web.Request) {
+//      conn, err := web.NewStreamConn(req, web.StreamXHR)
+//      if err != nil {
+//          req.Error(web.ErrorStatus(err, web.StatusBadRequest), err)
+//          return
+//      }
+//      hub.Register(conn)
+//      conn.Wait()
+//      hub.Unregister(conn)
+//  }
+type StreamConn struct {
+	// MaxLen is the number of bytes written to the response before the
+	// connection is closed.
+	MaxLen int
+
+	transport int
+	callback  string
+	w         ResponseBody
+	n         int
+
+	// writeMu serializes writes to w.
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	queue       chan []byte
+	queuePolicy int
+	closed      bool
+	done        chan bool
+	err         os.Error
+}
+
+// isCallbackName returns true if s is a valid name for a JavaScript function
+// or a property path to a function.
+func isCallbackName(s string) bool {
+	if s == "" || len(s) > 128 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewStreamConn responds to the request with a streaming response using
+// the given transport and returns the connection. The handler must call
+// Wait before returning.
+func NewStreamConn(req *Request, transport int) (*StreamConn, os.Error) {
+	conn := &StreamConn{MaxLen: DefaultMaxStreamLen, transport: transport, done: make(chan bool)}
+	var w ResponseBody
+	switch transport {
+	case StreamXHR:
+		w = req.Respond(StatusOK,
+			HeaderContentType, "text/plain; charset=utf-8",
+			HeaderCacheControl, "no-cache")
+		if w != nil {
+			conn.n, _ = w.Write([]byte(streamPadding + "\n"))
+		}
+	case StreamIFrame:
+		conn.callback = req.Param.GetDef("callback", "")
+		if !isCallbackName(conn.callback) {
+			return nil, errBadCallback
+		}
+		w = req.Respond(StatusOK,
+			HeaderContentType, "text/html; charset=utf-8",
+			HeaderCacheControl, "no-cache")
+		if w != nil {
+			conn.n, _ = w.Write([]byte("<html><body><!--" + streamPadding + "-->\n"))
+		}
+	default:
+		return nil, ErrInvalidState
+	}
+	if w == nil {
+		conn.closed = true
+		close(conn.done)
+		return conn, nil
+	}
+	if err := w.Flush(); err != nil {
+		conn.closed = true
+		close(conn.done)
+		return conn, nil
+	}
+	conn.w = w
+	return conn, nil
+}
+
+// quoteJS writes p to b as a JavaScript string literal. Characters that
+// could end a script element are escaped.
+func quoteJS(b *bytes.Buffer, p []byte) {
+	const hex = "0123456789abcdef"
+	b.WriteByte('"')
+	for len(p) > 0 {
+		rune, size := utf8.DecodeRune(p)
+		switch {
+		case rune == '"' || rune == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(rune))
+		case rune == '\n':
+			b.WriteString("\\n")
+		case rune == '\r':
+			b.WriteString("\\r")
+		case rune == '\t':
+			b.WriteString("\\t")
+		case rune < ' ' || rune == '<' || rune == '>' || rune == '&' || rune == 0x2028 || rune == 0x2029:
+			b.WriteString("\\u")
+			b.WriteByte(hex[rune>>12&0xf])
+			b.WriteByte(hex[rune>>8&0xf])
+			b.WriteByte(hex[rune>>4&0xf])
+			b.WriteByte(hex[rune&0xf])
+		case rune == utf8.RuneError && size == 1:
+			b.WriteString("\\ufffd")
+		default:
+			b.Write(p[0:size])
+		}
+		p = p[size:]
+	}
+	b.WriteByte('"')
+}
+
+// write writes a message to the response.
+func (conn *StreamConn) write(p []byte) os.Error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	conn.mu.Lock()
+	closed := conn.closed
+	conn.mu.Unlock()
+	if closed {
+		return ErrInvalidState
+	}
+	var b bytes.Buffer
+	if conn.transport == StreamIFrame {
+		b.WriteString("<script>")
+		b.WriteString(conn.callback)
+		b.WriteByte('(')
+		quoteJS(&b, p)
+		b.WriteString(");</script>\n")
+	} else {
+		quoteJS(&b, p)
+		b.WriteByte('\n')
+	}
+	if _, err := conn.w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if err := conn.w.Flush(); err != nil {
+		return err
+	}
+	conn.n += b.Len()
+	if conn.MaxLen > 0 && conn.n >= conn.MaxLen {
+		conn.Close()
+	}
+	return nil
+}
+
+// Send sends a message to the client. If the send queue is enabled, then
+// Send adds a copy of the message to the queue and returns without waiting
+// for the message to be written. The connection is closed if the write
+// fails.
+func (conn *StreamConn) Send(p []byte) os.Error {
+	conn.mu.Lock()
+	if conn.queue == nil {
+		conn.mu.Unlock()
+		err := conn.write(p)
+		if err != nil && err != ErrInvalidState {
+			conn.Close()
+		}
+		return err
+	}
+	defer conn.mu.Unlock()
+	if conn.err != nil {
+		return conn.err
+	}
+	if conn.closed {
+		return ErrInvalidState
+	}
+	q := make([]byte, len(p))
+	copy(q, p)
+	select {
+	case conn.queue <- q:
+		return nil
+	default:
+	}
+	if conn.queuePolicy == SendQueueClose {
+		conn.err = ErrSendQueueFull
+		conn.closeLocked()
+	}
+	return ErrSendQueueFull
+}
+
+// EnableSendQueue starts a goroutine that writes messages to the client
+// from a queue with room for size messages. The policy specifies how Send
+// handles a full queue as described in the documentation for
+// WebSocketConn.EnableSendQueue.
+func (conn *StreamConn) EnableSendQueue(size int, policy int) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.queue != nil || conn.closed {
+		return
+	}
+	conn.queue = make(chan []byte, size)
+	conn.queuePolicy = policy
+	go conn.pump(conn.queue)
+}
+
+// pump writes messages from the send queue to the response.
+func (conn *StreamConn) pump(queue chan []byte) {
+	for p := range queue {
+		if err := conn.write(p); err != nil {
+			conn.mu.Lock()
+			if conn.err == nil {
+				conn.err = err
+			}
+			conn.closeLocked()
+			conn.mu.Unlock()
+			break
+		}
+	}
+	// Discard messages queued after an error.
+	for _ = range queue {
+	}
+}
+
+func (conn *StreamConn) closeLocked() {
+	if conn.closed {
+		return
+	}
+	if conn.queue != nil {
+		close(conn.queue)
+	}
+	conn.closed = true
+	close(conn.done)
+}
+
+// Close ends the streaming response. Wait returns after Close is called.
+func (conn *StreamConn) Close() os.Error {
+	conn.mu.Lock()
+	conn.closeLocked()
+	conn.mu.Unlock()
+	return nil
+}
+
+// Wait waits for the connection to close. The connection is closed by a
+// call to Close, when a write to the client fails or when MaxLen bytes are
+// written. After Wait returns, no more data is written to the response.
+// Disconnected clients are detected on the next write to the client.
+func (conn *StreamConn) Wait() {
+	<-conn.done
+	// Wait for a write in progress.
+	conn.writeMu.Lock()
+	conn.writeMu.Unlock()
+}
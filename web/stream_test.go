@@ -0,0 +1,84 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type quoteJSTest struct {
+	s        string
+	expected string
+}
+
+var quoteJSTests = []quoteJSTest{
+	quoteJSTest{"hello", `"hello"`},
+	quoteJSTest{"a\"b\\c", `"a\"b\\c"`},
+	quoteJSTest{"a\nb\x01", `"a\nb\u0001"`},
+	quoteJSTest{"</script>&", `"\u003c/script\u003e\u0026"`},
+	quoteJSTest{"\u2028é", `"\u2028é"`},
+	quoteJSTest{"\xff", `"\ufffd"`},
+}
+
+func TestQuoteJS(t *testing.T) {
+	for _, tt := range quoteJSTests {
+		var b bytes.Buffer
+		quoteJS(&b, []byte(tt.s))
+		if b.String() != tt.expected {
+			t.Errorf("quoteJS(%q) = %s, expected %s", tt.s, b.String(), tt.expected)
+		}
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	r := &testResponder{}
+	req := &Request{Method: "GET", Param: NewStringsMap("callback", "parent.onmsg"), Responder: r}
+	conn, err := NewStreamConn(req, StreamIFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Send([]byte("a<b"))
+	conn.Close()
+	conn.Wait()
+	if err := conn.Send([]byte("c")); err != ErrInvalidState {
+		t.Errorf("Send after Close returned %v, expected ErrInvalidState", err)
+	}
+	body := r.body.String()
+	if !strings.HasPrefix(body, "<html>") || !strings.HasSuffix(body, "<script>parent.onmsg(\"a\\u003cb\");</script>\n") {
+		t.Errorf("body = %q", body)
+	}
+
+	r = &testResponder{}
+	req = &Request{Method: "GET", Param: make(StringsMap), Responder: r}
+	conn, err = NewStreamConn(req, StreamXHR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.MaxLen = r.body.Len() + 1
+	conn.Send([]byte("x"))
+	conn.Wait()
+	if lines := strings.Split(r.body.String(), "\n", -1); len(lines) != 3 || lines[1] != `"x"` {
+		t.Errorf("body = %q", r.body.String())
+	}
+}
+
+func TestStreamConnBadCallback(t *testing.T) {
+	req := &Request{Method: "GET", Param: NewStringsMap("callback", "alert(1)"), Responder: &testResponder{}}
+	if _, err := NewStreamConn(req, StreamIFrame); err != errBadCallback {
+		t.Errorf("err = %v, expected errBadCallback", err)
+	}
+}
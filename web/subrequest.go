@@ -0,0 +1,145 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"http"
+	"net"
+	"os"
+	"strings"
+)
+
+// MaxSubRequestDepth is the maximum nesting of subrequests. A handler that
+// issues a subrequest to itself fails at this depth instead of recursing
+// until the stack is exhausted.
+const MaxSubRequestDepth = 8
+
+// ErrSubRequestDepth is returned from SubRequest when the subrequest is
+// nested more than MaxSubRequestDepth levels deep.
+var ErrSubRequestDepth = os.NewError("subrequest nested too deeply")
+
+// subRequestDepthKey is the Env key for the nesting depth of a subrequest.
+const subRequestDepthKey = "web.subRequestDepth"
+
+// SubResponse is a response captured from a handler by SubRequest.
+type SubResponse struct {
+	Status int
+	Header StringsMap
+	Body   bytes.Buffer
+}
+
+// Respond responds to req with the captured status, header and body.
+func (sr *SubResponse) Respond(req *Request) {
+	w := req.Responder.Respond(sr.Status, sr.Header)
+	if w != nil && req.Method != "HEAD" {
+		w.Write(sr.Body.Bytes())
+	}
+}
+
+// subResponder captures the response to a subrequest.
+type subResponder struct {
+	sr        *SubResponse
+	responded bool
+}
+
+func (r *subResponder) Respond(status int, header StringsMap) ResponseBody {
+	if r.responded {
+		return nil
+	}
+	r.responded = true
+	r.sr.Status = status
+	r.sr.Header = header
+	return r
+}
+
+func (r *subResponder) Write(p []byte) (int, os.Error) { return r.sr.Body.Write(p) }
+func (r *subResponder) Flush() os.Error                { return nil }
+func (r *subResponder) Continue() os.Error             { return nil }
+
+func (r *subResponder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, ErrInvalidState
+}
+
+// Request headers not copied to subrequests. The subrequest does not have a
+// body and the response is not conditional.
+var subRequestSkipHeaders = map[string]bool{
+	HeaderContentLength:     true,
+	HeaderContentType:       true,
+	HeaderExpect:            true,
+	HeaderIfMatch:           true,
+	HeaderIfModifiedSince:   true,
+	HeaderIfNoneMatch:       true,
+	HeaderIfRange:           true,
+	HeaderIfUnmodifiedSince: true,
+	HeaderRange:             true,
+	HeaderTransferEncoding:  true,
+}
+
+// SubRequest calls handler with a request for rawURL and returns the
+// captured response. Use SubRequest to compose a response from the output of
+// other handlers or to render error pages with the application's handlers.
+// The rawURL is an absolute URL or a path with an optional query. The
+// subrequest does not have a body. The subrequest has the remote address,
+// protocol version, TLS state and error handler of req and copies of the
+// header and Env. Headers for the request body and conditional requests are
+// not copied. Functions registered with OnFinish on the subrequest are run
+// before SubRequest returns. SubRequest returns ErrSubRequestDepth if req is
+// already nested MaxSubRequestDepth subrequests deep.
+func SubRequest(req *Request, handler Handler, method string, rawURL string) (*SubResponse, os.Error) {
+	depth, _ := req.Env[subRequestDepthKey].(int)
+	if depth >= MaxSubRequestDepth {
+		return nil, ErrSubRequestDepth
+	}
+	if strings.HasPrefix(rawURL, "/") {
+		rawURL = req.URL.Scheme + "://" + req.URL.Host + rawURL
+	}
+	url, err := http.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	header := make(StringsMap)
+	for key, values := range req.Header {
+		if !subRequestSkipHeaders[key] {
+			header[key] = values
+		}
+	}
+	sub, err := NewRequest(req.RemoteAddr, method, url, req.ProtocolVersion, header)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range req.Env {
+		sub.Env[key] = value
+	}
+	if _, found := req.Env[templateDataKey]; found {
+		// Do not share the template data map with the subrequest.
+		sub.Env[templateDataKey] = TemplateData(req)
+	}
+	sub.Env[subRequestDepthKey] = depth + 1
+	sub.ErrorHandler = req.ErrorHandler
+	sub.TLS = req.TLS
+	sub.ContentLength = 0
+	sub.Body = bytes.NewBuffer(nil)
+	sr := &SubResponse{}
+	sub.Responder = &subResponder{sr: sr}
+	defer sub.Finish()
+	handler.ServeWeb(sub)
+	if sr.Status == 0 {
+		sr.Status = StatusOK
+		sr.Header = make(StringsMap)
+	}
+	return sr, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"http"
+	"os"
+	"testing"
+)
+
+func TestSubRequest(t *testing.T) {
+	router := NewRouter().
+		Register("/a/<x>", "GET", func(req *Request) {
+			if _, found := req.Header.Get(HeaderIfNoneMatch); found {
+				t.Error("conditional header copied to subrequest")
+			}
+			SetTemplateData(req, "sub", true)
+			req.Respond(StatusOK, HeaderContentType, "text/plain").Write([]byte(req.Param.GetDef("x", "") + req.Param.GetDef("y", "") + req.Env["v"].(string)))
+		}).
+		Register("/b", "GET", func(req *Request) {})
+	url, _ := http.ParseURL("http://example.com/page")
+	req, _ := NewRequest("127.0.0.1:1234", "GET", url, ProtocolVersion(1, 1), NewStringsMap(HeaderIfNoneMatch, `"1"`))
+	req.Env["v"] = "v"
+	SetTemplateData(req, "user", "gopher")
+
+	sr, err := SubRequest(req, router, "GET", "/a/x?y=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Status != StatusOK || sr.Body.String() != "xyv" || sr.Header.GetDef(HeaderContentType, "") != "text/plain" {
+		t.Errorf("status = %d, header = %v, body = %q", sr.Status, sr.Header, sr.Body.String())
+	}
+	if _, found := TemplateData(req)["sub"]; found {
+		t.Error("subrequest modified template data of request")
+	}
+
+	sr, _ = SubRequest(req, router, "GET", "/b")
+	if sr.Status != StatusOK || sr.Body.Len() != 0 {
+		t.Errorf("/b status = %d, body = %q", sr.Status, sr.Body.String())
+	}
+
+	var status int
+	req.ErrorHandler = func(req *Request, s int, reason os.Error) { status = s }
+	sr, _ = SubRequest(req, router, "GET", "/missing")
+	if status != StatusNotFound {
+		t.Errorf("/missing error status = %d, expected 404", status)
+	}
+
+	r := &testResponder{}
+	req.Responder = r
+	sr, _ = SubRequest(req, router, "GET", "http://example.com/a/1")
+	sr.Status = StatusNotFound
+	sr.Respond(req)
+	if r.status != StatusNotFound || r.body.String() != "1v" {
+		t.Errorf("Respond() status = %d, body = %q", r.status, r.body.String())
+	}
+}
+
+func TestSubRequestDepth(t *testing.T) {
+	depth := 0
+	var err os.Error
+	var handler HandlerFunc
+	handler = func(req *Request) {
+		depth += 1
+		if _, e := SubRequest(req, handler, "GET", "/"); e != nil {
+			err = e
+		}
+	}
+	url, _ := http.ParseURL("http://example.com/")
+	req, _ := NewRequest("127.0.0.1:1234", "GET", url, ProtocolVersion(1, 1), make(StringsMap))
+	handler(req)
+	if err != ErrSubRequestDepth || depth != MaxSubRequestDepth+1 {
+		t.Errorf("depth = %d, err = %v, expected %d, %v", depth, err, MaxSubRequestDepth+1, ErrSubRequestDepth)
+	}
+}
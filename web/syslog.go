@@ -0,0 +1,187 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Syslog severities.
+const (
+	SyslogEmerg = iota
+	SyslogAlert
+	SyslogCrit
+	SyslogErr
+	SyslogWarning
+	SyslogNotice
+	SyslogInfo
+	SyslogDebug
+)
+
+// Syslog facilities.
+const (
+	SyslogKern   = 0 << 3
+	SyslogUser   = 1 << 3
+	SyslogMail   = 2 << 3
+	SyslogDaemon = 3 << 3
+	SyslogAuth   = 4 << 3
+	SyslogLocal0 = 16 << 3
+	SyslogLocal1 = 17 << 3
+	SyslogLocal2 = 18 << 3
+	SyslogLocal3 = 19 << 3
+	SyslogLocal4 = 20 << 3
+	SyslogLocal5 = 21 << 3
+	SyslogLocal6 = 22 << 3
+	SyslogLocal7 = 23 << 3
+)
+
+var syslogSeverities = map[string]int{
+	"emerg":   SyslogEmerg,
+	"alert":   SyslogAlert,
+	"crit":    SyslogCrit,
+	"err":     SyslogErr,
+	"error":   SyslogErr,
+	"warning": SyslogWarning,
+	"warn":    SyslogWarning,
+	"notice":  SyslogNotice,
+	"info":    SyslogInfo,
+	"debug":   SyslogDebug,
+}
+
+var syslogFacilities = map[string]int{
+	"kern":   SyslogKern,
+	"user":   SyslogUser,
+	"mail":   SyslogMail,
+	"daemon": SyslogDaemon,
+	"auth":   SyslogAuth,
+	"local0": SyslogLocal0,
+	"local1": SyslogLocal1,
+	"local2": SyslogLocal2,
+	"local3": SyslogLocal3,
+	"local4": SyslogLocal4,
+	"local5": SyslogLocal5,
+	"local6": SyslogLocal6,
+	"local7": SyslogLocal7,
+}
+
+// ParseSyslogPriority parses a priority in the syslog.conf form
+// facility.severity, for example "local0.info".
+func ParseSyslogPriority(s string) (int, os.Error) {
+	s = strings.ToLower(s)
+	i := strings.Index(s, ".")
+	if i < 0 {
+		return 0, os.NewError("twister: bad syslog priority " + s)
+	}
+	facility, found := syslogFacilities[s[0:i]]
+	if !found {
+		return 0, os.NewError("twister: unknown syslog facility " + s[0:i])
+	}
+	severity, found := syslogSeverities[s[i+1:]]
+	if !found {
+		return 0, os.NewError("twister: unknown syslog severity " + s[i+1:])
+	}
+	return facility | severity, nil
+}
+
+// Paths of the local syslog socket.
+var syslogPaths = []string{"/dev/log", "/var/run/syslog"}
+
+// SyslogWriter writes messages to a syslog daemon. Each call to Write sends
+// one message. If sending fails, then the writer reconnects to the daemon
+// and sends the message again.
+type SyslogWriter struct {
+	network  string
+	addr     string
+	priority int
+	tag      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogWriter returns a writer that sends messages with the given
+// priority and tag to the syslog daemon at addr on network. If network is
+// "", then the writer connects to the local syslog daemon. Use
+// ParseSyslogPriority or the Syslog facility and severity constants to
+// specify the priority:
+//
+//  w, err := web.NewSyslogWriter("", "", web.SyslogLocal0|web.SyslogInfo, "myapp")
+func NewSyslogWriter(network, addr string, priority int, tag string) (*SyslogWriter, os.Error) {
+	w := &SyslogWriter{network: network, addr: addr, priority: priority, tag: tag}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *SyslogWriter) connect() (err os.Error) {
+	if w.network != "" {
+		w.conn, err = net.Dial(w.network, "", w.addr)
+		return err
+	}
+	for _, path := range syslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			w.conn, err = net.Dial(network, "", path)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// formatSyslogMessage formats a message in the BSD syslog format. The
+// syslog daemon adds the timestamp and host name.
+func formatSyslogMessage(priority int, tag string, pid int, p []byte) []byte {
+	msg := strings.TrimRight(string(p), "\r\n")
+	return []byte(fmt.Sprintf("<%d>%s[%d]: %s\n", priority, tag, pid, msg))
+}
+
+func (w *SyslogWriter) Write(p []byte) (int, os.Error) {
+	msg := formatSyslogMessage(w.priority, w.tag, os.Getpid(), p)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err os.Error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				return 0, err
+			}
+		}
+		if _, err = w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, err
+}
+
+// Close closes the connection to the syslog daemon.
+func (w *SyslogWriter) Close() os.Error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
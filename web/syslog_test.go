@@ -0,0 +1,52 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"testing"
+)
+
+type syslogPriorityTest struct {
+	s        string
+	priority int
+	ok       bool
+}
+
+var syslogPriorityTests = []syslogPriorityTest{
+	syslogPriorityTest{"local0.info", SyslogLocal0 | SyslogInfo, true},
+	syslogPriorityTest{"DAEMON.err", SyslogDaemon | SyslogErr, true},
+	syslogPriorityTest{"user.debug", 15, true},
+	syslogPriorityTest{"local0", 0, false},
+	syslogPriorityTest{"local9.info", 0, false},
+	syslogPriorityTest{"local0.loud", 0, false},
+}
+
+func TestParseSyslogPriority(t *testing.T) {
+	for _, tt := range syslogPriorityTests {
+		priority, err := ParseSyslogPriority(tt.s)
+		if (err == nil) != tt.ok || priority != tt.priority {
+			t.Errorf("ParseSyslogPriority(%q) = %d, %v, expected %d", tt.s, priority, err, tt.priority)
+		}
+	}
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	actual := string(formatSyslogMessage(SyslogLocal0|SyslogErr, "app", 42, []byte("failed\n")))
+	expected := "<131>app[42]: failed\n"
+	if actual != expected {
+		t.Errorf("formatSyslogMessage = %q, expected %q", actual, expected)
+	}
+}
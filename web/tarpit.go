@@ -0,0 +1,248 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTarpitFull os.Error = &Error{Status: StatusServiceUnavailable, Message: "service unavailable"}
+
+// remoteHost returns the host part of the request's remote address.
+func remoteHost(req *Request) string {
+	addr := req.RemoteAddr
+	if net.ParseIP(addr) != nil {
+		// RealIP sets the address without a port.
+		return addr
+	}
+	if i := strings.LastIndex(addr, ":"); i >= 0 && strings.Index(addr[i:], "]") < 0 {
+		addr = addr[0:i]
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// Tarpit slows down responses to abusive clients. Requests selected by the
+// Trap function are delayed and the response body is written at a trickle.
+type Tarpit struct {
+	// Trap returns true if the request should be slowed down.
+	Trap func(req *Request) bool
+
+	// Delay in nanoseconds before the handler is called.
+	Delay int64
+
+	// BytesPerSecond is the rate at which the response body is written.
+	BytesPerSecond int
+
+	// MaxDuration is the maximum time in nanoseconds that a request is held
+	// in the tarpit. The rest of the response is written at full speed.
+	MaxDuration int64
+
+	// MaxActive is the maximum number of requests held in the tarpit at the
+	// same time. Trapped requests over the limit are rejected with HTTP
+	// status 503 so that the tarpit does not exhaust the server's
+	// connections and goroutines.
+	MaxActive int
+
+	mu     sync.Mutex
+	active int
+}
+
+// NewTarpit returns a tarpit for requests selected by trap with a delay of
+// five seconds, a rate of 10 bytes per second, a maximum duration of one
+// minute and at most 100 active requests.
+func NewTarpit(trap func(req *Request) bool) *Tarpit {
+	return &Tarpit{
+		Trap:           trap,
+		Delay:          5e9,
+		BytesPerSecond: 10,
+		MaxDuration:    60e9,
+		MaxActive:      100,
+	}
+}
+
+func (tp *Tarpit) enter() bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.active >= tp.MaxActive {
+		return false
+	}
+	tp.active += 1
+	return true
+}
+
+func (tp *Tarpit) leave() {
+	tp.mu.Lock()
+	tp.active -= 1
+	tp.mu.Unlock()
+}
+
+// trickleBody writes the response body at a limited rate until the
+// deadline.
+type trickleBody struct {
+	ResponseBody
+	chunk    int
+	interval int64
+	deadline int64
+}
+
+func (b *trickleBody) Write(p []byte) (int, os.Error) {
+	n := 0
+	for len(p) > 0 {
+		if time.Nanoseconds() >= b.deadline {
+			m, err := b.ResponseBody.Write(p)
+			return n + m, err
+		}
+		q := p
+		if len(q) > b.chunk {
+			q = q[0:b.chunk]
+		}
+		m, err := b.ResponseBody.Write(q)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if err := b.ResponseBody.Flush(); err != nil {
+			return n, err
+		}
+		p = p[m:]
+		time.Sleep(b.interval)
+	}
+	return n, nil
+}
+
+// Handler returns a handler that holds requests selected by the trap
+// function in the tarpit before calling handler.
+func (tp *Tarpit) Handler(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		if !tp.Trap(req) {
+			handler.ServeWeb(req)
+			return
+		}
+		if !tp.enter() {
+			req.Error(StatusServiceUnavailable, errTarpitFull)
+			return
+		}
+		defer tp.leave()
+		deadline := time.Nanoseconds() + tp.MaxDuration
+		time.Sleep(tp.Delay)
+		if tp.BytesPerSecond > 0 {
+			// Write a chunk ten times a second.
+			chunk := tp.BytesPerSecond / 10
+			if chunk < 1 {
+				chunk = 1
+			}
+			interval := int64(1e9) * int64(chunk) / int64(tp.BytesPerSecond)
+			FilterResponse(req, func(status int, header StringsMap, respond func(int, StringsMap) ResponseBody) ResponseBody {
+				w := respond(status, header)
+				if w == nil {
+					return nil
+				}
+				return &trickleBody{w, chunk, interval, deadline}
+			})
+		}
+		handler.ServeWeb(req)
+	})
+}
+
+// IPTrap returns a trap function that selects requests from the given IP
+// addresses.
+func IPTrap(ips ...string) func(req *Request) bool {
+	m := make(map[string]bool)
+	for _, ip := range ips {
+		m[ip] = true
+	}
+	return func(req *Request) bool { return m[remoteHost(req)] }
+}
+
+// FailureTrap selects clients that recently received too many authentication
+// failures. Install the handler returned by Handler to count the failures
+// and use the Trap method as the trap function of a Tarpit.
+type FailureTrap struct {
+	// MaxFailures is the number of failures in Window nanoseconds after
+	// which a client is trapped.
+	MaxFailures int
+	Window      int64
+
+	mu       sync.Mutex
+	failures map[string]*failureCount
+	sweep    int64
+}
+
+type failureCount struct {
+	count int
+	start int64
+}
+
+// NewFailureTrap returns a trap that selects clients after maxFailures
+// authentication failures within window nanoseconds.
+func NewFailureTrap(maxFailures int, window int64) *FailureTrap {
+	return &FailureTrap{MaxFailures: maxFailures, Window: window, failures: make(map[string]*failureCount)}
+}
+
+// Trap returns true if the client that sent req is trapped.
+func (ft *FailureTrap) Trap(req *Request) bool {
+	host := remoteHost(req)
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	f := ft.failures[host]
+	if f == nil {
+		return false
+	}
+	if time.Nanoseconds()-f.start > ft.Window {
+		ft.failures[host] = nil, false
+		return false
+	}
+	return f.count >= ft.MaxFailures
+}
+
+func (ft *FailureTrap) fail(host string) {
+	now := time.Nanoseconds()
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	// Delete expired counts once per window.
+	if now >= ft.sweep {
+		for h, f := range ft.failures {
+			if now-f.start > ft.Window {
+				ft.failures[h] = nil, false
+			}
+		}
+		ft.sweep = now + ft.Window
+	}
+	f := ft.failures[host]
+	if f == nil || now-f.start > ft.Window {
+		f = &failureCount{start: now}
+		ft.failures[host] = f
+	}
+	f.count += 1
+}
+
+// Handler returns a handler that counts responses with HTTP status 401 and
+// 403 from handler as authentication failures.
+func (ft *FailureTrap) Handler(handler Handler) Handler {
+	return HandlerFunc(func(req *Request) {
+		FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+			if status == StatusUnauthorized || status == StatusForbidden {
+				ft.fail(remoteHost(req))
+			}
+			return status, header
+		})
+		handler.ServeWeb(req)
+	})
+}
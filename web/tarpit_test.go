@@ -0,0 +1,63 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"testing"
+)
+
+type remoteHostTest struct {
+	addr string
+	host string
+}
+
+var remoteHostTests = []remoteHostTest{
+	remoteHostTest{"10.0.0.1:1234", "10.0.0.1"},
+	remoteHostTest{"10.0.0.1", "10.0.0.1"},
+	remoteHostTest{"[::1]:80", "::1"},
+	remoteHostTest{"2001:db8::1", "2001:db8::1"},
+}
+
+func TestRemoteHost(t *testing.T) {
+	for _, tt := range remoteHostTests {
+		if host := remoteHost(&Request{RemoteAddr: tt.addr}); host != tt.host {
+			t.Errorf("remoteHost(%q) = %q, expected %q", tt.addr, host, tt.host)
+		}
+	}
+}
+
+func TestFailureTrap(t *testing.T) {
+	ft := NewFailureTrap(2, 60e9)
+	h := ft.Handler(HandlerFunc(func(req *Request) { req.Respond(StatusUnauthorized) }))
+	req := &Request{RemoteAddr: "10.0.0.1:1234"}
+	other := &Request{RemoteAddr: "10.0.0.2:1234"}
+	for i := 0; i < 2; i++ {
+		if ft.Trap(req) {
+			t.Errorf("trapped after %d failures", i)
+		}
+		req.Responder = &testResponder{}
+		h.ServeWeb(req)
+	}
+	if !ft.Trap(req) {
+		t.Errorf("not trapped after 2 failures")
+	}
+	if ft.Trap(other) {
+		t.Errorf("other client trapped")
+	}
+	if !IPTrap("10.0.0.2")(other) || IPTrap("10.0.0.2")(req) {
+		t.Errorf("IPTrap selected wrong client")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+// The key for the template data in the request Env.
+const templateDataKey = "web.templateData"
+
+// SetTemplateData sets a value in the data for rendering templates in
+// response to the request. Middleware uses SetTemplateData to provide values
+// used by all pages. The following values are set by the middleware in
+// this package and the auth package:
+//
+//  xsrf    XSRF token set by ProcessForm
+//  locale  Locale set by SelectLocale
+//  user    Current user set by auth.Handler
+func SetTemplateData(req *Request, key string, value interface{}) {
+	if req.Env == nil {
+		req.Env = make(map[string]interface{})
+	}
+	data, _ := req.Env[templateDataKey].(map[string]interface{})
+	if data == nil {
+		data = make(map[string]interface{})
+		req.Env[templateDataKey] = data
+	}
+	data[key] = value
+}
+
+// TemplateData returns a new map containing the values set with
+// SetTemplateData and the key-value pairs kvs. The keys in kvs are strings.
+// Values in kvs replace values set with SetTemplateData.
+//
+//  tmpl.Execute(web.TemplateData(req, "title", title, "items", items), w)
+func TemplateData(req *Request, kvs ...interface{}) map[string]interface{} {
+	if len(kvs)%2 == 1 {
+		panic("twister: even number args required for TemplateData")
+	}
+	data := make(map[string]interface{})
+	if m, ok := req.Env[templateDataKey].(map[string]interface{}); ok {
+		for k, v := range m {
+			data[k] = v
+		}
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		key, ok := kvs[i].(string)
+		if !ok {
+			panic("twister: TemplateData keys must be strings")
+		}
+		data[key] = kvs[i+1]
+	}
+	return data
+}
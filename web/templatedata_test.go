@@ -0,0 +1,36 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+func TestTemplateData(t *testing.T) {
+	req := &Request{}
+	if data := TemplateData(req, "a", 1); len(data) != 1 || data["a"] != 1 {
+		t.Errorf("TemplateData() = %v, expected map[a:1]", data)
+	}
+	SetTemplateData(req, "a", 1)
+	SetTemplateData(req, "b", 2)
+	data := TemplateData(req, "b", 3, "c", 4)
+	if len(data) != 3 || data["a"] != 1 || data["b"] != 3 || data["c"] != 4 {
+		t.Errorf("TemplateData() = %v, expected map[a:1 b:3 c:4]", data)
+	}
+	data["a"] = 5
+	if data := TemplateData(req); data["a"] != 1 || data["b"] != 2 {
+		t.Errorf("TemplateData() = %v, expected map[a:1 b:2]", data)
+	}
+}
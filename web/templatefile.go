@@ -0,0 +1,79 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"template"
+)
+
+// TemplateFile is a template loaded from a file. In development mode, the
+// template is loaded again when the file is modified. In production mode,
+// the template is loaded once.
+type TemplateFile struct {
+	filename string
+	fmap     template.FormatterMap
+
+	mu    sync.Mutex
+	t     *template.Template
+	mtime int64
+}
+
+// NewTemplateFile returns a template file for the named file. The template
+// is parsed with the given formatters.
+func NewTemplateFile(filename string, fmap template.FormatterMap) *TemplateFile {
+	return &TemplateFile{filename: filename, fmap: fmap}
+}
+
+// Get returns the template, loading the file as needed.
+func (tf *TemplateFile) Get() (*template.Template, os.Error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	if tf.t != nil && !Development() {
+		return tf.t, nil
+	}
+	info, err := os.Stat(tf.filename)
+	if err != nil {
+		return nil, err
+	}
+	if tf.t != nil && info.Mtime_ns == tf.mtime {
+		return tf.t, nil
+	}
+	p, err := ioutil.ReadFile(tf.filename)
+	if err != nil {
+		return nil, err
+	}
+	t := template.New(tf.fmap)
+	if err := t.Parse(string(p)); err != nil {
+		return nil, err
+	}
+	tf.t = t
+	tf.mtime = info.Mtime_ns
+	return t, nil
+}
+
+// Execute loads the template as needed and executes the template with data
+// and w.
+func (tf *TemplateFile) Execute(data interface{}, w io.Writer) os.Error {
+	t, err := tf.Get()
+	if err != nil {
+		return err
+	}
+	return t.Execute(data, w)
+}
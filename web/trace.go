@@ -0,0 +1,224 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span is a named and timed part of handling a request.
+type Span struct {
+	Name     string
+	Start    int64 // Start time in nanoseconds since the epoch.
+	Duration int64 // Duration in nanoseconds.
+}
+
+// End records the duration of the span. End is a no-op on a nil span.
+func (s *Span) End() {
+	if s != nil {
+		s.Duration = time.Nanoseconds() - s.Start
+	}
+}
+
+// Trace records the timing of a request.
+type Trace struct {
+	Method   string
+	URL      string
+	Status   int
+	Start    int64 // Start time in nanoseconds since the epoch.
+	Duration int64 // Duration in nanoseconds.
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// StartSpan starts a span with the given name. Call End on the returned span
+// when the work is complete. StartSpan returns nil if the trace is nil so
+// that handlers can record spans whether or not tracing is enabled:
+//
+//  span := web.RequestTrace(req).StartSpan("query")
+//  defer span.End()
+func (t *Trace) StartSpan(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{Name: name, Start: time.Nanoseconds()}
+	t.mu.Lock()
+	spans := make([]*Span, len(t.spans)+1)
+	copy(spans, t.spans)
+	spans[len(t.spans)] = s
+	t.spans = spans
+	t.mu.Unlock()
+	return s
+}
+
+// Spans returns the spans recorded in the trace.
+func (t *Trace) Spans() []*Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spans
+}
+
+// TraceReporter receives completed traces.
+type TraceReporter interface {
+	Report(t *Trace)
+}
+
+const traceKey = "web.trace"
+
+// RequestTrace returns the trace for the request or nil if the request is not
+// traced.
+func RequestTrace(req *Request) *Trace {
+	t, _ := req.Env[traceKey].(*Trace)
+	return t
+}
+
+// Tracer returns middleware that starts a trace, calls handler and sends the
+// completed trace to reporter.
+func Tracer(reporter TraceReporter) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			t := &Trace{Method: req.Method, URL: req.URL.String(), Start: time.Nanoseconds()}
+			if req.Env == nil {
+				req.Env = make(map[string]interface{})
+			}
+			req.Env[traceKey] = t
+			FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+				t.Status = status
+				return status, header
+			})
+			handler.ServeWeb(req)
+			t.Duration = time.Nanoseconds() - t.Start
+			reporter.Report(t)
+		})
+	}
+}
+
+// SlowTraces is a trace reporter that keeps the most recent traces that took
+// longer than a threshold. SlowTraces is also a handler that shows the
+// traces as plain text.
+type SlowTraces struct {
+	threshold int64
+	mu        sync.Mutex
+	traces    []*Trace
+	next      int
+	n         int
+}
+
+// NewSlowTraces returns a reporter that keeps the last size traces that took
+// longer than threshold nanoseconds.
+func NewSlowTraces(threshold int64, size int) *SlowTraces {
+	return &SlowTraces{threshold: threshold, traces: make([]*Trace, size)}
+}
+
+func (st *SlowTraces) Report(t *Trace) {
+	if t.Duration < st.threshold || len(st.traces) == 0 {
+		return
+	}
+	st.mu.Lock()
+	st.traces[st.next] = t
+	st.next = (st.next + 1) % len(st.traces)
+	if st.n < len(st.traces) {
+		st.n += 1
+	}
+	st.mu.Unlock()
+}
+
+// Traces returns the slow traces, most recent first.
+func (st *SlowTraces) Traces() []*Trace {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	result := make([]*Trace, st.n)
+	for i := 0; i < st.n; i++ {
+		result[i] = st.traces[(st.next-1-i+len(st.traces))%len(st.traces)]
+	}
+	return result
+}
+
+func (st *SlowTraces) ServeWeb(req *Request) {
+	w := req.Respond(StatusOK,
+		HeaderContentType, "text/plain; charset=utf-8",
+		HeaderCacheControl, "no-cache")
+	if w == nil {
+		return
+	}
+	for _, t := range st.Traces() {
+		fmt.Fprintf(w, "%s %s %s %d %.3fms\n",
+			time.SecondsToUTC(t.Start/1e9).Format(time.RFC3339),
+			t.Method, t.URL, t.Status, float64(t.Duration)/1e6)
+		for _, s := range t.Spans() {
+			fmt.Fprintf(w, "  +%.3fms %s %.3fms\n",
+				float64(s.Start-t.Start)/1e6, s.Name, float64(s.Duration)/1e6)
+		}
+	}
+}
+
+// timingName returns s with bytes that are not valid in a token replaced
+// with '_'.
+func timingName(s string) string {
+	p := []byte(s)
+	for i, b := range p {
+		if !IsTokenByte(b) {
+			p[i] = '_'
+		}
+	}
+	return string(p)
+}
+
+// formatMillis formats a duration in nanoseconds as milliseconds.
+func formatMillis(ns int64) string {
+	return strconv.Ftoa64(float64(ns)/1e6, 'f', 3)
+}
+
+// ResponseTime returns middleware that adds the X-Response-Time header to
+// the response. The value is the time in milliseconds from the start of the
+// request to the call to Respond. If serverTiming is true, then the
+// middleware also adds the Server-Timing header with the duration of each
+// span completed before the call to Respond and the total duration. Install
+// the middleware behind Tracer to record spans.
+func ResponseTime(serverTiming bool) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			start := time.Nanoseconds()
+			FilterRespond(req, func(status int, header StringsMap) (int, StringsMap) {
+				d := time.Nanoseconds() - start
+				header.Set(HeaderXResponseTime, formatMillis(d)+"ms")
+				if serverTiming {
+					var b bytes.Buffer
+					if t := RequestTrace(req); t != nil {
+						for _, s := range t.Spans() {
+							if s.Duration > 0 {
+								b.WriteString(timingName(s.Name))
+								b.WriteString(";dur=")
+								b.WriteString(formatMillis(s.Duration))
+								b.WriteString(", ")
+							}
+						}
+					}
+					b.WriteString("total;dur=")
+					b.WriteString(formatMillis(d))
+					header.Set(HeaderServerTiming, b.String())
+				}
+				return status, header
+			})
+			handler.ServeWeb(req)
+		})
+	}
+}
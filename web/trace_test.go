@@ -0,0 +1,74 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"http"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	st := NewSlowTraces(0, 2)
+	h := Tracer(st)(HandlerFunc(func(req *Request) {
+		span := RequestTrace(req).StartSpan("query")
+		span.End()
+		req.Respond(StatusNotFound)
+	}))
+	for _, path := range []string{"/a", "/b", "/c"} {
+		url, _ := http.ParseURL(path)
+		h.ServeWeb(&Request{Method: "GET", URL: url, Responder: &testResponder{}})
+	}
+	traces := st.Traces()
+	if len(traces) != 2 {
+		t.Fatalf("len(traces) = %d, expected 2", len(traces))
+	}
+	if traces[0].URL != "/c" || traces[1].URL != "/b" {
+		t.Errorf("traces = %s %s, expected /c /b", traces[0].URL, traces[1].URL)
+	}
+	if traces[0].Status != StatusNotFound {
+		t.Errorf("status = %d, expected %d", traces[0].Status, StatusNotFound)
+	}
+	if spans := traces[0].Spans(); len(spans) != 1 || spans[0].Name != "query" {
+		t.Errorf("spans = %v, expected query span", spans)
+	}
+	r := &testResponder{}
+	st.ServeWeb(&Request{Responder: r})
+	if lines := strings.Split(strings.TrimSpace(r.body.String()), "\n", -1); len(lines) != 4 {
+		t.Errorf("report has %d lines, expected 4:\n%s", len(lines), r.body.String())
+	}
+	if RequestTrace(&Request{}).StartSpan("untraced") != nil {
+		t.Errorf("StartSpan on nil trace returned span")
+	}
+}
+
+func TestResponseTime(t *testing.T) {
+	h := Chain(Tracer(NewSlowTraces(0, 1)), ResponseTime(true))(HandlerFunc(func(req *Request) {
+		RequestTrace(req).StartSpan("db query").End()
+		RequestTrace(req).StartSpan("unfinished")
+		req.Respond(StatusOK)
+	}))
+	r := &testResponder{}
+	url, _ := http.ParseURL("/")
+	h.ServeWeb(&Request{Method: "GET", URL: url, Responder: r})
+	if v := r.header.GetDef(HeaderXResponseTime, ""); !strings.HasSuffix(v, "ms") {
+		t.Errorf("X-Response-Time = %q", v)
+	}
+	v := r.header.GetDef(HeaderServerTiming, "")
+	if strings.Index(v, "total;dur=") < 0 || strings.Index(v, "unfinished") >= 0 || strings.Index(v, " ;") >= 0 {
+		t.Errorf("Server-Timing = %q", v)
+	}
+}
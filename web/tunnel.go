@@ -0,0 +1,121 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// upgrade hijacks the connection from the server and writes the status line
+// and header to the returned writer. The writer is not flushed.
+func upgrade(req *Request, statusLine string, header StringsMap) (net.Conn, *bufio.ReadWriter, os.Error) {
+	conn, br, err := req.Responder.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	bw := bufio.NewWriter(conn)
+	bw.WriteString(statusLine)
+	bw.WriteString("\r\n")
+	header.WriteHttpHeader(bw)
+	bw.WriteString("\r\n")
+	return conn, bufio.NewReadWriter(br, bw), nil
+}
+
+// Upgrade hijacks the connection from the server, writes a response with the
+// given status and header and returns the connection for use by another
+// protocol. The returned reader holds data sent by the client after the
+// request. Use Upgrade to implement protocols that switch from HTTP with
+// status 101 (Switching Protocols). The caller is responsible for closing
+// the connection.
+func Upgrade(req *Request, status int, header StringsMap) (net.Conn, *bufio.ReadWriter, os.Error) {
+	conn, rw, err := upgrade(req, "HTTP/1.1 "+strconv.Itoa(status)+" "+StatusText[status], header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// ConnectHandler returns middleware that handles CONNECT requests. The
+// middleware hijacks the connection from the server, writes a 200 response
+// to the client and calls f with the connection, the bytes buffered by the
+// server and the target host:port from the request. The function f is
+// responsible for closing the connection.
+//
+// Requests with a method other than CONNECT are dispatched to handler. If
+// handler is nil, then these requests are rejected with HTTP status 405.
+func ConnectHandler(f func(conn net.Conn, buf []byte, host string)) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			if req.Method != "CONNECT" {
+				if handler == nil {
+					req.Error(StatusMethodNotAllowed, errMethodNotAllowed)
+				} else {
+					handler.ServeWeb(req)
+				}
+				return
+			}
+			conn, rw, err := upgrade(req, "HTTP/1.1 200 Connection Established", NewStringsMap())
+			if err != nil {
+				return
+			}
+			buf, err := rw.Reader.Peek(rw.Reader.Buffered())
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if err := rw.Flush(); err != nil {
+				conn.Close()
+				return
+			}
+			f(conn, buf, req.URL.Host)
+		})
+	}
+}
+
+// DialTunnel connects to host and copies data between conn and the host
+// until either side closes the connection. DialTunnel can be used as the
+// function argument to ConnectHandler. Applications should restrict the
+// hosts that clients can connect to before calling DialTunnel.
+func DialTunnel(conn net.Conn, buf []byte, host string) {
+	defer conn.Close()
+	target, err := net.Dial("tcp", "", host)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	if len(buf) > 0 {
+		if _, err := target.Write(buf); err != nil {
+			return
+		}
+	}
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(target, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- true
+	}()
+	<-done
+}
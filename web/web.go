@@ -17,14 +17,17 @@
 package web
 
 import (
+	"bufio"
 	"bytes"
-	"container/vector"
+	"crypto/tls"
 	"fmt"
 	"http"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,8 +39,32 @@ var (
 	ErrInvalidState = os.NewError("invalid state")
 	ErrBadFormat    = os.NewError("bad format")
 	errParsed       = os.NewError("item parsed")
+
+	errMethodNotAllowed os.Error = &Error{Status: StatusMethodNotAllowed, Message: "method not allowed"}
+
+	// Request body is larger than the limit set by the application.
+	ErrRequestEntityTooLarge os.Error = &Error{Status: StatusRequestEntityTooLarge, Message: "request entity too large"}
+
+	// Request body is shorter than the Content-Length header.
+	ErrShortBody = os.NewError("request body shorter than content length")
+
+	// A write of the response to the network did not complete before the
+	// request's WriteTimeout. The connection is closed after the response.
+	ErrWriteTimeout = os.NewError("write timeout")
+
+	// The client closed the connection or reset the stream before the
+	// request body was read or the response was written.
+	ErrClientClosed = os.NewError("client closed connection")
 )
 
+// IsClientAbort returns true if err is returned from a request or response
+// body because the client went away: the client closed the connection or
+// stopped reading the response. Handlers and loggers use IsClientAbort to
+// distinguish aborted requests from server failures.
+func IsClientAbort(err os.Error) bool {
+	return err == ErrClientClosed || err == ErrWriteTimeout
+}
+
 // StringsMap maps strings to slices of strings.
 type StringsMap map[string][]string
 
@@ -47,9 +74,7 @@ func NewStringsMap(kvs ...string) StringsMap {
 		panic("twister: even number args required for NewStringsMap")
 	}
 	m := make(StringsMap)
-	for i := 0; i < len(kvs); i += 2 {
-		m.Append(kvs[i], kvs[i+1])
-	}
+	m.AppendMany(kvs...)
 	return m
 }
 
@@ -71,11 +96,26 @@ func (m StringsMap) GetDef(key string, def string) string {
 	return values[0]
 }
 
-// Append value to slice for given key.
+// Append value to slice for given key. Append allocates a new slice for the
+// values and does not modify the backing array of the previous slice. The
+// server uses this property to allocate the slices for single valued
+// headers from a shared array.
 func (m StringsMap) Append(key string, value string) {
-	v := vector.StringVector(m[key])
-	v.Push(value)
-	m[key] = v
+	values := m[key]
+	p := make([]string, len(values)+1)
+	copy(p, values)
+	p[len(values)] = value
+	m[key] = p
+}
+
+// AppendMany appends the given key-value pairs to the map.
+func (m StringsMap) AppendMany(kvs ...string) {
+	if len(kvs)%2 == 1 {
+		panic("twister: even number args required for AppendMany")
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		m.Append(kvs[i], kvs[i+1])
+	}
 }
 
 // Set value for given key, discarding previous values if any.
@@ -83,6 +123,71 @@ func (m StringsMap) Set(key string, value string) {
 	m[key] = []string{value}
 }
 
+// Del deletes the values for the given key.
+func (m StringsMap) Del(key string) {
+	m[key] = nil, false
+}
+
+// Has returns true if the map contains the given key.
+func (m StringsMap) Has(key string) bool {
+	_, found := m[key]
+	return found
+}
+
+// SortedKeys returns the keys of the map in sorted order. Use SortedKeys to
+// iterate over the map in a deterministic order.
+func (m StringsMap) SortedKeys() []string {
+	keys := make([]string, len(m))
+	i := 0
+	for key, _ := range m {
+		keys[i] = key
+		i += 1
+	}
+	sort.SortStrings(keys)
+	return keys
+}
+
+// WriteHttpHeader writes the map to w in HTTP header format with the keys in
+// sorted order. The line terminating the header is not written. Carriage
+// returns and line feeds in values are replaced with spaces to prevent
+// response splitting attacks.
+func (m StringsMap) WriteHttpHeader(w io.Writer) os.Error {
+	for _, key := range m.SortedKeys() {
+		for _, value := range m[key] {
+			for _, s := range [...]string{key, ": ", cleanHeaderValue(value), "\r\n"} {
+				if _, err := io.WriteString(w, s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cleanHeaderValue replaces \r and \n with ' ' in header values to prevent
+// response splitting attacks.  
+func cleanHeaderValue(s string) string {
+	dirty := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\r' || c == '\n' {
+			dirty = true
+			break
+		}
+	}
+	if !dirty {
+		return s
+	}
+	p := []byte(s)
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '\r' || c == '\n' {
+			p[i] = ' '
+		}
+	}
+	return string(p)
+}
+
 // RequestBody represents the request body.
 type RequestBody interface {
 	io.Reader
@@ -91,7 +196,9 @@ type RequestBody interface {
 // ResponseBody represents the response body.
 type ResponseBody interface {
 	io.Writer
-	// Flush writes any buffered data to the network.
+	// Flush writes any buffered data to the network. Response bodies that
+	// wrap another response body must write the data they hold and then
+	// flush the wrapped body.
 	Flush() os.Error
 }
 
@@ -101,10 +208,37 @@ type Responder interface {
 	// a writer for the response body.
 	Respond(status int, header StringsMap) ResponseBody
 
+	// Continue writes the "100 Continue" interim response if the client sent
+	// the "Expect: 100-continue" header and the response has not been
+	// written already. Continue must be called before Respond.
+	Continue() os.Error
+
 	// Hijack lets the caller take over the connection from the HTTP server.
-	// The caller is responsible for closing the connection. Returns connection
-	// and bytes buffered by the server.
-	Hijack() (conn net.Conn, buf []byte, err os.Error)
+	// The caller is responsible for closing the connection. Returns the
+	// connection and a reader for the connection. The reader holds data
+	// buffered by the server and is positioned at the first byte of the
+	// request body not read by the handler. Hijack returns ErrInvalidState if
+	// the response was started or the connection cannot be hijacked.
+	Hijack() (conn net.Conn, br *bufio.Reader, err os.Error)
+}
+
+// aborter is implemented by responders that can abort a response.
+type aborter interface {
+	Abort()
+}
+
+// AbortResponse aborts the response to req. The server closes the
+// connection without completing the response so that the client can detect
+// that the response is incomplete. Writes to the response body fail after
+// the response is aborted. AbortResponse returns false if the responder does
+// not support aborting responses.
+func AbortResponse(req *Request) bool {
+	a, ok := req.Responder.(aborter)
+	if !ok {
+		return false
+	}
+	a.Abort()
+	return true
 }
 
 // Request represents an HTTP request.
@@ -132,12 +266,18 @@ type Request struct {
 	// Cookies.
 	Cookie StringsMap
 
+	// Env holds values attached to the request by middleware such as the
+	// authenticated user. Packages should use keys prefixed with the package
+	// name to avoid collisions.
+	Env map[string]interface{}
+
 	// Lowercase content type, not including params.
 	ContentType string
 
-	// ErrorHandler responds to the request with the given status code.
-	// Applications set their error handler in middleware. 
-	ErrorHandler func(req *Request, status int, message string)
+	// ErrorHandler responds to the request with the given status code and
+	// the error that caused the response. Applications set their error
+	// handler in middleware. 
+	ErrorHandler func(req *Request, status int, reason os.Error)
 
 	// ContentLength is the length of the request body or -1 if the content
 	// length is not known.
@@ -146,7 +286,23 @@ type Request struct {
 	// The request body.
 	Body RequestBody
 
+	// TLS is the state of the TLS connection or nil if the request was not
+	// received over TLS. The verified client certificate chain is in
+	// TLS.PeerCertificates.
+	TLS *tls.ConnectionState
+
+	// WriteTimeout is the maximum time in nanoseconds to wait for each write
+	// of the response to the network. Handlers that stream to slow clients
+	// set the timeout to avoid blocking forever on a stalled client. When a
+	// write times out, the response body returns ErrWriteTimeout and the
+	// server closes the connection. The server's write timeout is used if
+	// the value is zero.
+	WriteTimeout int64
+
 	formParseErr os.Error
+
+	// Functions registered with OnFinish.
+	onFinish []func()
 }
 
 // Handler is the interface for web handlers.
@@ -161,6 +317,58 @@ type HandlerFunc func(*Request)
 // ServeWeb calls f(req).
 func (f HandlerFunc) ServeWeb(req *Request) { f(req) }
 
+// Error is an error with an HTTP status. Return an Error from an
+// ErrorHandlerFunc to respond with a specific status.
+//
+// The Message is safe to show to the client. The Detail and Fields describe
+// the error for logs and debugging. Error handlers should not include the
+// Detail and Fields in responses to clients.
+type Error struct {
+	Status  int        // HTTP status code.
+	Message string     // Public message or "" to use the status text.
+	Detail  string     // Internal detail.
+	Fields  StringsMap // Key/value pairs that describe the error.
+}
+
+// NewError returns a new error with the given status, message and fields.
+// The structure of kvs is (key value)*.
+func NewError(status int, message string, kvs ...string) *Error {
+	return &Error{Status: status, Message: message, Fields: NewStringsMap(kvs...)}
+}
+
+func (e Error) String() string {
+	if e.Message == "" {
+		return StatusText[e.Status]
+	}
+	return e.Message
+}
+
+// ErrorStatus returns the HTTP status for err if err is an Error and def
+// otherwise.
+func ErrorStatus(err os.Error, def int) int {
+	switch e := err.(type) {
+	case Error:
+		return e.Status
+	case *Error:
+		return e.Status
+	}
+	return def
+}
+
+// ErrorHandlerFunc is a type adapter to allow the use of ordinary functions
+// that return an error as web handlers.
+type ErrorHandlerFunc func(*Request) os.Error
+
+// ServeWeb calls f(req). If f returns an error, then ServeWeb responds to the
+// request using the request's error handler. The status is taken from the
+// error if the error is an Error. Otherwise, the status is
+// StatusInternalServerError.
+func (f ErrorHandlerFunc) ServeWeb(req *Request) {
+	if err := f(req); err != nil {
+		req.Error(ErrorStatus(err, StatusInternalServerError), err)
+	}
+}
+
 // NewRequest allocates and initializes a request. 
 func NewRequest(remoteAddr string, method string, url *http.URL, protocolVersion int, header StringsMap) (req *Request, err os.Error) {
 	req = &Request{
@@ -170,11 +378,12 @@ func NewRequest(remoteAddr string, method string, url *http.URL, protocolVersion
 		ProtocolVersion: protocolVersion,
 		ErrorHandler:    defaultErrorHandler,
 		Param:           make(StringsMap),
+		Env:             make(map[string]interface{}),
 		Header:          header,
 		Cookie:          parseCookieValues(header[HeaderCookie]),
 	}
 
-	err = parseUrlEncodedFormBytes([]byte(req.URL.RawQuery), req.Param)
+	err = parseUrlEncodedFormBytes([]byte(req.URL.RawQuery), req.Param, true)
 	if err != nil {
 		return nil, err
 	}
@@ -213,16 +422,109 @@ func (req *Request) Respond(status int, kvs ...string) ResponseBody {
 	return req.Responder.Respond(status, header)
 }
 
-func defaultErrorHandler(req *Request, status int, message string) {
+// RespondBytes responds to the request with the given status, content type
+// and body. The Content-Length header is set to the length of the body.
+func (req *Request) RespondBytes(status int, contentType string, body []byte) os.Error {
+	w := req.Respond(status,
+		HeaderContentType, contentType,
+		HeaderContentLength, strconv.Itoa(len(body)))
+	if w == nil {
+		return ErrInvalidState
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// RespondText responds to the request with the given status and plain text
+// body.
+func (req *Request) RespondText(status int, body string) os.Error {
+	return req.RespondBytes(status, "text/plain; charset=utf-8", []byte(body))
+}
+
+// RespondHTML responds to the request with the given status and HTML body.
+func (req *Request) RespondHTML(status int, body string) os.Error {
+	return req.RespondBytes(status, "text/html; charset=utf-8", []byte(body))
+}
+
+// RespondStatus responds to the request with the given status and an empty
+// body.
+func (req *Request) RespondStatus(status int) os.Error {
+	if req.Respond(status, HeaderContentLength, "0") == nil {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+func defaultErrorHandler(req *Request, status int, reason os.Error) {
 	w := req.Respond(status, HeaderContentType, "text/plain; charset=utf-8")
 	if w != nil {
-		fmt.Fprintln(w, message)
+		fmt.Fprintln(w, StatusText[status])
+		if reason != nil && status < 500 {
+			fmt.Fprintln(w, reason)
+		}
+	}
+}
+
+// Error responds to the request with an error. The reason is the error that
+// caused the response. The reason can be nil.
+func (req *Request) Error(status int, reason os.Error) {
+	req.ErrorHandler(req, status, reason)
+}
+
+// OnFinish registers f to be called after the response is finished or the
+// connection is hijacked. Use OnFinish to release resources held for the
+// request. The server calls the registered functions in the reverse order
+// of registration, even if the handler panics.
+func (req *Request) OnFinish(f func()) {
+	if len(req.onFinish) == cap(req.onFinish) {
+		tmp := make([]func(), len(req.onFinish), 2*len(req.onFinish)+2)
+		copy(tmp, req.onFinish)
+		req.onFinish = tmp
 	}
+	req.onFinish = req.onFinish[0 : len(req.onFinish)+1]
+	req.onFinish[len(req.onFinish)-1] = f
 }
 
-// Error responds to the request with an error. 
-func (req *Request) Error(status int, message string) {
-	req.ErrorHandler(req, status, message)
+// Finish calls the functions registered with OnFinish. A panic in one
+// function is logged and does not prevent the remaining functions from
+// running. Servers call Finish when done with the request; applications
+// should not call Finish.
+func (req *Request) Finish() {
+	fs := req.onFinish
+	req.onFinish = nil
+	for i := len(fs) - 1; i >= 0; i-- {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Stderr("twister: panic in finish function", r)
+				}
+			}()
+			fs[i]()
+		}()
+	}
+}
+
+// CheckLastModified checks the If-Modified-Since and If-Unmodified-Since
+// request headers against the time that the requested resource was last
+// modified. The time is in seconds since the epoch. CheckLastModified
+// returns StatusPreconditionFailed if the resource was modified after the
+// time in the If-Unmodified-Since header, StatusNotModified if the request
+// method is GET or HEAD and the resource was not modified after the time in
+// the If-Modified-Since header and StatusOK otherwise.
+func (req *Request) CheckLastModified(lastModified int64) int {
+	if s, found := req.Header.Get(HeaderIfUnmodifiedSince); found {
+		if t, err := ParseHTTPDate(s); err == nil && lastModified > t.Seconds() {
+			return StatusPreconditionFailed
+		}
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		if s, found := req.Header.Get(HeaderIfModifiedSince); found {
+			if t, err := ParseHTTPDate(s); err == nil && lastModified <= t.Seconds() {
+				return StatusNotModified
+			}
+		}
+	}
+	return StatusOK
 }
 
 // Redirect responds to the request with a redirect the specified URL.
@@ -242,25 +544,95 @@ func (req *Request) Redirect(url string, perm bool) {
 	req.Respond(status, HeaderLocation, url)
 }
 
-// BodyBytes returns the request body a slice of bytees.
-func (req *Request) BodyBytes() ([]byte, os.Error) {
-	var p []byte
-	if req.ContentLength > 0 {
-		p = make([]byte, req.ContentLength)
-		if _, err := req.Body.Read(p); err != nil {
-			return nil, err
+// BodyBytes returns the request body as a slice of bytes. BodyBytes returns
+// ErrRequestEntityTooLarge if the body is longer than maxLen bytes and
+// ErrShortBody if the body is shorter than the Content-Length header. There
+// is no limit on the length of the body if maxLen is less than zero.
+func (req *Request) BodyBytes(maxLen int) ([]byte, os.Error) {
+	if req.ContentLength >= 0 {
+		if maxLen >= 0 && req.ContentLength > maxLen {
+			return nil, ErrRequestEntityTooLarge
 		}
-	} else {
-		var err os.Error
-		if p, err = ioutil.ReadAll(req.Body); err != nil {
+		p := make([]byte, req.ContentLength)
+		if _, err := io.ReadFull(req.Body, p); err != nil {
+			if err == io.ErrUnexpectedEOF || err == os.EOF {
+				err = ErrShortBody
+			}
 			return nil, err
 		}
+		return p, nil
+	}
+	var r io.Reader = req.Body
+	if maxLen >= 0 {
+		r = io.LimitReader(r, int64(maxLen)+1)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxLen >= 0 && len(p) > maxLen {
+		return nil, ErrRequestEntityTooLarge
 	}
 	return p, nil
 }
 
-// ParseForm parses url-encoded form bodies. ParseForm is idempotent.
+// bufferedBody is a request body read into memory by BufferBody.
+type bufferedBody struct {
+	p   []byte
+	pos int
+}
+
+func (b *bufferedBody) Read(p []byte) (int, os.Error) {
+	if b.pos >= len(b.p) {
+		return 0, os.EOF
+	}
+	n := copy(p, b.p[b.pos:])
+	b.pos += n
+	return n, nil
+}
+
+// BufferBody reads the request body into memory so that the body can be
+// read more than once. Call RewindBody to read the body again. BufferBody
+// returns ErrRequestEntityTooLarge if the body is longer than maxLen bytes.
+// BufferBody does nothing if the body is already buffered.
+func (req *Request) BufferBody(maxLen int) os.Error {
+	if _, ok := req.Body.(*bufferedBody); ok {
+		return nil
+	}
+	p, err := req.BodyBytes(maxLen)
+	if err != nil {
+		return err
+	}
+	req.Body = &bufferedBody{p: p}
+	req.ContentLength = len(p)
+	return nil
+}
+
+// RewindBody resets a body buffered by BufferBody to the beginning. Returns
+// ErrInvalidState if the body is not buffered.
+func (req *Request) RewindBody() os.Error {
+	b, ok := req.Body.(*bufferedBody)
+	if !ok {
+		return ErrInvalidState
+	}
+	b.pos = 0
+	return nil
+}
+
+// DefaultMaxFormLen is the maximum length of a form body parsed by
+// ParseForm.
+const DefaultMaxFormLen = 1 << 20
+
+// ParseForm parses url-encoded form bodies. ParseForm is idempotent. The
+// form body is limited to DefaultMaxFormLen bytes. Forms submitted in a
+// character set other than UTF-8 are converted to UTF-8 using the converter
+// registered with RegisterCharset. The character set is taken from the
+// Content-Type header or the _charset_ form field.
 func (req *Request) ParseForm() os.Error {
+	return req.parseForm(DefaultMaxFormLen)
+}
+
+func (req *Request) parseForm(maxLen int) os.Error {
 	if req.formParseErr == errParsed {
 		return nil
 	} else if req.formParseErr != nil {
@@ -272,12 +644,36 @@ func (req *Request) ParseForm() os.Error {
 		(req.Method != "POST" && req.Method != "PUT") {
 		return nil
 	}
-	p, err := req.BodyBytes()
+	p, err := req.BodyBytes(maxLen)
 	if err != nil {
 		req.formParseErr = err
 		return err
 	}
-	if err := parseUrlEncodedFormBytes(p, req.Param); err != nil {
+	m := make(StringsMap)
+	if err := parseUrlEncodedFormBytes(p, m, true); err != nil {
+		req.formParseErr = err
+		return err
+	}
+	charset := contentTypeParam(req.Header.GetDef(HeaderContentType, ""), "charset")
+	if charset == "" {
+		// Browsers set the value of a hidden field named _charset_ to the
+		// charset used to submit the form.
+		charset = m.GetDef("_charset_", "")
+	}
+	if isUTF8Charset(charset) {
+		for key, values := range m {
+			for _, value := range values {
+				req.Param.Append(key, value)
+			}
+		}
+		return nil
+	}
+	converter := lookupCharset(charset)
+	if converter == nil {
+		req.formParseErr = ErrUnknownCharset
+		return ErrUnknownCharset
+	}
+	if err := convertStringsMap(req.Param, m, converter); err != nil {
 		req.formParseErr = err
 		return err
 	}
@@ -298,7 +694,7 @@ func RedirectHandler(url string, permanent bool) Handler {
 	return &redirectHandler{url, permanent}
 }
 
-var notFoundHandler = HandlerFunc(func(req *Request) { req.Error(StatusNotFound, "Not Found") })
+var notFoundHandler = HandlerFunc(func(req *Request) { req.Error(StatusNotFound, nil) })
 
 // NotFoundHandler returns a request handler that responds with 404 not found.
 func NotFoundHandler() Handler {
@@ -0,0 +1,211 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+// testResponder records the response in memory.
+type testResponder struct {
+	status int
+	header StringsMap
+	body   bytes.Buffer
+}
+
+func (r *testResponder) Respond(status int, header StringsMap) ResponseBody {
+	r.status = status
+	r.header = header
+	return r
+}
+
+func (r *testResponder) Write(p []byte) (int, os.Error) { return r.body.Write(p) }
+func (r *testResponder) Flush() os.Error                { return nil }
+func (r *testResponder) Continue() os.Error             { return nil }
+
+func (r *testResponder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, ErrInvalidState
+}
+
+type BodyBytesTest struct {
+	body          string
+	contentLength int
+	maxLen        int
+	expected      string
+	err           os.Error
+}
+
+var BodyBytesTests = []BodyBytesTest{
+	BodyBytesTest{"hello", 5, -1, "hello", nil},
+	BodyBytesTest{"hello", 5, 5, "hello", nil},
+	BodyBytesTest{"hello", 5, 4, "", ErrRequestEntityTooLarge},
+	BodyBytesTest{"hel", 5, -1, "", ErrShortBody},
+	BodyBytesTest{"", 5, -1, "", ErrShortBody},
+	BodyBytesTest{"", 0, -1, "", nil},
+	BodyBytesTest{"hello", -1, -1, "hello", nil},
+	BodyBytesTest{"hello", -1, 5, "hello", nil},
+	BodyBytesTest{"hello", -1, 4, "", ErrRequestEntityTooLarge},
+}
+
+func TestBodyBytes(t *testing.T) {
+	for _, bt := range BodyBytesTests {
+		req := &Request{Body: bytes.NewBufferString(bt.body), ContentLength: bt.contentLength}
+		p, err := req.BodyBytes(bt.maxLen)
+		if err != bt.err {
+			t.Errorf("body=%q contentLength=%d maxLen=%d, expected error %v, actual %v", bt.body, bt.contentLength, bt.maxLen, bt.err, err)
+			continue
+		}
+		if err == nil && string(p) != bt.expected {
+			t.Errorf("body=%q contentLength=%d maxLen=%d, expected %q, actual %q", bt.body, bt.contentLength, bt.maxLen, bt.expected, p)
+		}
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	req := &Request{Body: bytes.NewBufferString("hello"), ContentLength: -1}
+	if err := req.RewindBody(); err != ErrInvalidState {
+		t.Errorf("RewindBody before BufferBody returned %v", err)
+	}
+	if err := req.BufferBody(10); err != nil {
+		t.Fatalf("BufferBody returned %v", err)
+	}
+	if req.ContentLength != 5 {
+		t.Errorf("ContentLength = %d, expected 5", req.ContentLength)
+	}
+	for i := 0; i < 2; i++ {
+		p, err := req.BodyBytes(-1)
+		if err != nil || string(p) != "hello" {
+			t.Errorf("read %d, actual %q, %v", i, p, err)
+		}
+		req.RewindBody()
+	}
+}
+
+func TestWriteHttpHeader(t *testing.T) {
+	m := NewStringsMap("B", "2", "A", "1", "C", "x\r\ny", "B", "3")
+	var b bytes.Buffer
+	if err := m.WriteHttpHeader(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := "A: 1\r\nB: 2\r\nB: 3\r\nC: x  y\r\n"
+	if b.String() != expected {
+		t.Errorf("WriteHttpHeader wrote %q, expected %q", b.String(), expected)
+	}
+	m.Del("B")
+	if m.Has("B") || !m.Has("A") {
+		t.Errorf("Del or Has failed, keys=%q", m.SortedKeys())
+	}
+}
+
+type ParseFormCharsetTest struct {
+	contentType string
+	body        string
+	expected    string
+	err         os.Error
+}
+
+var ParseFormCharsetTests = []ParseFormCharsetTest{
+	ParseFormCharsetTest{"application/x-www-form-urlencoded", "a=caf%C3%A9", "café", nil},
+	ParseFormCharsetTest{"application/x-www-form-urlencoded; charset=utf-8", "a=caf%C3%A9", "café", nil},
+	ParseFormCharsetTest{"application/x-www-form-urlencoded; charset=ISO-8859-1", "a=caf%E9", "café", nil},
+	ParseFormCharsetTest{"application/x-www-form-urlencoded; charset=\"latin1\"", "a=caf%E9", "café", nil},
+	ParseFormCharsetTest{"application/x-www-form-urlencoded", "_charset_=iso-8859-1&a=caf%E9", "café", nil},
+	ParseFormCharsetTest{"application/x-www-form-urlencoded; charset=x-unknown", "a=b", "", ErrUnknownCharset},
+}
+
+func TestParseFormCharset(t *testing.T) {
+	for _, ft := range ParseFormCharsetTests {
+		req := &Request{
+			Method:        "POST",
+			Header:        NewStringsMap(HeaderContentType, ft.contentType),
+			Param:         make(StringsMap),
+			ContentType:   "application/x-www-form-urlencoded",
+			ContentLength: len(ft.body),
+			Body:          bytes.NewBufferString(ft.body),
+		}
+		err := req.ParseForm()
+		if err != ft.err {
+			t.Errorf("%s %s: expected error %v, actual %v", ft.contentType, ft.body, ft.err, err)
+			continue
+		}
+		if actual := req.Param.GetDef("a", ""); err == nil && actual != ft.expected {
+			t.Errorf("%s %s: expected %q, actual %q", ft.contentType, ft.body, ft.expected, actual)
+		}
+	}
+}
+
+type errorStatusTest struct {
+	err    os.Error
+	status int
+}
+
+var errorStatusTests = []errorStatusTest{
+	errorStatusTest{nil, 500},
+	errorStatusTest{ErrBadFormat, 500},
+	errorStatusTest{Error{Status: StatusNotFound}, StatusNotFound},
+	errorStatusTest{NewError(StatusForbidden, "forbidden", "user", "bob"), StatusForbidden},
+	errorStatusTest{ErrRequestEntityTooLarge, StatusRequestEntityTooLarge},
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, tt := range errorStatusTests {
+		if status := ErrorStatus(tt.err, 500); status != tt.status {
+			t.Errorf("ErrorStatus(%v) = %d, expected %d", tt.err, status, tt.status)
+		}
+	}
+}
+
+func TestOnFinish(t *testing.T) {
+	req := &Request{}
+	var calls []int
+	for i := 0; i < 3; i++ {
+		n := i
+		req.OnFinish(func() {
+			tmp := make([]int, len(calls)+1)
+			copy(tmp, calls)
+			tmp[len(calls)] = n
+			calls = tmp
+			if n == 1 {
+				panic("finish panic")
+			}
+		})
+	}
+	req.Finish()
+	if len(calls) != 3 || calls[0] != 2 || calls[1] != 1 || calls[2] != 0 {
+		t.Errorf("calls = %v, expected [2 1 0]", calls)
+	}
+	req.Finish()
+	if len(calls) != 3 {
+		t.Errorf("second Finish called functions again, calls = %v", calls)
+	}
+}
+
+func BenchmarkWriteHttpHeader(b *testing.B) {
+	header := NewStringsMap(
+		HeaderContentType, "text/html; charset=utf-8",
+		HeaderContentLength, "1234",
+		HeaderCacheControl, "private",
+		HeaderSetCookie, "a=b; Path=/; HttpOnly",
+		HeaderVary, HeaderAcceptEncoding)
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		header.WriteHttpHeader(&buf)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The webhook package implements handlers for receiving webhook deliveries.
+//
+// A Receiver reads the raw request body, verifies the signature of the body,
+// drops duplicate deliveries and calls a function to process the delivery:
+//
+//  r := webhook.NewReceiver(webhook.HubSignature, secret, func(req *web.Request, body []byte) os.Error {
+//      // process the delivery
+//      return nil
+//  })
+//  r.DeliveryHeader = "X-Github-Delivery"
+//  r.Deliveries = webhook.NewDeliveryCache(3600, 10000)
+//  router.Register("/hooks/github", "POST", r)
+//
+// The receiver responds with status 204 when the delivery is processed. If
+// the function returns an error, then the receiver responds with the status
+// from the error or status 500 so that the sender retries the delivery.
+// Return a *web.Error with a 4xx status to reject a delivery permanently.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/garyburd/twister/web"
+	"hash"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errBadSignature os.Error = &web.Error{Status: web.StatusUnauthorized, Message: "bad webhook signature"}
+	errInProgress   os.Error = &web.Error{Status: web.StatusServiceUnavailable, Message: "delivery in progress"}
+)
+
+// DefaultMaxBodyLen is the default maximum length of a delivery body.
+const DefaultMaxBodyLen = 1 << 20
+
+// The key for the raw request body in the request Env.
+const bodyKey = "webhook.body"
+
+// Scheme describes how a sender signs deliveries.
+type Scheme struct {
+	// Header is the name of the header that holds the signature.
+	Header string
+
+	// Prefix is the text before the encoded signature in the header value.
+	Prefix string
+
+	// NewHash returns the keyed hash used to compute the signature of the
+	// body.
+	NewHash func(key []byte) hash.Hash
+
+	// Encode encodes the hash sum. Hex encoding is used if Encode is nil.
+	Encode func(p []byte) string
+}
+
+// HubSignature is the scheme used by PubSubHubbub and GitHub. The signature
+// is the hex encoded HMAC-SHA1 of the body in the X-Hub-Signature header with
+// the prefix "sha1=".
+var HubSignature = &Scheme{Header: "X-Hub-Signature", Prefix: "sha1=", NewHash: hmac.NewSHA1}
+
+// Sign returns the header value for body signed with secret.
+func (s *Scheme) Sign(secret []byte, body []byte) string {
+	h := s.NewHash(secret)
+	h.Write(body)
+	encode := s.Encode
+	if encode == nil {
+		encode = hex.EncodeToString
+	}
+	return s.Prefix + encode(h.Sum())
+}
+
+// Verify returns true if the signature in header is valid for body and
+// secret.
+func (s *Scheme) Verify(secret []byte, header web.StringsMap, body []byte) bool {
+	sig, found := header.Get(s.Header)
+	if !found {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sig), []byte(s.Sign(secret, body))) == 1
+}
+
+// Delivery states in DeliveryCache.
+const (
+	deliveryNew = iota
+	deliveryPending
+	deliveryDone
+)
+
+type deliveryRecord struct {
+	id      string
+	expires int64
+}
+
+// DeliveryCache remembers the IDs of processed deliveries. Receivers use the
+// cache to drop deliveries that the sender retries after a lost response.
+type DeliveryCache struct {
+	ttl     int64
+	maxSize int
+
+	mu      sync.Mutex
+	pending map[string]bool
+	done    map[string]bool
+	// Processed deliveries in order of expiration.
+	queue []deliveryRecord
+}
+
+// NewDeliveryCache returns a cache that remembers up to maxSize processed
+// deliveries for ttl seconds.
+func NewDeliveryCache(ttl int64, maxSize int) *DeliveryCache {
+	return &DeliveryCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		pending: make(map[string]bool),
+		done:    make(map[string]bool),
+	}
+}
+
+// start records the start of processing for the delivery with the given ID
+// and returns the previous state of the delivery.
+func (dc *DeliveryCache) start(id string, now int64) int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.expire(now)
+	switch {
+	case dc.done[id]:
+		return deliveryDone
+	case dc.pending[id]:
+		return deliveryPending
+	}
+	dc.pending[id] = true
+	return deliveryNew
+}
+
+// finish records the end of processing for the delivery. If ok is false,
+// then the delivery is forgotten so that a retry from the sender is
+// processed.
+func (dc *DeliveryCache) finish(id string, ok bool, now int64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.pending[id] = false, false
+	if !ok {
+		return
+	}
+	if len(dc.queue) == cap(dc.queue) {
+		queue := make([]deliveryRecord, len(dc.queue), 2*len(dc.queue)+16)
+		copy(queue, dc.queue)
+		dc.queue = queue
+	}
+	dc.queue = dc.queue[0 : len(dc.queue)+1]
+	dc.queue[len(dc.queue)-1] = deliveryRecord{id, now + dc.ttl}
+	dc.done[id] = true
+	dc.expire(now)
+}
+
+// expire removes expired deliveries and the oldest deliveries over the
+// maximum size of the cache.
+func (dc *DeliveryCache) expire(now int64) {
+	i := 0
+	for ; i < len(dc.queue); i++ {
+		if dc.queue[i].expires > now && len(dc.queue)-i <= dc.maxSize {
+			break
+		}
+		dc.done[dc.queue[i].id] = false, false
+		dc.queue[i] = deliveryRecord{}
+	}
+	dc.queue = dc.queue[i:]
+}
+
+// Receiver is a handler for webhook deliveries.
+type Receiver struct {
+	// Scheme is the signature scheme. Signatures are not verified if Scheme
+	// is nil.
+	Scheme *Scheme
+
+	// Secret is the key shared with the sender.
+	Secret []byte
+
+	// DeliveryHeader is the name of the header that holds the unique ID of
+	// the delivery.
+	DeliveryHeader string
+
+	// Deliveries remembers processed deliveries. Duplicate deliveries are
+	// not dropped if Deliveries is nil or the request does not have the
+	// delivery header.
+	Deliveries *DeliveryCache
+
+	// MaxBodyLen is the maximum length of the request body. The default is
+	// used if the value is zero.
+	MaxBodyLen int
+
+	// Process processes the delivery. The body is the raw request body. The
+	// request body is rewound before Process is called so that Process can
+	// parse the body again. Process must not respond to the request.
+	Process func(req *web.Request, body []byte) os.Error
+}
+
+// NewReceiver returns a receiver that verifies deliveries with scheme and
+// secret and calls process for each new delivery.
+func NewReceiver(scheme *Scheme, secret []byte, process func(req *web.Request, body []byte) os.Error) *Receiver {
+	return &Receiver{Scheme: scheme, Secret: secret, Process: process}
+}
+
+// Body returns the raw request body captured by a Receiver or nil if the
+// request was not handled by a receiver.
+func Body(req *web.Request) []byte {
+	body, _ := req.Env[bodyKey].([]byte)
+	return body
+}
+
+func (r *Receiver) ServeWeb(req *web.Request) {
+	if req.Method != "POST" {
+		req.Respond(web.StatusMethodNotAllowed, web.HeaderAllow, "POST")
+		return
+	}
+	maxLen := r.MaxBodyLen
+	if maxLen == 0 {
+		maxLen = DefaultMaxBodyLen
+	}
+	if err := req.BufferBody(maxLen); err != nil {
+		req.Error(web.ErrorStatus(err, web.StatusBadRequest), err)
+		return
+	}
+	body, err := req.BodyBytes(-1)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	req.RewindBody()
+	req.Env[bodyKey] = body
+
+	if r.Scheme != nil && !r.Scheme.Verify(r.Secret, req.Header, body) {
+		req.Error(web.StatusUnauthorized, errBadSignature)
+		return
+	}
+
+	id := ""
+	if r.Deliveries != nil && r.DeliveryHeader != "" {
+		id = req.Header.GetDef(r.DeliveryHeader, "")
+	}
+	if id != "" {
+		switch r.Deliveries.start(id, time.Seconds()) {
+		case deliveryDone:
+			req.Respond(web.StatusNoContent)
+			return
+		case deliveryPending:
+			req.Error(web.StatusServiceUnavailable, errInProgress)
+			return
+		}
+	}
+
+	ok := false
+	if id != "" {
+		defer func() { r.Deliveries.finish(id, ok, time.Seconds()) }()
+	}
+	if err := r.Process(req, body); err != nil {
+		req.Error(web.ErrorStatus(err, web.StatusInternalServerError), err)
+		return
+	}
+	ok = true
+	req.Respond(web.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"github.com/garyburd/twister/web/webtest"
+	"os"
+	"testing"
+)
+
+func deliver(r *Receiver, body string, kvs ...string) int {
+	tr := &webtest.Responder{}
+	r.ServeWeb(&web.Request{
+		Method:        "POST",
+		Header:        web.NewStringsMap(kvs...),
+		Env:           make(map[string]interface{}),
+		Responder:     tr,
+		ErrorHandler:  func(req *web.Request, status int, reason os.Error) { req.Respond(status) },
+		ContentLength: len(body),
+		Body:          bytes.NewBufferString(body),
+	})
+	return tr.Status
+}
+
+func TestReceiver(t *testing.T) {
+	secret := []byte("secret")
+	var processed []string
+	var fail os.Error
+	r := NewReceiver(HubSignature, secret, func(req *web.Request, body []byte) os.Error {
+		if string(Body(req)) != string(body) {
+			t.Errorf("Body() = %q, expected %q", Body(req), body)
+		}
+		if fail != nil {
+			return fail
+		}
+		processed = appendString(processed, string(body))
+		return nil
+	})
+	r.DeliveryHeader = "X-Delivery"
+	r.Deliveries = NewDeliveryCache(3600, 10)
+
+	sig := HubSignature.Sign(secret, []byte("a"))
+	if status := deliver(r, "a", "X-Hub-Signature", "sha1=bad"); status != web.StatusUnauthorized {
+		t.Errorf("bad signature status = %d, expected 401", status)
+	}
+	if status := deliver(r, "a"); status != web.StatusUnauthorized {
+		t.Errorf("missing signature status = %d, expected 401", status)
+	}
+
+	fail = os.NewError("fail")
+	if status := deliver(r, "a", "X-Hub-Signature", sig, "X-Delivery", "1"); status != web.StatusInternalServerError {
+		t.Errorf("failed delivery status = %d, expected 500", status)
+	}
+	fail = nil
+	for i := 0; i < 2; i++ {
+		if status := deliver(r, "a", "X-Hub-Signature", sig, "X-Delivery", "1"); status != web.StatusNoContent {
+			t.Errorf("delivery %d status = %d, expected 204", i, status)
+		}
+	}
+	if len(processed) != 1 || processed[0] != "a" {
+		t.Errorf("processed = %v, expected [a]", processed)
+	}
+}
+
+func TestDeliveryCache(t *testing.T) {
+	dc := NewDeliveryCache(10, 2)
+	if s := dc.start("a", 0); s != deliveryNew {
+		t.Errorf("start(a) = %d, expected new", s)
+	}
+	if s := dc.start("a", 0); s != deliveryPending {
+		t.Errorf("start(a) = %d, expected pending", s)
+	}
+	dc.finish("a", true, 0)
+	if s := dc.start("a", 5); s != deliveryDone {
+		t.Errorf("start(a) = %d, expected done", s)
+	}
+	if s := dc.start("a", 10); s != deliveryNew {
+		t.Errorf("start(a) after expiration = %d, expected new", s)
+	}
+	dc.finish("a", true, 10)
+	for _, id := range []string{"b", "c"} {
+		dc.start(id, 10)
+		dc.finish(id, true, 10)
+	}
+	if s := dc.start("a", 11); s != deliveryNew {
+		t.Errorf("start(a) after eviction = %d, expected new", s)
+	}
+	if s := dc.start("c", 11); s != deliveryDone {
+		t.Errorf("start(c) = %d, expected done", s)
+	}
+}
+
+func appendString(s []string, v string) []string {
+	t := make([]string, len(s)+1)
+	copy(t, s)
+	t[len(s)] = v
+	return t
+}
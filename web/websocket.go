@@ -16,25 +16,86 @@ package web
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/md5"
 	"encoding/binary"
 	"io"
+	"json"
 	"net"
 	"os"
 	"strings"
+	"sync"
 )
 
+var (
+	// ErrMessageTooLarge is returned from Receive when a message is longer
+	// than the connection's MaxMessageLen.
+	ErrMessageTooLarge = os.NewError("twister.websocket: message too large")
+
+	// ErrSendQueueFull is returned from Send when the send queue is full.
+	ErrSendQueueFull = os.NewError("twister.websocket: send queue full")
+)
+
+// DefaultMaxWebSocketMessageLen is the default maximum length of a received
+// message.
+const DefaultMaxWebSocketMessageLen = 1 << 16
+
+// Policies for a full send queue.
+const (
+	// Discard the message and return ErrSendQueueFull from Send.
+	SendQueueDrop = iota
+
+	// Close the connection and return ErrSendQueueFull from Send.
+	SendQueueClose
+)
+
+// WebSocketConn is a WebSocket connection. Send and Close can be called
+// concurrently with each other and with Receive. Receive must be called from
+// a single goroutine.
 type WebSocketConn struct {
+	// MaxMessageLen is the maximum length of a received message. Receive
+	// closes the connection and returns ErrMessageTooLarge if a message is
+	// longer than the limit.
+	MaxMessageLen int
+
 	conn net.Conn
 	br   *bufio.Reader
 	bw   *bufio.Writer
+	rbuf []byte
+
+	// writeMu serializes writes to bw.
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	queue       chan []byte
+	queuePolicy int
+	closed      bool
+	err         os.Error
 }
 
 func (conn *WebSocketConn) Close() os.Error {
+	conn.mu.Lock()
+	if !conn.closed && conn.queue != nil {
+		close(conn.queue)
+	}
+	conn.closed = true
+	conn.mu.Unlock()
 	return conn.conn.Close()
 }
 
+// closeWithError sends the closing handshake to the peer and closes the
+// connection.
+func (conn *WebSocketConn) closeWithError(err os.Error) os.Error {
+	conn.writeMu.Lock()
+	conn.bw.Write([]byte{0xff, 0})
+	conn.bw.Flush()
+	conn.writeMu.Unlock()
+	conn.Close()
+	return err
+}
+
+// Receive returns the next message from the peer. The returned slice is
+// valid until the next call to Receive. Receive returns os.EOF when the peer
+// starts the closing handshake.
 func (conn *WebSocketConn) Receive() ([]byte, os.Error) {
 	// Support text framing for now. Revisit after browsers support framing
 	// described in later specs.
@@ -42,17 +103,61 @@ func (conn *WebSocketConn) Receive() ([]byte, os.Error) {
 	if err != nil {
 		return nil, err
 	}
-	if c != 0 {
+	switch c {
+	case 0:
+		// Text frame.
+	case 0xff:
+		// Closing handshake.
+		if c, err = conn.br.ReadByte(); err == nil && c == 0 {
+			err = os.EOF
+		}
+		return nil, err
+	default:
 		return nil, os.NewError("twister.websocket: unexpected framing.")
 	}
-	p, err := conn.br.ReadSlice(0xff)
-	if err != nil {
-		return nil, err
+	maxLen := conn.MaxMessageLen
+	if maxLen <= 0 {
+		maxLen = DefaultMaxWebSocketMessageLen
 	}
-	return p[:len(p)-1], nil
+	n := 0
+	for {
+		p, err := conn.br.ReadSlice(0xff)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		m := len(p)
+		if err == nil {
+			// Do not count the frame terminator.
+			m -= 1
+		}
+		if n+m > maxLen {
+			return nil, conn.closeWithError(ErrMessageTooLarge)
+		}
+		if n+m > len(conn.rbuf) {
+			size := 2 * len(conn.rbuf)
+			if size < n+m {
+				size = n + m
+			}
+			if size > maxLen {
+				size = maxLen
+			}
+			rbuf := make([]byte, size)
+			copy(rbuf, conn.rbuf[0:n])
+			conn.rbuf = rbuf
+		}
+		copy(conn.rbuf[n:], p[0:m])
+		n += m
+		if err == nil {
+			return conn.rbuf[0:n], nil
+		}
+	}
+	panic("not reached")
 }
 
-func (conn *WebSocketConn) Send(p []byte) os.Error {
+// write writes a text frame to the connection.
+func (conn *WebSocketConn) write(p []byte) os.Error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
 	// Support text framing for now. Revisit after browsers support framing
 	// described in later specs.
 	conn.bw.WriteByte(0)
@@ -61,6 +166,95 @@ func (conn *WebSocketConn) Send(p []byte) os.Error {
 	return conn.bw.Flush()
 }
 
+// Send sends a message to the peer. Send can be called from multiple
+// goroutines; concurrent messages are written one at a time. If the send
+// queue is enabled, then Send adds a copy of the message to the queue and
+// returns without waiting for the message to be written.
+func (conn *WebSocketConn) Send(p []byte) os.Error {
+	conn.mu.Lock()
+	if conn.queue == nil {
+		conn.mu.Unlock()
+		return conn.write(p)
+	}
+	defer conn.mu.Unlock()
+	if conn.err != nil {
+		return conn.err
+	}
+	if conn.closed {
+		return ErrInvalidState
+	}
+	q := make([]byte, len(p))
+	copy(q, p)
+	select {
+	case conn.queue <- q:
+		return nil
+	default:
+	}
+	if conn.queuePolicy == SendQueueClose {
+		conn.err = ErrSendQueueFull
+		close(conn.queue)
+		conn.closed = true
+		conn.conn.Close()
+	}
+	return ErrSendQueueFull
+}
+
+// SendJSON sends the JSON encoding of v to the peer. SendJSON returns
+// ErrMessageTooLarge without sending if the encoding is longer than the
+// connection's MaxMessageLen.
+func (conn *WebSocketConn) SendJSON(v interface{}) os.Error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if conn.MaxMessageLen > 0 && len(p) > conn.MaxMessageLen {
+		return ErrMessageTooLarge
+	}
+	return conn.Send(p)
+}
+
+// ReceiveJSON receives the next message from the peer and decodes the
+// message as JSON into the value pointed to by v.
+func (conn *WebSocketConn) ReceiveJSON(v interface{}) os.Error {
+	p, err := conn.Receive()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+// EnableSendQueue starts a goroutine that writes messages to the peer from
+// a queue with room for size messages. After EnableSendQueue is called,
+// Send does not block on a slow peer. The policy specifies how Send handles
+// a full queue: SendQueueDrop discards the message and SendQueueClose
+// closes the connection.
+func (conn *WebSocketConn) EnableSendQueue(size int, policy int) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.queue != nil || conn.closed {
+		return
+	}
+	conn.queue = make(chan []byte, size)
+	conn.queuePolicy = policy
+	go conn.pump(conn.queue)
+}
+
+// pump writes messages from the send queue to the connection.
+func (conn *WebSocketConn) pump(queue chan []byte) {
+	for p := range queue {
+		if err := conn.write(p); err != nil {
+			conn.mu.Lock()
+			conn.err = err
+			conn.mu.Unlock()
+			conn.Close()
+			break
+		}
+	}
+	// Discard messages queued after an error.
+	for _ = range queue {
+	}
+}
+
 // webSocketKey returns the key bytes from the specified websocket key header.
 func webSocketKey(req *Request, name string) (key []byte, err os.Error) {
 	s, found := req.Header.Get(name)
@@ -86,30 +280,11 @@ func webSocketKey(req *Request, name string) (key []byte, err os.Error) {
 }
 
 // WebSocketUpgrade upgrades the HTTP connection to the WebSocket protocol. The 
-// caller is responsbile for closing the returned connection.
+// caller is responsbile for closing the returned connection. If the request
+// is not a valid WebSocket handshake, then the connection is not hijacked
+// from the server.
 func WebSocketUpgrade(req *Request) (conn *WebSocketConn, err os.Error) {
 
-	netConn, buf, err := req.Responder.Hijack()
-	if err != nil {
-		panic("twister.websocket: hijack failed")
-		return nil, err
-	}
-
-	defer func() {
-		if netConn != nil {
-			netConn.Close()
-		}
-	}()
-
-	var r io.Reader
-	if len(buf) > 0 {
-		r = io.MultiReader(bytes.NewBuffer(buf), netConn)
-	} else {
-		r = netConn
-	}
-	br := bufio.NewReader(r)
-	bw := bufio.NewWriter(netConn)
-
 	if req.Method != "GET" {
 		return nil, os.NewError("twister.websocket: bad request method")
 	}
@@ -124,8 +299,8 @@ func WebSocketUpgrade(req *Request) (conn *WebSocketConn, err os.Error) {
 		return nil, os.NewError("twister.websocket: connection header missing or wrong value")
 	}
 
-	upgrade := strings.ToLower(req.Header.GetDef(HeaderUpgrade, ""))
-	if upgrade != "websocket" {
+	protocolUpgrade := strings.ToLower(req.Header.GetDef(HeaderUpgrade, ""))
+	if protocolUpgrade != "websocket" {
 		return nil, os.NewError("twister.websocket: upgrade header missing or wrong value")
 	}
 
@@ -139,8 +314,30 @@ func WebSocketUpgrade(req *Request) (conn *WebSocketConn, err os.Error) {
 		return nil, err
 	}
 
+	// TODO: handle tls
+	location := "ws://" + req.URL.Host + req.URL.RawPath
+	header := NewStringsMap(
+		"Upgrade", "WebSocket",
+		"Connection", "Upgrade",
+		"Sec-WebSocket-Location", location,
+		"Sec-WebSocket-Origin", origin)
+	if protocol := req.Header.GetDef(HeaderSecWebSocketProtocol, ""); len(protocol) > 0 {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+
+	netConn, rw, err := upgrade(req, "HTTP/1.1 101 WebSocket Protocol Handshake", header)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if netConn != nil {
+			netConn.Close()
+		}
+	}()
+
 	key3 := make([]byte, 8)
-	if _, err := io.ReadFull(br, key3); err != nil {
+	if _, err := io.ReadFull(rw, key3); err != nil {
 		return nil, err
 	}
 
@@ -148,31 +345,13 @@ func WebSocketUpgrade(req *Request) (conn *WebSocketConn, err os.Error) {
 	h.Write(key1)
 	h.Write(key2)
 	h.Write(key3)
-	response := h.Sum()
+	rw.Write(h.Sum())
 
-	// TODO: handle tls
-	location := "ws://" + req.URL.Host + req.URL.RawPath
-	protocol := req.Header.GetDef(HeaderSecWebSocketProtocol, "")
-
-	bw.WriteString("HTTP/1.1 101 WebSocket Protocol Handshake")
-	bw.WriteString("\r\nUpgrade: WebSocket")
-	bw.WriteString("\r\nConnection: Upgrade")
-	bw.WriteString("\r\nSec-WebSocket-Location: ")
-	bw.WriteString(location)
-	bw.WriteString("\r\nSec-WebSocket-Origin: ")
-	bw.WriteString(origin)
-	if len(protocol) > 0 {
-		bw.WriteString("\r\nSec-WebSocket-Protocol: ")
-		bw.WriteString(protocol)
-	}
-	bw.WriteString("\r\n\r\n")
-	bw.Write(response)
-
-	if err := bw.Flush(); err != nil {
+	if err := rw.Flush(); err != nil {
 		return nil, err
 	}
 
-	conn = &WebSocketConn{netConn, br, bw}
+	conn = &WebSocketConn{MaxMessageLen: DefaultMaxWebSocketMessageLen, conn: netConn, br: rw.Reader, bw: rw.Writer}
 	netConn = nil
 	return conn, nil
 }
@@ -0,0 +1,100 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testConn is a net.Conn that records writes. Other methods are not
+// implemented.
+type testConn struct {
+	net.Conn
+	w      bytes.Buffer
+	closed bool
+}
+
+func (c *testConn) Write(p []byte) (int, os.Error) { return c.w.Write(p) }
+func (c *testConn) Close() os.Error                { c.closed = true; return nil }
+
+type receiveTest struct {
+	input    string
+	maxLen   int
+	messages []string
+	err      os.Error
+}
+
+var receiveTests = []receiveTest{
+	receiveTest{"\x00hello\xff\x00\xff", 10, []string{"hello", ""}, nil},
+	receiveTest{"\x00" + strings.Repeat("x", 40) + "\xff", 40, []string{strings.Repeat("x", 40)}, nil},
+	receiveTest{"\x00" + strings.Repeat("x", 41) + "\xff", 40, nil, ErrMessageTooLarge},
+	receiveTest{"\x00hello\xff\xff\x00", 10, []string{"hello"}, os.EOF},
+}
+
+func TestWebSocketReceive(t *testing.T) {
+	for _, tt := range receiveTests {
+		br, _ := bufio.NewReaderSize(bytes.NewBufferString(tt.input), 16)
+		c := &testConn{}
+		conn := &WebSocketConn{MaxMessageLen: tt.maxLen, conn: c, br: br, bw: bufio.NewWriter(c)}
+		for _, expected := range tt.messages {
+			p, err := conn.Receive()
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tt.input, err)
+				break
+			}
+			if string(p) != expected {
+				t.Errorf("%q: message=%q, expected %q", tt.input, p, expected)
+			}
+		}
+		if tt.err != nil {
+			if _, err := conn.Receive(); err != tt.err {
+				t.Errorf("%q: err=%v, expected %v", tt.input, err, tt.err)
+			}
+		}
+		if tt.err == ErrMessageTooLarge && !c.closed {
+			t.Errorf("%q: connection not closed", tt.input)
+		}
+	}
+}
+
+type jsonMessage struct {
+	Name  string
+	Count int
+}
+
+func TestWebSocketJSON(t *testing.T) {
+	c := &testConn{}
+	conn := &WebSocketConn{MaxMessageLen: 64, conn: c, bw: bufio.NewWriter(c)}
+	if err := conn.SendJSON(&jsonMessage{"hello", 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SendJSON(&jsonMessage{strings.Repeat("x", 64), 0}); err != ErrMessageTooLarge {
+		t.Errorf("err=%v, expected %v", err, ErrMessageTooLarge)
+	}
+	conn.br = bufio.NewReader(bytes.NewBuffer(c.w.Bytes()))
+	var m jsonMessage
+	if err := conn.ReceiveJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "hello" || m.Count != 3 {
+		t.Errorf("received %v", m)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The webtest package provides helpers for testing handlers.
+package webtest
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"net"
+	"os"
+)
+
+// Responder records the response in memory. Use a Responder as the
+// Responder of a request passed to a handler under test.
+type Responder struct {
+	Status int
+	Header web.StringsMap
+	Body   bytes.Buffer
+}
+
+func (r *Responder) Respond(status int, header web.StringsMap) web.ResponseBody {
+	r.Status = status
+	r.Header = header
+	return r
+}
+
+func (r *Responder) Write(p []byte) (int, os.Error) { return r.Body.Write(p) }
+func (r *Responder) Flush() os.Error                { return nil }
+func (r *Responder) Continue() os.Error             { return nil }
+
+func (r *Responder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, web.ErrInvalidState
+}